@@ -16,8 +16,18 @@ func main() {
 	}
 
 	net := getNetwork(flags)
-	if flags.Create {
-		err := wallet.CreateWallet(net)
+	if flags.Create && flags.WatchOnly != "" {
+		err := wallet.CreateWatchOnlyWallet(net, flags.WatchOnly, flags.Birthday, uint32(flags.GapLimit))
+		if err != nil {
+			printErr(err)
+		}
+	} else if flags.Create {
+		err := wallet.CreateWallet(net, flags.WordCount)
+		if err != nil {
+			printErr(err)
+		}
+	} else if flags.Restore {
+		err := wallet.RestoreWallet(net, flags.Birthday, uint32(flags.GapLimit))
 		if err != nil {
 			printErr(err)
 		}
@@ -26,15 +36,26 @@ func main() {
 			printErr(errors.New("RPC username and password are required to start wallet"))
 		}
 
-		w, err := wallet.LoadWallet(net, flags.RPCUser, flags.RPCPass, flags.Node)
+		var err error
+		if flags.Recover {
+			err = wallet.EnableRecovery(net, flags.Birthday, uint32(flags.GapLimit))
+		}
+
+		var w *wallet.Wallet
+		if err == nil {
+			w, err = wallet.LoadWallet(net, flags.RPCUser, flags.RPCPass, flags.Node)
+		}
+		if err == nil {
+			err = w.SetCoinSelection(flags.CoinSelection)
+		}
 		if err != nil {
 			if err == wallet.ErrWalletNotExists {
-				printErr(errors.New("A wallet does not exist. Please create one first with -create"))
+				printErr(errors.New("A wallet does not exist. Please create one first with -create or -restore"))
 			}
 			printErr(fmt.Errorf("error loading wallet: %v", err))
 		}
 
-		err = rpcserver.StartRPCServer(w)
+		err = rpcserver.StartRPCServer(w, rpcConfig(flags, net))
 		if err != nil {
 			printErr(err)
 		}
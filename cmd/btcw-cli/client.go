@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync/atomic"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/elnosh/btcw/rpcserver"
+	"github.com/urfave/cli/v2"
+)
+
+var (
+	ErrUnauthorized = errors.New("unauthorized. check RPC username and password or cookie file")
+)
+
+var client *rpcClient
+
+// rpcClient calls the wallet RPC server over HTTP
+// using the JSON-RPC format of net/rpc/jsonrpc
+type rpcClient struct {
+	url        string
+	user       string
+	pass       string
+	httpClient *http.Client
+	id         atomic.Uint64
+}
+
+type rpcRequest struct {
+	Method string `json:"method"`
+	Params [1]any `json:"params"`
+	ID     uint64 `json:"id"`
+}
+
+type rpcResponse struct {
+	ID     uint64          `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  any             `json:"error"`
+}
+
+// Call calls the method with args and stores the result in reply
+func (c *rpcClient) Call(serviceMethod string, args any, reply any) error {
+	request := rpcRequest{Method: serviceMethod, Params: [1]any{args}, ID: c.id.Add(1)}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	httpRequest, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpRequest.SetBasicAuth(c.user, c.pass)
+	httpRequest.Header.Set("Content-Type", "application/json")
+
+	httpResponse, err := c.httpClient.Do(httpRequest)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+
+	if httpResponse.StatusCode == http.StatusUnauthorized {
+		return ErrUnauthorized
+	}
+	responseBody, err := io.ReadAll(httpResponse.Body)
+	if err != nil {
+		return err
+	}
+	if httpResponse.StatusCode != http.StatusOK {
+		return fmt.Errorf("error from RPC server: %s", bytes.TrimSpace(responseBody))
+	}
+
+	var response rpcResponse
+	if err := json.Unmarshal(responseBody, &response); err != nil {
+		return fmt.Errorf("invalid response from RPC server: %s", err.Error())
+	}
+	if response.Error != nil {
+		return errors.New(fmt.Sprint(response.Error))
+	}
+	return json.Unmarshal(response.Result, reply)
+}
+
+// setupClient creates the client from the global flags
+func setupClient(ctx *cli.Context) error {
+	net := &chaincfg.TestNet3Params
+	if ctx.Bool("simnet") {
+		net = &chaincfg.SimNetParams
+	} else if ctx.Bool("regtest") {
+		net = &chaincfg.RegressionNetParams
+	}
+
+	user, pass := ctx.String("rpcuser"), ctx.String("rpcpass")
+	if user == "" || pass == "" {
+		cookiePath := ctx.String("rpccookie")
+		if cookiePath == "" {
+			cookiePath = rpcserver.DefaultCookiePath(net)
+		}
+		var err error
+		user, pass, err = rpcserver.ReadCookie(cookiePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	scheme := "http"
+	httpClient := &http.Client{}
+	if ctx.Bool("tls") {
+		scheme = "https"
+		cert, err := os.ReadFile(ctx.String("rpccert"))
+		if err != nil {
+			return fmt.Errorf("error reading TLS certificate: %s", err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(cert) {
+			return errors.New("invalid TLS certificate")
+		}
+		httpClient.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+
+	client = &rpcClient{
+		url:        fmt.Sprintf("%s://%s/", scheme, ctx.String("rpcserver")),
+		user:       user,
+		pass:       pass,
+		httpClient: httpClient,
+	}
+	return nil
+}
+
+var clientFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "rpcserver",
+		Value: rpcserver.DefaultListen,
+		Usage: "address of the wallet RPC server",
+	},
+	&cli.StringFlag{
+		Name:  "rpcuser",
+		Usage: "wallet RPC username. read from cookie file if not set",
+	},
+	&cli.StringFlag{
+		Name:  "rpcpass",
+		Usage: "wallet RPC password. read from cookie file if not set",
+	},
+	&cli.StringFlag{
+		Name:  "rpccookie",
+		Usage: "path of the cookie file (default ~/.btcw/{network}/.cookie)",
+	},
+	&cli.BoolFlag{
+		Name:  "tls",
+		Usage: "connect to the wallet RPC server over TLS",
+	},
+	&cli.StringFlag{
+		Name:  "rpccert",
+		Value: rpcserver.DefaultCertPath(),
+		Usage: "TLS certificate of the wallet RPC server",
+	},
+	&cli.BoolFlag{
+		Name:  "simnet",
+		Usage: "wallet is on simnet",
+	},
+	&cli.BoolFlag{
+		Name:  "regtest",
+		Usage: "wallet is on regtest",
+	},
+}
@@ -10,13 +10,34 @@ import (
 
 func main() {
 	app := &cli.App{
-		Name:  "btcw-cli",
-		Usage: "cli tool for btcw",
+		Name:   "btcw-cli",
+		Usage:  "cli tool for btcw",
+		Flags:  clientFlags,
+		Before: setupClient,
 		Commands: []*cli.Command{
 			getBalanceCmd,
+			getBalancesCmd,
+			getWalletInfoCmd,
 			getNewAddressCmd,
 			sendToAddressCmd,
+			sendManyCmd,
+			sendAllCmd,
+			bumpFeeCmd,
+			cpfpCmd,
+			walletCreateFundedPSBTCmd,
+			walletProcessPSBTCmd,
+			finalizePSBTCmd,
+			combinePSBTCmd,
+			decodePSBTCmd,
+			sendPSBTCmd,
+			getXpubCmd,
+			listDescriptorsCmd,
+			importDescriptorsCmd,
+			listTransactionsCmd,
+			getTransactionCmd,
+			checkWalletCmd,
 			walletPassphraseCmd,
+			walletPassphraseChangeCmd,
 			walletLockCmd,
 		},
 	}
@@ -2,41 +2,51 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"net/rpc"
-	"net/rpc/jsonrpc"
+	"io"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/elnosh/btcw/rpcserver"
+	"github.com/elnosh/btcw/wallet"
 	"github.com/urfave/cli/v2"
 	"golang.org/x/term"
 )
 
-var client *rpc.Client
-
-func init() {
-	var err error
-	client, err = jsonrpc.Dial("tcp", "localhost:18557")
-	if err != nil {
-		printErr(err)
-	}
-}
-
 const (
 	maxWalletUnlockDuration = 3600 // one hour
 )
 
 var getBalanceCmd = &cli.Command{
-	Name:   "getbalance",
-	Action: getBalance,
+	Name:      "getbalance",
+	ArgsUsage: "[minconf]",
+	Action:    getBalance,
+}
+
+// parseMinConf returns the minconf passed as first
+// argument of the command or 0 if none
+func parseMinConf(ctx *cli.Context) int64 {
+	if ctx.Args().Len() == 0 {
+		return 0
+	}
+
+	minConf, err := strconv.ParseInt(ctx.Args().Get(0), 10, 64)
+	if err != nil || minConf < 0 {
+		printErr(errors.New("invalid minconf"))
+	}
+	return minConf
 }
 
 func getBalance(ctx *cli.Context) error {
-	var args struct{}
+	args := rpcserver.GetBalanceArgs{MinConf: parseMinConf(ctx)}
 	var reply *int64
 
 	err := client.Call("WalletRPC.GetBalance", args, &reply)
@@ -49,13 +59,41 @@ func getBalance(ctx *cli.Context) error {
 	return nil
 }
 
+var getBalancesCmd = &cli.Command{
+	Name:      "getbalances",
+	ArgsUsage: "[minconf]",
+	Action:    getBalances,
+}
+
+func getBalances(ctx *cli.Context) error {
+	args := rpcserver.GetBalanceArgs{MinConf: parseMinConf(ctx)}
+	var reply *wallet.Balances
+
+	err := client.Call("WalletRPC.GetBalances", args, &reply)
+	if err != nil {
+		printErr(err)
+	}
+
+	fmt.Printf("trusted: %v\n", reply.Trusted.String())
+	fmt.Printf("untrusted pending: %v\n", reply.UntrustedPending.String())
+	fmt.Printf("immature: %v\n", reply.Immature.String())
+	return nil
+}
+
 var getNewAddressCmd = &cli.Command{
-	Name:   "getnewaddress",
+	Name: "getnewaddress",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "type",
+			Usage: "address type: legacy, p2sh-segwit, bech32 or bech32m",
+			Value: "bech32",
+		},
+	},
 	Action: getNewAddress,
 }
 
 func getNewAddress(ctx *cli.Context) error {
-	var args struct{}
+	args := rpcserver.GetNewAddressArgs{AddressType: ctx.String("type")}
 	var reply *string
 
 	err := client.Call("WalletRPC.GetNewAddress", args, &reply)
@@ -68,7 +106,30 @@ func getNewAddress(ctx *cli.Context) error {
 }
 
 var sendToAddressCmd = &cli.Command{
-	Name:   "sendtoaddress",
+	Name:      "sendtoaddress",
+	ArgsUsage: "address amount",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "label",
+			Usage: "label for the transaction in wallet history",
+		},
+		&cli.Float64Flag{
+			Name:  "feerate",
+			Usage: "fee rate in sat/vB",
+		},
+		&cli.Int64Flag{
+			Name:  "conftarget",
+			Usage: "estimate fee rate to confirm within this number of blocks (default 6)",
+		},
+		&cli.StringFlag{
+			Name:  "coinselection",
+			Usage: "coin selection method (auto, bnb, knapsack, largestfirst, oldestfirst, srd). default is the one of the wallet",
+		},
+		&cli.BoolFlag{
+			Name:  "subtractfee",
+			Usage: "subtract the fee from the amount sent",
+		},
+	},
 	Action: SendToAddress,
 }
 
@@ -90,6 +151,12 @@ func SendToAddress(ctx *cli.Context) error {
 	args := rpcserver.SendToArgs{
 		Address: addr,
 		Amount:  amount,
+		Label:   ctx.String("label"),
+		// fee rate and conf target are validated by the wallet
+		FeeRate:               ctx.Float64("feerate"),
+		ConfTarget:            ctx.Int64("conftarget"),
+		CoinSelection:         ctx.String("coinselection"),
+		SubtractFeeFromAmount: ctx.Bool("subtractfee"),
 	}
 	var reply *string
 
@@ -102,6 +169,718 @@ func SendToAddress(ctx *cli.Context) error {
 	return nil
 }
 
+var sendManyCmd = &cli.Command{
+	Name:      "sendmany",
+	Usage:     "send to many addresses in one transaction",
+	ArgsUsage: `['{"address":amount,...}']`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "file",
+			Usage: "JSON file with an object of address to amount or CSV file with address,amount lines",
+		},
+		&cli.StringFlag{
+			Name:  "label",
+			Usage: "label for the transaction in wallet history",
+		},
+		&cli.Float64Flag{
+			Name:  "feerate",
+			Usage: "fee rate in sat/vB",
+		},
+		&cli.Int64Flag{
+			Name:  "conftarget",
+			Usage: "estimate fee rate to confirm within this number of blocks (default 6)",
+		},
+		&cli.StringFlag{
+			Name:  "coinselection",
+			Usage: "coin selection method (auto, bnb, knapsack, largestfirst, oldestfirst, srd). default is the one of the wallet",
+		},
+		&cli.StringSliceFlag{
+			Name:  "subtractfeefrom",
+			Usage: "address that pays the fee from its amount. Can be repeated to split the fee",
+		},
+	},
+	Action: sendMany,
+}
+
+func sendMany(ctx *cli.Context) error {
+	var amounts map[string]float64
+	var err error
+	if path := ctx.String("file"); path != "" {
+		if ctx.Args().Len() != 0 {
+			printErr(errors.New("please provide amounts either as argument or with --file"))
+		}
+		amounts, err = readAmountsFile(path)
+	} else {
+		if ctx.Args().Len() != 1 {
+			printErr(errors.New("please provide amounts to send as JSON or with --file"))
+		}
+		amounts, err = parseAmountsJSON([]byte(ctx.Args().First()))
+	}
+	if err != nil {
+		printErr(err)
+	}
+
+	args := rpcserver.SendManyArgs{
+		Amounts:         amounts,
+		Label:           ctx.String("label"),
+		FeeRate:         ctx.Float64("feerate"),
+		ConfTarget:      ctx.Int64("conftarget"),
+		CoinSelection:   ctx.String("coinselection"),
+		SubtractFeeFrom: ctx.StringSlice("subtractfeefrom"),
+	}
+	var reply *string
+
+	err = client.Call("WalletRPC.SendMany", args, &reply)
+	if err != nil {
+		printErr(err)
+	}
+
+	fmt.Println(*reply)
+	return nil
+}
+
+var sendAllCmd = &cli.Command{
+	Name:      "sendall",
+	Usage:     "send all funds to an address with no change. fee is paid from the amount",
+	ArgsUsage: "address",
+	Flags: []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "utxo",
+			Usage: "only send this utxo (txid:vout). Can be repeated",
+		},
+		&cli.StringFlag{
+			Name:  "label",
+			Usage: "label for the transaction in wallet history",
+		},
+		&cli.Float64Flag{
+			Name:  "feerate",
+			Usage: "fee rate in sat/vB",
+		},
+		&cli.Int64Flag{
+			Name:  "conftarget",
+			Usage: "estimate fee rate to confirm within this number of blocks (default 6)",
+		},
+	},
+	Action: sendAll,
+}
+
+func sendAll(ctx *cli.Context) error {
+	if ctx.Args().Len() != 1 {
+		printErr(errors.New("please provide address to send to"))
+	}
+
+	args := rpcserver.SendAllArgs{
+		Address:    ctx.Args().First(),
+		Outpoints:  ctx.StringSlice("utxo"),
+		Label:      ctx.String("label"),
+		FeeRate:    ctx.Float64("feerate"),
+		ConfTarget: ctx.Int64("conftarget"),
+	}
+	var reply *string
+
+	err := client.Call("WalletRPC.SendAll", args, &reply)
+	if err != nil {
+		printErr(err)
+	}
+
+	fmt.Println(*reply)
+	return nil
+}
+
+var bumpFeeCmd = &cli.Command{
+	Name:      "bumpfee",
+	Usage:     "replace an unconfirmed transaction with one paying a higher fee",
+	ArgsUsage: "txid [feerate]",
+	Flags: []cli.Flag{
+		&cli.Int64Flag{
+			Name:  "conftarget",
+			Usage: "estimate fee rate to confirm within this number of blocks (default 6)",
+		},
+	},
+	Action: bumpFee,
+}
+
+func bumpFee(ctx *cli.Context) error {
+	cliArgs := ctx.Args()
+	if cliArgs.Len() < 1 || cliArgs.Len() > 2 {
+		printErr(errors.New("please provide txid of transaction and optionally the fee rate in sat/vB"))
+	}
+
+	var feeRate float64
+	if cliArgs.Len() == 2 {
+		var err error
+		feeRate, err = strconv.ParseFloat(cliArgs.Get(1), 64)
+		if err != nil || feeRate <= 0 {
+			printErr(errors.New("invalid fee rate"))
+		}
+	}
+
+	args := rpcserver.BumpFeeArgs{
+		TxID:       cliArgs.Get(0),
+		FeeRate:    feeRate,
+		ConfTarget: ctx.Int64("conftarget"),
+	}
+	var reply *wallet.BumpFeeResult
+
+	err := client.Call("WalletRPC.BumpFee", args, &reply)
+	if err != nil {
+		printErr(err)
+	}
+
+	printJSON(reply)
+	return nil
+}
+
+var cpfpCmd = &cli.Command{
+	Name:      "cpfp",
+	Usage:     "spend a wallet output of an unconfirmed transaction in a child that pays the fee for both",
+	ArgsUsage: "txid vout feerate",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "label",
+			Usage: "label for the child transaction in wallet history",
+		},
+	},
+	Action: cpfp,
+}
+
+func cpfp(ctx *cli.Context) error {
+	cliArgs := ctx.Args()
+	if cliArgs.Len() != 3 {
+		printErr(errors.New("please provide txid, output index and target fee rate in sat/vB"))
+	}
+
+	vout, err := strconv.ParseUint(cliArgs.Get(1), 10, 32)
+	if err != nil {
+		printErr(errors.New("invalid output index"))
+	}
+	feeRate, err := strconv.ParseFloat(cliArgs.Get(2), 64)
+	if err != nil || feeRate <= 0 {
+		printErr(errors.New("invalid fee rate"))
+	}
+
+	args := rpcserver.CPFPArgs{
+		TxID:    cliArgs.Get(0),
+		Vout:    uint32(vout),
+		Label:   ctx.String("label"),
+		FeeRate: feeRate,
+	}
+	var reply *wallet.CPFPResult
+
+	err = client.Call("WalletRPC.CPFP", args, &reply)
+	if err != nil {
+		printErr(err)
+	}
+
+	printJSON(reply)
+	return nil
+}
+
+var walletCreateFundedPSBTCmd = &cli.Command{
+	Name:      "walletcreatefundedpsbt",
+	Usage:     "create a PSBT funded by the wallet to sign and send later",
+	ArgsUsage: `['{"address":amount,...}']`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "file",
+			Usage: "JSON file with an object of address to amount or CSV file with address,amount lines",
+		},
+		&cli.Float64Flag{
+			Name:  "feerate",
+			Usage: "fee rate in sat/vB",
+		},
+		&cli.Int64Flag{
+			Name:  "conftarget",
+			Usage: "estimate fee rate to confirm within this number of blocks (default 6)",
+		},
+		&cli.StringFlag{
+			Name:  "coinselection",
+			Usage: "coin selection method (auto, bnb, knapsack, largestfirst, oldestfirst, srd). default is the one of the wallet",
+		},
+		&cli.StringSliceFlag{
+			Name:  "subtractfeefrom",
+			Usage: "address that pays the fee from its amount. Can be repeated to split the fee",
+		},
+	},
+	Action: walletCreateFundedPSBT,
+}
+
+func walletCreateFundedPSBT(ctx *cli.Context) error {
+	var amounts map[string]float64
+	var err error
+	if path := ctx.String("file"); path != "" {
+		if ctx.Args().Len() != 0 {
+			printErr(errors.New("please provide amounts either as argument or with --file"))
+		}
+		amounts, err = readAmountsFile(path)
+	} else {
+		if ctx.Args().Len() != 1 {
+			printErr(errors.New("please provide amounts to send as JSON or with --file"))
+		}
+		amounts, err = parseAmountsJSON([]byte(ctx.Args().First()))
+	}
+	if err != nil {
+		printErr(err)
+	}
+
+	args := rpcserver.WalletCreateFundedPSBTArgs{
+		Amounts:         amounts,
+		FeeRate:         ctx.Float64("feerate"),
+		ConfTarget:      ctx.Int64("conftarget"),
+		CoinSelection:   ctx.String("coinselection"),
+		SubtractFeeFrom: ctx.StringSlice("subtractfeefrom"),
+	}
+	var reply *wallet.FundedPSBT
+
+	err = client.Call("WalletRPC.WalletCreateFundedPSBT", args, &reply)
+	if err != nil {
+		printErr(err)
+	}
+
+	printJSON(reply)
+	return nil
+}
+
+var walletProcessPSBTCmd = &cli.Command{
+	Name:      "walletprocesspsbt",
+	Usage:     "add wallet information to a PSBT and sign the inputs of the wallet",
+	ArgsUsage: "psbt",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "nosign",
+			Usage: "only add the UTXOs and key derivations without signing",
+		},
+		&cli.BoolFlag{
+			Name:  "nofinalize",
+			Usage: "do not finalize the inputs with all their signatures",
+		},
+	},
+	Action: walletProcessPSBT,
+}
+
+func walletProcessPSBT(ctx *cli.Context) error {
+	if ctx.Args().Len() != 1 {
+		printErr(errors.New("please provide base64 encoded psbt"))
+	}
+
+	args := rpcserver.WalletProcessPSBTArgs{
+		PSBT:     ctx.Args().First(),
+		Sign:     !ctx.Bool("nosign"),
+		Finalize: !ctx.Bool("nofinalize"),
+	}
+	var reply *wallet.ProcessedPSBT
+
+	err := client.Call("WalletRPC.WalletProcessPSBT", args, &reply)
+	if err != nil {
+		printErr(err)
+	}
+
+	printJSON(reply)
+	return nil
+}
+
+var finalizePSBTCmd = &cli.Command{
+	Name:      "finalizepsbt",
+	Usage:     "finalize the inputs of a PSBT and extract the transaction if it is complete",
+	ArgsUsage: "psbt",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "noextract",
+			Usage: "do not extract the network serialized transaction",
+		},
+	},
+	Action: finalizePSBT,
+}
+
+func finalizePSBT(ctx *cli.Context) error {
+	if ctx.Args().Len() != 1 {
+		printErr(errors.New("please provide base64 encoded psbt"))
+	}
+
+	args := rpcserver.FinalizePSBTArgs{
+		PSBT:    ctx.Args().First(),
+		Extract: !ctx.Bool("noextract"),
+	}
+	var reply *wallet.ProcessedPSBT
+
+	err := client.Call("WalletRPC.FinalizePSBT", args, &reply)
+	if err != nil {
+		printErr(err)
+	}
+
+	printJSON(reply)
+	return nil
+}
+
+var combinePSBTCmd = &cli.Command{
+	Name:      "combinepsbt",
+	Usage:     "combine the signatures of PSBTs for the same transaction",
+	ArgsUsage: "psbt psbt [psbt...]",
+	Action:    combinePSBT,
+}
+
+func combinePSBT(ctx *cli.Context) error {
+	if ctx.Args().Len() < 2 {
+		printErr(errors.New("please provide at least two psbts to combine"))
+	}
+
+	args := rpcserver.CombinePSBTArgs{PSBTs: ctx.Args().Slice()}
+	var reply *string
+
+	err := client.Call("WalletRPC.CombinePSBT", args, &reply)
+	if err != nil {
+		printErr(err)
+	}
+
+	fmt.Println(*reply)
+	return nil
+}
+
+var decodePSBTCmd = &cli.Command{
+	Name:      "decodepsbt",
+	Usage:     "show the transaction, signatures and key derivations of a PSBT",
+	ArgsUsage: "psbt",
+	Action:    decodePSBT,
+}
+
+func decodePSBT(ctx *cli.Context) error {
+	if ctx.Args().Len() != 1 {
+		printErr(errors.New("please provide base64 encoded psbt"))
+	}
+
+	args := rpcserver.PSBTArgs{PSBT: ctx.Args().First()}
+	var reply *wallet.DecodedPSBT
+
+	err := client.Call("WalletRPC.DecodePSBT", args, &reply)
+	if err != nil {
+		printErr(err)
+	}
+
+	printJSON(reply)
+	return nil
+}
+
+var sendPSBTCmd = &cli.Command{
+	Name:      "sendpsbt",
+	Usage:     "finalize a signed PSBT and send its transaction",
+	ArgsUsage: "psbt",
+	Action:    sendPSBT,
+}
+
+func sendPSBT(ctx *cli.Context) error {
+	if ctx.Args().Len() != 1 {
+		printErr(errors.New("please provide base64 encoded psbt"))
+	}
+
+	args := rpcserver.PSBTArgs{PSBT: ctx.Args().First()}
+	var reply *string
+
+	err := client.Call("WalletRPC.SendPSBT", args, &reply)
+	if err != nil {
+		printErr(err)
+	}
+
+	fmt.Println(*reply)
+	return nil
+}
+
+var getXpubCmd = &cli.Command{
+	Name:   "getxpub",
+	Usage:  "show the extended public key of the account with its key origin",
+	Action: getXpub,
+}
+
+func getXpub(ctx *cli.Context) error {
+	var args struct{}
+	var reply *string
+
+	err := client.Call("WalletRPC.GetXpub", args, &reply)
+	if err != nil {
+		printErr(err)
+	}
+
+	fmt.Println(*reply)
+	return nil
+}
+
+var listDescriptorsCmd = &cli.Command{
+	Name:   "listdescriptors",
+	Usage:  "show the output descriptors of the wallet",
+	Action: listDescriptors,
+}
+
+func listDescriptors(ctx *cli.Context) error {
+	var args struct{}
+	var reply *[]wallet.Descriptor
+
+	err := client.Call("WalletRPC.ListDescriptors", args, &reply)
+	if err != nil {
+		printErr(err)
+	}
+
+	printJSON(reply)
+	return nil
+}
+
+var importDescriptorsCmd = &cli.Command{
+	Name:  "importdescriptors",
+	Usage: "import output descriptors to watch and spend from",
+	ArgsUsage: `'[{"desc": "wpkh(tpub.../0/*)#checksum", "timestamp": "now", "active": true, ` +
+		`"range": [0, 100], "next_index": 0, "internal": false}, ...]'`,
+	Action: importDescriptors,
+}
+
+func importDescriptors(ctx *cli.Context) error {
+	if ctx.Args().Len() != 1 {
+		printErr(errors.New("please provide a JSON array of descriptors to import"))
+	}
+
+	var args rpcserver.ImportDescriptorsArgs
+	if err := json.Unmarshal([]byte(ctx.Args().First()), &args.Requests); err != nil {
+		printErr(fmt.Errorf("invalid requests: %v", err))
+	}
+	var reply *[]wallet.ImportDescriptorResult
+
+	err := client.Call("WalletRPC.ImportDescriptors", args, &reply)
+	if err != nil {
+		printErr(err)
+	}
+
+	printJSON(reply)
+	return nil
+}
+
+// readAmountsFile reads amounts by address from a JSON file
+// or a CSV file with address,amount lines
+func readAmountsFile(path string) (map[string]float64, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file: %s", err.Error())
+	}
+
+	if trimmed := bytes.TrimSpace(contents); len(trimmed) > 0 && trimmed[0] == '{' {
+		return parseAmountsJSON(trimmed)
+	}
+	return parseAmountsCSV(contents)
+}
+
+// parseAmountsJSON parses a JSON object of amounts by address.
+// Repeated addresses are an error instead of keeping the last amount
+func parseAmountsJSON(contents []byte) (map[string]float64, error) {
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, errors.New("invalid JSON amounts: expected an object of amounts by address")
+	}
+
+	amounts := make(map[string]float64)
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, fmt.Errorf("invalid JSON amounts: %s", err.Error())
+		}
+		address, ok := token.(string)
+		if !ok {
+			return nil, errors.New("invalid JSON amounts: invalid address")
+		}
+		var amount float64
+		if err := decoder.Decode(&amount); err != nil {
+			return nil, fmt.Errorf("invalid JSON amounts: invalid amount for %s", address)
+		}
+		if _, ok := amounts[address]; ok {
+			return nil, fmt.Errorf("duplicated address: %s", address)
+		}
+		amounts[address] = amount
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, fmt.Errorf("invalid JSON amounts: %s", err.Error())
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("invalid JSON amounts: unexpected data after object")
+	}
+
+	if len(amounts) == 0 {
+		return nil, errors.New("no amounts to send")
+	}
+	return amounts, nil
+}
+
+// parseAmountsCSV parses address,amount lines. The first line
+// is skipped if it is a header (i.e it does not start with an address)
+func parseAmountsCSV(contents []byte) (map[string]float64, error) {
+	reader := csv.NewReader(bytes.NewReader(contents))
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV amounts: %s", err.Error())
+	}
+
+	amounts := make(map[string]float64, len(records))
+	for i, record := range records {
+		address := strings.TrimSpace(record[0])
+		if i == 0 && !isAddress(address) {
+			continue
+		}
+		amount, err := strconv.ParseFloat(strings.TrimSpace(record[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid amount in line %v: %s", i+1, record[1])
+		}
+		if _, ok := amounts[address]; ok {
+			return nil, fmt.Errorf("duplicated address in line %v: %s", i+1, address)
+		}
+		amounts[address] = amount
+	}
+	if len(amounts) == 0 {
+		return nil, errors.New("no amounts to send")
+	}
+	return amounts, nil
+}
+
+// isAddress returns true if s is an address of any of the networks
+// supported. The network is checked by the wallet when sending
+func isAddress(s string) bool {
+	for _, net := range []*chaincfg.Params{&chaincfg.MainNetParams, &chaincfg.TestNet3Params,
+		&chaincfg.RegressionNetParams, &chaincfg.SimNetParams} {
+		if _, err := btcutil.DecodeAddress(s, net); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	defaultListTransactionsCount = 10
+)
+
+var listTransactionsCmd = &cli.Command{
+	Name:      "listtransactions",
+	Usage:     "list most recent transactions in wallet history",
+	ArgsUsage: "[count] [skip]",
+	Flags: []cli.Flag{
+		&cli.Int64Flag{
+			Name:  "sinceblock",
+			Usage: "only list transactions confirmed at or after this block height or unconfirmed",
+		},
+	},
+	Action: listTransactions,
+}
+
+func listTransactions(ctx *cli.Context) error {
+	cliArgs := ctx.Args()
+	if cliArgs.Len() > 2 {
+		printErr(errors.New("too many arguments. please provide only count and skip"))
+	}
+
+	count := defaultListTransactionsCount
+	if cliArgs.Len() > 0 {
+		var err error
+		count, err = strconv.Atoi(cliArgs.Get(0))
+		if err != nil || count < 0 {
+			printErr(errors.New("invalid count"))
+		}
+	}
+
+	skip := 0
+	if cliArgs.Len() > 1 {
+		var err error
+		skip, err = strconv.Atoi(cliArgs.Get(1))
+		if err != nil || skip < 0 {
+			printErr(errors.New("invalid skip"))
+		}
+	}
+
+	args := rpcserver.ListTransactionsArgs{
+		Count:      count,
+		Skip:       skip,
+		SinceBlock: ctx.Int64("sinceblock"),
+	}
+	var reply *[]wallet.TxRecord
+
+	err := client.Call("WalletRPC.ListTransactions", args, &reply)
+	if err != nil {
+		printErr(err)
+	}
+
+	printJSON(reply)
+	return nil
+}
+
+var getTransactionCmd = &cli.Command{
+	Name:      "gettransaction",
+	ArgsUsage: "txid",
+	Action:    getTransaction,
+}
+
+func getTransaction(ctx *cli.Context) error {
+	cliArgs := ctx.Args()
+	if cliArgs.Len() != 1 {
+		printErr(errors.New("please provide txid of transaction"))
+	}
+
+	args := rpcserver.GetTransactionArgs{TxID: cliArgs.Get(0)}
+	var reply *wallet.TxRecord
+
+	err := client.Call("WalletRPC.GetTransaction", args, &reply)
+	if err != nil {
+		printErr(err)
+	}
+
+	printJSON(reply)
+	return nil
+}
+
+var getWalletInfoCmd = &cli.Command{
+	Name:   "getwalletinfo",
+	Usage:  "show general information about the wallet",
+	Action: getWalletInfo,
+}
+
+func getWalletInfo(ctx *cli.Context) error {
+	var args struct{}
+	var reply *wallet.WalletInfo
+
+	err := client.Call("WalletRPC.GetWalletInfo", args, &reply)
+	if err != nil {
+		printErr(err)
+	}
+
+	printJSON(reply)
+	return nil
+}
+
+var checkWalletCmd = &cli.Command{
+	Name:  "checkwallet",
+	Usage: "check that the wallet balance matches its UTXOs",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "repair",
+			Usage: "recompute the balance from the stored UTXOs if there is a mismatch",
+		},
+	},
+	Action: checkWallet,
+}
+
+func checkWallet(ctx *cli.Context) error {
+	args := rpcserver.CheckWalletArgs{Repair: ctx.Bool("repair")}
+	var reply *wallet.WalletCheck
+
+	err := client.Call("WalletRPC.CheckWallet", args, &reply)
+	if err != nil {
+		printErr(err)
+	}
+
+	printJSON(reply)
+	return nil
+}
+
+func printJSON(v any) {
+	jsonbytes, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		printErr(err)
+	}
+	fmt.Println(string(jsonbytes))
+}
+
 var walletPassphraseCmd = &cli.Command{
 	Name:   "walletpassphrase",
 	Action: walletPassphrase,
@@ -143,6 +922,60 @@ func walletPassphrase(ctx *cli.Context) error {
 	return nil
 }
 
+var walletPassphraseChangeCmd = &cli.Command{
+	Name:  "walletpassphrasechange",
+	Usage: "change the wallet passphrase",
+	Flags: []cli.Flag{
+		&cli.UintFlag{
+			Name:  "memory",
+			Usage: "argon2 memory in KiB to derive keys from the new passphrase. keeps current one if not set",
+		},
+		&cli.UintFlag{
+			Name:  "iterations",
+			Usage: "argon2 iterations to derive keys from the new passphrase. keeps current one if not set",
+		},
+	},
+	Action: walletPassphraseChange,
+}
+
+func walletPassphraseChange(ctx *cli.Context) error {
+	fmt.Println("enter current passphrase: ")
+	oldPassphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	if err != nil {
+		printErr(errors.New("error reading passphrase, please try again"))
+	}
+
+	fmt.Println("enter new passphrase: ")
+	newPassphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	if err != nil {
+		printErr(errors.New("error reading passphrase, please try again"))
+	}
+	fmt.Println("confirm new passphrase: ")
+	confirmPassphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	if err != nil {
+		printErr(errors.New("error reading passphrase, please try again"))
+	}
+	if string(newPassphrase) != string(confirmPassphrase) {
+		printErr(errors.New("passphrases do not match, please try again"))
+	}
+
+	args := rpcserver.WalletPassphraseChangeArgs{
+		OldPassphrase: string(oldPassphrase),
+		NewPassphrase: string(newPassphrase),
+		Memory:        uint32(ctx.Uint("memory")),
+		Iterations:    uint32(ctx.Uint("iterations")),
+	}
+	var reply *string
+
+	err = client.Call("WalletRPC.WalletPassphraseChange", args, &reply)
+	if err != nil {
+		printErr(err)
+	}
+
+	fmt.Println("wallet passphrase changed")
+	return nil
+}
+
 var walletLockCmd = &cli.Command{
 	Name:   "walletlock",
 	Action: walletLock,
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"maps"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+func testAddress(t *testing.T, b byte, net *chaincfg.Params) string {
+	addr, err := btcutil.NewAddressWitnessPubKeyHash(bytes.Repeat([]byte{b}, 20), net)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr.EncodeAddress()
+}
+
+func TestParseAmountsJSON(t *testing.T) {
+	addr1 := testAddress(t, 1, &chaincfg.RegressionNetParams)
+	addr2 := testAddress(t, 2, &chaincfg.RegressionNetParams)
+
+	tests := []struct {
+		name          string
+		contents      string
+		wantedAmounts map[string]float64
+		wantErr       bool
+	}{
+		{
+			name:          "amounts",
+			contents:      `{"` + addr1 + `": 0.1, "` + addr2 + `": 0.25}`,
+			wantedAmounts: map[string]float64{addr1: 0.1, addr2: 0.25},
+		},
+		{
+			name:     "duplicated address",
+			contents: `{"` + addr1 + `": 0.1, "` + addr2 + `": 0.25, "` + addr1 + `": 0.3}`,
+			wantErr:  true,
+		},
+		{
+			name:     "empty object",
+			contents: `{}`,
+			wantErr:  true,
+		},
+		{
+			name:     "not an object",
+			contents: `["` + addr1 + `", 0.1]`,
+			wantErr:  true,
+		},
+		{
+			name:     "invalid amount",
+			contents: `{"` + addr1 + `": "abc"}`,
+			wantErr:  true,
+		},
+		{
+			name:     "unterminated object",
+			contents: `{"` + addr1 + `": 0.1`,
+			wantErr:  true,
+		},
+		{
+			name:     "data after object",
+			contents: `{"` + addr1 + `": 0.1} {}`,
+			wantErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			amounts, err := parseAmountsJSON([]byte(test.contents))
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected error but got amounts %v", amounts)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !maps.Equal(amounts, test.wantedAmounts) {
+				t.Errorf("amounts do not match - expected: %v, got: %v", test.wantedAmounts, amounts)
+			}
+		})
+	}
+}
+
+func TestParseAmountsCSV(t *testing.T) {
+	addr1 := testAddress(t, 1, &chaincfg.RegressionNetParams)
+	addr2 := testAddress(t, 2, &chaincfg.TestNet3Params)
+
+	tests := []struct {
+		name          string
+		contents      string
+		wantedAmounts map[string]float64
+		wantErr       bool
+	}{
+		{
+			name:          "amounts",
+			contents:      addr1 + ",0.1\n" + addr2 + ", 0.25\n",
+			wantedAmounts: map[string]float64{addr1: 0.1, addr2: 0.25},
+		},
+		{
+			name:          "header",
+			contents:      "address,amount\n" + addr1 + ",0.1\n",
+			wantedAmounts: map[string]float64{addr1: 0.1},
+		},
+		{
+			name:     "invalid amount in first line",
+			contents: addr1 + ",abc\n" + addr2 + ",0.25\n",
+			wantErr:  true,
+		},
+		{
+			name:     "invalid amount",
+			contents: addr1 + ",0.1\n" + addr2 + ",abc\n",
+			wantErr:  true,
+		},
+		{
+			name:     "duplicated address",
+			contents: addr1 + ",0.1\n" + addr1 + ",0.2\n",
+			wantErr:  true,
+		},
+		{
+			name:     "wrong number of fields",
+			contents: addr1 + ",0.1,0.2\n",
+			wantErr:  true,
+		},
+		{
+			name:     "only header",
+			contents: "address,amount\n",
+			wantErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			amounts, err := parseAmountsCSV([]byte(test.contents))
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected error but got amounts %v", amounts)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !maps.Equal(amounts, test.wantedAmounts) {
+				t.Errorf("amounts do not match - expected: %v, got: %v", test.wantedAmounts, amounts)
+			}
+		})
+	}
+}
@@ -3,33 +3,99 @@ package main
 import (
 	"flag"
 	"fmt"
+	"math"
+	"strings"
 
 	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/elnosh/btcw/rpcserver"
+	"github.com/elnosh/btcw/tx"
+	"github.com/elnosh/btcw/wallet"
 )
 
 type Flags struct {
-	Create  bool
-	Simnet  bool
-	Regtest bool
-	RPCUser string
-	RPCPass string
-	Node    string
+	Create    bool
+	Restore   bool
+	WordCount int
+	// extended public key to create a watch-only wallet
+	WatchOnly string
+	Recover   bool
+	Birthday  int64
+	GapLimit  uint
+	Simnet    bool
+	Regtest   bool
+	RPCUser   string
+	RPCPass   string
+	Node      string
+	// coin selection method used when sending
+	CoinSelection string
+
+	// wallet RPC server
+	RPCListen     string
+	WalletRPCUser string
+	WalletRPCPass string
+	RPCCookie     string
+	RPCTLS        bool
+	RPCCert       string
+	RPCKey        string
 }
 
 func parseFlags() (*Flags, error) {
 	flags := &Flags{}
 	flag.BoolVar(&flags.Create, "create", false, "Create a new wallet")
+	flag.BoolVar(&flags.Restore, "restore", false, "Restore a wallet from a mnemonic or hex seed")
+	flag.IntVar(&flags.WordCount, "words", 24, "Number of words in mnemonic for new wallet (12 or 24)")
+	flag.StringVar(&flags.WatchOnly, "watchonly", "", "Extended public key of account (xpub, tpub, zpub or vpub) to create a watch-only wallet with -create")
+	flag.BoolVar(&flags.Recover, "recover", false, "Rescan the blockchain from the birthday height to recover funds")
+	flag.Int64Var(&flags.Birthday, "birthday", 0, "Block height from which to start scanning when restoring or recovering a wallet")
+	flag.UintVar(&flags.GapLimit, "gaplimit", wallet.DefaultGapLimit, "Number of unused addresses to look ahead when recovering a wallet")
 	flag.BoolVar(&flags.Simnet, "simnet", false, "specify simnet")
 	flag.BoolVar(&flags.Regtest, "regtest", false, "specify regtest")
 	flag.StringVar(&flags.RPCUser, "rpcuser", "", "RPC username")
 	flag.StringVar(&flags.RPCPass, "rpcpass", "", "RPC password")
 	flag.StringVar(&flags.Node, "node", "btcd", "Node backing wallet (core or btcd)")
+	flag.StringVar(&flags.CoinSelection, "coinselection", tx.DefaultCoinSelector.Name(),
+		"Coin selection method used when sending ("+strings.Join(tx.CoinSelectorNames(), ", ")+")")
+	flag.StringVar(&flags.RPCListen, "rpclisten", rpcserver.DefaultListen, "Address for the wallet RPC server to listen on")
+	flag.StringVar(&flags.WalletRPCUser, "walletrpcuser", "", "Username for wallet RPC clients. A cookie file is used if not set")
+	flag.StringVar(&flags.WalletRPCPass, "walletrpcpass", "", "Password for wallet RPC clients. A cookie file is used if not set")
+	flag.StringVar(&flags.RPCCookie, "rpccookie", "", "Path of the cookie file with the wallet RPC credentials (default ~/.btcw/{network}/.cookie)")
+	flag.BoolVar(&flags.RPCTLS, "rpctls", false, "Serve wallet RPC over TLS")
+	flag.StringVar(&flags.RPCCert, "rpccert", rpcserver.DefaultCertPath(), "TLS certificate for the wallet RPC server. Generated if it does not exist")
+	flag.StringVar(&flags.RPCKey, "rpckey", rpcserver.DefaultKeyPath(), "TLS key for the wallet RPC server. Generated if it does not exist")
 	flag.Parse()
 
 	if flags.Node != "btcd" && flags.Node != "core" {
 		return nil, fmt.Errorf("Invalid node type. Please provide 'btcd' or 'core'")
 	}
 
+	if _, err := tx.NewCoinSelector(flags.CoinSelection); err != nil {
+		return nil, err
+	}
+
+	if flags.Create && flags.Restore {
+		return nil, fmt.Errorf("Please provide only one of -create or -restore")
+	}
+
+	if flags.WatchOnly != "" && !flags.Create {
+		return nil, fmt.Errorf("Please provide -watchonly with -create")
+	}
+
+	if flags.WordCount != 12 && flags.WordCount != 24 {
+		return nil, fmt.Errorf("Invalid number of words. Please provide 12 or 24")
+	}
+
+	if flags.Birthday < 0 {
+		return nil, fmt.Errorf("Invalid birthday height")
+	}
+
+	if flags.GapLimit == 0 || flags.GapLimit > math.MaxUint32 {
+		return nil, fmt.Errorf("Invalid gap limit")
+	}
+
+	if (flags.WalletRPCUser == "") != (flags.WalletRPCPass == "") {
+		return nil, fmt.Errorf("Please provide both -walletrpcuser and -walletrpcpass or neither to use a cookie file")
+	}
+
 	if flags.Node == "core" && flags.Simnet {
 		return nil, fmt.Errorf("Simnet is not available with core. For core please specify testnet or regtest")
 	}
@@ -46,3 +112,20 @@ func getNetwork(flags *Flags) *chaincfg.Params {
 		return &chaincfg.TestNet3Params
 	}
 }
+
+func rpcConfig(flags *Flags, net *chaincfg.Params) rpcserver.Config {
+	cookiePath := flags.RPCCookie
+	if cookiePath == "" {
+		cookiePath = rpcserver.DefaultCookiePath(net)
+	}
+
+	return rpcserver.Config{
+		Listen:     flags.RPCListen,
+		User:       flags.WalletRPCUser,
+		Pass:       flags.WalletRPCPass,
+		CookiePath: cookiePath,
+		TLS:        flags.RPCTLS,
+		CertPath:   flags.RPCCert,
+		KeyPath:    flags.RPCKey,
+	}
+}
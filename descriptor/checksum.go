@@ -0,0 +1,97 @@
+package descriptor
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// characters that can be used in descriptors. The position of a character
+	// is the value it is expanded to before computing the checksum
+	inputCharset = "0123456789()[],'/*abcdefgh@:$%{}" +
+		"IJKLMNOPQRSTUVWXYZ&+-.;<=>?!^_|~" +
+		"ijklmnopqrstuvwxyzABCDEFGH`#\"\\ "
+	checksumCharset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+	checksumLength  = 8
+)
+
+var generator = [5]uint64{0xf5dee51989, 0xa9fdca3312, 0x1bab10e32d, 0x3706b1677a, 0x644d626ffd}
+
+func polymod(c uint64, val uint64) uint64 {
+	c0 := c >> 35
+	c = ((c & 0x7ffffffff) << 5) ^ val
+	for i, g := range generator {
+		if (c0>>i)&1 == 1 {
+			c ^= g
+		}
+	}
+	return c
+}
+
+// Checksum computes the BIP380 checksum of a descriptor without checksum
+func Checksum(desc string) (string, error) {
+	c := uint64(1)
+	cls, clsCount := 0, 0
+	for _, ch := range desc {
+		pos := strings.IndexRune(inputCharset, ch)
+		if pos == -1 {
+			return "", fmt.Errorf("invalid character '%c' in descriptor", ch)
+		}
+		// symbol in the group of the character
+		c = polymod(c, uint64(pos&31))
+		// every 3 characters their groups are added as a single symbol
+		cls = cls*3 + pos>>5
+		clsCount++
+		if clsCount == 3 {
+			c = polymod(c, uint64(cls))
+			cls, clsCount = 0, 0
+		}
+	}
+	if clsCount > 0 {
+		c = polymod(c, uint64(cls))
+	}
+	for i := 0; i < checksumLength; i++ {
+		c = polymod(c, 0)
+	}
+	c ^= 1
+
+	checksum := make([]byte, checksumLength)
+	for i := range checksum {
+		checksum[i] = checksumCharset[(c>>(5*(checksumLength-1-i)))&31]
+	}
+	return string(checksum), nil
+}
+
+// AddChecksum returns the descriptor followed by '#' and its checksum
+func AddChecksum(desc string) (string, error) {
+	checksum, err := Checksum(desc)
+	if err != nil {
+		return "", err
+	}
+	return desc + "#" + checksum, nil
+}
+
+// SplitChecksum returns the descriptor without its checksum. If the descriptor
+// has a checksum it has to be valid. If requireChecksum is set it has to have one
+func SplitChecksum(desc string, requireChecksum bool) (string, error) {
+	payload, checksum, found := strings.Cut(desc, "#")
+	if !found {
+		if requireChecksum {
+			return "", errors.New("missing descriptor checksum")
+		}
+		return payload, nil
+	}
+
+	if len(checksum) != checksumLength {
+		return "", fmt.Errorf("expected %v character checksum, not %v characters", checksumLength, len(checksum))
+	}
+	expected, err := Checksum(payload)
+	if err != nil {
+		return "", err
+	}
+	if checksum != expected {
+		return "", fmt.Errorf("provided checksum '%s' does not match computed checksum '%s'", checksum, expected)
+	}
+	return payload, nil
+}
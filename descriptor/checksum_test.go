@@ -0,0 +1,65 @@
+package descriptor
+
+import "testing"
+
+func TestChecksum(t *testing.T) {
+	checksum, err := Checksum("raw(deadbeef)")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if checksum != "89f8spxm" {
+		t.Errorf("expected: 89f8spxm, got: %v", checksum)
+	}
+
+	desc, err := AddChecksum("raw(deadbeef)")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if desc != "raw(deadbeef)#89f8spxm" {
+		t.Errorf("expected: raw(deadbeef)#89f8spxm, got: %v", desc)
+	}
+
+	if _, err := Checksum("raw(Ü)"); err == nil {
+		t.Error("expected error for invalid character")
+	}
+}
+
+func TestSplitChecksum(t *testing.T) {
+	tests := []struct {
+		name            string
+		desc            string
+		requireChecksum bool
+		wanted          string
+		wantErr         bool
+	}{
+		{name: "valid checksum", desc: "raw(deadbeef)#89f8spxm", wanted: "raw(deadbeef)"},
+		{name: "required checksum", desc: "raw(deadbeef)#89f8spxm", requireChecksum: true, wanted: "raw(deadbeef)"},
+		{name: "no checksum", desc: "raw(deadbeef)", wanted: "raw(deadbeef)"},
+		{name: "missing required checksum", desc: "raw(deadbeef)", requireChecksum: true, wantErr: true},
+		{name: "empty checksum", desc: "raw(deadbeef)#", wantErr: true},
+		{name: "checksum too long", desc: "raw(deadbeef)#89f8spxmx", wantErr: true},
+		{name: "checksum too short", desc: "raw(deadbeef)#89f8spx", wantErr: true},
+		{name: "error in checksum", desc: "raw(deadbeef)#89f8spxn", wantErr: true},
+		{name: "error in payload", desc: "raw(Deadbeef)#89f8spxm", wantErr: true},
+		{name: "invalid character in checksum", desc: "raw(deadbeef)##9f8spxm", wantErr: true},
+		{name: "invalid character in payload", desc: "raw(Ü)#00000000", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payload, err := SplitChecksum(test.desc, test.requireChecksum)
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if payload != test.wanted {
+				t.Errorf("expected: %v, got: %v", test.wanted, payload)
+			}
+		})
+	}
+}
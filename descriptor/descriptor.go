@@ -0,0 +1,276 @@
+// Package descriptor parses BIP380 output script descriptors and
+// derives the output scripts and keys they describe
+package descriptor
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+// ScriptType is the type of output script of a descriptor
+type ScriptType int
+
+const (
+	// pkh(KEY) - BIP381
+	Pkh ScriptType = iota
+	// wpkh(KEY) - BIP382
+	Wpkh
+	// sh(wpkh(KEY)) - BIP381, BIP382
+	ShWpkh
+	// tr(KEY) key path only - BIP386
+	Tr
+	// multi(k,KEY,...) or sortedmulti(k,KEY,...) - BIP383
+	Multi
+	// sh(multi(...)) - BIP381, BIP383
+	ShMulti
+	// wsh(multi(...)) - BIP382, BIP383
+	WshMulti
+	// sh(wsh(multi(...)))
+	ShWshMulti
+)
+
+const (
+	// max number of keys of multi() in each context. Bare multisig
+	// is limited by standardness and P2SH by the size of the redeem script
+	maxBareMultiKeys = 3
+	maxShMultiKeys   = 15
+	maxWshMultiKeys  = 20
+)
+
+// Descriptor is a parsed output descriptor
+type Descriptor struct {
+	Type ScriptType
+	// single key or keys of multi() in the order of the descriptor
+	Keys []*Key
+	// number of signatures needed by multi()
+	Threshold int
+	// sortedmulti(): keys are sorted in the script
+	Sorted bool
+
+	net *chaincfg.Params
+}
+
+// Parse parses a descriptor for the network. The
+// checksum is optional but it has to be valid if present
+func Parse(s string, net *chaincfg.Params) (*Descriptor, error) {
+	payload, err := SplitChecksum(strings.TrimSpace(s), false)
+	if err != nil {
+		return nil, err
+	}
+
+	desc := &Descriptor{net: net}
+	name, args, err := splitFunc(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	switch name {
+	case "pkh":
+		desc.Type = Pkh
+		err = desc.parseSingleKey(args, false)
+	case "wpkh":
+		desc.Type = Wpkh
+		err = desc.parseSingleKey(args, false)
+	case "tr":
+		if strings.Contains(args, ",") {
+			return nil, errors.New("tr() script trees are not supported")
+		}
+		desc.Type = Tr
+		err = desc.parseSingleKey(args, true)
+	case "multi", "sortedmulti":
+		desc.Type = Multi
+		err = desc.parseMulti(name, args, maxBareMultiKeys)
+	case "sh":
+		err = desc.parseSh(args)
+	case "wsh":
+		desc.Type = WshMulti
+		err = desc.parseWsh(args)
+	default:
+		return nil, fmt.Errorf("'%s()' descriptors are not supported", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return desc, nil
+}
+
+// parseSh parses the script inside sh()
+func (d *Descriptor) parseSh(expr string) error {
+	name, args, err := splitFunc(expr)
+	if err != nil {
+		return err
+	}
+
+	switch name {
+	case "wpkh":
+		d.Type = ShWpkh
+		return d.parseSingleKey(args, false)
+	case "multi", "sortedmulti":
+		d.Type = ShMulti
+		return d.parseMulti(name, args, maxShMultiKeys)
+	case "wsh":
+		d.Type = ShWshMulti
+		return d.parseWsh(args)
+	default:
+		return fmt.Errorf("'%s()' is not supported inside sh()", name)
+	}
+}
+
+// parseWsh parses the script inside wsh()
+func (d *Descriptor) parseWsh(expr string) error {
+	name, args, err := splitFunc(expr)
+	if err != nil {
+		return err
+	}
+	if name != "multi" && name != "sortedmulti" {
+		return fmt.Errorf("'%s()' is not supported inside wsh()", name)
+	}
+	return d.parseMulti(name, args, maxWshMultiKeys)
+}
+
+func (d *Descriptor) parseSingleKey(expr string, xOnly bool) error {
+	key, err := parseKey(expr, d.net, xOnly)
+	if err != nil {
+		return err
+	}
+	d.Keys = []*Key{key}
+	return nil
+}
+
+// parseMulti parses the arguments of multi() or sortedmulti(): k,KEY_1,...,KEY_n
+func (d *Descriptor) parseMulti(name, args string, maxKeys int) error {
+	d.Sorted = name == "sortedmulti"
+
+	elems := strings.Split(args, ",")
+	threshold, err := strconv.Atoi(elems[0])
+	if err != nil {
+		return fmt.Errorf("multi threshold '%s' is not valid", elems[0])
+	}
+	keys := elems[1:]
+	if len(keys) == 0 {
+		return errors.New("multi requires at least one key")
+	}
+	if len(keys) > maxKeys {
+		return fmt.Errorf("multi in this context supports up to %v keys", maxKeys)
+	}
+	if threshold < 1 || threshold > len(keys) {
+		return fmt.Errorf("multi threshold %v is not between 1 and %v", threshold, len(keys))
+	}
+
+	d.Threshold = threshold
+	for _, s := range keys {
+		key, err := parseKey(s, d.net, false)
+		if err != nil {
+			return err
+		}
+		d.Keys = append(d.Keys, key)
+	}
+	return nil
+}
+
+// splitFunc splits name(args) into its name and args
+func splitFunc(expr string) (string, string, error) {
+	open := strings.Index(expr, "(")
+	if open == -1 || !strings.HasSuffix(expr, ")") {
+		return "", "", fmt.Errorf("'%s' is not a valid descriptor function", expr)
+	}
+	return expr[:open], expr[open+1 : len(expr)-1], nil
+}
+
+// IsRange returns true if the descriptor has keys with a wildcard
+func (d *Descriptor) IsRange() bool {
+	for _, key := range d.Keys {
+		if key.Wildcard {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPrivateKeys returns true if the descriptor has any private key
+func (d *Descriptor) HasPrivateKeys() bool {
+	for _, key := range d.Keys {
+		if key.HasPrivateKey() {
+			return true
+		}
+	}
+	return false
+}
+
+// Zero wipes the private keys of the descriptor from memory
+func (d *Descriptor) Zero() {
+	for _, key := range d.Keys {
+		key.zero()
+	}
+}
+
+// AddressType returns the type of address of the descriptor
+// as named by bitcoin core: legacy, p2sh-segwit, bech32 or bech32m.
+// Bare multisig has no address and it returns an empty string
+func (d *Descriptor) AddressType() string {
+	switch d.Type {
+	case Pkh, ShMulti:
+		return "legacy"
+	case ShWpkh, ShWshMulti:
+		return "p2sh-segwit"
+	case Wpkh, WshMulti:
+		return "bech32"
+	case Tr:
+		return "bech32m"
+	}
+	return ""
+}
+
+// String returns the descriptor with public keys and its checksum
+func (d *Descriptor) String() string {
+	desc, _ := d.format(false)
+	return desc
+}
+
+// PrivateString returns the descriptor with the private
+// keys it has and its checksum
+func (d *Descriptor) PrivateString() (string, error) {
+	return d.format(true)
+}
+
+func (d *Descriptor) format(private bool) (string, error) {
+	keys := make([]string, len(d.Keys))
+	for i, key := range d.Keys {
+		s, err := key.String(private)
+		if err != nil {
+			return "", err
+		}
+		keys[i] = s
+	}
+
+	var desc string
+	switch d.Type {
+	case Pkh:
+		desc = "pkh(" + keys[0] + ")"
+	case Wpkh:
+		desc = "wpkh(" + keys[0] + ")"
+	case ShWpkh:
+		desc = "sh(wpkh(" + keys[0] + "))"
+	case Tr:
+		desc = "tr(" + keys[0] + ")"
+	default:
+		name := "multi"
+		if d.Sorted {
+			name = "sortedmulti"
+		}
+		desc = name + "(" + strconv.Itoa(d.Threshold) + "," + strings.Join(keys, ",") + ")"
+		switch d.Type {
+		case ShMulti:
+			desc = "sh(" + desc + ")"
+		case WshMulti:
+			desc = "wsh(" + desc + ")"
+		case ShWshMulti:
+			desc = "sh(wsh(" + desc + "))"
+		}
+	}
+	return AddChecksum(desc)
+}
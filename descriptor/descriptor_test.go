@@ -0,0 +1,238 @@
+package descriptor
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+// master key of BIP32 test vector 1
+const testXpub = "xpub661MyMwAqRbcFtXgS5sYJABqqG9YLmC4Q1Rdap9gSE8NqtwybGhePY2gZ29ESFjqJoCu1Rupje8YtGqsefD265TMg7usUDFdp6W1EGMcet8"
+
+func TestExpand(t *testing.T) {
+	tests := []struct {
+		name     string
+		desc     string
+		pkScript string
+	}{
+		{
+			name:     "pkh",
+			desc:     "pkh(02c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee5)",
+			pkScript: "76a91406afd46bcdfd22ef94ac122aa11f241244a37ecc88ac",
+		},
+		{
+			name:     "wpkh",
+			desc:     "wpkh(02f9308a019258c31049344f85f89d5229b531c845836f99b08601f113bce036f9)",
+			pkScript: "00147dd65592d0ab2fe0d0257d571abf032cd9db93dc",
+		},
+		{
+			name:     "sh wpkh",
+			desc:     "sh(wpkh(03fff97bd5755eeea420453a14355235d382f6472f8568a18b2f057a1460297556))",
+			pkScript: "a914cc6ffbc0bf31af759451068f90ba7a0272b6b33287",
+		},
+		{
+			name:     "tr",
+			desc:     "tr(a34b99f22c790c4e36b2b3c2c35a36db06226e41c692fc82b8b56ac1c540c5bd)",
+			pkScript: "512077aab6e066f8a7419c5ab714c12c67d25007ed55a43cadcacb4d7a970a093f11",
+		},
+		{
+			name:     "sh wsh multi",
+			desc:     "sh(wsh(multi(1,03f28773c2d975288bc7d1d205c3748651b075fbc6610e58cddeeddf8f19405aa8,03499fdf9e895e719cfd64e67f07d38e3226aa7b63678949e6e49b241a60e823e4,02d7924d4f7d43ea965a465ae3095ff41131e5946f3c85f79e44adbcf8e27e080e)))",
+			pkScript: "a914aec509e284f909f769bb7dda299a717c87cc97ac87",
+		},
+		{
+			name:     "bare sortedmulti",
+			desc:     "sortedmulti(1,03acd484e2f0c7f65309ad178a9f559abde09796974c57e714c35f110dfc27ccbe,022f01e5e15cca351daff3843fb70f3c2f0a1bdd05e5af888a67784ef3e10a2a01)",
+			pkScript: "5121022f01e5e15cca351daff3843fb70f3c2f0a1bdd05e5af888a67784ef3e10a2a012103acd484e2f0c7f65309ad178a9f559abde09796974c57e714c35f110dfc27ccbe52ae",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			desc, err := Parse(test.desc, &chaincfg.MainNetParams)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			expansion, err := desc.Expand(0)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			pkScript := hex.EncodeToString(expansion.PkScript)
+			if pkScript != test.pkScript {
+				t.Errorf("expected: %v, got: %v", test.pkScript, pkScript)
+			}
+		})
+	}
+}
+
+func TestExpandRanged(t *testing.T) {
+	desc, err := Parse("wpkh([d34db33f/84'/0'/0']"+testXpub+"/1/*)", &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !desc.IsRange() {
+		t.Fatal("expected ranged descriptor")
+	}
+
+	master, _ := hdkeychain.NewKeyFromString(testXpub)
+	for idx := uint32(0); idx < 3; idx++ {
+		expansion, err := desc.Expand(idx)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		chainKey, _ := master.Derive(1)
+		key, _ := chainKey.Derive(idx)
+		pubKey, _ := key.ECPubKey()
+		addr, _ := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(pubKey.SerializeCompressed()),
+			&chaincfg.MainNetParams)
+		if expansion.Address.String() != addr.String() {
+			t.Errorf("expected address %v at index %v, got: %v", addr, idx, expansion.Address)
+		}
+
+		derived := expansion.Keys[0]
+		if derived.Fingerprint != 0x3fb34dd3 {
+			t.Errorf("expected fingerprint of key origin, got: %x", derived.Fingerprint)
+		}
+		expectedPath := []uint32{hdkeychain.HardenedKeyStart + 84, hdkeychain.HardenedKeyStart,
+			hdkeychain.HardenedKeyStart, 1, idx}
+		if formatPath(derived.Path) != formatPath(expectedPath) {
+			t.Errorf("expected path %v, got: %v", formatPath(expectedPath), formatPath(derived.Path))
+		}
+	}
+}
+
+func TestSortedMulti(t *testing.T) {
+	keyA := "022f01e5e15cca351daff3843fb70f3c2f0a1bdd05e5af888a67784ef3e10a2a01"
+	keyB := "03acd484e2f0c7f65309ad178a9f559abde09796974c57e714c35f110dfc27ccbe"
+
+	sorted, err := Parse("wsh(sortedmulti(2,"+keyB+","+keyA+"))", &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	multi, err := Parse("wsh(multi(2,"+keyA+","+keyB+"))", &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	sortedExpansion, _ := sorted.Expand(0)
+	multiExpansion, _ := multi.Expand(0)
+	if sortedExpansion.Address.String() != multiExpansion.Address.String() {
+		t.Errorf("expected address: %v, got: %v", multiExpansion.Address, sortedExpansion.Address)
+	}
+}
+
+func TestString(t *testing.T) {
+	xprv := "tprv8ZgxMBicQKsPd7Uf69XL1XwhmjHopUGep8GuEiJDZmbQz6o58LninorQAfcKZWARbtRtfnLcJ5MQ2AtHcQJCCRUcMRvmDUjyEmNUWwx8UbK"
+	desc, err := Parse("tr("+xprv+"/0/*)", &chaincfg.TestNet3Params)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !desc.HasPrivateKeys() {
+		t.Fatal("expected descriptor with private keys")
+	}
+
+	private, err := desc.PrivateString()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected, _ := AddChecksum("tr(" + xprv + "/0/*)")
+	if private != expected {
+		t.Errorf("expected: %v, got: %v", expected, private)
+	}
+
+	public, err := Parse(desc.String(), &chaincfg.TestNet3Params)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if public.HasPrivateKeys() {
+		t.Fatal("expected descriptor without private keys")
+	}
+	privateExpansion, _ := desc.Expand(5)
+	publicExpansion, _ := public.Expand(5)
+	if privateExpansion.Address.String() != publicExpansion.Address.String() {
+		t.Errorf("expected address: %v, got: %v", privateExpansion.Address, publicExpansion.Address)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		desc string
+	}{
+		{name: "unsupported function", desc: "combo(02c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee5)"},
+		{name: "pkh inside sh", desc: "sh(pkh(02c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee5))"},
+		{name: "wpkh inside wsh", desc: "wsh(wpkh(02c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee5))"},
+		{name: "uncompressed key", desc: "pkh(04a34b99f22c790c4e36b2b3c2c35a36db06226e41c692fc82b8b56ac1c540c5bd5b8dec5235a0fa8722476c7709c02559e3aa73aa03918ba2d492eea75abea235)"},
+		{name: "x-only key outside tr", desc: "wpkh(a34b99f22c790c4e36b2b3c2c35a36db06226e41c692fc82b8b56ac1c540c5bd)"},
+		{name: "hardened wildcard", desc: "wpkh(" + testXpub + "/0/*')"},
+		{name: "hardened derivation from xpub", desc: "wpkh(" + testXpub + "/0'/*)"},
+		{name: "wrong network", desc: "wpkh(" + testXpub + "/0/*)"},
+		{name: "invalid checksum", desc: "pkh(02c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee5)#00000000"},
+		{name: "threshold too high", desc: "wsh(multi(3,022f01e5e15cca351daff3843fb70f3c2f0a1bdd05e5af888a67784ef3e10a2a01,03acd484e2f0c7f65309ad178a9f559abde09796974c57e714c35f110dfc27ccbe))"},
+		{name: "tr script tree", desc: "tr(a34b99f22c790c4e36b2b3c2c35a36db06226e41c692fc82b8b56ac1c540c5bd,pk(02c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee5))"},
+		{name: "invalid fingerprint", desc: "pkh([d34db3/44'/0'/0']02c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee5)"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Parse(test.desc, &chaincfg.TestNet3Params); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestInputWeight(t *testing.T) {
+	tests := []struct {
+		name   string
+		desc   string
+		weight int64
+	}{
+		{name: "pkh", desc: "pkh(02c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee5)", weight: 593},
+		{name: "wpkh", desc: "wpkh(02f9308a019258c31049344f85f89d5229b531c845836f99b08601f113bce036f9)", weight: 272},
+		{name: "sh wpkh", desc: "sh(wpkh(03fff97bd5755eeea420453a14355235d382f6472f8568a18b2f057a1460297556))", weight: 364},
+		{name: "tr", desc: "tr(a34b99f22c790c4e36b2b3c2c35a36db06226e41c692fc82b8b56ac1c540c5bd)", weight: 230},
+		// 2 of 2: witness count, empty item, 2 signatures, script of 71 bytes
+		{name: "wsh multi", desc: "wsh(multi(2,022f01e5e15cca351daff3843fb70f3c2f0a1bdd05e5af888a67784ef3e10a2a01,03acd484e2f0c7f65309ad178a9f559abde09796974c57e714c35f110dfc27ccbe))",
+			weight: 41*4 + 1 + 1 + 2*73 + 1 + 71},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			desc, err := Parse(test.desc, &chaincfg.MainNetParams)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if weight := desc.InputWeight(); weight != test.weight {
+				t.Errorf("expected: %v, got: %v", test.weight, weight)
+			}
+		})
+	}
+}
+
+func TestZero(t *testing.T) {
+	xprv := "tprv8ZgxMBicQKsPd7Uf69XL1XwhmjHopUGep8GuEiJDZmbQz6o58LninorQAfcKZWARbtRtfnLcJ5MQ2AtHcQJCCRUcMRvmDUjyEmNUWwx8UbK"
+	privKey, _ := btcec.PrivKeyFromBytes(bytes.Repeat([]byte{0x01}, 32))
+	wif, err := btcutil.NewWIF(privKey, &chaincfg.TestNet3Params, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	desc, err := Parse("wsh(multi(1,"+xprv+"/0/*,"+wif.String()+"))", &chaincfg.TestNet3Params)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	desc.Zero()
+	if desc.Keys[0].Extended.IsPrivate() {
+		t.Error("extended private key was not wiped")
+	}
+	if !desc.Keys[1].PrivKey.PrivKey.Key.IsZero() {
+		t.Error("private key was not wiped")
+	}
+}
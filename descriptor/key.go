@@ -0,0 +1,302 @@
+package descriptor
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+// KeyOrigin is the fingerprint of the master key and the
+// path from it to the key: [fingerprint/44'/1'/0']
+type KeyOrigin struct {
+	// little endian so that it serializes in the order of the hex
+	Fingerprint uint32
+	Path        []uint32
+}
+
+// Key is a KEY expression of a descriptor. It is either an extended key
+// with the path to derive from it or a single public or private key
+type Key struct {
+	Origin *KeyOrigin
+
+	// extended key (public or private) and unhardened path after it.
+	// If Wildcard is set, the index of the expansion is derived last
+	Extended *hdkeychain.ExtendedKey
+	Path     []uint32
+	Wildcard bool
+
+	// single key. PrivKey is nil if only the public key was given
+	PubKey  *btcec.PublicKey
+	PrivKey *btcutil.WIF
+	// public key given as 32 bytes x-only key in tr()
+	XOnly bool
+}
+
+// DerivedKey is a key of a descriptor at an index
+type DerivedKey struct {
+	PubKey *btcec.PublicKey
+	// nil if the descriptor does not have the private key
+	PrivKey *btcec.PrivateKey
+	// fingerprint of the master key and full path from it. If the key has no
+	// origin, the fingerprint is the one of the key in the descriptor itself
+	Fingerprint uint32
+	Path        []uint32
+}
+
+// parseKey parses a KEY expression. xOnly allows 32 bytes public keys (tr)
+func parseKey(s string, net *chaincfg.Params, xOnly bool) (*Key, error) {
+	key := &Key{}
+
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]")
+		if end == -1 {
+			return nil, fmt.Errorf("key origin start '[' has no matching ']' in '%s'", s)
+		}
+		origin, err := parseOrigin(s[1:end])
+		if err != nil {
+			return nil, err
+		}
+		key.Origin = origin
+		s = s[end+1:]
+	}
+	if s == "" {
+		return nil, errors.New("missing key")
+	}
+
+	elems := strings.Split(s, "/")
+	if len(elems) == 1 {
+		if err := key.parseSingleKey(s, net, xOnly); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+
+	extended, err := hdkeychain.NewKeyFromString(elems[0])
+	if err != nil {
+		return nil, fmt.Errorf("key '%s' is not valid", elems[0])
+	}
+	if !extended.IsForNet(net) {
+		return nil, fmt.Errorf("extended key '%s' is not for network %s", elems[0], net.Name)
+	}
+	key.Extended = extended
+
+	for i, elem := range elems[1:] {
+		if i == len(elems)-2 && elem == "*" {
+			key.Wildcard = true
+			break
+		}
+		if elem == "*'" || elem == "*h" {
+			return nil, errors.New("hardened wildcards are not supported")
+		}
+		idx, hardened, err := parsePathElem(elem)
+		if err != nil {
+			return nil, err
+		}
+		if hardened {
+			return nil, fmt.Errorf("hardened derivation after an extended key is not supported in '%s'", s)
+		}
+		key.Path = append(key.Path, idx)
+	}
+	return key, nil
+}
+
+// parseSingleKey parses a hex encoded public key or a WIF private key
+func (k *Key) parseSingleKey(s string, net *chaincfg.Params, xOnly bool) error {
+	if b, err := hex.DecodeString(s); err == nil {
+		switch {
+		case len(b) == btcec.PubKeyBytesLenCompressed:
+			pubKey, err := btcec.ParsePubKey(b)
+			if err != nil {
+				return fmt.Errorf("public key '%s' is not valid", s)
+			}
+			k.PubKey = pubKey
+		case len(b) == schnorr.PubKeyBytesLen && xOnly:
+			pubKey, err := schnorr.ParsePubKey(b)
+			if err != nil {
+				return fmt.Errorf("public key '%s' is not valid", s)
+			}
+			k.PubKey = pubKey
+			k.XOnly = true
+		case len(b) == 65:
+			// uncompressed public key
+			return errors.New("uncompressed keys are not supported")
+		default:
+			return fmt.Errorf("public key '%s' is not valid", s)
+		}
+		return nil
+	}
+
+	wif, err := btcutil.DecodeWIF(s)
+	if err != nil {
+		return fmt.Errorf("key '%s' is not valid", s)
+	}
+	if !wif.IsForNet(net) {
+		return fmt.Errorf("private key is not for network %s", net.Name)
+	}
+	if !wif.CompressPubKey {
+		return errors.New("uncompressed keys are not supported")
+	}
+	k.PrivKey = wif
+	k.PubKey = wif.PrivKey.PubKey()
+	return nil
+}
+
+// parseOrigin parses the content of a key origin: fingerprint/path
+func parseOrigin(s string) (*KeyOrigin, error) {
+	elems := strings.Split(s, "/")
+	fingerprint, err := hex.DecodeString(elems[0])
+	if err != nil || len(fingerprint) != 4 {
+		return nil, fmt.Errorf("fingerprint '%s' is not valid", elems[0])
+	}
+
+	origin := &KeyOrigin{Fingerprint: binary.LittleEndian.Uint32(fingerprint)}
+	for _, elem := range elems[1:] {
+		idx, hardened, err := parsePathElem(elem)
+		if err != nil {
+			return nil, err
+		}
+		if hardened {
+			idx += hdkeychain.HardenedKeyStart
+		}
+		origin.Path = append(origin.Path, idx)
+	}
+	return origin, nil
+}
+
+// parsePathElem parses an index of a path. Hardened
+// indexes can be marked with ' or h
+func parsePathElem(elem string) (uint32, bool, error) {
+	hardened := strings.HasSuffix(elem, "'") || strings.HasSuffix(elem, "h")
+	if hardened {
+		elem = elem[:len(elem)-1]
+	}
+	idx, err := strconv.ParseUint(elem, 10, 31)
+	if err != nil {
+		return 0, false, fmt.Errorf("key path value '%s' is not valid", elem)
+	}
+	return uint32(idx), hardened, nil
+}
+
+// formatPath returns the path as /44'/1'/0'
+func formatPath(path []uint32) string {
+	var sb strings.Builder
+	for _, idx := range path {
+		if idx >= hdkeychain.HardenedKeyStart {
+			fmt.Fprintf(&sb, "/%d'", idx-hdkeychain.HardenedKeyStart)
+		} else {
+			fmt.Fprintf(&sb, "/%d", idx)
+		}
+	}
+	return sb.String()
+}
+
+// fingerprint returns the first 4 bytes of the hash160 of the public key
+func fingerprint(pubKey *btcec.PublicKey) uint32 {
+	return binary.LittleEndian.Uint32(btcutil.Hash160(pubKey.SerializeCompressed())[:4])
+}
+
+// String returns the KEY expression. Private keys
+// are only included if private is true
+func (k *Key) String(private bool) (string, error) {
+	var sb strings.Builder
+	if k.Origin != nil {
+		fp := make([]byte, 4)
+		binary.LittleEndian.PutUint32(fp, k.Origin.Fingerprint)
+		sb.WriteString("[" + hex.EncodeToString(fp) + formatPath(k.Origin.Path) + "]")
+	}
+
+	switch {
+	case k.Extended != nil:
+		extended := k.Extended
+		if !private && extended.IsPrivate() {
+			var err error
+			if extended, err = extended.Neuter(); err != nil {
+				return "", err
+			}
+		}
+		sb.WriteString(extended.String() + formatPath(k.Path))
+		if k.Wildcard {
+			sb.WriteString("/*")
+		}
+	case private && k.PrivKey != nil:
+		sb.WriteString(k.PrivKey.String())
+	case k.XOnly:
+		sb.WriteString(hex.EncodeToString(schnorr.SerializePubKey(k.PubKey)))
+	default:
+		sb.WriteString(hex.EncodeToString(k.PubKey.SerializeCompressed()))
+	}
+	return sb.String(), nil
+}
+
+// HasPrivateKey returns true if the private key is known
+func (k *Key) HasPrivateKey() bool {
+	if k.Extended != nil {
+		return k.Extended.IsPrivate()
+	}
+	return k.PrivKey != nil
+}
+
+// zero wipes the private key from memory
+func (k *Key) zero() {
+	if k.Extended != nil && k.Extended.IsPrivate() {
+		k.Extended.Zero()
+	}
+	if k.PrivKey != nil {
+		k.PrivKey.PrivKey.Zero()
+	}
+}
+
+// derive returns the key at index idx. idx is ignored if the key is not ranged
+func (k *Key) derive(idx uint32) (*DerivedKey, error) {
+	derived := &DerivedKey{}
+
+	if k.Extended == nil {
+		derived.PubKey = k.PubKey
+		if k.PrivKey != nil {
+			derived.PrivKey = k.PrivKey.PrivKey
+		}
+		derived.Fingerprint = fingerprint(k.PubKey)
+	} else {
+		extended := k.Extended
+		path := append([]uint32{}, k.Path...)
+		if k.Wildcard {
+			path = append(path, idx)
+		}
+
+		pubKey, err := extended.ECPubKey()
+		if err != nil {
+			return nil, err
+		}
+		derived.Fingerprint = fingerprint(pubKey)
+
+		for _, i := range path {
+			if extended, err = extended.Derive(i); err != nil {
+				return nil, err
+			}
+		}
+		if derived.PubKey, err = extended.ECPubKey(); err != nil {
+			return nil, err
+		}
+		if extended.IsPrivate() {
+			if derived.PrivKey, err = extended.ECPrivKey(); err != nil {
+				return nil, err
+			}
+		}
+		derived.Path = path
+	}
+
+	if k.Origin != nil {
+		derived.Fingerprint = k.Origin.Fingerprint
+		derived.Path = append(append([]uint32{}, k.Origin.Path...), derived.Path...)
+	}
+	return derived, nil
+}
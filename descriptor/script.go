@@ -0,0 +1,181 @@
+package descriptor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"slices"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	// outpoint + sequence
+	inputBaseSize = 36 + 4
+	// max DER signature with sighash byte
+	maxSigSize = 72
+	// schnorr signature with the default sighash
+	schnorrSigSize = 64
+	// compressed public key
+	pubKeySize = 33
+)
+
+// Expansion is the output script of a descriptor at an index with the
+// scripts and keys needed to spend it
+type Expansion struct {
+	PkScript []byte
+	Address  btcutil.Address
+	// script of P2SH outputs. For sh(wpkh()) and sh(wsh()) it is the witness program
+	RedeemScript []byte
+	// script of P2WSH outputs
+	WitnessScript []byte
+	// keys in the order of the script
+	Keys []*DerivedKey
+}
+
+// Expand derives the output script at index idx. idx is
+// ignored if the descriptor is not ranged
+func (d *Descriptor) Expand(idx uint32) (*Expansion, error) {
+	keys := make([]*DerivedKey, len(d.Keys))
+	for i, key := range d.Keys {
+		derived, err := key.derive(idx)
+		if err != nil {
+			return nil, fmt.Errorf("error deriving key at index %v: %v", idx, err)
+		}
+		keys[i] = derived
+	}
+	if d.Sorted {
+		slices.SortFunc(keys, func(a, b *DerivedKey) int {
+			return bytes.Compare(a.PubKey.SerializeCompressed(), b.PubKey.SerializeCompressed())
+		})
+	}
+
+	expansion := &Expansion{Keys: keys}
+	var err error
+	switch d.Type {
+	case Pkh:
+		pubKeyHash := btcutil.Hash160(keys[0].PubKey.SerializeCompressed())
+		expansion.Address, err = btcutil.NewAddressPubKeyHash(pubKeyHash, d.net)
+
+	case Wpkh:
+		pubKeyHash := btcutil.Hash160(keys[0].PubKey.SerializeCompressed())
+		expansion.Address, err = btcutil.NewAddressWitnessPubKeyHash(pubKeyHash, d.net)
+
+	case ShWpkh:
+		pubKeyHash := btcutil.Hash160(keys[0].PubKey.SerializeCompressed())
+		expansion.RedeemScript, err = txscript.NewScriptBuilder().AddOp(txscript.OP_0).
+			AddData(pubKeyHash).Script()
+		if err != nil {
+			return nil, err
+		}
+		expansion.Address, err = btcutil.NewAddressScriptHash(expansion.RedeemScript, d.net)
+
+	case Tr:
+		outputKey := txscript.ComputeTaprootKeyNoScript(keys[0].PubKey)
+		expansion.Address, err = btcutil.NewAddressTaproot(schnorr.SerializePubKey(outputKey), d.net)
+
+	case Multi:
+		expansion.PkScript, err = multiSigScript(d.Threshold, keys)
+		if err != nil {
+			return nil, err
+		}
+		return expansion, nil
+
+	case ShMulti:
+		expansion.RedeemScript, err = multiSigScript(d.Threshold, keys)
+		if err != nil {
+			return nil, err
+		}
+		expansion.Address, err = btcutil.NewAddressScriptHash(expansion.RedeemScript, d.net)
+
+	case WshMulti, ShWshMulti:
+		expansion.WitnessScript, err = multiSigScript(d.Threshold, keys)
+		if err != nil {
+			return nil, err
+		}
+		scriptHash := sha256.Sum256(expansion.WitnessScript)
+		expansion.Address, err = btcutil.NewAddressWitnessScriptHash(scriptHash[:], d.net)
+		if err != nil || d.Type == WshMulti {
+			break
+		}
+		expansion.RedeemScript, err = txscript.PayToAddrScript(expansion.Address)
+		if err != nil {
+			return nil, err
+		}
+		expansion.Address, err = btcutil.NewAddressScriptHash(expansion.RedeemScript, d.net)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	expansion.PkScript, err = txscript.PayToAddrScript(expansion.Address)
+	if err != nil {
+		return nil, err
+	}
+	return expansion, nil
+}
+
+func multiSigScript(threshold int, keys []*DerivedKey) ([]byte, error) {
+	builder := txscript.NewScriptBuilder().AddInt64(int64(threshold))
+	for _, key := range keys {
+		builder.AddData(key.PubKey.SerializeCompressed())
+	}
+	return builder.AddInt64(int64(len(keys))).AddOp(txscript.OP_CHECKMULTISIG).Script()
+}
+
+// InputWeight returns the estimated weight of an input
+// spending an output of the descriptor once it is signed
+func (d *Descriptor) InputWeight() int64 {
+	n := len(d.Keys)
+	// threshold signatures and the extra item consumed by OP_CHECKMULTISIG
+	multiSigs := int64(1 + d.Threshold*(1+maxSigSize))
+	// threshold, keys, n and OP_CHECKMULTISIG
+	multiScriptSize := int64(1 + n*(1+pubKeySize) + 1 + 1)
+
+	var scriptSig, witness int64
+	switch d.Type {
+	case Pkh:
+		scriptSig = 1 + maxSigSize + 1 + pubKeySize
+	case Wpkh:
+		witness = 1 + 1 + maxSigSize + 1 + pubKeySize
+	case ShWpkh:
+		// push of the witness program
+		scriptSig = 1 + 22
+		witness = 1 + 1 + maxSigSize + 1 + pubKeySize
+	case Tr:
+		witness = 1 + 1 + schnorrSigSize
+	case Multi:
+		scriptSig = multiSigs
+	case ShMulti:
+		scriptSig = multiSigs + pushSize(multiScriptSize) + multiScriptSize
+	case WshMulti, ShWshMulti:
+		witness = int64(wire.VarIntSerializeSize(uint64(d.Threshold+2))) + multiSigs +
+			int64(wire.VarIntSerializeSize(uint64(multiScriptSize))) + multiScriptSize
+		if d.Type == ShWshMulti {
+			scriptSig = 1 + 34
+		}
+	}
+
+	base := inputBaseSize + int64(wire.VarIntSerializeSize(uint64(scriptSig))) + scriptSig
+	if witness == 0 {
+		// empty witness if the tx has witness inputs
+		witness = 1
+	}
+	return base*blockchain.WitnessScaleFactor + witness
+}
+
+// pushSize returns the size of the opcode that pushes data of size
+func pushSize(size int64) int64 {
+	switch {
+	case size < txscript.OP_PUSHDATA1:
+		return 1
+	case size <= 0xff:
+		return 2
+	default:
+		return 3
+	}
+}
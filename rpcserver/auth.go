@@ -0,0 +1,146 @@
+package rpcserver
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+const (
+	// username in the cookie file like bitcoind
+	cookieUser = "__cookie__"
+
+	// wait after a failed authentication to slow down brute forcing
+	authFailureDelay = 250 * time.Millisecond
+)
+
+func appDir() string {
+	homedir, err := os.UserHomeDir()
+	if err != nil {
+		return ".btcw"
+	}
+	return filepath.Join(homedir, ".btcw")
+}
+
+// DefaultCookiePath is where the cookie file is written
+// when no RPC username and password are set
+func DefaultCookiePath(net *chaincfg.Params) string {
+	return filepath.Join(appDir(), net.Name, ".cookie")
+}
+
+// DefaultCertPath is where the TLS certificate of the RPC server is stored
+func DefaultCertPath() string {
+	return filepath.Join(appDir(), "rpc.cert")
+}
+
+// DefaultKeyPath is where the TLS key of the RPC server is stored
+func DefaultKeyPath() string {
+	return filepath.Join(appDir(), "rpc.key")
+}
+
+// writeCookie generates random credentials and writes them to the cookie
+// file as username:password so that local clients can read them
+func writeCookie(path string) (user, pass string, err error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	pass = hex.EncodeToString(secret)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(path, []byte(cookieUser+":"+pass), 0600); err != nil {
+		return "", "", fmt.Errorf("error writing cookie file: %s", err.Error())
+	}
+	return cookieUser, pass, nil
+}
+
+// ReadCookie returns the username and password in the cookie file
+func ReadCookie(path string) (user, pass string, err error) {
+	cookie, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", fmt.Errorf("error reading cookie file: %s", err.Error())
+	}
+
+	user, pass, ok := strings.Cut(strings.TrimSpace(string(cookie)), ":")
+	if !ok {
+		return "", "", errors.New("invalid cookie file")
+	}
+	return user, pass, nil
+}
+
+// generateCertPair creates a self-signed certificate and key
+// for the RPC server if they do not exist
+func generateCertPair(certPath, keyPath string) error {
+	_, certErr := os.Stat(certPath)
+	_, keyErr := os.Stat(keyPath)
+	if certErr == nil && keyErr == nil {
+		return nil
+	}
+
+	validUntil := time.Now().Add(10 * 365 * 24 * time.Hour)
+	cert, key, err := btcutil.NewTLSCertPair("btcw autogenerated cert", validUntil, nil)
+	if err != nil {
+		return fmt.Errorf("error generating TLS certificate: %s", err.Error())
+	}
+
+	if err := os.MkdirAll(filepath.Dir(certPath), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(certPath, cert, 0644); err != nil {
+		return fmt.Errorf("error writing TLS certificate: %s", err.Error())
+	}
+	if err := os.WriteFile(keyPath, key, 0600); err != nil {
+		os.Remove(certPath)
+		return fmt.Errorf("error writing TLS key: %s", err.Error())
+	}
+	return nil
+}
+
+// authenticator checks HTTP basic auth credentials of requests
+type authenticator struct {
+	// sha256 of username:password
+	credentials [sha256.Size]byte
+	// held while delaying a failed authentication so that
+	// concurrent requests can't try credentials faster
+	failMtx sync.Mutex
+}
+
+func newAuthenticator(user, pass string) *authenticator {
+	return &authenticator{credentials: sha256.Sum256([]byte(user + ":" + pass))}
+}
+
+// authenticate returns true if the request has the credentials.
+// Failed attempts wait authFailureDelay one at a time
+func (a *authenticator) authenticate(r *http.Request) bool {
+	if a.checkCredentials(r) {
+		return true
+	}
+
+	a.failMtx.Lock()
+	time.Sleep(authFailureDelay)
+	a.failMtx.Unlock()
+	return false
+}
+
+func (a *authenticator) checkCredentials(r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	provided := sha256.Sum256([]byte(user + ":" + pass))
+	return subtle.ConstantTimeCompare(provided[:], a.credentials[:]) == 1
+}
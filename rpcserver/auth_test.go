@@ -0,0 +1,186 @@
+package rpcserver
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCookie(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "regtest", ".cookie")
+
+	user, pass, err := writeCookie(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != cookieUser || len(pass) != 64 {
+		t.Errorf("unexpected cookie credentials %s:%s", user, pass)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("cookie file can be read by other users: %v", info.Mode().Perm())
+	}
+
+	readUser, readPass, err := ReadCookie(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readUser != user || readPass != pass {
+		t.Errorf("expected cookie %s:%s, got %s:%s", user, pass, readUser, readPass)
+	}
+
+	// a new cookie is written each time the server starts
+	_, newPass, err := writeCookie(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newPass == pass {
+		t.Error("cookie password was reused")
+	}
+	if _, readPass, _ := ReadCookie(path); readPass != newPass {
+		t.Errorf("expected password %s from new cookie, got %s", newPass, readPass)
+	}
+}
+
+func TestReadCookie(t *testing.T) {
+	tests := []struct {
+		name       string
+		cookie     string
+		wantedUser string
+		wantedPass string
+		wantedErr  bool
+	}{
+		{
+			name:       "valid cookie",
+			cookie:     cookieUser + ":secret",
+			wantedUser: cookieUser,
+			wantedPass: "secret",
+		},
+		{
+			name:       "trailing newline",
+			cookie:     cookieUser + ":secret\n",
+			wantedUser: cookieUser,
+			wantedPass: "secret",
+		},
+		{
+			name:      "no separator",
+			cookie:    "secret",
+			wantedErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), ".cookie")
+			if err := os.WriteFile(path, []byte(test.cookie), 0600); err != nil {
+				t.Fatal(err)
+			}
+			user, pass, err := ReadCookie(path)
+			if test.wantedErr {
+				if err == nil {
+					t.Fatal("expected error reading invalid cookie")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user != test.wantedUser || pass != test.wantedPass {
+				t.Errorf("expected %s:%s, got %s:%s", test.wantedUser, test.wantedPass, user, pass)
+			}
+		})
+	}
+
+	if _, _, err := ReadCookie(filepath.Join(t.TempDir(), ".cookie")); err == nil {
+		t.Error("expected error reading missing cookie file")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".cookie")
+	user, pass, err := writeCookie(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := newAuthenticator(user, pass)
+
+	tests := []struct {
+		name string
+		// no basic auth header if empty
+		user          string
+		pass          string
+		authenticated bool
+	}{
+		{
+			name:          "cookie credentials",
+			user:          user,
+			pass:          pass,
+			authenticated: true,
+		},
+		{
+			name: "wrong password",
+			user: user,
+			pass: pass[:len(pass)-1],
+		},
+		{
+			name: "wrong user",
+			user: "btcw",
+			pass: pass,
+		},
+		{
+			name: "missing basic auth",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", nil)
+			if test.user != "" {
+				r.SetBasicAuth(test.user, test.pass)
+			}
+			if authenticated := auth.authenticate(r); authenticated != test.authenticated {
+				t.Errorf("expected authenticated to be %v", test.authenticated)
+			}
+		})
+	}
+}
+
+func TestAuthFailuresSerialized(t *testing.T) {
+	auth := newAuthenticator(cookieUser, "secret")
+
+	const attempts = 4
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest("POST", "/", nil)
+			r.SetBasicAuth(cookieUser, "wrong")
+			auth.authenticate(r)
+		}()
+	}
+	wg.Wait()
+
+	// concurrent failed attempts are delayed one after the other
+	if elapsed := time.Since(start); elapsed < attempts*authFailureDelay {
+		t.Errorf("%v failed attempts took %v, expected at least %v", attempts, elapsed, attempts*authFailureDelay)
+	}
+
+	// successful attempts are not delayed
+	start = time.Now()
+	r := httptest.NewRequest("POST", "/", nil)
+	r.SetBasicAuth(cookieUser, "secret")
+	if !auth.authenticate(r) {
+		t.Fatal("expected request with the credentials to be authenticated")
+	}
+	if elapsed := time.Since(start); elapsed >= authFailureDelay {
+		t.Errorf("successful attempt was delayed %v", elapsed)
+	}
+}
@@ -0,0 +1,1018 @@
+package rpcserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/elnosh/btcw/tx"
+	"github.com/elnosh/btcw/wallet"
+)
+
+// handlers for the methods in the dialect of bitcoin core.
+// Params are listed in the same order as in bitcoin core
+var coreHandlers = map[string]coreHandler{
+	"getbalance": {
+		params:  []string{"dummy", "minconf", "include_watchonly", "avoid_reuse"},
+		handler: coreGetBalance,
+	},
+	"getbalances": {
+		handler: coreGetBalances,
+	},
+	"getnewaddress": {
+		params:  []string{"label", "address_type"},
+		handler: coreGetNewAddress,
+	},
+	"sendtoaddress": {
+		params: []string{"address", "amount", "comment", "comment_to", "subtractfeefromamount",
+			"replaceable", "conf_target", "estimate_mode", "avoid_reuse", "fee_rate", "verbose"},
+		handler: coreSendToAddress,
+	},
+	"sendmany": {
+		params: []string{"dummy", "amounts", "minconf", "comment", "subtractfeefrom",
+			"replaceable", "conf_target", "estimate_mode", "fee_rate", "verbose"},
+		handler: coreSendMany,
+	},
+	"sendall": {
+		params:  []string{"recipients", "conf_target", "estimate_mode", "fee_rate", "options"},
+		handler: coreSendAll,
+	},
+	"bumpfee": {
+		params:  []string{"txid", "options"},
+		handler: coreBumpFee,
+	},
+	"walletcreatefundedpsbt": {
+		params:  []string{"inputs", "outputs", "locktime", "options", "bip32derivs"},
+		handler: coreWalletCreateFundedPSBT,
+	},
+	"walletprocesspsbt": {
+		params:  []string{"psbt", "sign", "sighashtype", "bip32derivs", "finalize"},
+		handler: coreWalletProcessPSBT,
+	},
+	"finalizepsbt": {
+		params:  []string{"psbt", "extract"},
+		handler: coreFinalizePSBT,
+	},
+	"combinepsbt": {
+		params:  []string{"txs"},
+		handler: coreCombinePSBT,
+	},
+	"decodepsbt": {
+		params:  []string{"psbt"},
+		handler: coreDecodePSBT,
+	},
+	"getxpub": {
+		handler: coreGetXpub,
+	},
+	"listdescriptors": {
+		params:  []string{"private"},
+		handler: coreListDescriptors,
+	},
+	"importdescriptors": {
+		params:  []string{"requests"},
+		handler: coreImportDescriptors,
+	},
+	"listtransactions": {
+		params:  []string{"label", "count", "skip", "include_watchonly"},
+		handler: coreListTransactions,
+	},
+	"gettransaction": {
+		params:  []string{"txid", "include_watchonly", "verbose"},
+		handler: coreGetTransaction,
+	},
+	"getwalletinfo": {
+		handler: coreGetWalletInfo,
+	},
+	"walletpassphrase": {
+		params:  []string{"passphrase", "timeout"},
+		handler: coreWalletPassphrase,
+	},
+	"walletpassphrasechange": {
+		params:  []string{"oldpassphrase", "newpassphrase"},
+		handler: coreWalletPassphraseChange,
+	},
+	"walletlock": {
+		handler: coreWalletLock,
+	},
+	"checkwallet": {
+		params:  []string{"repair"},
+		handler: coreCheckWallet,
+	},
+}
+
+// parseParam unmarshals the param at idx into v. It
+// returns false if the param was not passed or is null
+func parseParam(params []json.RawMessage, idx int, name string, v any) (bool, error) {
+	if idx >= len(params) || params[idx] == nil || string(params[idx]) == "null" {
+		return false, nil
+	}
+	if err := json.Unmarshal(params[idx], v); err != nil {
+		return false, btcjson.NewRPCError(btcjson.ErrRPCType, fmt.Sprintf("invalid type for %s", name))
+	}
+	return true, nil
+}
+
+// requireParam is like parseParam but returns an error if the param was not passed
+func requireParam(params []json.RawMessage, idx int, name string, v any) error {
+	ok, err := parseParam(params, idx, name, v)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, "missing required parameter "+name)
+	}
+	return nil
+}
+
+// parseAmount parses a BTC amount passed as a number or a string
+func parseAmount(params []json.RawMessage, idx int, name string) (btcutil.Amount, error) {
+	var number json.Number
+	if err := requireParam(params, idx, name, &number); err != nil {
+		return 0, err
+	}
+	value, err := strconv.ParseFloat(number.String(), 64)
+	if err != nil {
+		return 0, btcjson.NewRPCError(btcjson.ErrRPCType, "invalid amount")
+	}
+	amount, err := btcutil.NewAmount(value)
+	if err != nil || amount <= 0 {
+		return 0, btcjson.NewRPCError(btcjson.ErrRPCType, "invalid amount")
+	}
+	return amount, nil
+}
+
+// parseAddressAmounts validates the addresses and BTC amounts
+// in rawAmounts and adds them to amounts
+func parseAddressAmounts(w *wallet.Wallet, rawAmounts map[string]json.RawMessage, amounts map[string]float64) error {
+	for address, rawAmount := range rawAmounts {
+		addr, err := btcutil.DecodeAddress(address, w.Network())
+		if err != nil || !addr.IsForNet(w.Network()) {
+			return btcjson.NewRPCError(btcjson.ErrRPCInvalidAddressOrKey, "Invalid address: "+address)
+		}
+		if _, ok := amounts[address]; ok {
+			return btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, "Invalid parameter, duplicated address: "+address)
+		}
+		amount, err := parseAmount([]json.RawMessage{rawAmount}, 0, "amount")
+		if err != nil {
+			return err
+		}
+		amounts[address] = amount.ToBTC()
+	}
+	return nil
+}
+
+// parseFeeParams returns the send options from the conf_target, estimate_mode
+// and fee_rate params at their index. fee_rate is in sat/vB
+func parseFeeParams(params []json.RawMessage, confTargetIdx, estimateModeIdx, feeRateIdx int) (wallet.SendOptions, error) {
+	var opts wallet.SendOptions
+	if _, err := parseParam(params, confTargetIdx, "conf_target", &opts.ConfTarget); err != nil {
+		return opts, err
+	}
+
+	// the node always estimates in conservative mode
+	var estimateMode string
+	if ok, err := parseParam(params, estimateModeIdx, "estimate_mode", &estimateMode); err != nil {
+		return opts, err
+	} else if ok {
+		switch strings.ToLower(estimateMode) {
+		case "unset", "economical", "conservative":
+		default:
+			return opts, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, "Invalid estimate_mode parameter")
+		}
+	}
+
+	var feeRate json.Number
+	if ok, err := parseParam(params, feeRateIdx, "fee_rate", &feeRate); err != nil {
+		return opts, err
+	} else if ok {
+		satPerVByte, err := strconv.ParseFloat(feeRate.String(), 64)
+		if err != nil {
+			return opts, btcjson.NewRPCError(btcjson.ErrRPCType, "invalid fee_rate")
+		}
+		if opts.FeeRate, err = tx.NewFeeRate(satPerVByte); err != nil {
+			return opts, btcjson.NewRPCError(btcjson.ErrRPCType, "invalid fee_rate")
+		}
+	}
+
+	if opts.FeeRate != 0 && opts.ConfTarget != 0 {
+		return opts, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter,
+			"Cannot specify both conf_target and fee_rate. Please provide either a confirmation target in blocks for automatic fee estimation, or an explicit fee rate.")
+	}
+	return opts, nil
+}
+
+// parseReplaceable sets the options to not signal
+// BIP125 if the replaceable param at idx is false
+func parseReplaceable(params []json.RawMessage, idx int, opts *wallet.SendOptions) error {
+	replaceable := true
+	if _, err := parseParam(params, idx, "replaceable", &replaceable); err != nil {
+		return err
+	}
+	opts.DisableRBF = !replaceable
+	return nil
+}
+
+// toRPCError converts errors from the wallet to the error codes of bitcoin core
+func toRPCError(err error) *btcjson.RPCError {
+	var rpcErr *btcjson.RPCError
+	switch {
+	case errors.As(err, &rpcErr):
+		return rpcErr
+	case errors.Is(err, wallet.ErrWalletLocked):
+		return btcjson.NewRPCError(btcjson.ErrRPCWalletUnlockNeeded, err.Error())
+	case errors.Is(err, wallet.ErrWatchOnly):
+		return btcjson.NewRPCError(btcjson.ErrRPCWallet, "Error: Private keys are disabled for this wallet")
+	case errors.Is(err, wallet.ErrInvalidPassphrase):
+		return btcjson.NewRPCError(btcjson.ErrRPCWalletPassphraseIncorrect, err.Error())
+	case errors.Is(err, wallet.ErrInsufficientFunds), errors.Is(err, tx.ErrInsufficientAmount):
+		return btcjson.NewRPCError(btcjson.ErrRPCWalletInsufficientFunds, err.Error())
+	case errors.Is(err, wallet.ErrTxNotFound):
+		return btcjson.NewRPCError(btcjson.ErrRPCInvalidAddressOrKey, "Invalid or non-wallet transaction id")
+	default:
+		return btcjson.NewRPCError(btcjson.ErrRPCWallet, err.Error())
+	}
+}
+
+func coreGetBalance(w *wallet.Wallet, params []json.RawMessage) (any, error) {
+	var dummy string
+	if ok, err := parseParam(params, 0, "dummy", &dummy); err != nil {
+		return nil, err
+	} else if ok && dummy != "*" {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCMethodDeprecated,
+			`dummy first argument must be excluded or set to "*"`)
+	}
+
+	var minConf int64
+	if _, err := parseParam(params, 1, "minconf", &minConf); err != nil {
+		return nil, err
+	}
+	if minConf < 0 {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, "invalid minconf")
+	}
+
+	return w.GetBalance(minConf).ToBTC(), nil
+}
+
+func coreGetBalances(w *wallet.Wallet, params []json.RawMessage) (any, error) {
+	balances := w.GetBalances(0)
+	return map[string]any{
+		"mine": map[string]float64{
+			"trusted":           balances.Trusted.ToBTC(),
+			"untrusted_pending": balances.UntrustedPending.ToBTC(),
+			"immature":          balances.Immature.ToBTC(),
+		},
+	}, nil
+}
+
+func coreGetNewAddress(w *wallet.Wallet, params []json.RawMessage) (any, error) {
+	// labels are not stored for addresses
+	var label string
+	if _, err := parseParam(params, 0, "label", &label); err != nil {
+		return nil, err
+	} else if label != "" {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, "only label \"\" is supported")
+	}
+
+	var addressType string
+	if ok, err := parseParam(params, 1, "address_type", &addressType); err != nil {
+		return nil, err
+	} else if ok && !slices.Contains([]string{"legacy", "p2sh-segwit", "bech32", "bech32m"}, addressType) {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidAddressOrKey,
+			fmt.Sprintf("Unknown address type '%s'", addressType))
+	}
+
+	return w.GetNewAddress(addressType)
+}
+
+func coreSendToAddress(w *wallet.Wallet, params []json.RawMessage) (any, error) {
+	// only a txid can be returned so watch-only
+	// wallets use walletcreatefundedpsbt instead
+	if w.IsWatchOnly() {
+		return nil, wallet.ErrWatchOnly
+	}
+	var address string
+	if err := requireParam(params, 0, "address", &address); err != nil {
+		return nil, err
+	}
+	addr, err := btcutil.DecodeAddress(address, w.Network())
+	if err != nil || !addr.IsForNet(w.Network()) {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidAddressOrKey, "Invalid address")
+	}
+
+	amount, err := parseAmount(params, 1, "amount")
+	if err != nil {
+		return nil, err
+	}
+
+	// comment is saved as the label of the tx
+	var comment string
+	if _, err := parseParam(params, 2, "comment", &comment); err != nil {
+		return nil, err
+	}
+	opts, err := parseFeeParams(params, 6, 7, 9)
+	if err != nil {
+		return nil, err
+	}
+	if err := parseReplaceable(params, 5, &opts); err != nil {
+		return nil, err
+	}
+	var subtractFee bool
+	if _, err := parseParam(params, 4, "subtractfeefromamount", &subtractFee); err != nil {
+		return nil, err
+	} else if subtractFee {
+		opts.SubtractFeeFrom = []string{address}
+	}
+
+	return w.SendToAddress(address, amount.ToBTC(), comment, opts)
+}
+
+func coreSendMany(w *wallet.Wallet, params []json.RawMessage) (any, error) {
+	if w.IsWatchOnly() {
+		return nil, wallet.ErrWatchOnly
+	}
+	var dummy string
+	if ok, err := parseParam(params, 0, "dummy", &dummy); err != nil {
+		return nil, err
+	} else if ok && dummy != "" {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter,
+			`Dummy value must be set to ""`)
+	}
+
+	var rawAmounts map[string]json.RawMessage
+	if err := requireParam(params, 1, "amounts", &rawAmounts); err != nil {
+		return nil, err
+	}
+	if len(rawAmounts) == 0 {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, "amounts cannot be empty")
+	}
+	if _, err := outputAddresses(params[1], "amounts"); err != nil {
+		return nil, err
+	}
+	amounts := make(map[string]float64, len(rawAmounts))
+	if err := parseAddressAmounts(w, rawAmounts, amounts); err != nil {
+		return nil, err
+	}
+
+	// UTXOs are selected with the spend policy of the wallet
+	var minConf int64
+	if ok, err := parseParam(params, 2, "minconf", &minConf); err != nil {
+		return nil, err
+	} else if ok && minConf != wallet.DefaultSpendMinConf {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter,
+			fmt.Sprintf("only minconf %v is supported", wallet.DefaultSpendMinConf))
+	}
+
+	// comment is saved as the label of the tx
+	var comment string
+	if _, err := parseParam(params, 3, "comment", &comment); err != nil {
+		return nil, err
+	}
+	opts, err := parseFeeParams(params, 6, 7, 8)
+	if err != nil {
+		return nil, err
+	}
+	if err := parseReplaceable(params, 5, &opts); err != nil {
+		return nil, err
+	}
+	if _, err := parseParam(params, 4, "subtractfeefrom", &opts.SubtractFeeFrom); err != nil {
+		return nil, err
+	}
+	for _, address := range opts.SubtractFeeFrom {
+		if _, ok := amounts[address]; !ok {
+			return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter,
+				"Invalid parameter 'subtract fee from output', destination "+address+" not found in tx outputs")
+		}
+	}
+
+	return w.SendMany(amounts, comment, opts)
+}
+
+func coreSendAll(w *wallet.Wallet, params []json.RawMessage) (any, error) {
+	// only a single address without amount is supported
+	var recipients []string
+	if err := requireParam(params, 0, "recipients", &recipients); err != nil {
+		return nil, err
+	}
+	if len(recipients) != 1 {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, "only one recipient is supported")
+	}
+	address := recipients[0]
+	addr, err := btcutil.DecodeAddress(address, w.Network())
+	if err != nil || !addr.IsForNet(w.Network()) {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidAddressOrKey, "Invalid address: "+address)
+	}
+
+	// fee options can also be passed in the options object
+	var options map[string]json.RawMessage
+	if _, err := parseParam(params, 4, "options", &options); err != nil {
+		return nil, err
+	}
+	feeParams := params
+	if len(options) > 0 {
+		feeParams = []json.RawMessage{nil, options["conf_target"], options["estimate_mode"], options["fee_rate"]}
+		for i := 1; i < 4 && i < len(params); i++ {
+			if params[i] != nil {
+				feeParams[i] = params[i]
+			}
+		}
+	}
+	opts, err := parseFeeParams(feeParams, 1, 2, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	var inputs []struct {
+		TxID string `json:"txid"`
+		Vout uint32 `json:"vout"`
+	}
+	if _, err := parseParam([]json.RawMessage{options["inputs"]}, 0, "inputs", &inputs); err != nil {
+		return nil, err
+	}
+	outpoints := make([]string, len(inputs))
+	for i, input := range inputs {
+		outpoints[i] = input.TxID + ":" + strconv.FormatUint(uint64(input.Vout), 10)
+	}
+
+	txid, err := w.SendAll(address, outpoints, "", opts)
+	if err != nil {
+		return nil, err
+	}
+	// watch-only wallets return the tx to sign as a psbt
+	if w.IsWatchOnly() {
+		return map[string]any{"psbt": txid, "complete": false}, nil
+	}
+	return map[string]any{"txid": txid, "complete": true}, nil
+}
+
+func coreBumpFee(w *wallet.Wallet, params []json.RawMessage) (any, error) {
+	var txid string
+	if err := requireParam(params, 0, "txid", &txid); err != nil {
+		return nil, err
+	}
+
+	var options map[string]json.RawMessage
+	if _, err := parseParam(params, 1, "options", &options); err != nil {
+		return nil, err
+	}
+	feeParams := []json.RawMessage{options["conf_target"], options["estimate_mode"], options["fee_rate"]}
+	opts, err := parseFeeParams(feeParams, 0, 1, 2)
+	if err != nil {
+		return nil, err
+	}
+	if err := parseReplaceable([]json.RawMessage{options["replaceable"]}, 0, &opts); err != nil {
+		return nil, err
+	}
+
+	result, err := w.BumpFee(txid, opts)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{
+		"txid":    result.TxID,
+		"origfee": result.OrigFee.ToBTC(),
+		"fee":     result.Fee.ToBTC(),
+		"errors":  []string{},
+	}, nil
+}
+
+func coreWalletCreateFundedPSBT(w *wallet.Wallet, params []json.RawMessage) (any, error) {
+	// inputs are always selected by the wallet
+	var inputs []json.RawMessage
+	if _, err := parseParam(params, 0, "inputs", &inputs); err != nil {
+		return nil, err
+	}
+	if len(inputs) > 0 {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, "Selecting inputs is not supported")
+	}
+	var locktime uint32
+	if _, err := parseParam(params, 2, "locktime", &locktime); err != nil {
+		return nil, err
+	} else if locktime != 0 {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, "locktime is not supported")
+	}
+
+	// outputs are an object or an array of objects of address to amount
+	var rawOutputs []json.RawMessage
+	if err := requireParam(params, 1, "outputs", &rawOutputs); err != nil {
+		var rawOutput json.RawMessage
+		if err := requireParam(params, 1, "outputs", &rawOutput); err != nil {
+			return nil, err
+		}
+		rawOutputs = []json.RawMessage{rawOutput}
+	}
+	amounts := make(map[string]float64)
+	// addresses in the order of outputs for subtractFeeFromOutputs
+	addresses := []string{}
+	for _, rawOutput := range rawOutputs {
+		var output map[string]json.RawMessage
+		if err := json.Unmarshal(rawOutput, &output); err != nil {
+			return nil, btcjson.NewRPCError(btcjson.ErrRPCType, "invalid type for outputs")
+		}
+		if _, ok := output["data"]; ok {
+			return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, "data outputs are not supported")
+		}
+		if err := parseAddressAmounts(w, output, amounts); err != nil {
+			return nil, err
+		}
+		keys, err := outputAddresses(rawOutput, "outputs")
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, keys...)
+	}
+	if len(amounts) == 0 {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, "outputs cannot be empty")
+	}
+
+	var options map[string]json.RawMessage
+	if _, err := parseParam(params, 3, "options", &options); err != nil {
+		return nil, err
+	}
+	feeParams := []json.RawMessage{options["conf_target"], options["estimate_mode"], options["fee_rate"]}
+	opts, err := parseFeeParams(feeParams, 0, 1, 2)
+	if err != nil {
+		return nil, err
+	}
+	if err := parseReplaceable([]json.RawMessage{options["replaceable"]}, 0, &opts); err != nil {
+		return nil, err
+	}
+	// outputs that pay the fee are given by their index in outputs
+	var subtractFeeFrom []int
+	if _, err := parseParam([]json.RawMessage{options["subtractFeeFromOutputs"]}, 0,
+		"subtractFeeFromOutputs", &subtractFeeFrom); err != nil {
+		return nil, err
+	}
+	for _, idx := range subtractFeeFrom {
+		if idx < 0 || idx >= len(addresses) {
+			return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter,
+				fmt.Sprintf("Invalid parameter, subtractFeeFromOutputs out of bounds: %d", idx))
+		}
+		opts.SubtractFeeFrom = append(opts.SubtractFeeFrom, addresses[idx])
+	}
+
+	funded, err := w.WalletCreateFundedPSBT(amounts, opts)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{
+		"psbt":      funded.PSBT,
+		"fee":       funded.Fee.ToBTC(),
+		"changepos": funded.ChangePos,
+	}, nil
+}
+
+func coreWalletProcessPSBT(w *wallet.Wallet, params []json.RawMessage) (any, error) {
+	var encoded string
+	if err := requireParam(params, 0, "psbt", &encoded); err != nil {
+		return nil, err
+	}
+	sign := true
+	if _, err := parseParam(params, 1, "sign", &sign); err != nil {
+		return nil, err
+	}
+	var sighashType string
+	if ok, err := parseParam(params, 2, "sighashtype", &sighashType); err != nil {
+		return nil, err
+	} else if ok && sighashType != "ALL" && sighashType != "DEFAULT" {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, "Only sighash type ALL is supported")
+	}
+	finalize := true
+	if _, err := parseParam(params, 4, "finalize", &finalize); err != nil {
+		return nil, err
+	}
+
+	processed, err := w.WalletProcessPSBT(encoded, sign, finalize)
+	if err != nil {
+		return nil, err
+	}
+	return processed, nil
+}
+
+func coreFinalizePSBT(w *wallet.Wallet, params []json.RawMessage) (any, error) {
+	var encoded string
+	if err := requireParam(params, 0, "psbt", &encoded); err != nil {
+		return nil, err
+	}
+	extract := true
+	if _, err := parseParam(params, 1, "extract", &extract); err != nil {
+		return nil, err
+	}
+
+	finalized, err := w.FinalizePSBT(encoded, extract)
+	if err != nil {
+		return nil, err
+	}
+	// the psbt is only returned if the tx was not extracted
+	if finalized.Hex != "" {
+		return map[string]any{"hex": finalized.Hex, "complete": finalized.Complete}, nil
+	}
+	return map[string]any{"psbt": finalized.PSBT, "complete": finalized.Complete}, nil
+}
+
+func coreCombinePSBT(w *wallet.Wallet, params []json.RawMessage) (any, error) {
+	var encoded []string
+	if err := requireParam(params, 0, "txs", &encoded); err != nil {
+		return nil, err
+	}
+	if len(encoded) == 0 {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, "Parameter 'txs' cannot be empty")
+	}
+	return w.CombinePSBT(encoded)
+}
+
+func coreDecodePSBT(w *wallet.Wallet, params []json.RawMessage) (any, error) {
+	var encoded string
+	if err := requireParam(params, 0, "psbt", &encoded); err != nil {
+		return nil, err
+	}
+	decoded, err := w.DecodePSBT(encoded)
+	if err != nil {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCDeserialization, err.Error())
+	}
+
+	// amounts are in BTC like bitcoin core
+	inputs := make([]map[string]any, len(decoded.Inputs))
+	for i, input := range decoded.Inputs {
+		entry := map[string]any{
+			"txid":     input.TxID,
+			"vout":     input.Vout,
+			"sequence": input.Sequence,
+			"is_mine":  input.IsMine,
+		}
+		if input.Amount != nil {
+			entry["utxo"] = map[string]any{
+				"amount":       input.Amount.ToBTC(),
+				"scriptPubKey": coreScriptPubKey(input.ScriptPubKey, input.Type, input.Address),
+			}
+		}
+		if len(input.PartialSigs) > 0 {
+			entry["partial_signatures"] = input.PartialSigs
+		}
+		if input.RedeemScript != "" {
+			entry["redeem_script"] = map[string]any{"hex": input.RedeemScript}
+		}
+		if input.WitnessScript != "" {
+			entry["witness_script"] = map[string]any{"hex": input.WitnessScript}
+		}
+		if len(input.Bip32Derivs) > 0 {
+			entry["bip32_derivs"] = input.Bip32Derivs
+		}
+		if input.FinalScriptSig != "" {
+			entry["final_scriptSig"] = map[string]any{"hex": input.FinalScriptSig}
+		}
+		if len(input.FinalScriptWitness) > 0 {
+			entry["final_scriptwitness"] = input.FinalScriptWitness
+		}
+		inputs[i] = entry
+	}
+
+	outputs := make([]map[string]any, len(decoded.Outputs))
+	for i, output := range decoded.Outputs {
+		entry := map[string]any{
+			"amount":       output.Amount.ToBTC(),
+			"scriptPubKey": coreScriptPubKey(output.ScriptPubKey, output.Type, output.Address),
+			"is_mine":      output.IsMine,
+		}
+		if len(output.Bip32Derivs) > 0 {
+			entry["bip32_derivs"] = output.Bip32Derivs
+		}
+		outputs[i] = entry
+	}
+
+	result := map[string]any{
+		"tx": map[string]any{
+			"txid":     decoded.TxID,
+			"version":  decoded.Version,
+			"locktime": decoded.LockTime,
+		},
+		"inputs":   inputs,
+		"outputs":  outputs,
+		"complete": decoded.Complete,
+	}
+	if decoded.Fee != nil {
+		result["fee"] = decoded.Fee.ToBTC()
+	}
+	return result, nil
+}
+
+// outputAddresses returns the addresses of a JSON object of amounts by
+// address in order. Repeated addresses are an error since only the last
+// amount would be kept when unmarshaling the object into a map
+func outputAddresses(raw json.RawMessage, name string) ([]string, error) {
+	keys, err := objectKeys(raw)
+	if err != nil {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCType, "invalid type for "+name)
+	}
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if seen[key] {
+			return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, "Invalid parameter, duplicated address: "+key)
+		}
+		seen[key] = true
+	}
+	return keys, nil
+}
+
+// objectKeys returns the keys of a JSON object in order
+func objectKeys(raw json.RawMessage) ([]string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := token.(string)
+		if !ok {
+			return nil, errors.New("invalid object key")
+		}
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func coreScriptPubKey(script, scriptType, address string) map[string]any {
+	scriptPubKey := map[string]any{"hex": script, "type": scriptType}
+	if address != "" {
+		scriptPubKey["address"] = address
+	}
+	return scriptPubKey
+}
+
+// coreTxEntry is an entry of listtransactions and
+// the details of gettransaction in bitcoin core
+type coreTxEntry struct {
+	Address       string   `json:"address,omitempty"`
+	Category      string   `json:"category"`
+	Amount        float64  `json:"amount"`
+	Label         string   `json:"label,omitempty"`
+	Fee           *float64 `json:"fee,omitempty"`
+	Confirmations int64    `json:"confirmations"`
+	BlockHash     string   `json:"blockhash,omitempty"`
+	BlockHeight   int64    `json:"blockheight,omitempty"`
+	TxID          string   `json:"txid"`
+	Time          int64    `json:"time"`
+	TimeReceived  int64    `json:"timereceived"`
+	ReplacedBy    string   `json:"replaced_by_txid,omitempty"`
+	Replaces      string   `json:"replaces_txid,omitempty"`
+}
+
+// coreAmounts returns the amount excluding the fee and the negative
+// fee of the record like bitcoin core. Fee is nil if the wallet did not send
+func coreAmounts(record *wallet.TxRecord) (float64, *float64) {
+	if record.Sent == 0 {
+		return record.Received.ToBTC(), nil
+	}
+	fee := -record.Fee.ToBTC()
+	return (record.Amount + record.Fee).ToBTC(), &fee
+}
+
+func newCoreTxEntry(record *wallet.TxRecord) coreTxEntry {
+	category := "receive"
+	if record.Direction != wallet.DirectionReceive {
+		category = "send"
+	}
+	address := ""
+	if len(record.Addresses) > 0 {
+		address = record.Addresses[0]
+	}
+	amount, fee := coreAmounts(record)
+
+	return coreTxEntry{
+		Address:       address,
+		Category:      category,
+		Amount:        amount,
+		Label:         record.Label,
+		Fee:           fee,
+		Confirmations: record.Confirmations,
+		BlockHash:     record.BlockHash,
+		BlockHeight:   record.BlockHeight,
+		TxID:          record.TxID,
+		Time:          record.Timestamp,
+		TimeReceived:  record.Timestamp,
+		ReplacedBy:    record.ReplacedBy,
+		Replaces:      record.Replaces,
+	}
+}
+
+func coreListTransactions(w *wallet.Wallet, params []json.RawMessage) (any, error) {
+	var label string
+	if ok, err := parseParam(params, 0, "label", &label); err != nil {
+		return nil, err
+	} else if ok && label != "*" {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, "only label \"*\" is supported")
+	}
+
+	count, skip := 10, 0
+	if _, err := parseParam(params, 1, "count", &count); err != nil {
+		return nil, err
+	}
+	if _, err := parseParam(params, 2, "skip", &skip); err != nil {
+		return nil, err
+	}
+	if count < 0 {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, "Negative count")
+	}
+	if skip < 0 {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, "Negative from")
+	}
+
+	records, err := w.ListTransactions(count, skip, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// bitcoin core lists the most recent last
+	entries := make([]coreTxEntry, len(records))
+	for i := range records {
+		entries[i] = newCoreTxEntry(&records[i])
+	}
+	slices.Reverse(entries)
+	return entries, nil
+}
+
+type coreGetTransactionResult struct {
+	Amount        float64       `json:"amount"`
+	Fee           *float64      `json:"fee,omitempty"`
+	Confirmations int64         `json:"confirmations"`
+	BlockHash     string        `json:"blockhash,omitempty"`
+	BlockHeight   int64         `json:"blockheight,omitempty"`
+	TxID          string        `json:"txid"`
+	Time          int64         `json:"time"`
+	TimeReceived  int64         `json:"timereceived"`
+	ReplacedBy    string        `json:"replaced_by_txid,omitempty"`
+	Replaces      string        `json:"replaces_txid,omitempty"`
+	Comment       string        `json:"comment,omitempty"`
+	Details       []coreTxEntry `json:"details"`
+	Hex           string        `json:"hex"`
+}
+
+func coreGetTransaction(w *wallet.Wallet, params []json.RawMessage) (any, error) {
+	var txid string
+	if err := requireParam(params, 0, "txid", &txid); err != nil {
+		return nil, err
+	}
+
+	record, err := w.GetTransaction(txid)
+	if err != nil {
+		return nil, err
+	}
+	amount, fee := coreAmounts(record)
+
+	return coreGetTransactionResult{
+		Amount:        amount,
+		Fee:           fee,
+		Confirmations: record.Confirmations,
+		BlockHash:     record.BlockHash,
+		BlockHeight:   record.BlockHeight,
+		TxID:          record.TxID,
+		Time:          record.Timestamp,
+		TimeReceived:  record.Timestamp,
+		ReplacedBy:    record.ReplacedBy,
+		Replaces:      record.Replaces,
+		Comment:       record.Label,
+		Details:       []coreTxEntry{newCoreTxEntry(record)},
+		Hex:           record.RawTx,
+	}, nil
+}
+
+func coreGetWalletInfo(w *wallet.Wallet, params []json.RawMessage) (any, error) {
+	info := w.GetWalletInfo()
+	balances := w.GetBalances(0)
+
+	var scanning any = false
+	if info.Recovering {
+		scanning = map[string]int64{"last_scanned_block": info.LastScannedBlock}
+	}
+
+	return map[string]any{
+		"walletname":           "",
+		"walletversion":        info.WalletVersion,
+		"format":               "bolt",
+		"balance":              balances.Trusted.ToBTC(),
+		"unconfirmed_balance":  balances.UntrustedPending.ToBTC(),
+		"immature_balance":     balances.Immature.ToBTC(),
+		"txcount":              info.TxCount,
+		"unlocked_until":       info.UnlockedUntil,
+		"private_keys_enabled": !info.WatchOnly,
+		"avoid_reuse":          false,
+		"scanning":             scanning,
+		"descriptors":          true,
+	}, nil
+}
+
+func coreGetXpub(w *wallet.Wallet, params []json.RawMessage) (any, error) {
+	return w.GetXpub()
+}
+
+func coreListDescriptors(w *wallet.Wallet, params []json.RawMessage) (any, error) {
+	var private bool
+	if _, err := parseParam(params, 0, "private", &private); err != nil {
+		return nil, err
+	}
+	if private {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, "private descriptors are not supported")
+	}
+
+	descriptors, err := w.ListDescriptors()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{
+		"wallet_name": "",
+		"descriptors": descriptors,
+	}, nil
+}
+
+func coreImportDescriptors(w *wallet.Wallet, params []json.RawMessage) (any, error) {
+	var requests []json.RawMessage
+	if err := requireParam(params, 0, "requests", &requests); err != nil {
+		return nil, err
+	}
+
+	importRequests := make([]wallet.ImportDescriptorRequest, len(requests))
+	for i, request := range requests {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(request, &fields); err != nil {
+			return nil, btcjson.NewRPCError(btcjson.ErrRPCType, "invalid type for requests")
+		}
+		if _, ok := fields["timestamp"]; !ok {
+			return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, "Missing required timestamp field for key")
+		}
+		if err := json.Unmarshal(request, &importRequests[i]); err != nil {
+			return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, err.Error())
+		}
+	}
+
+	results, err := w.ImportDescriptors(importRequests)
+	if err != nil {
+		return nil, err
+	}
+
+	response := make([]map[string]any, len(results))
+	for i, result := range results {
+		response[i] = map[string]any{"success": result.Success}
+		if len(result.Warnings) > 0 {
+			response[i]["warnings"] = result.Warnings
+		}
+		if result.Err != nil {
+			response[i]["error"] = toRPCError(result.Err)
+		}
+	}
+	return response, nil
+}
+
+func coreWalletPassphrase(w *wallet.Wallet, params []json.RawMessage) (any, error) {
+	var passphrase string
+	if err := requireParam(params, 0, "passphrase", &passphrase); err != nil {
+		return nil, err
+	}
+	var timeout int64
+	if err := requireParam(params, 1, "timeout", &timeout); err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, "Timeout cannot be negative.")
+	}
+
+	return nil, w.WalletPassphrase(passphrase, time.Duration(timeout)*time.Second)
+}
+
+func coreWalletPassphraseChange(w *wallet.Wallet, params []json.RawMessage) (any, error) {
+	var oldPassphrase, newPassphrase string
+	if err := requireParam(params, 0, "oldpassphrase", &oldPassphrase); err != nil {
+		return nil, err
+	}
+	if err := requireParam(params, 1, "newpassphrase", &newPassphrase); err != nil {
+		return nil, err
+	}
+
+	return nil, w.WalletPassphraseChange(oldPassphrase, newPassphrase, 0, 0)
+}
+
+func coreWalletLock(w *wallet.Wallet, params []json.RawMessage) (any, error) {
+	w.WalletLock()
+	return nil, nil
+}
+
+func coreCheckWallet(w *wallet.Wallet, params []json.RawMessage) (any, error) {
+	var repair bool
+	if _, err := parseParam(params, 0, "repair", &repair); err != nil {
+		return nil, err
+	}
+	return w.CheckWallet(repair)
+}
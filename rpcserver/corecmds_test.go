@@ -0,0 +1,123 @@
+package rpcserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/elnosh/btcw/wallet"
+)
+
+func testAddress(t *testing.T, b byte) string {
+	addr, err := btcutil.NewAddressWitnessPubKeyHash(bytes.Repeat([]byte{b}, 20), &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr.EncodeAddress()
+}
+
+func TestOutputAddresses(t *testing.T) {
+	addr1, addr2 := testAddress(t, 1), testAddress(t, 2)
+
+	tests := []struct {
+		name            string
+		raw             string
+		wantedAddresses []string
+		wantedCode      btcjson.RPCErrorCode
+	}{
+		{
+			name:            "addresses in order",
+			raw:             `{"` + addr2 + `": 0.2, "` + addr1 + `": 0.1}`,
+			wantedAddresses: []string{addr2, addr1},
+		},
+		{
+			name:       "duplicated address",
+			raw:        `{"` + addr1 + `": 0.1, "` + addr2 + `": 0.2, "` + addr1 + `": 0.3}`,
+			wantedCode: btcjson.ErrRPCInvalidParameter,
+		},
+		{
+			name:       "not an object",
+			raw:        `{"` + addr1 + `": }`,
+			wantedCode: btcjson.ErrRPCType,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addresses, err := outputAddresses(json.RawMessage(test.raw), "amounts")
+			if test.wantedCode != 0 {
+				var rpcErr *btcjson.RPCError
+				if !errors.As(err, &rpcErr) || rpcErr.Code != test.wantedCode {
+					t.Fatalf("expected RPC error with code %v, got: %v", test.wantedCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !slices.Equal(addresses, test.wantedAddresses) {
+				t.Errorf("addresses do not match - expected: %v, got: %v", test.wantedAddresses, addresses)
+			}
+		})
+	}
+}
+
+func TestSendManyParams(t *testing.T) {
+	w := wallet.NewWallet(nil, &chaincfg.RegressionNetParams)
+	addr1, addr2 := testAddress(t, 1), testAddress(t, 2)
+
+	tests := []struct {
+		name       string
+		params     []string
+		wantedCode btcjson.RPCErrorCode
+	}{
+		{
+			name:       "duplicated address",
+			params:     []string{`""`, `{"` + addr1 + `": 0.1, "` + addr2 + `": 0.2, "` + addr1 + `": 0.3}`},
+			wantedCode: btcjson.ErrRPCInvalidParameter,
+		},
+		{
+			name:       "empty amounts",
+			params:     []string{`""`, `{}`},
+			wantedCode: btcjson.ErrRPCInvalidParameter,
+		},
+		{
+			name:       "invalid address",
+			params:     []string{`""`, `{"notanaddress": 0.1}`},
+			wantedCode: btcjson.ErrRPCInvalidAddressOrKey,
+		},
+		{
+			name:       "unsupported minconf",
+			params:     []string{`""`, `{"` + addr1 + `": 0.1}`, `0`},
+			wantedCode: btcjson.ErrRPCInvalidParameter,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params := make([]json.RawMessage, len(test.params))
+			for i, param := range test.params {
+				params[i] = json.RawMessage(param)
+			}
+			_, err := coreSendMany(w, params)
+			var rpcErr *btcjson.RPCError
+			if !errors.As(err, &rpcErr) || rpcErr.Code != test.wantedCode {
+				t.Fatalf("expected RPC error with code %v, got: %v", test.wantedCode, err)
+			}
+		})
+	}
+}
+
+func TestGetNewAddressLabel(t *testing.T) {
+	w := wallet.NewWallet(nil, &chaincfg.RegressionNetParams)
+	_, err := coreGetNewAddress(w, []json.RawMessage{json.RawMessage(`"savings"`)})
+	var rpcErr *btcjson.RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != btcjson.ErrRPCInvalidParameter {
+		t.Fatalf("expected invalid parameter error for label, got: %v", err)
+	}
+}
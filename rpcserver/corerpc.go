@@ -0,0 +1,229 @@
+package rpcserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/elnosh/btcw/wallet"
+)
+
+// coreRequest is a JSON-RPC 1.0 or 2.0 request
+// in the dialect of bitcoin core
+type coreRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// coreResponse is a JSON-RPC 1.0 response. Both
+// result and error are set with one of them null
+type coreResponse struct {
+	Result any               `json:"result"`
+	Error  *btcjson.RPCError `json:"error"`
+	ID     json.RawMessage   `json:"id"`
+}
+
+// coreResponseV2 is a JSON-RPC 2.0 response. Only one
+// of result or error is set
+type coreResponseV2 struct {
+	JSONRPC string            `json:"jsonrpc"`
+	Result  json.RawMessage   `json:"result,omitempty"`
+	Error   *btcjson.RPCError `json:"error,omitempty"`
+	ID      json.RawMessage   `json:"id"`
+}
+
+// coreHandler handles a method called with params in positional order.
+// Missing optional params are nil
+type coreHandler struct {
+	// names of params to allow passing them by name
+	params  []string
+	handler func(w *wallet.Wallet, params []json.RawMessage) (any, error)
+}
+
+// isCoreRequest returns true if the body is a batch or a
+// request for a method that is not from the net/rpc service
+func isCoreRequest(body []byte) bool {
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		return true
+	}
+
+	var request struct {
+		Method string `json:"method"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		// let net/rpc reject it
+		return false
+	}
+	return !bytes.ContainsRune([]byte(request.Method), '.')
+}
+
+// serveCore handles a single or batch request in the bitcoin core dialect
+func (s *server) serveCore(w http.ResponseWriter, body []byte) {
+	body = bytes.TrimSpace(body)
+
+	if body[0] != '[' {
+		var request coreRequest
+		if err := json.Unmarshal(body, &request); err != nil {
+			writeCoreResponse(w, http.StatusInternalServerError,
+				coreResponse{Error: btcjson.ErrRPCParse, ID: json.RawMessage("null")})
+			return
+		}
+
+		response, isNotification := s.handleCoreRequest(&request)
+		if isNotification {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeCoreResponse(w, httpStatus(&request, response), response)
+		return
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(body, &batch); err != nil {
+		writeCoreResponse(w, http.StatusInternalServerError,
+			coreResponse{Error: btcjson.ErrRPCParse, ID: json.RawMessage("null")})
+		return
+	}
+	if len(batch) == 0 {
+		writeCoreResponse(w, http.StatusBadRequest,
+			coreResponse{Error: btcjson.ErrRPCInvalidRequest, ID: json.RawMessage("null")})
+		return
+	}
+
+	responses := make([]any, 0, len(batch))
+	for _, raw := range batch {
+		var request coreRequest
+		if err := json.Unmarshal(raw, &request); err != nil {
+			responses = append(responses, coreResponse{Error: btcjson.ErrRPCInvalidRequest, ID: json.RawMessage("null")})
+			continue
+		}
+		response, isNotification := s.handleCoreRequest(&request)
+		if !isNotification {
+			responses = append(responses, response)
+		}
+	}
+	writeCoreResponse(w, http.StatusOK, responses)
+}
+
+// handleCoreRequest calls the method of the request and returns the
+// response. It returns true if the request is a JSON-RPC 2.0 notification
+// which should not get a response
+func (s *server) handleCoreRequest(request *coreRequest) (any, bool) {
+	isV2 := request.JSONRPC == "2.0"
+	id := request.ID
+	if id == nil {
+		if isV2 {
+			// notification. call method but do not respond
+			s.callCore(request)
+			return nil, true
+		}
+		id = json.RawMessage("null")
+	}
+
+	result, rpcErr := s.callCore(request)
+	if isV2 {
+		if rpcErr != nil {
+			return coreResponseV2{JSONRPC: "2.0", Error: rpcErr, ID: id}, false
+		}
+		resultJSON, err := json.Marshal(result)
+		if err != nil {
+			return coreResponseV2{JSONRPC: "2.0", Error: btcjson.ErrRPCInternal, ID: id}, false
+		}
+		return coreResponseV2{JSONRPC: "2.0", Result: resultJSON, ID: id}, false
+	}
+	return coreResponse{Result: result, Error: rpcErr, ID: id}, false
+}
+
+func (s *server) callCore(request *coreRequest) (any, *btcjson.RPCError) {
+	if request.Method == "" {
+		return nil, btcjson.ErrRPCInvalidRequest
+	}
+
+	handler, ok := coreHandlers[request.Method]
+	if !ok {
+		return nil, btcjson.ErrRPCMethodNotFound
+	}
+
+	params, rpcErr := parseCoreParams(request.Params, handler.params)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	result, err := handler.handler(s.wallet, params)
+	if err != nil {
+		return nil, toRPCError(err)
+	}
+	return result, nil
+}
+
+// parseCoreParams returns the params in positional order. Params can be passed
+// as an array or as an object with the names of the params
+func parseCoreParams(raw json.RawMessage, names []string) ([]json.RawMessage, *btcjson.RPCError) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return nil, nil
+	}
+
+	if raw[0] == '[' {
+		var params []json.RawMessage
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, btcjson.ErrRPCInvalidParams
+		}
+		if len(params) > len(names) {
+			return nil, btcjson.NewRPCError(btcjson.ErrRPCMisc, "too many parameters")
+		}
+		return params, nil
+	}
+
+	var named map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &named); err != nil {
+		return nil, btcjson.ErrRPCInvalidParams
+	}
+
+	params := make([]json.RawMessage, len(names))
+	for i, name := range names {
+		if param, ok := named[name]; ok {
+			params[i] = param
+			delete(named, name)
+		}
+	}
+	for name := range named {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, "unknown named parameter "+name)
+	}
+	return params, nil
+}
+
+// httpStatus returns the HTTP status bitcoin core uses for the response.
+// JSON-RPC 1.0 errors get an error status while JSON-RPC 2.0 always get 200
+func httpStatus(request *coreRequest, response any) int {
+	if request.JSONRPC == "2.0" {
+		return http.StatusOK
+	}
+
+	v1, ok := response.(coreResponse)
+	if !ok || v1.Error == nil {
+		return http.StatusOK
+	}
+	switch v1.Error.Code {
+	case btcjson.ErrRPCMethodNotFound.Code:
+		return http.StatusNotFound
+	case btcjson.ErrRPCInvalidRequest.Code:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeCoreResponse(w http.ResponseWriter, status int, response any) {
+	jsonbytes, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(status)
+	w.Write(append(jsonbytes, '\n'))
+}
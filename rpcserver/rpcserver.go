@@ -1,30 +1,132 @@
 package rpcserver
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
+	"net/http"
 	"net/rpc"
 	"net/rpc/jsonrpc"
+	"time"
 
 	"github.com/elnosh/btcw/wallet"
 )
 
-func StartRPCServer(wallet *wallet.Wallet) error {
+const (
+	DefaultListen = "127.0.0.1:18557"
+
+	maxRequestSize = 1 << 20
+)
+
+type Config struct {
+	// address to listen on
+	Listen string
+	// credentials for HTTP basic auth. If not set, random
+	// credentials are generated and written to CookiePath
+	User       string
+	Pass       string
+	CookiePath string
+	// serve over TLS using the certificate and key. They
+	// are generated if they do not exist
+	TLS      bool
+	CertPath string
+	KeyPath  string
+}
+
+type server struct {
+	wallet    *wallet.Wallet
+	rpcServer *rpc.Server
+	auth      *authenticator
+}
+
+func StartRPCServer(wallet *wallet.Wallet, config Config) error {
+	rpcServer := rpc.NewServer()
 	walletRPC := &WalletRPC{wallet: wallet}
-	rpc.Register(walletRPC)
+	if err := rpcServer.Register(walletRPC); err != nil {
+		return fmt.Errorf("error starting RPC server: %s", err.Error())
+	}
+
+	user, pass := config.User, config.Pass
+	if user == "" || pass == "" {
+		var err error
+		user, pass, err = writeCookie(config.CookiePath)
+		if err != nil {
+			return fmt.Errorf("error starting RPC server: %s", err.Error())
+		}
+		slog.Info("rpc credentials written to cookie file: " + config.CookiePath)
+	}
 
-	listener, err := net.Listen("tcp", ":18557")
+	listener, err := net.Listen("tcp", config.Listen)
 	if err != nil {
 		return fmt.Errorf("error starting RPC server: %s", err.Error())
 	}
 
-	slog.Info("rpc server listening on: " + listener.Addr().String())
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			return err
+	httpServer := &http.Server{
+		Handler:           &server{wallet: wallet, rpcServer: rpcServer, auth: newAuthenticator(user, pass)},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	if config.TLS {
+		if err := generateCertPair(config.CertPath, config.KeyPath); err != nil {
+			return fmt.Errorf("error starting RPC server: %s", err.Error())
 		}
-		go jsonrpc.ServeConn(conn)
+		slog.Info("rpc server listening with TLS on: " + listener.Addr().String())
+		return httpServer.ServeTLS(listener, config.CertPath, config.KeyPath)
 	}
+
+	slog.Info("rpc server listening on: " + listener.Addr().String())
+	return httpServer.Serve(listener)
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !s.auth.authenticate(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="btcw RPC"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err != nil {
+		http.Error(w, "error reading request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	// requests for methods of the WalletRPC service go to net/rpc.
+	// Others are in the dialect of bitcoin core
+	if isCoreRequest(body) {
+		s.serveCore(w, body)
+		return
+	}
+
+	codec := jsonrpc.NewServerCodec(&httpConn{in: bytes.NewReader(body), out: w})
+	if err := s.rpcServer.ServeRequest(codec); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+	}
+}
+
+// httpConn reads a request from the body of an HTTP
+// request and writes the response to the HTTP response
+type httpConn struct {
+	in  io.Reader
+	out io.Writer
+}
+
+func (c *httpConn) Read(p []byte) (int, error) {
+	return c.in.Read(p)
+}
+
+func (c *httpConn) Write(p []byte) (int, error) {
+	return c.out.Write(p)
+}
+
+func (c *httpConn) Close() error {
+	return nil
 }
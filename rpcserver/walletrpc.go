@@ -3,6 +3,7 @@ package rpcserver
 import (
 	"time"
 
+	"github.com/elnosh/btcw/tx"
 	"github.com/elnosh/btcw/wallet"
 )
 
@@ -10,13 +11,32 @@ type WalletRPC struct {
 	wallet *wallet.Wallet
 }
 
-func (w *WalletRPC) GetBalance(args struct{}, reply *int64) error {
-	*reply = int64(w.wallet.GetBalance())
+type GetBalanceArgs struct {
+	MinConf int64
+}
+
+func (w *WalletRPC) GetBalance(args GetBalanceArgs, reply *int64) error {
+	*reply = int64(w.wallet.GetBalance(args.MinConf))
+	return nil
+}
+
+func (w *WalletRPC) GetBalances(args GetBalanceArgs, reply *wallet.Balances) error {
+	*reply = w.wallet.GetBalances(args.MinConf)
+	return nil
+}
+
+func (w *WalletRPC) GetWalletInfo(args struct{}, reply *wallet.WalletInfo) error {
+	*reply = w.wallet.GetWalletInfo()
 	return nil
 }
 
-func (w *WalletRPC) GetNewAddress(args struct{}, reply *string) error {
-	address, err := w.wallet.GetNewAddress()
+type GetNewAddressArgs struct {
+	// legacy, p2sh-segwit, bech32 or bech32m. bech32 if not set
+	AddressType string
+}
+
+func (w *WalletRPC) GetNewAddress(args GetNewAddressArgs, reply *string) error {
+	address, err := w.wallet.GetNewAddress(args.AddressType)
 	if err != nil {
 		return err
 	}
@@ -25,13 +45,46 @@ func (w *WalletRPC) GetNewAddress(args struct{}, reply *string) error {
 	return nil
 }
 
+// sendOptions returns the options of a send from the RPC args.
+// feeRate is in sat/vB
+func sendOptions(feeRate float64, confTarget int64, coinSelection string,
+	subtractFeeFrom []string) (wallet.SendOptions, error) {
+	rate, err := tx.NewFeeRate(feeRate)
+	if err != nil {
+		return wallet.SendOptions{}, err
+	}
+	return wallet.SendOptions{
+		FeeRate:         rate,
+		ConfTarget:      confTarget,
+		CoinSelection:   coinSelection,
+		SubtractFeeFrom: subtractFeeFrom,
+	}, nil
+}
+
 type SendToArgs struct {
 	Address string
 	Amount  float64
+	Label   string
+	// fee rate in sat/vB. If not set, it is estimated to confirm within ConfTarget blocks
+	FeeRate    float64
+	ConfTarget int64
+	// coin selection method. If not set, the one of the wallet is used
+	CoinSelection string
+	// recipient pays the fee from the amount
+	SubtractFeeFromAmount bool
 }
 
 func (w *WalletRPC) SendToAddress(args SendToArgs, reply *string) error {
-	txHash, err := w.wallet.SendToAddress(args.Address, args.Amount)
+	var subtractFeeFrom []string
+	if args.SubtractFeeFromAmount {
+		subtractFeeFrom = []string{args.Address}
+	}
+	opts, err := sendOptions(args.FeeRate, args.ConfTarget, args.CoinSelection, subtractFeeFrom)
+	if err != nil {
+		return err
+	}
+
+	txHash, err := w.wallet.SendToAddress(args.Address, args.Amount, args.Label, opts)
 	if err != nil {
 		return err
 	}
@@ -40,6 +93,237 @@ func (w *WalletRPC) SendToAddress(args SendToArgs, reply *string) error {
 	return nil
 }
 
+type SendManyArgs struct {
+	// amounts in BTC by address
+	Amounts map[string]float64
+	Label   string
+	// fee rate in sat/vB. If not set, it is estimated to confirm within ConfTarget blocks
+	FeeRate    float64
+	ConfTarget int64
+	// coin selection method. If not set, the one of the wallet is used
+	CoinSelection string
+	// addresses that pay the fee from their amounts
+	SubtractFeeFrom []string
+}
+
+func (w *WalletRPC) SendMany(args SendManyArgs, reply *string) error {
+	opts, err := sendOptions(args.FeeRate, args.ConfTarget, args.CoinSelection, args.SubtractFeeFrom)
+	if err != nil {
+		return err
+	}
+
+	txHash, err := w.wallet.SendMany(args.Amounts, args.Label, opts)
+	if err != nil {
+		return err
+	}
+
+	*reply = txHash
+	return nil
+}
+
+type SendAllArgs struct {
+	Address string
+	// utxos (txid:vout) to send. If empty, all spendable utxos are sent
+	Outpoints []string
+	Label     string
+	// fee rate in sat/vB. If not set, it is estimated to confirm within ConfTarget blocks
+	FeeRate    float64
+	ConfTarget int64
+}
+
+func (w *WalletRPC) SendAll(args SendAllArgs, reply *string) error {
+	opts, err := sendOptions(args.FeeRate, args.ConfTarget, "", nil)
+	if err != nil {
+		return err
+	}
+
+	txHash, err := w.wallet.SendAll(args.Address, args.Outpoints, args.Label, opts)
+	if err != nil {
+		return err
+	}
+
+	*reply = txHash
+	return nil
+}
+
+type BumpFeeArgs struct {
+	TxID string
+	// fee rate in sat/vB. If not set, it is estimated to confirm within ConfTarget blocks
+	FeeRate    float64
+	ConfTarget int64
+}
+
+func (w *WalletRPC) BumpFee(args BumpFeeArgs, reply *wallet.BumpFeeResult) error {
+	opts, err := sendOptions(args.FeeRate, args.ConfTarget, "", nil)
+	if err != nil {
+		return err
+	}
+
+	result, err := w.wallet.BumpFee(args.TxID, opts)
+	if err != nil {
+		return err
+	}
+
+	*reply = *result
+	return nil
+}
+
+type CPFPArgs struct {
+	TxID string
+	// output of the tx paid to the wallet that is spent by the child
+	Vout  uint32
+	Label string
+	// fee rate in sat/vB of the parent and child together. If not
+	// set, it is estimated to confirm within ConfTarget blocks
+	FeeRate    float64
+	ConfTarget int64
+}
+
+func (w *WalletRPC) CPFP(args CPFPArgs, reply *wallet.CPFPResult) error {
+	opts, err := sendOptions(args.FeeRate, args.ConfTarget, "", nil)
+	if err != nil {
+		return err
+	}
+
+	result, err := w.wallet.CPFP(args.TxID, args.Vout, args.Label, opts)
+	if err != nil {
+		return err
+	}
+
+	*reply = *result
+	return nil
+}
+
+type WalletCreateFundedPSBTArgs struct {
+	// amounts in BTC by address
+	Amounts map[string]float64
+	// fee rate in sat/vB. If not set, it is estimated to confirm within ConfTarget blocks
+	FeeRate    float64
+	ConfTarget int64
+	// coin selection method. If not set, the one of the wallet is used
+	CoinSelection string
+	// addresses that pay the fee from their amounts
+	SubtractFeeFrom []string
+}
+
+func (w *WalletRPC) WalletCreateFundedPSBT(args WalletCreateFundedPSBTArgs, reply *wallet.FundedPSBT) error {
+	opts, err := sendOptions(args.FeeRate, args.ConfTarget, args.CoinSelection, args.SubtractFeeFrom)
+	if err != nil {
+		return err
+	}
+
+	result, err := w.wallet.WalletCreateFundedPSBT(args.Amounts, opts)
+	if err != nil {
+		return err
+	}
+
+	*reply = *result
+	return nil
+}
+
+type WalletProcessPSBTArgs struct {
+	PSBT     string
+	Sign     bool
+	Finalize bool
+}
+
+func (w *WalletRPC) WalletProcessPSBT(args WalletProcessPSBTArgs, reply *wallet.ProcessedPSBT) error {
+	result, err := w.wallet.WalletProcessPSBT(args.PSBT, args.Sign, args.Finalize)
+	if err != nil {
+		return err
+	}
+
+	*reply = *result
+	return nil
+}
+
+type FinalizePSBTArgs struct {
+	PSBT    string
+	Extract bool
+}
+
+func (w *WalletRPC) FinalizePSBT(args FinalizePSBTArgs, reply *wallet.ProcessedPSBT) error {
+	result, err := w.wallet.FinalizePSBT(args.PSBT, args.Extract)
+	if err != nil {
+		return err
+	}
+
+	*reply = *result
+	return nil
+}
+
+type CombinePSBTArgs struct {
+	PSBTs []string
+}
+
+func (w *WalletRPC) CombinePSBT(args CombinePSBTArgs, reply *string) error {
+	combined, err := w.wallet.CombinePSBT(args.PSBTs)
+	if err != nil {
+		return err
+	}
+
+	*reply = combined
+	return nil
+}
+
+type PSBTArgs struct {
+	PSBT string
+}
+
+func (w *WalletRPC) DecodePSBT(args PSBTArgs, reply *wallet.DecodedPSBT) error {
+	decoded, err := w.wallet.DecodePSBT(args.PSBT)
+	if err != nil {
+		return err
+	}
+
+	*reply = *decoded
+	return nil
+}
+
+func (w *WalletRPC) SendPSBT(args PSBTArgs, reply *string) error {
+	txHash, err := w.wallet.SendPSBT(args.PSBT)
+	if err != nil {
+		return err
+	}
+
+	*reply = txHash
+	return nil
+}
+
+func (w *WalletRPC) GetXpub(args struct{}, reply *string) error {
+	xpub, err := w.wallet.GetXpub()
+	if err != nil {
+		return err
+	}
+
+	*reply = xpub
+	return nil
+}
+
+func (w *WalletRPC) ListDescriptors(args struct{}, reply *[]wallet.Descriptor) error {
+	descriptors, err := w.wallet.ListDescriptors()
+	if err != nil {
+		return err
+	}
+
+	*reply = descriptors
+	return nil
+}
+
+type ImportDescriptorsArgs struct {
+	Requests []wallet.ImportDescriptorRequest
+}
+
+func (w *WalletRPC) ImportDescriptors(args ImportDescriptorsArgs, reply *[]wallet.ImportDescriptorResult) error {
+	results, err := w.wallet.ImportDescriptors(args.Requests)
+	if err != nil {
+		return err
+	}
+
+	*reply = results
+	return nil
+}
+
 type WalletPassphraseArgs struct {
 	Passphrase string
 	Duration   time.Duration
@@ -54,7 +338,63 @@ func (w *WalletRPC) WalletPassphrase(args WalletPassphraseArgs, reply *string) e
 	return nil
 }
 
+type WalletPassphraseChangeArgs struct {
+	OldPassphrase string
+	NewPassphrase string
+	// argon2 memory in KiB and iterations. zero keeps the current ones
+	Memory     uint32
+	Iterations uint32
+}
+
+func (w *WalletRPC) WalletPassphraseChange(args WalletPassphraseChangeArgs, reply *string) error {
+	return w.wallet.WalletPassphraseChange(args.OldPassphrase, args.NewPassphrase, args.Memory, args.Iterations)
+}
+
 func (w *WalletRPC) WalletLock(args struct{}, reply *string) error {
 	w.wallet.WalletLock()
 	return nil
 }
+
+type ListTransactionsArgs struct {
+	Count      int
+	Skip       int
+	SinceBlock int64
+}
+
+func (w *WalletRPC) ListTransactions(args ListTransactionsArgs, reply *[]wallet.TxRecord) error {
+	records, err := w.wallet.ListTransactions(args.Count, args.Skip, args.SinceBlock)
+	if err != nil {
+		return err
+	}
+
+	*reply = records
+	return nil
+}
+
+type GetTransactionArgs struct {
+	TxID string
+}
+
+func (w *WalletRPC) GetTransaction(args GetTransactionArgs, reply *wallet.TxRecord) error {
+	record, err := w.wallet.GetTransaction(args.TxID)
+	if err != nil {
+		return err
+	}
+
+	*reply = *record
+	return nil
+}
+
+type CheckWalletArgs struct {
+	Repair bool
+}
+
+func (w *WalletRPC) CheckWallet(args CheckWalletArgs, reply *wallet.WalletCheck) error {
+	check, err := w.wallet.CheckWallet(args.Repair)
+	if err != nil {
+		return err
+	}
+
+	*reply = *check
+	return nil
+}
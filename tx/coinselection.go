@@ -0,0 +1,477 @@
+package tx
+
+import (
+	"cmp"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"slices"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcutil"
+)
+
+const (
+	// max number of branches explored by branch and bound
+	bnbMaxTries = 100000
+	// number of random subsets tried by knapsack
+	knapsackIterations = 1000
+)
+
+var (
+	ErrNoExactMatch           = errors.New("no selection without change found")
+	ErrUnknownSelectionMethod = errors.New("unknown coin selection method")
+)
+
+// SelectionParams are the parameters to select utxos to fund a tx
+type SelectionParams struct {
+	// amount to send plus the fee of the tx without inputs
+	Target btcutil.Amount
+	// fee rate of the tx. utxos count for their value minus the fee to spend them
+	FeeRate FeeRate
+	// fee rate at which utxos are expected to be spent in the future. If the
+	// fee rate is higher than it, selections with fewer inputs waste less
+	LongTermFeeRate FeeRate
+	// fee to add a change output at FeeRate plus the fee to spend it at LongTermFeeRate
+	CostOfChange btcutil.Amount
+	// min excess over the target to create a change output
+	// that is not dust. Smaller excess goes to the fee
+	MinChange btcutil.Amount
+}
+
+// CoinSelector selects utxos to fund a tx. Spent utxos and utxos that cost
+// more to spend than their value are never selected. The effective value
+// (value minus fee to spend at the fee rate) of the utxos selected adds up
+// to at least the target. If it can't, it returns ErrInsufficientAmount
+type CoinSelector interface {
+	Select(utxos []UTXO, params SelectionParams) ([]UTXO, error)
+	Name() string
+}
+
+// DefaultCoinSelector is the selector used if none is set
+var DefaultCoinSelector CoinSelector = LowestWaste{}
+
+// coinSelectors are the available selectors by name
+var coinSelectors = []CoinSelector{
+	LowestWaste{}, BranchAndBound{}, Knapsack{}, LargestFirst{}, OldestFirst{}, SingleRandomDraw{},
+}
+
+// NewCoinSelector returns the selector with the name
+func NewCoinSelector(name string) (CoinSelector, error) {
+	for _, selector := range coinSelectors {
+		if selector.Name() == strings.ToLower(name) {
+			return selector, nil
+		}
+	}
+	return nil, fmt.Errorf("%w '%s'. use one of %s", ErrUnknownSelectionMethod, name, strings.Join(CoinSelectorNames(), ", "))
+}
+
+// CoinSelectorNames returns the names of the available selectors
+func CoinSelectorNames() []string {
+	names := make([]string, len(coinSelectors))
+	for i, selector := range coinSelectors {
+		names[i] = selector.Name()
+	}
+	return names
+}
+
+// candidate is a utxo that can be selected with its effective value
+// and the fees to spend it now and at the long term fee rate
+type candidate struct {
+	utxo           UTXO
+	effectiveValue btcutil.Amount
+	fee            btcutil.Amount
+	longTermFee    btcutil.Amount
+}
+
+// selectionCandidates returns the unspent utxos with positive effective value
+func selectionCandidates(utxos []UTXO, params SelectionParams) []candidate {
+	candidates := make([]candidate, 0, len(utxos))
+	for _, utxo := range utxos {
+		if utxo.Spent {
+			continue
+		}
+		weight, ok := utxoInputWeight(utxo)
+		if !ok {
+			continue
+		}
+		fee := params.FeeRate.FeeForWeight(weight)
+		if utxo.Value-fee <= 0 {
+			continue
+		}
+		candidates = append(candidates, candidate{
+			utxo:           utxo,
+			effectiveValue: utxo.Value - fee,
+			fee:            fee,
+			longTermFee:    params.LongTermFeeRate.FeeForWeight(weight),
+		})
+	}
+	return candidates
+}
+
+func sumEffectiveValues(candidates []candidate) btcutil.Amount {
+	var sum btcutil.Amount
+	for _, c := range candidates {
+		sum += c.effectiveValue
+	}
+	return sum
+}
+
+func candidateUTXOs(candidates []candidate) []UTXO {
+	utxos := make([]UTXO, len(candidates))
+	for i, c := range candidates {
+		utxos[i] = c.utxo
+	}
+	return utxos
+}
+
+// selectInOrder adds candidates in the order passed until they reach the target
+func selectInOrder(candidates []candidate, target btcutil.Amount) ([]UTXO, error) {
+	var selectedValue btcutil.Amount
+	for i, c := range candidates {
+		selectedValue += c.effectiveValue
+		if selectedValue >= target {
+			return candidateUTXOs(candidates[:i+1]), nil
+		}
+	}
+	return nil, ErrInsufficientAmount
+}
+
+// Waste returns the waste metric of the selection. It is the difference
+// between the fees to spend the utxos now and at the long term fee rate
+// plus the cost of the change output if there is change or the excess
+// over the target that goes to the fee if there is no change
+func Waste(selected []UTXO, params SelectionParams) btcutil.Amount {
+	var waste, selectedValue btcutil.Amount
+	for _, c := range selectionCandidates(selected, params) {
+		waste += c.fee - c.longTermFee
+		selectedValue += c.effectiveValue
+	}
+
+	excess := selectedValue - params.Target
+	if excess >= params.MinChange && excess > 0 {
+		return waste + params.CostOfChange
+	}
+	return waste + excess
+}
+
+// BranchAndBound searches for a selection that does not need change. Its
+// effective value is between the target and the target plus the cost of
+// change. Of those found, it returns the one with the least waste.
+// It returns ErrNoExactMatch if there is none
+type BranchAndBound struct{}
+
+func (BranchAndBound) Name() string {
+	return "bnb"
+}
+
+func (BranchAndBound) Select(utxos []UTXO, params SelectionParams) ([]UTXO, error) {
+	candidates := selectionCandidates(utxos, params)
+	availableValue := sumEffectiveValues(candidates)
+	if availableValue < params.Target {
+		return nil, ErrInsufficientAmount
+	}
+
+	// explore largest first
+	slices.SortFunc(candidates, func(a, b candidate) int {
+		return cmp.Compare(b.effectiveValue, a.effectiveValue)
+	})
+
+	feeRateIsHigh := params.FeeRate > params.LongTermFeeRate
+	// indexes of candidates included in the current branch
+	var selection, bestSelection []int
+	var selectedValue, waste btcutil.Amount
+	bestWaste := btcutil.Amount(math.MaxInt64)
+
+	for try, idx := 0, 0; try < bnbMaxTries; try, idx = try+1, idx+1 {
+		backtrack := false
+		if selectedValue+availableValue < params.Target ||
+			selectedValue > params.Target+params.CostOfChange ||
+			(waste > bestWaste && feeRateIsHigh) {
+			// can't reach the target, overshot it or adding
+			// more inputs only adds waste
+			backtrack = true
+		} else if selectedValue >= params.Target {
+			// excess goes to the fee
+			excess := selectedValue - params.Target
+			if waste+excess <= bestWaste {
+				bestSelection = slices.Clone(selection)
+				bestWaste = waste + excess
+			}
+			backtrack = true
+		}
+
+		if backtrack {
+			if len(selection) == 0 {
+				// explored all branches
+				break
+			}
+			// candidates after the last included are available again
+			// for the branch without it
+			last := selection[len(selection)-1]
+			for idx--; idx > last; idx-- {
+				availableValue += candidates[idx].effectiveValue
+			}
+			selectedValue -= candidates[last].effectiveValue
+			waste -= candidates[last].fee - candidates[last].longTermFee
+			selection = selection[:len(selection)-1]
+		} else {
+			c := candidates[idx]
+			availableValue -= c.effectiveValue
+
+			// skip including it if the previous candidate was excluded and is
+			// equivalent since that branch was already explored
+			if len(selection) == 0 || idx-1 == selection[len(selection)-1] ||
+				c.effectiveValue != candidates[idx-1].effectiveValue || c.fee != candidates[idx-1].fee {
+				selection = append(selection, idx)
+				selectedValue += c.effectiveValue
+				waste += c.fee - c.longTermFee
+			}
+		}
+	}
+
+	if bestSelection == nil {
+		return nil, ErrNoExactMatch
+	}
+
+	selected := make([]UTXO, len(bestSelection))
+	for i, idx := range bestSelection {
+		selected[i] = candidates[idx].utxo
+	}
+	return selected, nil
+}
+
+// Knapsack picks the utxo or random subset of utxos that goes over the
+// target plus min change by the least, like the original selection of
+// bitcoin core. It returns an exact match for the target if there is one
+type Knapsack struct{}
+
+func (Knapsack) Name() string {
+	return "knapsack"
+}
+
+func (Knapsack) Select(utxos []UTXO, params SelectionParams) ([]UTXO, error) {
+	candidates := selectionCandidates(utxos, params)
+	shuffle(candidates)
+
+	target := params.Target
+	changeTarget := target + params.MinChange
+
+	// candidates lower than the target plus min change and
+	// the smallest candidate larger than it
+	var lower []candidate
+	var lowestLarger *candidate
+	var totalLower btcutil.Amount
+	for i, c := range candidates {
+		if c.effectiveValue == target {
+			return []UTXO{c.utxo}, nil
+		} else if c.effectiveValue < changeTarget {
+			lower = append(lower, c)
+			totalLower += c.effectiveValue
+		} else if lowestLarger == nil || c.effectiveValue < lowestLarger.effectiveValue {
+			lowestLarger = &candidates[i]
+		}
+	}
+
+	if totalLower == target {
+		return candidateUTXOs(lower), nil
+	}
+	if totalLower < target {
+		if lowestLarger == nil {
+			return nil, ErrInsufficientAmount
+		}
+		return []UTXO{lowestLarger.utxo}, nil
+	}
+
+	slices.SortFunc(lower, func(a, b candidate) int {
+		return cmp.Compare(b.effectiveValue, a.effectiveValue)
+	})
+	best, bestValue := approximateBestSubset(lower, totalLower, target)
+	if bestValue != target && totalLower >= changeTarget {
+		best, bestValue = approximateBestSubset(lower, totalLower, changeTarget)
+	}
+
+	// use the larger candidate if the subset does not leave
+	// enough change or it is closer to the target
+	if lowestLarger != nil &&
+		((bestValue != target && bestValue < changeTarget) || lowestLarger.effectiveValue <= bestValue) {
+		return []UTXO{lowestLarger.utxo}, nil
+	}
+
+	selected := make([]UTXO, 0, len(best))
+	for i, included := range best {
+		if included {
+			selected = append(selected, lower[i].utxo)
+		}
+	}
+	return selected, nil
+}
+
+// approximateBestSubset tries random subsets of the candidates to find the
+// one with the lowest value over the target. It returns which candidates are
+// included in the best subset and its value
+func approximateBestSubset(candidates []candidate, totalValue, target btcutil.Amount) ([]bool, btcutil.Amount) {
+	best := make([]bool, len(candidates))
+	for i := range best {
+		best[i] = true
+	}
+	bestValue := totalValue
+
+	included := make([]bool, len(candidates))
+	for rep := 0; rep < knapsackIterations && bestValue != target; rep++ {
+		clear(included)
+		randomBits := randBits(len(candidates))
+		var value btcutil.Amount
+		reachedTarget := false
+
+		// first pass includes candidates at random and second
+		// pass includes the ones not included in the first
+		for pass := 0; pass < 2 && !reachedTarget; pass++ {
+			for i, c := range candidates {
+				include := !included[i]
+				if pass == 0 {
+					include = randomBits[i]
+				}
+				if !include {
+					continue
+				}
+
+				value += c.effectiveValue
+				included[i] = true
+				if value >= target {
+					reachedTarget = true
+					if value < bestValue {
+						bestValue = value
+						copy(best, included)
+					}
+					// try without it to find a lower subset
+					value -= c.effectiveValue
+					included[i] = false
+				}
+			}
+		}
+	}
+	return best, bestValue
+}
+
+// LargestFirst selects utxos with the largest effective value first.
+// It results in fewer inputs
+type LargestFirst struct{}
+
+func (LargestFirst) Name() string {
+	return "largestfirst"
+}
+
+func (LargestFirst) Select(utxos []UTXO, params SelectionParams) ([]UTXO, error) {
+	candidates := selectionCandidates(utxos, params)
+	slices.SortStableFunc(candidates, func(a, b candidate) int {
+		return cmp.Compare(b.effectiveValue, a.effectiveValue)
+	})
+	return selectInOrder(candidates, params.Target)
+}
+
+// OldestFirst selects utxos confirmed earlier first. Unconfirmed utxos
+// are selected last
+type OldestFirst struct{}
+
+func (OldestFirst) Name() string {
+	return "oldestfirst"
+}
+
+func (OldestFirst) Select(utxos []UTXO, params SelectionParams) ([]UTXO, error) {
+	candidates := selectionCandidates(utxos, params)
+	slices.SortStableFunc(candidates, func(a, b candidate) int {
+		aHeight, bHeight := a.utxo.Height, b.utxo.Height
+		if aHeight == 0 {
+			aHeight = math.MaxInt64
+		}
+		if bHeight == 0 {
+			bHeight = math.MaxInt64
+		}
+		return cmp.Compare(aHeight, bHeight)
+	})
+	return selectInOrder(candidates, params.Target)
+}
+
+// SingleRandomDraw selects utxos in random order until they reach the
+// target plus min change. If all utxos together only reach the target,
+// they are all selected and the excess goes to the fee
+type SingleRandomDraw struct{}
+
+func (SingleRandomDraw) Name() string {
+	return "srd"
+}
+
+func (SingleRandomDraw) Select(utxos []UTXO, params SelectionParams) ([]UTXO, error) {
+	candidates := selectionCandidates(utxos, params)
+	shuffle(candidates)
+
+	if selected, err := selectInOrder(candidates, params.Target+params.MinChange); err == nil {
+		return selected, nil
+	}
+	if sumEffectiveValues(candidates) >= params.Target {
+		return candidateUTXOs(candidates), nil
+	}
+	return nil, ErrInsufficientAmount
+}
+
+// LowestWaste runs branch and bound, knapsack and single random draw and
+// returns the selection with the lowest waste
+type LowestWaste struct{}
+
+func (LowestWaste) Name() string {
+	return "auto"
+}
+
+func (LowestWaste) Select(utxos []UTXO, params SelectionParams) ([]UTXO, error) {
+	var best []UTXO
+	bestWaste := btcutil.Amount(math.MaxInt64)
+	for _, selector := range []CoinSelector{BranchAndBound{}, Knapsack{}, SingleRandomDraw{}} {
+		selected, err := selector.Select(utxos, params)
+		if err != nil {
+			continue
+		}
+		if waste := Waste(selected, params); waste < bestWaste {
+			best = selected
+			bestWaste = waste
+		}
+	}
+
+	if best == nil {
+		return nil, ErrInsufficientAmount
+	}
+	return best, nil
+}
+
+// randIntn returns a random number in [0, n) from crypto/rand
+func randIntn(n int) int {
+	v, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		// crypto/rand does not fail on supported platforms
+		panic(err)
+	}
+	return int(v.Int64())
+}
+
+// shuffle shuffles s in place with crypto/rand (Fisher-Yates)
+func shuffle[T any](s []T) {
+	for i := len(s) - 1; i > 0; i-- {
+		j := randIntn(i + 1)
+		s[i], s[j] = s[j], s[i]
+	}
+}
+
+// randBits returns n random booleans from crypto/rand
+func randBits(n int) []bool {
+	buf := make([]byte, (n+7)/8)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	bits := make([]bool, n)
+	for i := range bits {
+		bits[i] = buf[i/8]&(1<<(i%8)) != 0
+	}
+	return bits
+}
@@ -0,0 +1,191 @@
+package tx
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	// MinRelayFeeRate is the default minimum fee rate of nodes to relay a tx
+	MinRelayFeeRate = FeeRate(1000)
+
+	// rate used by nodes to compute the dust threshold of outputs
+	dustRelayFeeRate = FeeRate(3000)
+
+	// outpoint + sequence
+	inputBaseSize = 36 + 4
+	// max DER signature with sighash byte
+	maxSigSize = 72
+	// compressed public key
+	pubKeySize = 33
+	// schnorr signature with the default sighash
+	schnorrSigSize = 64
+
+	// version + locktime
+	txBaseSize = 4 + 4
+	// segwit marker and flag
+	segwitMarkerWeight = 2
+)
+
+var (
+	ErrUnsupportedScript = errors.New("unsupported script type")
+)
+
+// FeeRate is a fee rate in sat/kvB. Using sat/kvB allows
+// fractional sat/vB rates like those estimated by nodes
+type FeeRate int64
+
+// NewFeeRate returns the fee rate from a rate in sat/vB
+func NewFeeRate(satPerVByte float64) (FeeRate, error) {
+	if math.IsNaN(satPerVByte) || math.IsInf(satPerVByte, 0) || satPerVByte < 0 {
+		return 0, errors.New("invalid fee rate")
+	}
+	return FeeRate(math.Round(satPerVByte * 1000)), nil
+}
+
+// FeeRateFromBTCPerKvB returns the fee rate from a rate in BTC/kvB
+// which is the unit of the fee estimation RPCs of nodes
+func FeeRateFromBTCPerKvB(btcPerKvB float64) (FeeRate, error) {
+	if btcPerKvB < 0 {
+		return 0, errors.New("invalid fee rate")
+	}
+	satPerKvB, err := btcutil.NewAmount(btcPerKvB)
+	if err != nil {
+		return 0, err
+	}
+	return FeeRate(satPerKvB), nil
+}
+
+// SatPerVByte returns the fee rate in sat/vB
+func (r FeeRate) SatPerVByte() float64 {
+	return float64(r) / 1000
+}
+
+// FeeForVSize returns the fee for a tx of vsize virtual bytes.
+// It is rounded up so that the rate paid is not lower than r
+func (r FeeRate) FeeForVSize(vsize int64) btcutil.Amount {
+	return btcutil.Amount((int64(r)*vsize + 999) / 1000)
+}
+
+// FeeForWeight returns the fee for a tx of weight units
+func (r FeeRate) FeeForWeight(weight int64) btcutil.Amount {
+	return r.FeeForVSize(vsizeFromWeight(weight))
+}
+
+func (r FeeRate) String() string {
+	return fmt.Sprintf("%.3f sat/vB", r.SatPerVByte())
+}
+
+func vsizeFromWeight(weight int64) int64 {
+	return (weight + blockchain.WitnessScaleFactor - 1) / blockchain.WitnessScaleFactor
+}
+
+// InputWeight returns the estimated weight of an input spending
+// the script once it is signed. It returns false if the type of
+// script is not supported
+func InputWeight(pkScript []byte) (int64, bool) {
+	switch txscript.GetScriptClass(pkScript) {
+	case txscript.WitnessV0PubKeyHashTy:
+		// empty script sig. witness has item count, signature and public key
+		base := int64(inputBaseSize + 1)
+		witness := int64(1 + 1 + maxSigSize + 1 + pubKeySize)
+		return base*blockchain.WitnessScaleFactor + witness, true
+
+	case txscript.PubKeyHashTy:
+		// script sig has signature and public key. 1 more weight unit
+		// for the empty witness if the tx has witness inputs
+		scriptSigSize := 1 + maxSigSize + 1 + pubKeySize
+		base := int64(inputBaseSize + wire.VarIntSerializeSize(uint64(scriptSigSize)) + scriptSigSize)
+		return base*blockchain.WitnessScaleFactor + 1, true
+
+	case txscript.WitnessV1TaprootTy:
+		// key path spend. witness has item count and signature
+		base := int64(inputBaseSize + 1)
+		witness := int64(1 + 1 + schnorrSigSize)
+		return base*blockchain.WitnessScaleFactor + witness, true
+	}
+	return 0, false
+}
+
+// utxoInputWeight returns the weight of the input spending the utxo.
+// It is estimated from its script if the utxo does not set it
+func utxoInputWeight(utxo UTXO) (int64, bool) {
+	if utxo.InputWeight > 0 {
+		return utxo.InputWeight, true
+	}
+	return InputWeight(utxo.ScriptPubKey)
+}
+
+// InputFee returns the fee to spend the utxo at the fee rate
+func InputFee(utxo UTXO, feeRate FeeRate) (btcutil.Amount, error) {
+	weight, ok := utxoInputWeight(utxo)
+	if !ok {
+		return 0, ErrUnsupportedScript
+	}
+	return feeRate.FeeForWeight(weight), nil
+}
+
+// EffectiveValue returns the value of the utxo minus the fee to spend it
+// at the fee rate. It returns false if the script of the utxo is not supported
+func EffectiveValue(utxo UTXO, feeRate FeeRate) (btcutil.Amount, bool) {
+	fee, err := InputFee(utxo, feeRate)
+	if err != nil {
+		return 0, false
+	}
+	return utxo.Value - fee, true
+}
+
+// outputSize returns the serialized size of the output
+func outputSize(txOut *wire.TxOut) int64 {
+	return int64(txOut.SerializeSize())
+}
+
+// TxOverheadWeight returns the weight of a tx with the outputs and no inputs
+// other than the count of inputs. It includes the segwit marker and flag
+func TxOverheadWeight(numInputs int, outputs []*wire.TxOut) int64 {
+	base := int64(txBaseSize + wire.VarIntSerializeSize(uint64(numInputs)) +
+		wire.VarIntSerializeSize(uint64(len(outputs))))
+	for _, txOut := range outputs {
+		base += outputSize(txOut)
+	}
+	return base*blockchain.WitnessScaleFactor + segwitMarkerWeight
+}
+
+// EstimateVirtualSize returns the estimated vsize of the tx spending
+// the utxos to the outputs once it is signed
+func EstimateVirtualSize(utxos []UTXO, outputs []*wire.TxOut) (int64, error) {
+	weight := TxOverheadWeight(len(utxos), outputs)
+	for _, utxo := range utxos {
+		inputWeight, ok := utxoInputWeight(utxo)
+		if !ok {
+			return 0, ErrUnsupportedScript
+		}
+		weight += inputWeight
+	}
+	return vsizeFromWeight(weight), nil
+}
+
+// DustThreshold returns the value below which an output with the script
+// is considered dust by nodes. It is the cost to create and spend it at
+// the dust relay fee rate
+func DustThreshold(pkScript []byte) btcutil.Amount {
+	size := outputSize(wire.NewTxOut(0, pkScript))
+	if txscript.IsWitnessProgram(pkScript) {
+		// input with a witness of a signature and public key discounted
+		size += inputBaseSize + 1 + (1+maxSigSize+1+pubKeySize)/blockchain.WitnessScaleFactor
+	} else {
+		size += inputBaseSize + 1 + 1 + maxSigSize + 1 + pubKeySize
+	}
+	return dustRelayFeeRate.FeeForVSize(size)
+}
+
+// IsDust returns true if the value of the output is below its dust threshold
+func IsDust(txOut *wire.TxOut) bool {
+	return btcutil.Amount(txOut.Value) < DustThreshold(txOut.PkScript)
+}
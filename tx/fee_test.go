@@ -0,0 +1,118 @@
+package tx
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/wire"
+)
+
+var p2pkhScript, _ = hex.DecodeString("76a914751e76e8199196d454941c45d1b3a323f1433bd688ac")
+var p2trScript, _ = hex.DecodeString("512077aab6e066f8a7419c5ab714c12c67d25007ed55a43cadcacb4d7a970a093f11")
+var p2shScript, _ = hex.DecodeString("a914cc6ffbc0bf31af759451068f90ba7a0272b6b33287")
+
+func TestFeeRate(t *testing.T) {
+	tests := []struct {
+		name    string
+		feeRate func() (FeeRate, error)
+		wanted  FeeRate
+	}{
+		{name: "sat/vB", feeRate: func() (FeeRate, error) { return NewFeeRate(2.5) }, wanted: 2500},
+		{name: "BTC/kvB", feeRate: func() (FeeRate, error) { return FeeRateFromBTCPerKvB(0.00012) }, wanted: 12000},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			feeRate, err := test.feeRate()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if feeRate != test.wanted {
+				t.Errorf("expected: %v, got: %v", test.wanted, feeRate)
+			}
+		})
+	}
+
+	if _, err := NewFeeRate(-1); err == nil {
+		t.Error("expected error for negative fee rate")
+	}
+
+	// fee is rounded up
+	if fee := FeeRate(1500).FeeForVSize(141); fee != 212 {
+		t.Errorf("expected fee of 212, got: %v", fee)
+	}
+}
+
+func TestEstimateVirtualSize(t *testing.T) {
+	p2wpkhOut := wire.NewTxOut(10000, p2wpkhScript)
+	p2pkhOut := wire.NewTxOut(10000, p2pkhScript)
+
+	tests := []struct {
+		name    string
+		utxos   []UTXO
+		outputs []*wire.TxOut
+		wanted  int64
+	}{
+		{
+			name:    "1 p2wpkh input 2 p2wpkh outputs",
+			utxos:   []UTXO{*NewUTXO("txid1", 0, 20000, p2wpkhScript, "")},
+			outputs: []*wire.TxOut{p2wpkhOut, p2wpkhOut},
+			wanted:  141,
+		},
+		{
+			name: "2 p2wpkh inputs 1 p2pkh output",
+			utxos: []UTXO{
+				*NewUTXO("txid1", 0, 20000, p2wpkhScript, ""),
+				*NewUTXO("txid2", 0, 20000, p2wpkhScript, ""),
+			},
+			outputs: []*wire.TxOut{p2pkhOut},
+			wanted:  181,
+		},
+		{
+			name:    "1 p2pkh input 1 p2wpkh output",
+			utxos:   []UTXO{*NewUTXO("txid1", 0, 20000, p2pkhScript, "")},
+			outputs: []*wire.TxOut{p2wpkhOut},
+			wanted:  190,
+		},
+		{
+			name:    "1 p2tr input 1 p2wpkh output",
+			utxos:   []UTXO{*NewUTXO("txid1", 0, 20000, p2trScript, "")},
+			outputs: []*wire.TxOut{p2wpkhOut},
+			wanted:  99,
+		},
+		{
+			name: "1 p2sh-p2wpkh input with its weight 1 p2wpkh output",
+			utxos: []UTXO{
+				{TxID: "txid1", Value: 20000, ScriptPubKey: p2shScript, InputWeight: 364},
+			},
+			outputs: []*wire.TxOut{p2wpkhOut},
+			wanted:  133,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vsize, err := EstimateVirtualSize(test.utxos, test.outputs)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if vsize != test.wanted {
+				t.Errorf("expected vsize: %v, got: %v", test.wanted, vsize)
+			}
+		})
+	}
+
+	if _, err := EstimateVirtualSize([]UTXO{*NewUTXO("txid1", 0, 20000, nil, "")}, nil); err != ErrUnsupportedScript {
+		t.Errorf("expected: %v, got: %v", ErrUnsupportedScript, err)
+	}
+}
+
+func TestDustThreshold(t *testing.T) {
+	if dust := DustThreshold(p2wpkhScript); dust != btcutil.Amount(294) {
+		t.Errorf("expected p2wpkh dust threshold of 294, got: %v", dust)
+	}
+	if dust := DustThreshold(p2pkhScript); dust != btcutil.Amount(546) {
+		t.Errorf("expected p2pkh dust threshold of 546, got: %v", dust)
+	}
+}
@@ -10,6 +10,20 @@ import (
 	"github.com/btcsuite/btcd/wire"
 )
 
+// RBFSequence is the sequence of inputs of txs that
+// signal they can be replaced by a higher fee tx (BIP125)
+const RBFSequence = wire.MaxTxInSequenceNum - 2
+
+// SignalsReplacement returns true if an input of the tx signals that it can be replaced
+func SignalsReplacement(msgTx *wire.MsgTx) bool {
+	for _, txIn := range msgTx.TxIn {
+		if txIn.Sequence < wire.MaxTxInSequenceNum-1 {
+			return true
+		}
+	}
+	return false
+}
+
 // CreateTxIn returns a new wire.TxIn from the utxo referenced
 func CreateTxIn(previousUtxo UTXO) (*wire.TxIn, error) {
 	prevTxHash, err := chainhash.NewHashFromStr(previousUtxo.TxID)
@@ -37,3 +51,9 @@ func CreateTxOut(address string, amount btcutil.Amount, net *chaincfg.Params) (*
 	txOut := wire.NewTxOut(int64(amount), script)
 	return txOut, nil
 }
+
+// ShuffleTxOuts shuffles the outputs with crypto/rand so
+// that their order does not reveal which one is change
+func ShuffleTxOuts(txOuts []*wire.TxOut) {
+	shuffle(txOuts)
+}
@@ -2,17 +2,12 @@ package tx
 
 import (
 	"errors"
-	"math/rand"
-	"slices"
 	"strconv"
 
 	"github.com/btcsuite/btcd/btcutil"
 )
 
-var (
-	ErrInsufficientAmount = errors.New("not enough value in utxos to fulfill amount")
-	ErrNoUTXOs            = errors.New("no utxos to select")
-)
+var ErrInsufficientAmount = errors.New("not enough value in utxos to fulfill amount")
 
 type UTXO struct {
 	TxID           string
@@ -21,6 +16,15 @@ type UTXO struct {
 	ScriptPubKey   []byte
 	Spent          bool
 	DerivationPath string // path of the key associated with this utxo
+	Height         int64  // height of block where utxo was confirmed. 0 if unconfirmed
+	BlockHash      string // hash of block where utxo was confirmed
+	SpentBy        string // id of tx spending this utxo
+	SpentHeight    int64  // height of block where spending tx was confirmed. 0 if unconfirmed
+	Coinbase       bool   // output of a coinbase tx
+	FromWallet     bool   // output of a tx sent by the wallet (i.e change)
+	// estimated weight of the input spending this utxo once
+	// signed. If 0, it is estimated from the script
+	InputWeight int64
 }
 
 func NewUTXO(txid string, voutIdx uint32, value btcutil.Amount, script []byte, path string) *UTXO {
@@ -33,62 +37,60 @@ func (utxo *UTXO) GetOutpoint() string {
 	return utxo.TxID + ":" + idx
 }
 
-// SelectUTXOs will take a desired amount to send and a list of utxos
-// to select from to fulfill that amount. It will return a list of randomly
-// selected utxos and the amount those utxos add up to. If
-// there is not enough to fulfill the amount, it will return an error
-func SelectUTXOs(amountToSend btcutil.Amount, utxos []UTXO) ([]UTXO, btcutil.Amount, error) {
-	// copy utxos slice to then delete from copy
-	// without affecting original utxos slice passed
-	utxosCopy := make([]UTXO, len(utxos))
-	copy(utxosCopy, utxos)
-
-	if len(utxos) == 0 {
-		return nil, 0, ErrNoUTXOs
-	} else if len(utxos) == 1 {
-		utxosAmount := utxos[0].Value
-		if utxosAmount > amountToSend {
-			return utxosCopy, utxosAmount, nil
-		} else {
-			return nil, 0, ErrInsufficientAmount
-		}
+// Confirmations returns the number of confirmations of the utxo
+// given the height of the tip of the chain
+func (utxo *UTXO) Confirmations(tipHeight int64) int64 {
+	if utxo.Height == 0 || utxo.Height > tipHeight {
+		return 0
 	}
+	return tipHeight - utxo.Height + 1
+}
 
-	selectedUtxos := []UTXO{}
-	var selectedAmount btcutil.Amount
+// IsMature returns false if utxo is from a coinbase tx that
+// does not have the coinbaseMaturity confirmations to be spent yet
+func (utxo *UTXO) IsMature(tipHeight int64, coinbaseMaturity uint16) bool {
+	return !utxo.Coinbase || utxo.Confirmations(tipHeight) >= int64(coinbaseMaturity)
+}
 
-	for {
-		// TODO: change to crypto rand
-		max := len(utxosCopy) - 1
-		idx := rand.Intn(max)
+// SpendPolicy sets the conditions for utxos to be selected
+// to fund a transaction
+type SpendPolicy struct {
+	TipHeight        int64
+	MinConf          int64
+	CoinbaseMaturity uint16
+	// allow unconfirmed outputs of txs sent by the wallet
+	SpendUnconfirmedChange bool
+}
 
-		utxo := utxosCopy[idx]
-		// only use utxo if it's unspent
-		if !utxo.Spent {
-			selectedUtxos = append(selectedUtxos, utxo)
-			selectedAmount += utxo.Value
-		}
+// CanSpend returns true if utxo is unspent and meets the policy
+func (p SpendPolicy) CanSpend(utxo UTXO) bool {
+	if utxo.Spent || !utxo.IsMature(p.TipHeight, p.CoinbaseMaturity) {
+		return false
+	}
 
-		// delete selected utxo so that it does not
-		// get selected again
-		utxosCopy = slices.Delete(utxosCopy, idx, idx+1)
+	confs := utxo.Confirmations(p.TipHeight)
+	if confs == 0 && utxo.FromWallet && p.SpendUnconfirmedChange {
+		return true
+	}
+	return confs >= p.MinConf
+}
 
-		if selectedAmount > amountToSend {
-			break
-		} else {
-			// if there is only 1 utxo left and amountToSend has not been
-			// reached yet, check if last utxo is unspent and value is enough.
-			// if it is, add it up and if not then return err
-			if len(utxosCopy) == 1 {
-				if !utxosCopy[0].Spent && selectedAmount+utxosCopy[0].Value > amountToSend {
-					selectedAmount += utxosCopy[0].Value
-					selectedUtxos = append(selectedUtxos, utxosCopy[0])
-					break
-				} else {
-					return nil, 0, ErrInsufficientAmount
-				}
-			}
+// FilterSpendable returns the utxos that can be spent under the policy
+func FilterSpendable(utxos []UTXO, policy SpendPolicy) []UTXO {
+	spendable := make([]UTXO, 0, len(utxos))
+	for _, utxo := range utxos {
+		if policy.CanSpend(utxo) {
+			spendable = append(spendable, utxo)
 		}
 	}
-	return selectedUtxos, selectedAmount, nil
+	return spendable
+}
+
+// SumValues returns the sum of the value of the utxos
+func SumValues(utxos []UTXO) btcutil.Amount {
+	var sum btcutil.Amount
+	for _, utxo := range utxos {
+		sum += utxo.Value
+	}
+	return sum
 }
@@ -1,15 +1,21 @@
 package tx
 
 import (
+	"encoding/hex"
+	"errors"
+	"slices"
 	"testing"
 
 	"github.com/btcsuite/btcd/btcutil"
 )
 
-func TestSelectUTXOs(t *testing.T) {
+var p2wpkhScript, _ = hex.DecodeString("0014751e76e8199196d454941c45d1b3a323f1433bd6")
+
+func TestSingleRandomDraw(t *testing.T) {
 	tests := []struct {
 		name             string
 		amountToSend     btcutil.Amount
+		feeRate          FeeRate
 		utxos            []UTXO
 		wantedAmount     btcutil.Amount
 		numSelectedUTXOs int
@@ -19,7 +25,7 @@ func TestSelectUTXOs(t *testing.T) {
 			name:         "one utxo meet amount to send",
 			amountToSend: btcutil.Amount(30000),
 			utxos: []UTXO{
-				*NewUTXO("txid1", 1, 70000, nil, ""),
+				*NewUTXO("txid1", 1, 70000, p2wpkhScript, ""),
 			},
 			wantedAmount:     btcutil.Amount(70000),
 			numSelectedUTXOs: 1,
@@ -29,8 +35,8 @@ func TestSelectUTXOs(t *testing.T) {
 			name:         "UTXOs meet amount to send",
 			amountToSend: btcutil.Amount(80000),
 			utxos: []UTXO{
-				*NewUTXO("txid1", 1, 30000, nil, ""),
-				*NewUTXO("txid1", 6, 60000, nil, ""),
+				*NewUTXO("txid1", 1, 30000, p2wpkhScript, ""),
+				*NewUTXO("txid1", 6, 60000, p2wpkhScript, ""),
 			},
 			wantedAmount:     btcutil.Amount(90000),
 			numSelectedUTXOs: 2,
@@ -40,7 +46,7 @@ func TestSelectUTXOs(t *testing.T) {
 			name:         "insufficient amount one utxo",
 			amountToSend: btcutil.Amount(80000),
 			utxos: []UTXO{
-				*NewUTXO("txid1", 1, 30000, nil, ""),
+				*NewUTXO("txid1", 1, 30000, p2wpkhScript, ""),
 			},
 			wantedAmount:     btcutil.Amount(0),
 			numSelectedUTXOs: 0,
@@ -50,27 +56,52 @@ func TestSelectUTXOs(t *testing.T) {
 			name:         "insufficient amount",
 			amountToSend: btcutil.Amount(140000),
 			utxos: []UTXO{
-				*NewUTXO("txid1", 1, 50000, nil, ""),
-				*NewUTXO("txid2", 1, 10000, nil, ""),
-				*NewUTXO("txid2", 2, 30000, nil, ""),
+				*NewUTXO("txid1", 1, 50000, p2wpkhScript, ""),
+				*NewUTXO("txid2", 1, 10000, p2wpkhScript, ""),
+				*NewUTXO("txid2", 2, 30000, p2wpkhScript, ""),
+			},
+			wantedAmount:     btcutil.Amount(0),
+			numSelectedUTXOs: 0,
+			wantedErr:        ErrInsufficientAmount,
+		},
+		{
+			name:         "utxo meets amount but not the fee to spend it",
+			amountToSend: btcutil.Amount(30000),
+			feeRate:      FeeRate(10000),
+			utxos: []UTXO{
+				*NewUTXO("txid1", 1, 30500, p2wpkhScript, ""),
 			},
 			wantedAmount:     btcutil.Amount(0),
 			numSelectedUTXOs: 0,
 			wantedErr:        ErrInsufficientAmount,
 		},
+		{
+			name:         "uneconomical utxo not selected",
+			amountToSend: btcutil.Amount(30000),
+			feeRate:      FeeRate(10000),
+			utxos: []UTXO{
+				*NewUTXO("txid1", 1, 600, p2wpkhScript, ""),
+				*NewUTXO("txid2", 0, 40000, p2wpkhScript, ""),
+			},
+			wantedAmount:     btcutil.Amount(40000),
+			numSelectedUTXOs: 1,
+			wantedErr:        nil,
+		},
 		{
 			name:             "no utxos",
 			amountToSend:     btcutil.Amount(40000),
 			utxos:            []UTXO{},
 			wantedAmount:     btcutil.Amount(0),
 			numSelectedUTXOs: 0,
-			wantedErr:        ErrNoUTXOs,
+			wantedErr:        ErrInsufficientAmount,
 		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			selectedUTXOs, selectedAmount, err := SelectUTXOs(test.amountToSend, test.utxos)
+			params := SelectionParams{Target: test.amountToSend, FeeRate: test.feeRate, LongTermFeeRate: test.feeRate}
+			selectedUTXOs, err := SingleRandomDraw{}.Select(test.utxos, params)
+			selectedAmount := SumValues(selectedUTXOs)
 			selectedLen := len(selectedUTXOs)
 
 			if selectedLen != test.numSelectedUTXOs {
@@ -88,18 +119,19 @@ func TestSelectUTXOs(t *testing.T) {
 	}
 
 	t.Run("multiple UTXOs", func(t *testing.T) {
-		utxo1 := NewUTXO("txid1", 1, 30000, nil, "")
-		utxo2 := NewUTXO("txid2", 0, 10000, nil, "")
-		utxo3 := NewUTXO("txid1", 8, 70000, nil, "")
-		utxo4 := NewUTXO("txid3", 1, 110000, nil, "")
-		utxo5 := NewUTXO("txid438", 2, 10000, nil, "")
-		utxo6 := NewUTXO("txid11", 1, 80000, nil, "")
-		utxo7 := NewUTXO("txid11", 2, 990000, nil, "")
+		utxo1 := NewUTXO("txid1", 1, 30000, p2wpkhScript, "")
+		utxo2 := NewUTXO("txid2", 0, 10000, p2wpkhScript, "")
+		utxo3 := NewUTXO("txid1", 8, 70000, p2wpkhScript, "")
+		utxo4 := NewUTXO("txid3", 1, 110000, p2wpkhScript, "")
+		utxo5 := NewUTXO("txid438", 2, 10000, p2wpkhScript, "")
+		utxo6 := NewUTXO("txid11", 1, 80000, p2wpkhScript, "")
+		utxo7 := NewUTXO("txid11", 2, 990000, p2wpkhScript, "")
 		utxos := []UTXO{*utxo1, *utxo2, *utxo3, *utxo4, *utxo5, *utxo6, *utxo7}
 
 		amountToSend := btcutil.Amount(125000)
 
-		selectedUTXOs, selectedAmount, err := SelectUTXOs(amountToSend, utxos)
+		selectedUTXOs, err := SingleRandomDraw{}.Select(utxos, SelectionParams{Target: amountToSend})
+		selectedAmount := SumValues(selectedUTXOs)
 		for _, selected := range selectedUTXOs {
 			if selected.Spent {
 				t.Errorf("error selected spent UTXO - %v", selected)
@@ -115,3 +147,365 @@ func TestSelectUTXOs(t *testing.T) {
 		}
 	})
 }
+
+func TestSpendPolicy(t *testing.T) {
+	policy := SpendPolicy{
+		TipHeight:              200,
+		MinConf:                1,
+		CoinbaseMaturity:       100,
+		SpendUnconfirmedChange: true,
+	}
+
+	confirmed := NewUTXO("txid1", 0, 10000, nil, "")
+	confirmed.Height = 200
+
+	unconfirmed := NewUTXO("txid2", 0, 10000, nil, "")
+
+	change := NewUTXO("txid3", 1, 10000, nil, "")
+	change.FromWallet = true
+
+	spent := NewUTXO("txid4", 0, 10000, nil, "")
+	spent.Height = 150
+	spent.Spent = true
+
+	immature := NewUTXO("txid5", 0, 10000, nil, "")
+	immature.Height = 150
+	immature.Coinbase = true
+
+	mature := NewUTXO("txid6", 0, 10000, nil, "")
+	mature.Height = 101
+	mature.Coinbase = true
+
+	tests := []struct {
+		name     string
+		utxo     *UTXO
+		policy   SpendPolicy
+		canSpend bool
+	}{
+		{name: "confirmed", utxo: confirmed, policy: policy, canSpend: true},
+		{name: "unconfirmed", utxo: unconfirmed, policy: policy, canSpend: false},
+		{name: "unconfirmed change", utxo: change, policy: policy, canSpend: true},
+		{name: "spent", utxo: spent, policy: policy, canSpend: false},
+		{name: "immature coinbase", utxo: immature, policy: policy, canSpend: false},
+		{name: "mature coinbase", utxo: mature, policy: policy, canSpend: true},
+		{
+			name:     "not enough confirmations",
+			utxo:     confirmed,
+			policy:   SpendPolicy{TipHeight: 200, MinConf: 6, CoinbaseMaturity: 100},
+			canSpend: false,
+		},
+		{
+			name:     "unconfirmed change not allowed",
+			utxo:     change,
+			policy:   SpendPolicy{TipHeight: 200, MinConf: 1, CoinbaseMaturity: 100},
+			canSpend: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			canSpend := test.policy.CanSpend(*test.utxo)
+			if canSpend != test.canSpend {
+				t.Errorf("expected: %v, got: %v", test.canSpend, canSpend)
+			}
+		})
+	}
+}
+
+// utxosWithValues returns unspent p2wpkh utxos with the values
+func utxosWithValues(values ...btcutil.Amount) []UTXO {
+	utxos := make([]UTXO, len(values))
+	for i, value := range values {
+		utxos[i] = *NewUTXO("txid", uint32(i), value, p2wpkhScript, "")
+	}
+	return utxos
+}
+
+func effectiveSum(t *testing.T, utxos []UTXO, feeRate FeeRate) btcutil.Amount {
+	var sum btcutil.Amount
+	for _, utxo := range utxos {
+		effectiveValue, ok := EffectiveValue(utxo, feeRate)
+		if !ok {
+			t.Fatalf("selected utxo with unsupported script")
+		}
+		sum += effectiveValue
+	}
+	return sum
+}
+
+func TestCoinSelectors(t *testing.T) {
+	spent := utxosWithValues(90000)[0]
+	spent.Spent = true
+
+	oldest := *NewUTXO("txid1", 0, 20000, p2wpkhScript, "")
+	oldest.Height = 100
+	newer := *NewUTXO("txid2", 0, 50000, p2wpkhScript, "")
+	newer.Height = 150
+	unconfirmed := *NewUTXO("txid3", 0, 90000, p2wpkhScript, "")
+
+	tests := []struct {
+		name     string
+		selector CoinSelector
+		utxos    []UTXO
+		params   SelectionParams
+		// expected values of the selected utxos in any order. If nil, only
+		// checks that the selection reaches the target
+		wantedValues []btcutil.Amount
+		wantedErr    error
+	}{
+		{
+			name:         "bnb exact match",
+			selector:     BranchAndBound{},
+			utxos:        utxosWithValues(40000, 70000, 25000, 30000),
+			params:       SelectionParams{Target: 100000},
+			wantedValues: []btcutil.Amount{70000, 30000},
+		},
+		{
+			name:         "bnb match within cost of change",
+			selector:     BranchAndBound{},
+			utxos:        utxosWithValues(60000, 41000, 5000),
+			params:       SelectionParams{Target: 100000, CostOfChange: 2000},
+			wantedValues: []btcutil.Amount{60000, 41000},
+		},
+		{
+			name:      "bnb no match",
+			selector:  BranchAndBound{},
+			utxos:     utxosWithValues(30000, 60000),
+			params:    SelectionParams{Target: 50000, CostOfChange: 1000},
+			wantedErr: ErrNoExactMatch,
+		},
+		{
+			name:     "bnb fewer inputs at high fee rate",
+			selector: BranchAndBound{},
+			// fee to spend each input at 20 sat/vB is 1360
+			utxos:        utxosWithValues(51360, 26360, 26360),
+			params:       SelectionParams{Target: 50000, FeeRate: 20000, LongTermFeeRate: 10000, CostOfChange: 100},
+			wantedValues: []btcutil.Amount{51360},
+		},
+		{
+			name:     "bnb more inputs at low fee rate",
+			selector: BranchAndBound{},
+			// fee to spend each input at 1 sat/vB is 68
+			utxos:        utxosWithValues(50068, 25068, 25068),
+			params:       SelectionParams{Target: 50000, FeeRate: 1000, LongTermFeeRate: 10000, CostOfChange: 100},
+			wantedValues: []btcutil.Amount{25068, 25068},
+		},
+		{
+			name:         "knapsack exact match",
+			selector:     Knapsack{},
+			utxos:        utxosWithValues(10000, 45000, 80000),
+			params:       SelectionParams{Target: 45000, MinChange: 1000},
+			wantedValues: []btcutil.Amount{45000},
+		},
+		{
+			name:         "knapsack lowest larger",
+			selector:     Knapsack{},
+			utxos:        utxosWithValues(10000, 20000, 80000, 120000),
+			params:       SelectionParams{Target: 45000, MinChange: 1000},
+			wantedValues: []btcutil.Amount{80000},
+		},
+		{
+			name:         "knapsack subset of lower",
+			selector:     Knapsack{},
+			utxos:        utxosWithValues(10000, 20000, 26000, 300000),
+			params:       SelectionParams{Target: 45000, MinChange: 1000},
+			wantedValues: []btcutil.Amount{20000, 26000},
+		},
+		{
+			name:         "largest first",
+			selector:     LargestFirst{},
+			utxos:        utxosWithValues(10000, 50000, 30000),
+			params:       SelectionParams{Target: 55000},
+			wantedValues: []btcutil.Amount{50000, 30000},
+		},
+		{
+			name:         "oldest first",
+			selector:     OldestFirst{},
+			utxos:        []UTXO{unconfirmed, newer, oldest},
+			params:       SelectionParams{Target: 60000},
+			wantedValues: []btcutil.Amount{20000, 50000},
+		},
+		{
+			name:     "single random draw",
+			selector: SingleRandomDraw{},
+			utxos:    utxosWithValues(10000, 50000, 30000, 25000),
+			params:   SelectionParams{Target: 60000, MinChange: 1000},
+		},
+		{
+			name:         "single random draw no change",
+			selector:     SingleRandomDraw{},
+			utxos:        utxosWithValues(10000, 50000),
+			params:       SelectionParams{Target: 59500, MinChange: 1000},
+			wantedValues: []btcutil.Amount{10000, 50000},
+		},
+		{
+			name:         "lowest waste prefers changeless",
+			selector:     LowestWaste{},
+			utxos:        utxosWithValues(40000, 70000, 25000, 30000),
+			params:       SelectionParams{Target: 100000, CostOfChange: 500, MinChange: 800},
+			wantedValues: []btcutil.Amount{70000, 30000},
+		},
+		{
+			name:         "spent utxo not selected",
+			selector:     LargestFirst{},
+			utxos:        append(utxosWithValues(10000, 20000), spent),
+			params:       SelectionParams{Target: 25000},
+			wantedValues: []btcutil.Amount{20000, 10000},
+		},
+		{
+			name:      "insufficient amount",
+			selector:  LargestFirst{},
+			utxos:     append(utxosWithValues(10000, 20000), spent),
+			params:    SelectionParams{Target: 40000},
+			wantedErr: ErrInsufficientAmount,
+		},
+		{
+			name:      "insufficient amount after fees",
+			selector:  LowestWaste{},
+			utxos:     utxosWithValues(10000, 20000),
+			params:    SelectionParams{Target: 30000, FeeRate: 1000},
+			wantedErr: ErrInsufficientAmount,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			selected, err := test.selector.Select(test.utxos, test.params)
+			if err != test.wantedErr {
+				t.Fatalf("errors do not match - expected: %v, got %v", test.wantedErr, err)
+			}
+			if err != nil {
+				return
+			}
+
+			if sum := effectiveSum(t, selected, test.params.FeeRate); sum < test.params.Target {
+				t.Errorf("selection does not reach target - target: %v, got: %v", test.params.Target, sum)
+			}
+
+			if test.wantedValues != nil {
+				values := make([]btcutil.Amount, len(selected))
+				for i, utxo := range selected {
+					values[i] = utxo.Value
+				}
+				slices.Sort(values)
+				wanted := slices.Clone(test.wantedValues)
+				slices.Sort(wanted)
+				if !slices.Equal(values, wanted) {
+					t.Errorf("selected values do not match - expected: %v, got: %v", wanted, values)
+				}
+			}
+		})
+	}
+}
+
+func TestWaste(t *testing.T) {
+	// fee to spend each input is 1360 at 20 sat/vB and 680 at 10 sat/vB
+	utxos := utxosWithValues(61360)
+	params := SelectionParams{Target: 50000, FeeRate: 20000, LongTermFeeRate: 10000,
+		CostOfChange: 2000, MinChange: 1000}
+
+	// excess of 10000 goes to change
+	if waste := Waste(utxos, params); waste != 680+2000 {
+		t.Errorf("expected waste: %v, got: %v", 680+2000, waste)
+	}
+
+	// excess of 500 goes to fee
+	params.Target = 59500
+	if waste := Waste(utxos, params); waste != 680+500 {
+		t.Errorf("expected waste: %v, got: %v", 680+500, waste)
+	}
+}
+
+func TestNewCoinSelector(t *testing.T) {
+	for _, name := range CoinSelectorNames() {
+		selector, err := NewCoinSelector(name)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if selector.Name() != name {
+			t.Errorf("expected selector %v, got: %v", name, selector.Name())
+		}
+	}
+
+	if _, err := NewCoinSelector("nope"); !errors.Is(err, ErrUnknownSelectionMethod) {
+		t.Errorf("expected: %v, got: %v", ErrUnknownSelectionMethod, err)
+	}
+}
+
+func FuzzCoinSelectors(f *testing.F) {
+	f.Add([]byte{1, 0, 2, 0, 3, 0}, uint32(50000), uint16(1000), uint16(500))
+	f.Add([]byte{0, 10, 255, 255, 17, 4, 128, 0}, uint32(1000000), uint16(25000), uint16(0))
+	f.Add([]byte{}, uint32(1), uint16(1), uint16(1))
+
+	f.Fuzz(func(t *testing.T, data []byte, target uint32, feeRate uint16, costOfChange uint16) {
+		// a tx always has outputs to pay for
+		if target == 0 {
+			t.Skip()
+		}
+
+		// every 2 bytes is a utxo. The low bits of the second byte
+		// set if it is spent and its script type
+		utxos := make([]UTXO, 0, len(data)/2)
+		for i := 0; i+1 < len(data); i += 2 {
+			value := btcutil.Amount(int64(data[i])<<8|int64(data[i+1])) * 100
+			script := p2wpkhScript
+			if data[i+1]&1 == 1 {
+				script = p2pkhScript
+			}
+			utxo := NewUTXO("txid", uint32(i/2), value, script, "")
+			utxo.Spent = data[i+1]&2 == 2
+			utxos = append(utxos, *utxo)
+		}
+
+		params := SelectionParams{
+			Target:          btcutil.Amount(target),
+			FeeRate:         FeeRate(feeRate),
+			LongTermFeeRate: FeeRate(10000),
+			CostOfChange:    btcutil.Amount(costOfChange),
+			MinChange:       btcutil.Amount(costOfChange) * 2,
+		}
+
+		var available btcutil.Amount
+		for _, utxo := range utxos {
+			if effectiveValue, _ := EffectiveValue(utxo, params.FeeRate); !utxo.Spent && effectiveValue > 0 {
+				available += effectiveValue
+			}
+		}
+
+		for _, name := range CoinSelectorNames() {
+			selector, _ := NewCoinSelector(name)
+			selected, err := selector.Select(utxos, params)
+			if err != nil {
+				if err == ErrNoExactMatch && name == "bnb" {
+					continue
+				}
+				if err != ErrInsufficientAmount {
+					t.Fatalf("%v: unexpected error: %v", name, err)
+				}
+				if available >= params.Target {
+					t.Fatalf("%v: insufficient amount with %v available for target %v", name, available, params.Target)
+				}
+				continue
+			}
+
+			outpoints := make(map[string]bool, len(selected))
+			for _, utxo := range selected {
+				if utxo.Spent {
+					t.Fatalf("%v: selected spent utxo", name)
+				}
+				if outpoints[utxo.GetOutpoint()] {
+					t.Fatalf("%v: selected utxo twice", name)
+				}
+				outpoints[utxo.GetOutpoint()] = true
+			}
+
+			sum := effectiveSum(t, selected, params.FeeRate)
+			if sum < params.Target {
+				t.Fatalf("%v: selection does not reach target - target: %v, got: %v", name, params.Target, sum)
+			}
+			if name == "bnb" && sum > params.Target+params.CostOfChange {
+				t.Fatalf("%v: selection over target plus cost of change - got: %v", name, sum)
+			}
+		}
+	})
+}
@@ -25,18 +25,75 @@ type params struct {
 	keylen      uint32
 }
 
-func HashPassphrase(passphrase []byte) (string, error) {
-	p := &params{
+const (
+	// minimum argon2 memory in KiB and iterations that can be set
+	MinArgon2Memory     = 8 * 1024
+	MinArgon2Iterations = 1
+)
+
+// Argon2Params are the cost parameters of argon2id
+// that can be changed. Memory is in KiB
+type Argon2Params struct {
+	Memory     uint32
+	Iterations uint32
+}
+
+func DefaultArgon2Params() Argon2Params {
+	p := defaultParams()
+	return Argon2Params{Memory: p.memory, Iterations: p.iterations}
+}
+
+func (ap Argon2Params) Validate() error {
+	if ap.Memory < MinArgon2Memory {
+		return fmt.Errorf("argon2 memory must be at least %d KiB", MinArgon2Memory)
+	}
+	if ap.Iterations < MinArgon2Iterations {
+		return fmt.Errorf("argon2 iterations must be at least %d", MinArgon2Iterations)
+	}
+	return nil
+}
+
+func defaultParams() *params {
+	return &params{
 		memory:      64 * 1024,
 		iterations:  3,
 		parallelism: 2,
 		saltlen:     16,
 		keylen:      32,
 	}
+}
 
-	// generate random salt
+func paramsWith(ap Argon2Params) (*params, error) {
+	if err := ap.Validate(); err != nil {
+		return nil, err
+	}
+	p := defaultParams()
+	p.memory = ap.Memory
+	p.iterations = ap.Iterations
+	return p, nil
+}
+
+func newSalt(p *params) ([]byte, error) {
 	salt := make([]byte, p.saltlen)
-	_, err := rand.Read(salt)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+func HashPassphrase(passphrase []byte) (string, error) {
+	return HashPassphraseWithParams(passphrase, DefaultArgon2Params())
+}
+
+// HashPassphraseWithParams hashes the passphrase using the argon2 cost parameters passed
+func HashPassphraseWithParams(passphrase []byte, ap Argon2Params) (string, error) {
+	p, err := paramsWith(ap)
+	if err != nil {
+		return "", err
+	}
+
+	// generate random salt
+	salt, err := newSalt(p)
 	if err != nil {
 		return "", err
 	}
@@ -48,6 +105,75 @@ func HashPassphrase(passphrase []byte) (string, error) {
 	return encoded, nil
 }
 
+// NewKDF returns the argon2id parameters and a random salt to derive
+// an encryption key from a passphrase with DeriveKey. It is encoded like
+// the hash from HashPassphrase but without the key
+func NewKDF() (string, error) {
+	return NewKDFWithParams(DefaultArgon2Params())
+}
+
+// NewKDFWithParams is like NewKDF using the argon2 cost parameters passed
+func NewKDFWithParams(ap Argon2Params) (string, error) {
+	p, err := paramsWith(ap)
+	if err != nil {
+		return "", err
+	}
+	salt, err := newSalt(p)
+	if err != nil {
+		return "", err
+	}
+
+	b64salt := base64.RawStdEncoding.EncodeToString(salt)
+	encoded := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s", argon2.Version, p.memory, p.iterations, p.parallelism, b64salt)
+	return encoded, nil
+}
+
+// DeriveKey derives a 32 byte key from the passphrase
+// using the parameters encoded by NewKDF
+func DeriveKey(passphrase []byte, encodedKDF string) ([]byte, error) {
+	split := strings.Split(encodedKDF, "$")
+	if len(split) != 5 {
+		return nil, invalidHashErr
+	}
+
+	// decode as a hash with an empty key
+	p, _, salt, err := DecodeHash(encodedKDF + "$")
+	if err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey(passphrase, salt, p.iterations, p.memory, p.parallelism, defaultParams().keylen)
+	return key, nil
+}
+
+// KDFParams returns the argon2 cost parameters encoded by NewKDF
+func KDFParams(encodedKDF string) (Argon2Params, error) {
+	if len(strings.Split(encodedKDF, "$")) != 5 {
+		return Argon2Params{}, invalidHashErr
+	}
+	p, _, _, err := DecodeHash(encodedKDF + "$")
+	if err != nil {
+		return Argon2Params{}, err
+	}
+	return Argon2Params{Memory: p.memory, Iterations: p.iterations}, nil
+}
+
+// NewMasterKey returns a random 32 byte key
+func NewMasterKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, fmt.Errorf("io.ReadFull: %w", err)
+	}
+	return key, nil
+}
+
+// Wipe overwrites the key with zeros
+func Wipe(key []byte) {
+	for i := range key {
+		key[i] = 0
+	}
+}
+
 func VerifyPassphrase(encodedHash, passphrase string) bool {
 	p, key, salt, err := DecodeHash(encodedHash)
 	if err != nil {
@@ -0,0 +1,272 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/elnosh/btcw/tx"
+)
+
+// changeOutput is the change output of a tx created by the wallet.
+// Its key is derived when creating the tx but only saved in the
+// wallet once the tx is broadcast
+type changeOutput struct {
+	Index   uint32   `json:"index"`
+	Path    string   `json:"path"`
+	KeyPair *KeyPair `json:"key"`
+}
+
+// pendingBroadcast is saved before a tx is broadcast and removed once the
+// wallet has been updated with it. If the wallet stops in between, it is
+// reconciled on restart
+type pendingBroadcast struct {
+	TxID   string        `json:"txid"`
+	RawTx  string        `json:"hex"`
+	Inputs []tx.UTXO     `json:"inputs"`
+	Change *changeOutput `json:"change,omitempty"`
+	Label  string        `json:"label"`
+	// time the tx was broadcast
+	Timestamp int64 `json:"time"`
+	// txid of the unconfirmed tx this one replaces
+	Replaces string `json:"replaces,omitempty"`
+}
+
+func newPendingBroadcast(msgTx *wire.MsgTx, inputs []tx.UTXO, change *changeOutput,
+	label, replaces string) (*pendingBroadcast, error) {
+	var buf bytes.Buffer
+	if err := msgTx.Serialize(&buf); err != nil {
+		return nil, err
+	}
+
+	return &pendingBroadcast{
+		TxID:      msgTx.TxHash().String(),
+		RawTx:     hex.EncodeToString(buf.Bytes()),
+		Inputs:    inputs,
+		Change:    change,
+		Label:     label,
+		Timestamp: time.Now().Unix(),
+		Replaces:  replaces,
+	}, nil
+}
+
+func (pb *pendingBroadcast) msgTx() (*wire.MsgTx, error) {
+	serializedTx, err := hex.DecodeString(pb.RawTx)
+	if err != nil {
+		return nil, err
+	}
+
+	msgTx := wire.NewMsgTx(wire.TxVersion)
+	if err := msgTx.Deserialize(bytes.NewReader(serializedTx)); err != nil {
+		return nil, err
+	}
+	return msgTx, nil
+}
+
+// broadcastTx saves the signed tx in the pending broadcasts journal, sends
+// it to the network and then updates the wallet with it. If the tx replaces
+// an unconfirmed tx, replaces is its txid. Callers must hold scanMtx
+func (w *Wallet) broadcastTx(msgTx *wire.MsgTx, inputs []tx.UTXO, change *changeOutput, label, replaces string) error {
+	pending, err := newPendingBroadcast(msgTx, inputs, change, label, replaces)
+	if err != nil {
+		return fmt.Errorf("error serializing transaction: %s", err.Error())
+	}
+	if err := w.savePendingBroadcast(pending); err != nil {
+		return err
+	}
+
+	if _, err := w.client.SendRawTransaction(msgTx, true); err != nil {
+		w.LogError("error sending transaction to network: %s", err.Error())
+		// the node may have accepted the tx if there was no response
+		// from it. It is kept in the journal to be reconciled on restart
+		if !isRejectedByNode(err) {
+			return fmt.Errorf("error sending transaction %s. it may have been sent and will be "+
+				"checked when the wallet restarts: %s", pending.TxID, err.Error())
+		}
+		if err := w.deletePendingBroadcast(pending.TxID); err != nil {
+			w.LogError("%v", err)
+		}
+		return fmt.Errorf("error sending transaction: %s", err.Error())
+	}
+	w.LogInfo("sent tx %s to network", pending.TxID)
+
+	if err := w.commitSentTx(pending, msgTx); err != nil {
+		w.LogError("error updating wallet with sent tx %s: %v", pending.TxID, err)
+		return fmt.Errorf("transaction %s was sent but the wallet could not be updated. "+
+			"it will be updated when the wallet restarts: %s", pending.TxID, err.Error())
+	}
+	return nil
+}
+
+// commitSentTx updates the wallet with a tx it sent. Spent UTXOs, change
+// UTXO and key, change descriptor, tx record and unconfirmed tx are saved
+// in a single db transaction before updating the wallet in memory
+func (w *Wallet) commitSentTx(pending *pendingBroadcast, msgTx *wire.MsgTx) error {
+	txid := pending.TxID
+
+	spent := make([]tx.UTXO, len(pending.Inputs))
+	for i, utxo := range pending.Inputs {
+		utxo.Spent = true
+		utxo.SpentBy = txid
+		utxo.SpentHeight = 0
+		spent[i] = utxo
+	}
+
+	var changeUTXO *tx.UTXO
+	var changeID, changeIdx uint32
+	if pending.Change != nil {
+		var err error
+		changeID, changeIdx, err = parseDescriptorPath(pending.Change.Path)
+		if err != nil {
+			return err
+		}
+
+		if int(pending.Change.Index) >= len(msgTx.TxOut) {
+			return fmt.Errorf("invalid change output index %v", pending.Change.Index)
+		}
+		changeTxOut := msgTx.TxOut[pending.Change.Index]
+		changeUTXO = w.newUTXO(txid, pending.Change.Index, btcutil.Amount(changeTxOut.Value),
+			changeTxOut.PkScript, pending.Change.Path)
+		changeUTXO.FromWallet = true
+
+		// tracked before building the record so that change is not counted as sent
+		w.addressesMtx.Lock()
+		w.addresses[pending.Change.KeyPair.Address] = pending.Change.Path
+		w.addressesMtx.Unlock()
+	}
+
+	record, err := w.buildTxRecord(msgTx, 0, "", pending.Timestamp)
+	if err != nil {
+		return err
+	}
+	record.Label = pending.Label
+	record.Replaces = pending.Replaces
+
+	serializedTx, err := hex.DecodeString(pending.RawTx)
+	if err != nil {
+		return err
+	}
+
+	// outputs of the replaced tx are removed. Inputs it
+	// shares with this tx are kept spent by this tx
+	var replaced *droppedTxs
+	if pending.Replaces != "" {
+		keep := make(map[string]bool, len(spent))
+		for _, utxo := range spent {
+			keep[utxo.GetOutpoint()] = true
+		}
+		replaced = w.planDrop(pending.Replaces, keep)
+	}
+
+	if pending.Change == nil {
+		err = w.commitSentTxDB(spent, nil, nil, nil, record, serializedTx, replaced)
+	} else {
+		err = w.updateDescriptor(changeID, func(wd *walletDescriptor) error {
+			wd.NextIndex = max(wd.NextIndex, changeIdx+1)
+			wd.RangeEnd = max(wd.RangeEnd, changeIdx+1)
+			return w.commitSentTxDB(spent, pending.Change, changeUTXO, wd, record, serializedTx, replaced)
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	w.utxoMtx.Lock()
+	for _, utxo := range spent {
+		for i := range w.utxos {
+			if w.utxos[i].GetOutpoint() == utxo.GetOutpoint() {
+				w.utxos[i] = utxo
+				break
+			}
+		}
+	}
+	if changeUTXO != nil {
+		w.utxos = append(w.utxos, *changeUTXO)
+	}
+	w.utxoMtx.Unlock()
+
+	w.mempoolMtx.Lock()
+	w.mempoolTxs[txid] = msgTx
+	w.mempoolMtx.Unlock()
+
+	if changeUTXO != nil {
+		w.addToTxFilter(pending.Change.KeyPair.Address)
+		w.addOutPointToTxFilter(*changeUTXO)
+	}
+
+	if replaced != nil {
+		w.applyDroppedTxs(replaced, "replaced by "+txid)
+	}
+	return nil
+}
+
+// reconcilePendingBroadcasts resolves sends that were interrupted before the
+// wallet was updated. Txs the node knows about or accepts again are committed
+// to the wallet. Txs rejected by the node are removed from the journal and
+// the rest are kept until the node can be reached. Callers must hold scanMtx
+func (w *Wallet) reconcilePendingBroadcasts() error {
+	pending, err := w.loadPendingBroadcasts()
+	if err != nil {
+		return err
+	}
+
+	for i := range pending {
+		pb := &pending[i]
+		msgTx, err := pb.msgTx()
+		if err != nil {
+			w.LogError("error decoding pending broadcast %s: %v", pb.TxID, err)
+			continue
+		}
+
+		txHash := msgTx.TxHash()
+		if _, err := w.client.GetRawTransaction(&txHash); err != nil {
+			if _, err := w.client.SendRawTransaction(msgTx, true); err != nil {
+				if !isRejectedByNode(err) {
+					w.LogError("error sending interrupted send of tx %s. it will be checked again "+
+						"on restart: %v", pb.TxID, err)
+					continue
+				}
+				w.LogInfo("dropping interrupted send of tx %s rejected by node: %v", pb.TxID, err)
+				w.dropPendingBroadcast(pb)
+				continue
+			}
+			w.LogInfo("broadcast again interrupted send of tx %s", pb.TxID)
+		}
+
+		if err := w.commitSentTx(pb, msgTx); err != nil {
+			return fmt.Errorf("error reconciling tx %s: %v", pb.TxID, err)
+		}
+		w.LogInfo("updated wallet with interrupted send of tx %s", pb.TxID)
+	}
+
+	return nil
+}
+
+// isRejectedByNode returns true if the error sending a tx is a response
+// from the node rejecting it. Other errors (i.e timeouts or connection
+// errors) do not tell whether the node got the tx
+func isRejectedByNode(err error) bool {
+	var rpcErr *btcjson.RPCError
+	return errors.As(err, &rpcErr)
+}
+
+// dropPendingBroadcast removes the tx from the journal. The change key is
+// still saved in case the tx was confirmed and the node can not find it
+// (i.e no txindex), so that the change is found when scanning
+func (w *Wallet) dropPendingBroadcast(pb *pendingBroadcast) {
+	if pb.Change != nil {
+		if err := w.useKey(pb.Change.Path); err != nil {
+			w.LogError("error saving change key of dropped tx: %v", err)
+			return
+		}
+	}
+
+	if err := w.deletePendingBroadcast(pb.TxID); err != nil {
+		w.LogError("%v", err)
+	}
+}
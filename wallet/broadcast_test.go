@@ -0,0 +1,428 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/elnosh/btcw/tx"
+)
+
+// journalSend creates and signs a tx sending amount to address and saves it
+// in the pending broadcasts journal like broadcastTx does before sending it
+func journalSend(t *testing.T, w *Wallet, address string, amount float64) (*pendingBroadcast, *wire.MsgTx) {
+	t.Helper()
+
+	outputs, _, err := w.recipientOutputs(map[string]float64{address: amount}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgTx, utxos, change, err := w.fundTransaction(outputs, nil, tx.FeeRate(2000), w.selector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.signTransaction(msgTx, utxos); err != nil {
+		t.Fatal(err)
+	}
+	pending, err := newPendingBroadcast(msgTx, utxos, change, "payment", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.savePendingBroadcast(pending); err != nil {
+		t.Fatal(err)
+	}
+	return pending, msgTx
+}
+
+// checkConsistent fails if the stored balance, UTXOs in the db and
+// UTXOs loaded in the wallet do not match
+func checkConsistent(t *testing.T, w *Wallet) {
+	t.Helper()
+
+	check, err := w.CheckWallet(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !check.Consistent {
+		t.Fatalf("wallet is not consistent: %+v", check)
+	}
+}
+
+// checkSentTx fails if the wallet was not updated with the sent tx
+func checkSentTx(t *testing.T, w *Wallet, pending *pendingBroadcast) {
+	t.Helper()
+
+	for _, input := range pending.Inputs {
+		utxo := findTestUTXO(t, w, input.GetOutpoint())
+		if !utxo.Spent || utxo.SpentBy != pending.TxID {
+			t.Errorf("utxo %s not spent by sent tx", input.GetOutpoint())
+		}
+	}
+	if pending.Change != nil {
+		change := findTestUTXO(t, w, fmt.Sprintf("%s:%v", pending.TxID, pending.Change.Index))
+		if !change.FromWallet || change.DerivationPath != pending.Change.Path {
+			t.Errorf("unexpected change utxo: %+v", change)
+		}
+		if _, ok := w.lookupAddress(pending.Change.KeyPair.Address); !ok {
+			t.Error("change address is not tracked")
+		}
+	}
+
+	record := w.getTxRecord(pending.TxID)
+	if record == nil {
+		t.Fatal("sent tx was not recorded")
+	}
+	if record.Direction != DirectionSend || record.Label != pending.Label {
+		t.Errorf("unexpected record of sent tx: %+v", record)
+	}
+	if _, ok := w.mempoolTxs[pending.TxID]; !ok {
+		t.Error("sent tx is not tracked as unconfirmed")
+	}
+	checkNoPending(t, w)
+	checkConsistent(t, w)
+}
+
+func checkNoPending(t *testing.T, w *Wallet) {
+	t.Helper()
+
+	pending, err := w.loadPendingBroadcasts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("expected no pending broadcasts but there are %v", len(pending))
+	}
+}
+
+// errNodeTimeout is an error sending a tx without a response from the node
+var errNodeTimeout = &url.Error{Op: "Post", URL: "http://localhost:18443", Err: context.DeadlineExceeded}
+
+// checkPending fails if txid is not the only pending broadcast
+func checkPending(t *testing.T, w *Wallet, txid string) {
+	t.Helper()
+
+	pending, err := w.loadPendingBroadcasts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].TxID != txid {
+		t.Errorf("expected pending broadcast of tx %s, got %+v", txid, pending)
+	}
+}
+
+func TestBroadcastTx(t *testing.T) {
+	w, client := newTestWallet(t)
+	fundWallet(t, w, client, "", 100000)
+
+	txid, err := w.SendToAddress(newTestAddress(t), 0.0003, "payment", SendOptions{FeeRate: 2000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(client.sent) != 1 || client.sent[0].TxHash().String() != txid {
+		t.Fatal("tx was not sent to the node")
+	}
+	verifyTx(t, client.sent[0], prevOuts(t, w))
+
+	// wallet loaded again from the db has the same state
+	for _, wallet := range []*Wallet{w, loadTestWallet(t, w.db, client)} {
+		record := wallet.getTxRecord(txid)
+		if record == nil {
+			t.Fatal("sent tx was not recorded")
+		}
+		if balance := wallet.GetBalance(0); balance != 100000-30000-record.Fee {
+			t.Errorf("unexpected balance after send: %v", balance)
+		}
+		checkNoPending(t, wallet)
+		checkConsistent(t, wallet)
+	}
+
+	// rejected tx leaves the wallet as it was
+	client.sendErr = &btcjson.RPCError{Code: btcjson.ErrRPCVerify, Message: "insufficient fee"}
+	balance := w.GetBalance(0)
+	if _, err := w.SendToAddress(newTestAddress(t), 0.0001, "", SendOptions{FeeRate: 2000}); err == nil {
+		t.Fatal("expected error sending tx rejected by node")
+	}
+	if w.GetBalance(0) != balance {
+		t.Errorf("balance changed after rejected tx - expected: %v, got: %v", balance, w.GetBalance(0))
+	}
+	checkNoPending(t, w)
+	checkConsistent(t, w)
+}
+
+func TestSendAll(t *testing.T) {
+	tests := []struct {
+		name string
+		// index of the funded utxos to send. All if empty
+		selected      []int
+		wantedSent    btcutil.Amount
+		wantedBalance btcutil.Amount
+	}{
+		{
+			name:          "all utxos",
+			wantedSent:    100000,
+			wantedBalance: 0,
+		},
+		{
+			name:          "selected utxos",
+			selected:      []int{0, 2},
+			wantedSent:    70000,
+			wantedBalance: 30000,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w, client := newTestWallet(t)
+			funded := []tx.UTXO{
+				fundWallet(t, w, client, "", 50000),
+				fundWallet(t, w, client, "", 30000),
+				fundWallet(t, w, client, "", 20000),
+			}
+			outpoints := []string{}
+			for _, idx := range test.selected {
+				outpoints = append(outpoints, funded[idx].GetOutpoint())
+			}
+			outputs := prevOuts(t, w)
+
+			address := newTestAddress(t)
+			txid, err := w.SendAll(address, outpoints, "sweep", SendOptions{FeeRate: 2000})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(client.sent) != 1 || client.sent[0].TxHash().String() != txid {
+				t.Fatal("tx was not sent to the node")
+			}
+			sentTx := client.sent[0]
+			verifyTx(t, sentTx, outputs)
+
+			// single output with no change
+			if len(sentTx.TxOut) != 1 {
+				t.Fatalf("expected tx with 1 output, got %v", len(sentTx.TxOut))
+			}
+			record := w.getTxRecord(txid)
+			if record == nil {
+				t.Fatal("sent tx was not recorded")
+			}
+			if value := outputValue(t, sentTx, address); value != test.wantedSent-record.Fee {
+				t.Errorf("unexpected amount sent - expected: %v, got: %v", test.wantedSent-record.Fee, value)
+			}
+			if record.Fee <= 0 || record.Sent != test.wantedSent || record.Received != 0 {
+				t.Errorf("unexpected record of sent tx: %+v", record)
+			}
+
+			for _, wallet := range []*Wallet{w, loadTestWallet(t, w.db, client)} {
+				if balance := wallet.GetBalance(0); balance != test.wantedBalance {
+					t.Errorf("unexpected balance - expected: %v, got: %v", test.wantedBalance, balance)
+				}
+				if spendable := tx.SumValues(wallet.spendableUTXOs()); spendable != test.wantedBalance {
+					t.Errorf("unexpected spendable amount - expected: %v, got: %v", test.wantedBalance, spendable)
+				}
+				checkConsistent(t, wallet)
+			}
+		})
+	}
+}
+
+func TestSendSubtractFeeFrom(t *testing.T) {
+	w, client := newTestWallet(t)
+	fundWallet(t, w, client, "", 100000)
+	outputs := prevOuts(t, w)
+
+	payFee1, payFee2, recipient := newTestAddress(t), newTestAddress(t), newTestAddress(t)
+	amounts := map[string]float64{payFee1: 0.0003, payFee2: 0.0002, recipient: 0.0001}
+	opts := SendOptions{FeeRate: 2000, SubtractFeeFrom: []string{payFee1, payFee2}}
+	txid, err := w.SendMany(amounts, "", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(client.sent) != 1 || client.sent[0].TxHash().String() != txid {
+		t.Fatal("tx was not sent to the node")
+	}
+	sentTx := client.sent[0]
+	verifyTx(t, sentTx, outputs)
+
+	record := w.getTxRecord(txid)
+	if record == nil {
+		t.Fatal("sent tx was not recorded")
+	}
+	fee := record.Fee
+	if fee <= 0 {
+		t.Fatalf("unexpected fee %v", fee)
+	}
+
+	// fee is split equally and the first address pays what is left from the split
+	wantedAmounts := map[string]btcutil.Amount{
+		payFee1:   30000 - fee/2 - fee%2,
+		payFee2:   20000 - fee/2,
+		recipient: 10000,
+	}
+	for address, wanted := range wantedAmounts {
+		if value := outputValue(t, sentTx, address); value != wanted {
+			t.Errorf("unexpected amount sent to %s - expected: %v, got: %v", address, wanted, value)
+		}
+	}
+
+	// utxos only pay the amounts so the change is what is left over them
+	change := sentTx.TxOut[changeIndex(t, w, sentTx)]
+	if change.Value != 100000-60000 {
+		t.Errorf("unexpected change - expected: %v, got: %v", 100000-60000, change.Value)
+	}
+	for _, wallet := range []*Wallet{w, loadTestWallet(t, w.db, client)} {
+		if balance := wallet.GetBalance(0); balance != 40000 {
+			t.Errorf("unexpected balance - expected: %v, got: %v", 40000, balance)
+		}
+		checkConsistent(t, wallet)
+	}
+}
+
+// outputValue returns the value of the output of msgTx to address
+func outputValue(t *testing.T, msgTx *wire.MsgTx, address string) btcutil.Amount {
+	t.Helper()
+
+	txOut, err := tx.CreateTxOut(address, 0, &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, out := range msgTx.TxOut {
+		if bytes.Equal(out.PkScript, txOut.PkScript) {
+			return btcutil.Amount(out.Value)
+		}
+	}
+	t.Fatalf("tx has no output to %s", address)
+	return 0
+}
+
+func TestBroadcastTxNoResponse(t *testing.T) {
+	w, client := newTestWallet(t)
+	funding := fundWallet(t, w, client, "", 100000)
+
+	// node accepts the tx but the wallet does not get the response
+	client.sendErr = errNodeTimeout
+	if _, err := w.SendToAddress(newTestAddress(t), 0.0003, "payment", SendOptions{FeeRate: 2000}); err == nil {
+		t.Fatal("expected error sending tx without response from node")
+	}
+	pending, err := w.loadPendingBroadcasts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 {
+		t.Fatalf("expected tx to be kept in the journal, got %v pending broadcasts", len(pending))
+	}
+	msgTx, err := pending[0].msgTx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.txs[msgTx.TxHash()] = msgTx
+	client.sendErr = nil
+
+	// wallet is updated with the tx the node has when it restarts
+	restarted := loadTestWallet(t, w.db, client)
+	restarted.scanMtx.Lock()
+	err = restarted.reconcilePendingBroadcasts()
+	restarted.scanMtx.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(client.sent) != 0 {
+		t.Error("tx known by the node was sent again")
+	}
+	checkSentTx(t, restarted, &pending[0])
+	if utxo := findTestUTXO(t, restarted, funding.GetOutpoint()); utxo.SpentBy != pending[0].TxID {
+		t.Errorf("funding utxo not spent by the tx: %+v", utxo)
+	}
+}
+
+func TestReconcilePendingBroadcasts(t *testing.T) {
+	tests := []struct {
+		name string
+		// node got the tx before the wallet stopped
+		sentBeforeCrash bool
+		sendErr         error
+		committed       bool
+		resent          bool
+		// tx is kept in the journal to be reconciled again
+		kept bool
+	}{
+		{
+			name:            "sent before crash",
+			sentBeforeCrash: true,
+			committed:       true,
+		},
+		{
+			name:      "not sent before crash",
+			committed: true,
+			resent:    true,
+		},
+		{
+			name:    "rejected by node",
+			sendErr: &btcjson.RPCError{Code: btcjson.ErrRPCVerify, Message: "missing inputs"},
+		},
+		{
+			name:    "node not reachable",
+			sendErr: errNodeTimeout,
+			kept:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w, client := newTestWallet(t)
+			funding := fundWallet(t, w, client, "", 100000)
+
+			pending, msgTx := journalSend(t, w, newTestAddress(t), 0.0003)
+			if pending.Change == nil {
+				t.Fatal("expected tx with change")
+			}
+			if test.sentBeforeCrash {
+				client.txs[msgTx.TxHash()] = msgTx
+			}
+			client.sendErr = test.sendErr
+
+			// wallet stops before it is updated with the tx
+			restarted := loadTestWallet(t, w.db, client)
+			restarted.scanMtx.Lock()
+			err := restarted.reconcilePendingBroadcasts()
+			restarted.scanMtx.Unlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resent := len(client.sent) == 1; resent != test.resent {
+				t.Errorf("expected resent to be %v", test.resent)
+			}
+
+			for _, wallet := range []*Wallet{restarted, loadTestWallet(t, w.db, client)} {
+				if test.committed {
+					checkSentTx(t, wallet, pending)
+					continue
+				}
+
+				if utxo := findTestUTXO(t, wallet, funding.GetOutpoint()); utxo.Spent {
+					t.Error("utxo of rejected tx is spent")
+				}
+				if wallet.getTxRecord(pending.TxID) != nil {
+					t.Error("rejected tx was recorded")
+				}
+				if test.kept {
+					checkPending(t, wallet, pending.TxID)
+					continue
+				}
+				// change key is kept in case the tx confirms
+				if wallet.getKeyPair(pending.Change.Path) == nil {
+					t.Error("change key of rejected tx was not saved")
+				}
+				if wallet.GetBalance(1) != btcutil.Amount(100000) {
+					t.Errorf("unexpected balance: %v", wallet.GetBalance(1))
+				}
+				checkNoPending(t, wallet)
+				checkConsistent(t, wallet)
+			}
+		})
+	}
+}
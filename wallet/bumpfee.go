@@ -0,0 +1,251 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/elnosh/btcw/tx"
+)
+
+// BumpFeeResult is the replacement tx created to bump the fee of a tx
+type BumpFeeResult struct {
+	TxID    string
+	OrigFee btcutil.Amount
+	Fee     btcutil.Amount
+}
+
+// BumpFee replaces an unconfirmed tx sent by the wallet with one that pays a
+// higher fee (BIP125). The replacement spends the same inputs and pays the
+// same recipients. The fee increase is taken from the change and more
+// inputs are added if the change is not enough. If no fee rate is set in
+// the options, the estimated one is used if it is higher than the min
+// increase over the fee rate of the original tx
+func (w *Wallet) BumpFee(txid string, opts SendOptions) (*BumpFeeResult, error) {
+	if err := w.canSign(); err != nil {
+		return nil, err
+	}
+	if len(opts.SubtractFeeFrom) > 0 {
+		return nil, errors.New("cannot subtract fee from outputs when bumping the fee")
+	}
+
+	feeRate, err := w.feeRate(opts)
+	if err != nil {
+		return nil, err
+	}
+	selector, err := w.coinSelector(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	w.scanMtx.Lock()
+	defer w.scanMtx.Unlock()
+
+	origTx, record, err := w.replaceableTx(txid)
+	if err != nil {
+		return nil, err
+	}
+
+	inputs := make([]tx.UTXO, 0, len(origTx.TxIn))
+	for _, txIn := range origTx.TxIn {
+		utxo, ok := w.findUTXO(txIn.PreviousOutPoint.String())
+		if !ok || utxo.SpentBy != txid {
+			return nil, errors.New("transaction has inputs not from the wallet")
+		}
+		utxo.Spent = false
+		utxo.SpentBy = ""
+		utxo.SpentHeight = 0
+		inputs = append(inputs, utxo)
+	}
+
+	// outputs to recipients are kept. The change is
+	// replaced by one with the new amount to the same key
+	outputs := make([]*wire.TxOut, 0, len(origTx.TxOut))
+	var change *changeOutput
+	recipientsAmount := btcutil.Amount(0)
+	origOutputsAmount := btcutil.Amount(0)
+	for _, txOut := range origTx.TxOut {
+		origOutputsAmount += btcutil.Amount(txOut.Value)
+		if change == nil {
+			if path, ok := w.changePath(txOut.PkScript); ok {
+				if keyPair := w.getKeyPair(path); keyPair != nil {
+					change = &changeOutput{Path: path, KeyPair: keyPair}
+					continue
+				}
+			}
+		}
+		outputs = append(outputs, wire.NewTxOut(txOut.Value, txOut.PkScript))
+		recipientsAmount += btcutil.Amount(txOut.Value)
+	}
+	if change == nil {
+		change, err = w.deriveChangeKey()
+		if err != nil {
+			return nil, err
+		}
+	}
+	changeTxOut, err := tx.CreateTxOut(change.KeyPair.Address, 0, w.network)
+	if err != nil {
+		return nil, err
+	}
+
+	origFee := tx.SumValues(inputs) - origOutputsAmount
+	origVSize := (blockchain.GetTransactionWeight(btcutil.NewTx(origTx)) + blockchain.WitnessScaleFactor - 1) /
+		blockchain.WitnessScaleFactor
+	origFeeRate := tx.FeeRate(int64(origFee) * 1000 / origVSize)
+
+	// fee rate has to be higher than the original one by at least the min relay fee rate
+	minFeeRate := origFeeRate + tx.MinRelayFeeRate
+	if feeRate < minFeeRate {
+		if opts.FeeRate != 0 {
+			return nil, fmt.Errorf("fee rate %v is too low. it must be at least %v", feeRate, minFeeRate)
+		}
+		feeRate = minFeeRate
+	}
+	// replacement also has to pay for its own relay on top of the original fee
+	requiredFee := func(vsize int64) btcutil.Amount {
+		return max(feeRate.FeeForVSize(vsize), origFee+tx.MinRelayFeeRate.FeeForVSize(vsize))
+	}
+
+	vsize, err := tx.EstimateVirtualSize(inputs, outputs)
+	if err != nil {
+		return nil, err
+	}
+	if missing := recipientsAmount + requiredFee(vsize) - tx.SumValues(inputs); missing > 0 {
+		// outputs of the original tx can't be spent since they will not exist.
+		// New unconfirmed inputs are not allowed in a replacement (BIP125 rule 2)
+		candidates := slices.DeleteFunc(w.spendableUTXOs(), func(utxo tx.UTXO) bool {
+			return utxo.TxID == txid || utxo.Height <= 0
+		})
+
+		changeOutputFee := feeRate.FeeForVSize(int64(changeTxOut.SerializeSize()))
+		changeInputWeight := w.inputWeight(change.Path)
+		params := tx.SelectionParams{
+			Target:          missing,
+			FeeRate:         feeRate,
+			LongTermFeeRate: longTermFeeRate,
+			CostOfChange:    changeOutputFee + longTermFeeRate.FeeForWeight(changeInputWeight),
+			MinChange:       changeOutputFee + tx.DustThreshold(changeTxOut.PkScript),
+		}
+		extra, err := selector.Select(candidates, params)
+		if err != nil {
+			if errors.Is(err, tx.ErrInsufficientAmount) {
+				return nil, fmt.Errorf("%w. not enough to pay the fee at %v", ErrInsufficientFunds, feeRate)
+			}
+			return nil, err
+		}
+		w.LogInfo("adding %v utxos to bump fee of tx %s", len(extra), txid)
+		inputs = append(inputs, extra...)
+	}
+	totalInputsAmount := tx.SumValues(inputs)
+
+	vsize, err = tx.EstimateVirtualSize(inputs, outputs)
+	if err != nil {
+		return nil, err
+	}
+	if vsize*blockchain.WitnessScaleFactor > maxStandardTxWeight {
+		return nil, errors.New("replacement transaction is too large")
+	}
+	fee := requiredFee(vsize)
+	if totalInputsAmount < recipientsAmount+fee {
+		return nil, fmt.Errorf("%w. not enough to pay the fee at %v", ErrInsufficientFunds, feeRate)
+	}
+
+	vsizeWithChange, err := tx.EstimateVirtualSize(inputs, append(outputs, changeTxOut))
+	if err != nil {
+		return nil, err
+	}
+	feeWithChange := requiredFee(vsizeWithChange)
+	changeTxOut.Value = int64(totalInputsAmount - recipientsAmount - feeWithChange)
+	if changeTxOut.Value <= 0 || tx.IsDust(changeTxOut) {
+		fee = totalInputsAmount - recipientsAmount
+		change = nil
+	} else {
+		fee = feeWithChange
+		outputs = append(outputs, changeTxOut)
+	}
+
+	replacement := wire.NewMsgTx(origTx.Version)
+	for _, utxo := range inputs {
+		txIn, err := tx.CreateTxIn(utxo)
+		if err != nil {
+			return nil, err
+		}
+		replacement.AddTxIn(txIn)
+	}
+	tx.ShuffleTxOuts(outputs)
+	for _, txOut := range outputs {
+		replacement.AddTxOut(txOut)
+	}
+	if change != nil {
+		change.Index = uint32(slices.Index(outputs, changeTxOut))
+	}
+	setReplaceable(replacement, !opts.DisableRBF)
+	w.LogInfo("replacing tx %s with fee %v (%v). original fee: %v (%v)", txid, fee, feeRate, origFee, origFeeRate)
+
+	if err := w.signTransaction(replacement, inputs); err != nil {
+		w.LogError("unable to bump fee - error signing transaction: %s", err.Error())
+		return nil, fmt.Errorf("error signing transaction: %s", err.Error())
+	}
+	if err := w.broadcastTx(replacement, inputs, change, record.Label, txid); err != nil {
+		return nil, err
+	}
+
+	return &BumpFeeResult{TxID: replacement.TxHash().String(), OrigFee: origFee, Fee: fee}, nil
+}
+
+// replaceableTx returns the unconfirmed tx and its record if the
+// wallet can replace it. Callers must hold scanMtx
+func (w *Wallet) replaceableTx(txid string) (*wire.MsgTx, *TxRecord, error) {
+	record := w.getTxRecord(txid)
+	if record == nil {
+		return nil, nil, ErrTxNotFound
+	}
+	if record.BlockHeight > 0 {
+		return nil, nil, errors.New("transaction is already confirmed")
+	}
+	if record.ReplacedBy != "" {
+		return nil, nil, fmt.Errorf("transaction was already replaced by %s", record.ReplacedBy)
+	}
+
+	w.mempoolMtx.Lock()
+	msgTx, ok := w.mempoolTxs[txid]
+	w.mempoolMtx.Unlock()
+	if !ok || record.Dropped {
+		return nil, nil, errors.New("transaction is not in the mempool")
+	}
+	if record.Sent == 0 {
+		return nil, nil, errors.New("transaction does not spend from the wallet")
+	}
+	if !tx.SignalsReplacement(msgTx) {
+		return nil, nil, errors.New("transaction does not signal it can be replaced (BIP125)")
+	}
+
+	// replacing the tx would drop the txs spending its outputs
+	w.utxoMtx.Lock()
+	defer w.utxoMtx.Unlock()
+	for _, utxo := range w.utxos {
+		if utxo.TxID == txid && utxo.Spent {
+			return nil, nil, fmt.Errorf("transaction has outputs spent by %s", utxo.SpentBy)
+		}
+	}
+
+	return msgTx, record, nil
+}
+
+// changePath returns the derivation path of the key of the
+// pkScript if it is from an internal descriptor of the wallet
+func (w *Wallet) changePath(pkScript []byte) (derivationPath, bool) {
+	_, addrs, _, err := txscript.ExtractPkScriptAddrs(pkScript, w.network)
+	if err != nil || len(addrs) != 1 {
+		return "", false
+	}
+	path, ok := w.lookupAddress(addrs[0].String())
+	if !ok {
+		return "", false
+	}
+	return path, w.isChange(path)
+}
@@ -0,0 +1,246 @@
+package wallet
+
+import (
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/elnosh/btcw/tx"
+)
+
+func TestReplaceableTx(t *testing.T) {
+	tests := []struct {
+		name string
+		opts SendOptions
+		// changes the wallet after sending the tx
+		setup   func(t *testing.T, w *Wallet, txid string)
+		wantErr string
+	}{
+		{
+			name: "replaceable",
+		},
+		{
+			name: "confirmed",
+			setup: func(t *testing.T, w *Wallet, txid string) {
+				record := w.getTxRecord(txid)
+				record.BlockHeight = testTipHeight
+				if err := w.saveTxRecord(record); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: "already confirmed",
+		},
+		{
+			name:    "does not signal replacement",
+			opts:    SendOptions{FeeRate: 2000, DisableRBF: true},
+			wantErr: "does not signal",
+		},
+		{
+			name: "outputs spent by descendant",
+			setup: func(t *testing.T, w *Wallet, txid string) {
+				w.utxoMtx.Lock()
+				var change string
+				for _, utxo := range w.utxos {
+					if utxo.TxID == txid {
+						change = utxo.GetOutpoint()
+					}
+				}
+				w.utxoMtx.Unlock()
+				if _, _, err := w.spendUTXO(change, strings.Repeat("ab", 32), 0); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: "has outputs spent by",
+		},
+		{
+			name: "already replaced",
+			setup: func(t *testing.T, w *Wallet, txid string) {
+				if _, err := w.BumpFee(txid, SendOptions{FeeRate: 5000}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: "already replaced",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w, client := newTestWallet(t)
+			fundWallet(t, w, client, "", 100000)
+
+			opts := test.opts
+			if opts.FeeRate == 0 {
+				opts.FeeRate = 2000
+			}
+			txid, err := w.SendToAddress(newTestAddress(t), 0.0003, "", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.setup != nil {
+				test.setup(t, w, txid)
+			}
+
+			w.scanMtx.Lock()
+			_, _, err = w.replaceableTx(txid)
+			w.scanMtx.Unlock()
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("expected error containing %q, got: %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestBumpFee(t *testing.T) {
+	w, client := newTestWallet(t)
+	fundWallet(t, w, client, "", 100000)
+
+	txid, err := w.SendToAddress(newTestAddress(t), 0.0003, "payment", SendOptions{FeeRate: 2000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	origFee := w.getTxRecord(txid).Fee
+
+	// fee rate must be higher than the original one by the min relay fee rate
+	for _, feeRate := range []tx.FeeRate{2000, 2500} {
+		if _, err := w.BumpFee(txid, SendOptions{FeeRate: feeRate}); err == nil {
+			t.Errorf("expected error bumping fee at %v", feeRate)
+		}
+	}
+
+	result, err := w.BumpFee(txid, SendOptions{FeeRate: 5000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.OrigFee != origFee {
+		t.Errorf("original fee does not match - expected: %v, got: %v", origFee, result.OrigFee)
+	}
+	replacement := client.sent[len(client.sent)-1]
+	if replacement.TxHash().String() != result.TxID {
+		t.Fatal("replacement was not sent to the node")
+	}
+	verifyTx(t, replacement, prevOuts(t, w))
+	vsize := (blockchain.GetTransactionWeight(btcutil.NewTx(replacement)) + blockchain.WitnessScaleFactor - 1) /
+		blockchain.WitnessScaleFactor
+	if minFee := origFee + tx.MinRelayFeeRate.FeeForVSize(vsize); result.Fee < minFee {
+		t.Errorf("replacement fee %v is lower than %v", result.Fee, minFee)
+	}
+	if feeRate := tx.FeeRate(int64(result.Fee) * 1000 / vsize); feeRate < 5000 {
+		t.Errorf("replacement fee rate %v is lower than 5000", feeRate)
+	}
+
+	// wallet loaded again from the db has the same state
+	for _, wallet := range []*Wallet{w, loadTestWallet(t, w.db, client)} {
+		orig := wallet.getTxRecord(txid)
+		if orig == nil || !orig.Dropped || orig.ReplacedBy != result.TxID {
+			t.Errorf("original tx is not marked as replaced: %+v", orig)
+		}
+		record := wallet.getTxRecord(result.TxID)
+		if record == nil || record.Replaces != txid || record.Label != "payment" {
+			t.Errorf("unexpected record of replacement: %+v", record)
+		}
+		if _, ok := wallet.mempoolTxs[txid]; ok {
+			t.Error("original tx is still tracked as unconfirmed")
+		}
+		for _, txIn := range replacement.TxIn {
+			if utxo := findTestUTXO(t, wallet, txIn.PreviousOutPoint.String()); utxo.SpentBy != result.TxID {
+				t.Errorf("utxo %v not spent by replacement", txIn.PreviousOutPoint)
+			}
+		}
+		wallet.utxoMtx.Lock()
+		for _, utxo := range wallet.utxos {
+			if utxo.TxID == txid {
+				t.Errorf("output %s of the original tx was not removed", utxo.GetOutpoint())
+			}
+		}
+		wallet.utxoMtx.Unlock()
+		if balance := wallet.GetBalance(0); balance != 100000-30000-result.Fee {
+			t.Errorf("unexpected balance after bump: %v", balance)
+		}
+		checkNoPending(t, wallet)
+		checkConsistent(t, wallet)
+	}
+}
+
+func TestBumpFeeAddsInputs(t *testing.T) {
+	w, client := newTestWallet(t)
+	fundWallet(t, w, client, "", 32000)
+
+	txid, err := w.SendToAddress(newTestAddress(t), 0.0003, "", SendOptions{FeeRate: 2000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// change is not enough to pay the higher fee
+	if _, err := w.BumpFee(txid, SendOptions{FeeRate: 50000}); err == nil {
+		t.Fatal("expected error bumping fee without more funds")
+	}
+
+	// unconfirmed change can't be added to the replacement
+	unconfirmed := addUnconfirmedChange(t, w, 100000)
+	if _, err := w.BumpFee(txid, SendOptions{FeeRate: 50000}); err == nil {
+		t.Fatal("expected error bumping fee with only unconfirmed change")
+	}
+	if utxo := findTestUTXO(t, w, unconfirmed.GetOutpoint()); utxo.Spent {
+		t.Error("unconfirmed change was spent by replacement")
+	}
+	if _, err := w.removeUTXO(unconfirmed.GetOutpoint()); err != nil {
+		t.Fatal(err)
+	}
+
+	funding := fundWallet(t, w, client, "", 100000)
+	result, err := w.BumpFee(txid, SendOptions{FeeRate: 50000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	replacement := client.sent[len(client.sent)-1]
+	if len(replacement.TxIn) != 2 {
+		t.Fatalf("expected replacement with 2 inputs, got %v", len(replacement.TxIn))
+	}
+	if utxo := findTestUTXO(t, w, funding.GetOutpoint()); utxo.SpentBy != result.TxID {
+		t.Error("added utxo is not spent by replacement")
+	}
+	verifyTx(t, replacement, prevOuts(t, w))
+	if balance := w.GetBalance(0); balance != 132000-30000-result.Fee {
+		t.Errorf("unexpected balance after bump: %v", balance)
+	}
+	checkConsistent(t, w)
+	if record := w.getTxRecord(txid); record.ReplacedBy != result.TxID {
+		t.Errorf("original tx is not marked as replaced: %+v", record)
+	}
+}
+
+// addUnconfirmedChange adds an unconfirmed UTXO to a change
+// address like the change of a tx sent by the wallet
+func addUnconfirmedChange(t *testing.T, w *Wallet, value btcutil.Amount) tx.UTXO {
+	t.Helper()
+
+	change, err := w.deriveChangeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.useKey(change.Path); err != nil {
+		t.Fatal(err)
+	}
+	txOut, err := tx.CreateTxOut(change.KeyPair.Address, value, w.network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hash chainhash.Hash
+	if _, err := rand.Read(hash[:]); err != nil {
+		t.Fatal(err)
+	}
+	utxo := w.newUTXO(hash.String(), 0, value, txOut.PkScript, change.Path)
+	utxo.FromWallet = true
+	if err := w.addUTXO(*utxo); err != nil {
+		t.Fatal(err)
+	}
+	return *utxo
+}
@@ -0,0 +1,109 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/elnosh/btcw/tx"
+)
+
+// CPFPResult is the child tx created to pay for an unconfirmed parent
+type CPFPResult struct {
+	TxID string
+	Fee  btcutil.Amount
+	// fee rate of the parent with its unconfirmed ancestors and the child
+	PackageFeeRate tx.FeeRate
+}
+
+// CPFP accelerates an unconfirmed tx by spending the wallet output at vout
+// in a child tx that pays enough fee for the parent and the child together
+// to reach the fee rate of the options. The size and fee of the parent and
+// its unconfirmed ancestors are taken from the mempool of the node. The
+// child sends the output minus its fee to a change address of the wallet
+func (w *Wallet) CPFP(txid string, vout uint32, label string, opts SendOptions) (*CPFPResult, error) {
+	if err := w.canSign(); err != nil {
+		return nil, err
+	}
+	hash, err := chainhash.NewHashFromStr(txid)
+	if err != nil {
+		return nil, fmt.Errorf("invalid txid: %s", err.Error())
+	}
+
+	feeRate, err := w.feeRate(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	w.scanMtx.Lock()
+	defer w.scanMtx.Unlock()
+
+	entry, err := w.client.GetMempoolEntry(hash)
+	if err != nil {
+		return nil, fmt.Errorf("transaction is not in the mempool: %s", err.Error())
+	}
+
+	outpoint := wire.NewOutPoint(hash, vout).String()
+	utxo, ok := w.findUTXO(outpoint)
+	if !ok {
+		return nil, fmt.Errorf("output %s is not from the wallet", outpoint)
+	}
+	if utxo.Spent {
+		return nil, fmt.Errorf("output %s is already spent by %s", outpoint, utxo.SpentBy)
+	}
+	if utxo.Height > 0 {
+		return nil, errors.New("transaction is already confirmed")
+	}
+
+	// package is the parent with its unconfirmed ancestors and the child
+	if entry.AncestorFees >= feeRate.FeeForVSize(entry.AncestorSize) {
+		return nil, fmt.Errorf("transaction already pays a fee rate of %v or higher", feeRate)
+	}
+
+	change, err := w.deriveChangeKey()
+	if err != nil {
+		return nil, err
+	}
+	changeTxOut, err := tx.CreateTxOut(change.KeyPair.Address, 0, w.network)
+	if err != nil {
+		return nil, err
+	}
+
+	childVSize, err := tx.EstimateVirtualSize([]tx.UTXO{utxo}, []*wire.TxOut{changeTxOut})
+	if err != nil {
+		return nil, err
+	}
+	packageFee := feeRate.FeeForVSize(entry.AncestorSize + childVSize)
+	// child has to pay at least the min relay fee for itself
+	fee := max(packageFee-entry.AncestorFees, tx.MinRelayFeeRate.FeeForVSize(childVSize))
+
+	changeTxOut.Value = int64(utxo.Value - fee)
+	if changeTxOut.Value <= 0 || tx.IsDust(changeTxOut) {
+		return nil, fmt.Errorf("%w. output %v is too small to pay the fee of %v", ErrInsufficientFunds, utxo.Value, fee)
+	}
+
+	child := wire.NewMsgTx(wire.TxVersion)
+	txIn, err := tx.CreateTxIn(utxo)
+	if err != nil {
+		return nil, err
+	}
+	child.AddTxIn(txIn)
+	child.AddTxOut(changeTxOut)
+	setReplaceable(child, !opts.DisableRBF)
+
+	packageFeeRate := tx.FeeRate(int64(entry.AncestorFees+fee) * 1000 / (entry.AncestorSize + childVSize))
+	w.LogInfo("creating child of tx %s with fee %v. package fee rate: %v", txid, fee, packageFeeRate)
+
+	inputs := []tx.UTXO{utxo}
+	if err := w.signTransaction(child, inputs); err != nil {
+		w.LogError("unable to cpfp - error signing transaction: %s", err.Error())
+		return nil, fmt.Errorf("error signing transaction: %s", err.Error())
+	}
+	if err := w.broadcastTx(child, inputs, change, label, ""); err != nil {
+		return nil, err
+	}
+
+	return &CPFPResult{TxID: child.TxHash().String(), Fee: fee, PackageFeeRate: packageFeeRate}, nil
+}
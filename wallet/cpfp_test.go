@@ -0,0 +1,144 @@
+package wallet
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/elnosh/btcw/tx"
+)
+
+// receiveUnconfirmed adds an unconfirmed tx sending value to a new wallet
+// address to the mempool of the node with the entry and notifies the wallet
+func receiveUnconfirmed(t *testing.T, w *Wallet, client *fakeClient, value btcutil.Amount,
+	entry MempoolEntry) *wire.MsgTx {
+	t.Helper()
+
+	address, err := w.GetNewAddress("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	txOut, err := tx.CreateTxOut(address, value, w.network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var prevHash chainhash.Hash
+	if _, err := rand.Read(prevHash[:]); err != nil {
+		t.Fatal(err)
+	}
+	parent := wire.NewMsgTx(wire.TxVersion)
+	parent.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&prevHash, 0), nil, nil))
+	parent.AddTxOut(txOut)
+
+	hash := parent.TxHash()
+	client.txs[hash] = parent
+	client.entries[hash] = &entry
+	w.handleMempoolTx(parent)
+	return parent
+}
+
+func TestCPFP(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   btcutil.Amount
+		entry   MempoolEntry
+		feeRate tx.FeeRate
+		wantErr bool
+	}{
+		{
+			name:    "parent without ancestors",
+			value:   50000,
+			entry:   MempoolEntry{VSize: 200, Fee: 200, AncestorSize: 200, AncestorFees: 200},
+			feeRate: 10000,
+		},
+		{
+			name:  "parent with low fee ancestors",
+			value: 50000,
+			// parent pays a high fee rate but its ancestors do not
+			entry:   MempoolEntry{VSize: 200, Fee: 4000, AncestorSize: 1200, AncestorFees: 5000},
+			feeRate: 10000,
+		},
+		{
+			name:    "min relay fee rate",
+			value:   50000,
+			entry:   MempoolEntry{VSize: 1000, Fee: 900, AncestorSize: 1000, AncestorFees: 900},
+			feeRate: tx.MinRelayFeeRate,
+		},
+		{
+			name:    "package already pays fee rate",
+			value:   50000,
+			entry:   MempoolEntry{VSize: 200, Fee: 200, AncestorSize: 1000, AncestorFees: 10000},
+			feeRate: 10000,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w, client := newTestWallet(t)
+			parent := receiveUnconfirmed(t, w, client, test.value, test.entry)
+			txid := parent.TxHash().String()
+
+			result, err := w.CPFP(txid, 0, "", SendOptions{FeeRate: test.feeRate})
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected error but got child %+v", result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			child := client.sent[len(client.sent)-1]
+			if child.TxHash().String() != result.TxID {
+				t.Fatal("child was not sent to the node")
+			}
+			verifyTx(t, child, prevOuts(t, w))
+			if len(child.TxIn) != 1 || child.TxIn[0].PreviousOutPoint.Hash != parent.TxHash() {
+				t.Fatal("child does not spend the output of the parent")
+			}
+			if fee := test.value - btcutil.Amount(child.TxOut[0].Value); fee != result.Fee {
+				t.Errorf("fee does not match - expected: %v, got: %v", result.Fee, fee)
+			}
+
+			utxo := findTestUTXO(t, w, child.TxIn[0].PreviousOutPoint.String())
+			childVSize, err := tx.EstimateVirtualSize([]tx.UTXO{utxo}, child.TxOut)
+			if err != nil {
+				t.Fatal(err)
+			}
+			packageSize := test.entry.AncestorSize + childVSize
+			wantedFee := test.feeRate.FeeForVSize(packageSize) - test.entry.AncestorFees
+			if result.Fee != wantedFee {
+				t.Errorf("fee does not match - expected: %v, got: %v", wantedFee, result.Fee)
+			}
+			wantedFeeRate := tx.FeeRate(int64(test.entry.AncestorFees+result.Fee) * 1000 / packageSize)
+			if result.PackageFeeRate != wantedFeeRate || result.PackageFeeRate < test.feeRate {
+				t.Errorf("unexpected package fee rate - expected: %v, got: %v", wantedFeeRate, result.PackageFeeRate)
+			}
+			checkConsistent(t, w)
+		})
+	}
+
+	t.Run("output not from the wallet", func(t *testing.T) {
+		w, client := newTestWallet(t)
+		parent := receiveUnconfirmed(t, w, client, 50000,
+			MempoolEntry{VSize: 200, Fee: 200, AncestorSize: 200, AncestorFees: 200})
+		if _, err := w.CPFP(parent.TxHash().String(), 1, "", SendOptions{FeeRate: 10000}); err == nil {
+			t.Fatal("expected error spending output not from the wallet")
+		}
+	})
+
+	t.Run("output too small", func(t *testing.T) {
+		w, client := newTestWallet(t)
+		parent := receiveUnconfirmed(t, w, client, 3000,
+			MempoolEntry{VSize: 200, Fee: 200, AncestorSize: 200, AncestorFees: 200})
+		_, err := w.CPFP(parent.TxHash().String(), 0, "", SendOptions{FeeRate: 10000})
+		if !errors.Is(err, ErrInsufficientFunds) {
+			t.Fatalf("expected insufficient funds error, got: %v", err)
+		}
+	})
+}
@@ -2,12 +2,16 @@ package wallet
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"log"
 
 	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
 	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/elnosh/btcw/descriptor"
 	"github.com/elnosh/btcw/tx"
 	"github.com/elnosh/btcw/utils"
 	bolt "go.etcd.io/bbolt"
@@ -19,30 +23,60 @@ const (
 	utxosBucket          = "utxos"
 	keysBucket           = "keys"
 	walletMetadataBucket = "wallet_metadata"
+	blocksBucket         = "blocks"
+	mempoolBucket        = "mempool"
+	transactionsBucket   = "transactions"
+	// txs that were about to be broadcast but the wallet was not updated yet
+	pendingBroadcastsBucket = "pending_broadcasts"
+	// output descriptors of the wallet with the id as key
+	descriptorsBucket = "descriptors"
 
-	// constant key in auth bucket
+	// constant keys in auth bucket
+	// hash to verify the passphrase
 	encodedHashKey = "encoded_hash"
+	// params to derive the key that encrypts the master key from the passphrase
+	kdfKey = "kdf"
+	// random key that encrypts the HD keys
+	encryptedMasterKeyKey = "encrypted_master_key"
 
 	// constant keys in wallet metadata bucket
-	balanceKey          = "balance"
-	masterSeedKey       = "master_seed"
-	account0ExternelKey = "account_0_external"
-	account0InternalKey = "account_0_internal"
-	lastScannedBlockKey = "last_scanned_block"
-	lastExternalIdxKey  = "last_external_idx"
-	lastInternalIdxKey  = "last_internal_idx"
+	balanceKey           = "balance"
+	masterSeedKey        = "master_seed"
+	account0ExternelKey  = "account_0_external"
+	account0InternalKey  = "account_0_internal"
+	lastScannedBlockKey  = "last_scanned_block"
+	recoveryGapLimitKey  = "recovery_gap_limit"
+	walletVersionKey     = "wallet_version"
+	masterFingerprintKey = "master_fingerprint"
+	// last indexes and extended public keys of the chains of account 0 in
+	// wallets created before descriptors. They are replaced by the descriptors
+	lastExternalIdxKey = "last_external_idx"
+	lastInternalIdxKey = "last_internal_idx"
+	account0ExtXpubKey = "account_0_external_xpub"
+	account0IntXpubKey = "account_0_internal_xpub"
+	// set in wallets created from an extended public key
+	watchOnlyKey = "watch_only"
+	// extended public key of account 0. Wallets created from a seed
+	// before it was saved derive it when the wallet is unlocked
+	account0XpubKey = "account_0_xpub"
+	// path of the account key from the master key. Not set
+	// in wallets created from a seed which use m/44'/1'/0'
+	account0PathKey = "account_0_path"
 )
 
 // create auth, utxos, keys and wallet metadata buckets
-func (w *Wallet) initWalletBuckets(seed []byte, encodedHash string, net *chaincfg.Params) error {
+func (w *Wallet) initWalletBuckets(seed, passphrase []byte, net *chaincfg.Params) error {
 	return w.db.Update(func(tx *bolt.Tx) error {
-		if err := createAuthBucket(tx, encodedHash); err != nil {
+		masterKey, auth, err := newWalletAuth(passphrase)
+		if err != nil {
 			return err
 		}
-		if err := createUTXOBucket(tx); err != nil {
+		defer utils.Wipe(masterKey)
+
+		if err := createAuthBucket(tx, auth); err != nil {
 			return err
 		}
-		if err := createKeysBucket(tx); err != nil {
+		if err := createWalletBuckets(tx); err != nil {
 			return err
 		}
 
@@ -52,32 +86,154 @@ func (w *Wallet) initWalletBuckets(seed []byte, encodedHash string, net *chaincf
 			return err
 		}
 
-		// decode hash to get passkey that will be used to encrypt HD keys
-		_, key, _, err := utils.DecodeHash(encodedHash)
+		// encrypt derived keys with the master key
+		encryptedMaster, encryptedAcct0ext, encryptedAcct0int, err := EncryptHDKeys(masterKey, master, acct0ext, acct0int)
 		if err != nil {
 			return err
 		}
 
-		// encrypt derived keys
-		encryptedMaster, encryptedAcct0ext, encryptedAcct0int, err := EncryptHDKeys(key, master, acct0ext, acct0int)
+		if err := createWalletMetadataBucket(tx); err != nil {
+			return err
+		}
+		if err := putEncryptedHDKeys(tx, encryptedMaster, encryptedAcct0ext, encryptedAcct0int); err != nil {
+			return err
+		}
+		if err := putMasterFingerprint(tx, master); err != nil {
+			return err
+		}
+		if err := putAccount0Xpub(tx, master); err != nil {
+			return err
+		}
+
+		account, err := seedAccountXpub(master)
 		if err != nil {
 			return err
 		}
+		if err := putDefaultDescriptors(tx, account, net); err != nil {
+			return err
+		}
+		return putWalletVersion(tx, currentWalletVersion)
+	})
+}
+
+// initWatchOnlyWalletBuckets creates the buckets of a wallet that only has
+// the extended public key of the account. It has no passphrase since there
+// are no private keys to encrypt
+func (w *Wallet) initWatchOnlyWalletBuckets(account *AccountXpub, net *chaincfg.Params) error {
+	return w.db.Update(func(tx *bolt.Tx) error {
+		// auth bucket is left empty
+		if _, err := tx.CreateBucket([]byte(authBucket)); err != nil {
+			return err
+		}
+		if err := createWalletBuckets(tx); err != nil {
+			return err
+		}
+		if err := createWalletMetadataBucket(tx); err != nil {
+			return err
+		}
 
-		if err := createWalletMetadataBucket(tx, encryptedMaster, encryptedAcct0ext, encryptedAcct0int); err != nil {
+		walletMetadata := tx.Bucket([]byte(walletMetadataBucket))
+		if err := walletMetadata.Put([]byte(watchOnlyKey), []byte{1}); err != nil {
 			return err
 		}
-		return nil
+		if err := walletMetadata.Put([]byte(account0PathKey), []byte(FormatBIP32Path(account.Path))); err != nil {
+			return err
+		}
+		if err := walletMetadata.Put([]byte(masterFingerprintKey), utils.Uint32ToBytes(account.Fingerprint)); err != nil {
+			return err
+		}
+		if err := walletMetadata.Put([]byte(account0XpubKey), []byte(account.Key.String())); err != nil {
+			return err
+		}
+		if err := putDefaultDescriptors(tx, account, net); err != nil {
+			return err
+		}
+		return putWalletVersion(tx, currentWalletVersion)
 	})
 }
 
-// create bucket with hashed passphrase
-func createAuthBucket(tx *bolt.Tx, encodedHash string) error {
-	b, err := tx.CreateBucket([]byte(authBucket))
+// createWalletBuckets creates the buckets for utxos, keys, descriptors,
+// scanned blocks, mempool txs and wallet history
+func createWalletBuckets(tx *bolt.Tx) error {
+	if err := createUTXOBucket(tx); err != nil {
+		return err
+	}
+	if err := createKeysBucket(tx); err != nil {
+		return err
+	}
+	if err := createBlocksBucket(tx); err != nil {
+		return err
+	}
+	if _, err := tx.CreateBucket([]byte(mempoolBucket)); err != nil {
+		return err
+	}
+	if _, err := tx.CreateBucket([]byte(descriptorsBucket)); err != nil {
+		return err
+	}
+	_, err := tx.CreateBucket([]byte(transactionsBucket))
+	return err
+}
+
+// create bucket with hashed passphrase and encrypted master key
+func createAuthBucket(tx *bolt.Tx, auth *walletAuth) error {
+	if _, err := tx.CreateBucket([]byte(authBucket)); err != nil {
+		return err
+	}
+	return putWalletAuth(tx, auth)
+}
+
+func putWalletAuth(tx *bolt.Tx, auth *walletAuth) error {
+	b := tx.Bucket([]byte(authBucket))
+	if err := b.Put([]byte(encodedHashKey), []byte(auth.encodedHash)); err != nil {
+		return err
+	}
+	if err := b.Put([]byte(kdfKey), []byte(auth.kdf)); err != nil {
+		return err
+	}
+	return b.Put([]byte(encryptedMasterKeyKey), auth.encryptedMasterKey)
+}
+
+// putWalletVersion saves the version of the wallet format
+func putWalletVersion(tx *bolt.Tx, version uint32) error {
+	walletMetadata := tx.Bucket([]byte(walletMetadataBucket))
+	return walletMetadata.Put([]byte(walletVersionKey), utils.Uint32ToBytes(version))
+}
+
+// putMasterFingerprint saves the fingerprint of the master key
+// so that it can be used in PSBTs without unlocking the wallet
+func putMasterFingerprint(tx *bolt.Tx, master *hdkeychain.ExtendedKey) error {
+	fingerprint, err := MasterFingerprint(master)
 	if err != nil {
 		return err
 	}
-	return b.Put([]byte(encodedHashKey), []byte(encodedHash))
+	walletMetadata := tx.Bucket([]byte(walletMetadataBucket))
+	return walletMetadata.Put([]byte(masterFingerprintKey), utils.Uint32ToBytes(fingerprint))
+}
+
+// putAccount0Xpub saves the extended public key of account 0 derived
+// from the master key so that it can be exported without unlocking the wallet
+func putAccount0Xpub(tx *bolt.Tx, master *hdkeychain.ExtendedKey) error {
+	account, err := seedAccountXpub(master)
+	if err != nil {
+		return err
+	}
+	walletMetadata := tx.Bucket([]byte(walletMetadataBucket))
+	return walletMetadata.Put([]byte(account0XpubKey), []byte(account.Key.String()))
+}
+
+// putDefaultDescriptors saves the descriptors of the receive
+// and change addresses of the account of a new wallet
+func putDefaultDescriptors(tx *bolt.Tx, account *AccountXpub, net *chaincfg.Params) error {
+	descriptors, err := defaultDescriptors(account, net)
+	if err != nil {
+		return err
+	}
+	for _, wd := range descriptors {
+		if err := putDescriptor(tx, wd); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func createUTXOBucket(tx *bolt.Tx) error {
@@ -90,30 +246,49 @@ func createKeysBucket(tx *bolt.Tx) error {
 	return err
 }
 
-func createWalletMetadataBucket(tx *bolt.Tx, encryptedMaster, encryptedAcct0ext, encryptedAcct0int []byte) error {
-	wallet, err := tx.CreateBucket([]byte(walletMetadataBucket))
-	if err != nil {
-		return err
-	}
+// createBlocksBucket creates bucket to store hashes
+// of scanned blocks with the height as key
+func createBlocksBucket(tx *bolt.Tx) error {
+	_, err := tx.CreateBucket([]byte(blocksBucket))
+	return err
+}
+
+// ensureBuckets creates the buckets added after
+// a wallet could have been created
+func (w *Wallet) ensureBuckets() error {
+	return w.db.Update(func(tx *bolt.Tx) error {
+		buckets := []string{blocksBucket, mempoolBucket, transactionsBucket, pendingBroadcastsBucket,
+			descriptorsBucket}
+		for _, bucket := range buckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
 
-	if err = wallet.Put([]byte(masterSeedKey), encryptedMaster); err != nil {
+// putEncryptedHDKeys saves the encrypted master key and account chain keys
+func putEncryptedHDKeys(tx *bolt.Tx, encryptedMaster, encryptedAcct0ext, encryptedAcct0int []byte) error {
+	wallet := tx.Bucket([]byte(walletMetadataBucket))
+	if err := wallet.Put([]byte(masterSeedKey), encryptedMaster); err != nil {
 		return err
 	}
-	if err = wallet.Put([]byte(account0ExternelKey), encryptedAcct0ext); err != nil {
+	if err := wallet.Put([]byte(account0ExternelKey), encryptedAcct0ext); err != nil {
 		return err
 	}
-	if err = wallet.Put([]byte(account0InternalKey), encryptedAcct0int); err != nil {
+	return wallet.Put([]byte(account0InternalKey), encryptedAcct0int)
+}
+
+func createWalletMetadataBucket(tx *bolt.Tx) error {
+	wallet, err := tx.CreateBucket([]byte(walletMetadataBucket))
+	if err != nil {
 		return err
 	}
+
 	if err = wallet.Put([]byte(balanceKey), utils.Int64ToBytes(0)); err != nil {
 		return err
 	}
-	if err = wallet.Put([]byte(lastExternalIdxKey), utils.Uint32ToBytes(0)); err != nil {
-		return err
-	}
-	if err = wallet.Put([]byte(lastInternalIdxKey), utils.Uint32ToBytes(0)); err != nil {
-		return err
-	}
 	if err = wallet.Put([]byte(lastScannedBlockKey), utils.Int64ToBytes(0)); err != nil {
 		return err
 	}
@@ -121,7 +296,7 @@ func createWalletMetadataBucket(tx *bolt.Tx, encryptedMaster, encryptedAcct0ext,
 	return nil
 }
 
-func (w Wallet) getEncodedHash() []byte {
+func (w *Wallet) getEncodedHash() []byte {
 	var encodedHash []byte
 	w.db.View(func(tx *bolt.Tx) error {
 		walletMetadata := tx.Bucket([]byte(authBucket))
@@ -131,40 +306,44 @@ func (w Wallet) getEncodedHash() []byte {
 	return encodedHash
 }
 
-func (w Wallet) getBalance() btcutil.Amount {
-	var bytes []byte
+// getAuth returns the value of key in the auth bucket
+func (w *Wallet) getAuth(key string) []byte {
+	var value []byte
 	w.db.View(func(tx *bolt.Tx) error {
-		walletMetadata := tx.Bucket([]byte(walletMetadataBucket))
-		bytes = walletMetadata.Get([]byte(balanceKey))
+		authb := tx.Bucket([]byte(authBucket))
+		value = authb.Get([]byte(key))
 		return nil
 	})
-	balance := btcutil.Amount(utils.BytesToInt64(bytes))
-	return balance
+	return value
 }
 
-func (w Wallet) getLastExternalIdx() uint32 {
+// getWalletVersion returns the version of the wallet format.
+// Wallets created before versions were added are version 0
+func (w *Wallet) getWalletVersion() uint32 {
 	var bytes []byte
 	w.db.View(func(tx *bolt.Tx) error {
 		walletMetadata := tx.Bucket([]byte(walletMetadataBucket))
-		bytes = walletMetadata.Get([]byte(lastExternalIdxKey))
+		bytes = walletMetadata.Get([]byte(walletVersionKey))
 		return nil
 	})
-	lastExternalIdx := utils.BytesToUint32(bytes)
-	return lastExternalIdx
+	if bytes == nil {
+		return 0
+	}
+	return utils.BytesToUint32(bytes)
 }
 
-func (w Wallet) getLastInternalIdx() uint32 {
+func (w *Wallet) getBalance() btcutil.Amount {
 	var bytes []byte
 	w.db.View(func(tx *bolt.Tx) error {
 		walletMetadata := tx.Bucket([]byte(walletMetadataBucket))
-		bytes = walletMetadata.Get([]byte(lastInternalIdxKey))
+		bytes = walletMetadata.Get([]byte(balanceKey))
 		return nil
 	})
-	lastInternalIdx := utils.BytesToUint32(bytes)
-	return lastInternalIdx
+	balance := btcutil.Amount(utils.BytesToInt64(bytes))
+	return balance
 }
 
-func (w Wallet) getLastScannedBlock() int64 {
+func (w *Wallet) getLastScannedBlock() int64 {
 	var bytes []byte
 	w.db.View(func(tx *bolt.Tx) error {
 		walletMetadata := tx.Bucket([]byte(walletMetadataBucket))
@@ -175,82 +354,344 @@ func (w Wallet) getLastScannedBlock() int64 {
 	return lastScannedBlock
 }
 
-// getAcct0External retrieves the extended key for external chain
-// it can then be used to generate an external address
-func (w Wallet) getAcct0External() []byte {
-	var encryptedAcct0ext []byte
+// getMasterFingerprint returns the saved fingerprint of the master key.
+// nil if it was not saved (i.e wallet created before PSBTs were supported)
+func (w *Wallet) getMasterFingerprint() []byte {
+	var fingerprint []byte
 	w.db.View(func(tx *bolt.Tx) error {
 		walletMetadata := tx.Bucket([]byte(walletMetadataBucket))
-		encryptedAcct0ext = walletMetadata.Get([]byte(account0ExternelKey))
+		fingerprint = walletMetadata.Get([]byte(masterFingerprintKey))
 		return nil
 	})
-	return encryptedAcct0ext
+	return fingerprint
 }
 
-// getAcct0Internal retrieves the extended key for internal chain
-// it can then be used to generate an internal addresses for change outputs
-func (w Wallet) getAcct0Internal() []byte {
-	var encryptedAcct0internal []byte
+// getAccount0Xpub returns the saved extended public key of account 0.
+// nil if it was not saved (i.e wallet created before it could be exported)
+func (w *Wallet) getAccount0Xpub() []byte {
+	var xpub []byte
 	w.db.View(func(tx *bolt.Tx) error {
 		walletMetadata := tx.Bucket([]byte(walletMetadataBucket))
-		encryptedAcct0internal = walletMetadata.Get([]byte(account0InternalKey))
+		xpub = walletMetadata.Get([]byte(account0XpubKey))
 		return nil
 	})
-	return encryptedAcct0internal
+	return xpub
 }
 
-func (w *Wallet) updateLastExternalIdx(idx uint32) error {
-	if err := w.db.Update(func(tx *bolt.Tx) error {
+// isWatchOnly returns true if the wallet was created from an extended public key
+func (w *Wallet) isWatchOnly() bool {
+	var watchOnly []byte
+	w.db.View(func(tx *bolt.Tx) error {
 		walletMetadata := tx.Bucket([]byte(walletMetadataBucket))
-		newIdx := utils.Uint32ToBytes(idx)
-		err := walletMetadata.Put([]byte(lastExternalIdxKey), newIdx)
-		return err
+		watchOnly = walletMetadata.Get([]byte(watchOnlyKey))
+		return nil
+	})
+	return watchOnly != nil
+}
+
+// getAccountPath returns the saved path of the account key from the master key.
+// nil if it was not saved (i.e wallet created from a seed)
+func (w *Wallet) getAccountPath() []byte {
+	var path []byte
+	w.db.View(func(tx *bolt.Tx) error {
+		walletMetadata := tx.Bucket([]byte(walletMetadataBucket))
+		path = walletMetadata.Get([]byte(account0PathKey))
+		return nil
+	})
+	return path
+}
+
+// getMasterSeed retrieves the encrypted master key
+func (w *Wallet) getMasterSeed() []byte {
+	var encryptedMaster []byte
+	w.db.View(func(tx *bolt.Tx) error {
+		walletMetadata := tx.Bucket([]byte(walletMetadataBucket))
+		encryptedMaster = walletMetadata.Get([]byte(masterSeedKey))
+		return nil
+	})
+	return encryptedMaster
+}
+
+func (w *Wallet) saveMasterFingerprint(master *hdkeychain.ExtendedKey) error {
+	if err := w.db.Update(func(tx *bolt.Tx) error {
+		return putMasterFingerprint(tx, master)
 	}); err != nil {
-		return fmt.Errorf("error updating last external idx: %s", err.Error())
+		return fmt.Errorf("error saving master key fingerprint: %v", err)
 	}
 	return nil
 }
 
-func (w *Wallet) updateLastInternalIdx(idx uint32) error {
+func (w *Wallet) saveAccount0Xpub(master *hdkeychain.ExtendedKey) error {
 	if err := w.db.Update(func(tx *bolt.Tx) error {
-		walletMetadata := tx.Bucket([]byte(walletMetadataBucket))
-		newIdx := utils.Uint32ToBytes(idx)
-		err := walletMetadata.Put([]byte(lastInternalIdxKey), newIdx)
-		return err
+		return putAccount0Xpub(tx, master)
 	}); err != nil {
-		return fmt.Errorf("error updating last internal idx: %s", err.Error())
+		return fmt.Errorf("error saving account extended public key: %v", err)
 	}
 	return nil
 }
 
-func (w *Wallet) updateLastScannedBlock(height int64) error {
+// updateLastScannedBlock saves the height of the last scanned block and
+// its hash. Hashes of blocks older than maxReorgDepth are removed
+func (w *Wallet) updateLastScannedBlock(height int64, hash string) error {
 	if err := w.db.Update(func(tx *bolt.Tx) error {
 		walletMetadata := tx.Bucket([]byte(walletMetadataBucket))
 		v := utils.Int64ToBytes(height)
-		err := walletMetadata.Put([]byte(lastScannedBlockKey), v)
-		return err
+		if err := walletMetadata.Put([]byte(lastScannedBlockKey), v); err != nil {
+			return err
+		}
+
+		blocksb := tx.Bucket([]byte(blocksBucket))
+		if err := blocksb.Put(heightKey(height), []byte(hash)); err != nil {
+			return err
+		}
+
+		c := blocksb.Cursor()
+		for k, _ := c.First(); k != nil && heightFromKey(k) <= height-maxReorgDepth; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
 	}); err != nil {
 		return fmt.Errorf("error updating last scanned block: %s", err.Error())
 	}
 	return nil
 }
 
-func (w *Wallet) saveKeyPair(derivationPath string, keypair *KeyPair) error {
-	jsonbytes, err := json.Marshal(keypair)
+// getBlockHash returns the hash of the scanned block at height.
+// If it does not have it, it returns an empty string
+func (w *Wallet) getBlockHash(height int64) string {
+	var hash []byte
+	w.db.View(func(tx *bolt.Tx) error {
+		blocksb := tx.Bucket([]byte(blocksBucket))
+		hash = blocksb.Get(heightKey(height))
+		return nil
+	})
+	return string(hash)
+}
+
+// rollbackDB removes and updates the UTXOs affected by a chain reorganization,
+// saves the txs that go back to the mempool and removes hashes of blocks
+// after forkHeight. Records of txs confirmed after the fork are unconfirmed
+// again or dropped if they can't go back to the mempool
+func (w *Wallet) rollbackDB(forkHeight int64, removed []string, updated []tx.UTXO,
+	unconfirmed map[string]*wire.MsgTx) error {
+	if err := w.db.Update(func(dbtx *bolt.Tx) error {
+		for _, outpoint := range removed {
+			if err := deleteUTXOTx(dbtx, outpoint); err != nil {
+				return err
+			}
+		}
+		for _, utxo := range updated {
+			if err := putUTXO(dbtx, utxo); err != nil {
+				return err
+			}
+		}
+
+		mempoolb := dbtx.Bucket([]byte(mempoolBucket))
+		for txid, msgTx := range unconfirmed {
+			var buf bytes.Buffer
+			if err := msgTx.Serialize(&buf); err != nil {
+				return err
+			}
+			if err := mempoolb.Put([]byte(txid), buf.Bytes()); err != nil {
+				return err
+			}
+		}
+
+		blocksb := dbtx.Bucket([]byte(blocksBucket))
+		c := blocksb.Cursor()
+		for k, _ := c.Seek(heightKey(forkHeight + 1)); k != nil; k, _ = c.Seek(heightKey(forkHeight + 1)) {
+			if err := blocksb.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		// txs confirmed after the fork are unconfirmed again
+		txsb := dbtx.Bucket([]byte(transactionsBucket))
+		txc := txsb.Cursor()
+		for k, v := txc.First(); k != nil; k, v = txc.Next() {
+			var record TxRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			if record.BlockHeight <= forkHeight {
+				continue
+			}
+			record.BlockHeight = 0
+			record.BlockHash = ""
+			if _, ok := unconfirmed[record.TxID]; !ok {
+				record.Dropped = true
+			}
+			jsonbytes, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			if err := txsb.Put(k, jsonbytes); err != nil {
+				return err
+			}
+		}
+
+		walletMetadata := dbtx.Bucket([]byte(walletMetadataBucket))
+		return walletMetadata.Put([]byte(lastScannedBlockKey), utils.Int64ToBytes(forkHeight))
+	}); err != nil {
+		return fmt.Errorf("error rolling back wallet: %s", err.Error())
+	}
+	return nil
+}
+
+// heightKey returns height as big endian bytes
+// so that keys in blocks bucket are sorted by height
+func heightKey(height int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(height))
+	return b
+}
+
+func heightFromKey(key []byte) int64 {
+	return int64(binary.BigEndian.Uint64(key))
+}
+
+func (w *Wallet) getRecoveryGapLimit() uint32 {
+	var bytes []byte
+	w.db.View(func(tx *bolt.Tx) error {
+		walletMetadata := tx.Bucket([]byte(walletMetadataBucket))
+		bytes = walletMetadata.Get([]byte(recoveryGapLimitKey))
+		return nil
+	})
+	if bytes == nil {
+		return 0
+	}
+	return utils.BytesToUint32(bytes)
+}
+
+// updateRecovery sets the gap limit used while recovering and
+// the last scanned block from where the recovery should start
+func (w *Wallet) updateRecovery(gapLimit uint32, lastScannedBlock int64) error {
+	if err := w.db.Update(func(tx *bolt.Tx) error {
+		walletMetadata := tx.Bucket([]byte(walletMetadataBucket))
+		err := walletMetadata.Put([]byte(recoveryGapLimitKey), utils.Uint32ToBytes(gapLimit))
+		if err != nil {
+			return err
+		}
+		return putRescan(tx, lastScannedBlock)
+	}); err != nil {
+		return fmt.Errorf("error updating recovery: %s", err.Error())
+	}
+	return nil
+}
+
+// updateRescan sets the last scanned block so
+// that blocks after it are scanned again
+func (w *Wallet) updateRescan(lastScannedBlock int64) error {
+	if err := w.db.Update(func(tx *bolt.Tx) error {
+		return putRescan(tx, lastScannedBlock)
+	}); err != nil {
+		return fmt.Errorf("error updating rescan: %s", err.Error())
+	}
+	return nil
+}
+
+// putRescan sets the last scanned block and removes
+// the hashes of the scanned blocks since they will be scanned again
+func putRescan(tx *bolt.Tx, lastScannedBlock int64) error {
+	walletMetadata := tx.Bucket([]byte(walletMetadataBucket))
+	if err := walletMetadata.Put([]byte(lastScannedBlockKey), utils.Int64ToBytes(lastScannedBlock)); err != nil {
+		return err
+	}
+
+	if err := tx.DeleteBucket([]byte(blocksBucket)); err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+	_, err := tx.CreateBucket([]byte(blocksBucket))
+	return err
+}
+
+func (w *Wallet) deleteRecovery() error {
+	if err := w.db.Update(func(tx *bolt.Tx) error {
+		walletMetadata := tx.Bucket([]byte(walletMetadataBucket))
+		return walletMetadata.Delete([]byte(recoveryGapLimitKey))
+	}); err != nil {
+		return fmt.Errorf("error deleting recovery: %s", err.Error())
+	}
+	return nil
+}
+
+// descriptorKey returns id as big endian bytes
+// so that keys in descriptors bucket are sorted by id
+func descriptorKey(id uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, id)
+	return b
+}
+
+func putDescriptor(tx *bolt.Tx, wd walletDescriptor) error {
+	jsonbytes, err := json.Marshal(wd)
 	if err != nil {
-		return fmt.Errorf("error marshalling key pair: %s", err.Error())
+		return err
 	}
+	descriptorsb := tx.Bucket([]byte(descriptorsBucket))
+	return descriptorsb.Put(descriptorKey(wd.ID), jsonbytes)
+}
 
+// putDescriptors saves the descriptors and key pairs derived
+// from them with their derivation path as key in a single db transaction
+func (w *Wallet) putDescriptors(descriptors []walletDescriptor, keyPairs map[derivationPath]*KeyPair) error {
 	if err := w.db.Update(func(tx *bolt.Tx) error {
+		for _, wd := range descriptors {
+			if err := putDescriptor(tx, wd); err != nil {
+				return err
+			}
+		}
+
 		keysb := tx.Bucket([]byte(keysBucket))
-		err := keysb.Put([]byte(derivationPath), jsonbytes)
-		return err
+		for path, keyPair := range keyPairs {
+			jsonbytes, err := json.Marshal(keyPair)
+			if err != nil {
+				return err
+			}
+			if err := keysb.Put([]byte(path), jsonbytes); err != nil {
+				return err
+			}
+		}
+		return nil
 	}); err != nil {
-		return fmt.Errorf("error saving key pair: %s", err.Error())
+		return fmt.Errorf("error saving descriptors: %s", err.Error())
 	}
 	return nil
 }
 
+// loadDescriptors loads the descriptors of the wallet
+func (w *Wallet) loadDescriptors() error {
+	descriptors := make(map[uint32]walletDescriptor)
+
+	if err := w.db.View(func(tx *bolt.Tx) error {
+		descriptorsb := tx.Bucket([]byte(descriptorsBucket))
+
+		c := descriptorsb.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var wd walletDescriptor
+			if err := json.Unmarshal(v, &wd); err != nil {
+				return err
+			}
+			parsed, err := descriptor.Parse(wd.Desc, w.network)
+			if err != nil {
+				return err
+			}
+			wd.parsed = parsed
+			descriptors[wd.ID] = wd
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("error loading descriptors: %s", err.Error())
+	}
+
+	w.descriptorsMtx.Lock()
+	w.descriptors = descriptors
+	w.descriptorsMtx.Unlock()
+	return nil
+}
+
 func (w *Wallet) getKeyPair(derivationPath string) *KeyPair {
 	keyPair := &KeyPair{}
 
@@ -295,22 +736,22 @@ func (w *Wallet) getDerivationPathForAddress(address string) string {
 	return derivationPath
 }
 
-// loadExternalAddresses loads addresses generated from external chain
-// into the wallet addresses map
-func (w *Wallet) loadExternalAddresses() error {
+// loadAddresses loads addresses derived from
+// the descriptors into the wallet addresses map
+func (w *Wallet) loadAddresses() error {
 	if err := w.db.View(func(tx *bolt.Tx) error {
 		keysb := tx.Bucket([]byte(keysBucket))
 
+		w.addressesMtx.Lock()
+		defer w.addressesMtx.Unlock()
+
 		c := keysb.Cursor()
 		for k, v := c.First(); k != nil; k, v = c.Next() {
 			var kp KeyPair
 			if err := json.Unmarshal(v, &kp); err != nil {
 				return fmt.Errorf("error loading addresses: %s", err.Error())
 			}
-			// check to add only external addresses
-			if bytes.Contains(k, []byte("m/44'/1'/0'/0")) {
-				w.addresses[kp.Address] = string(k)
-			}
+			w.addresses[kp.Address] = string(k)
 		}
 		return nil
 	}); err != nil {
@@ -319,61 +760,245 @@ func (w *Wallet) loadExternalAddresses() error {
 	return nil
 }
 
-func (w *Wallet) updateBalanceDB(balance btcutil.Amount) error {
-	balancebytes := utils.Int64ToBytes(int64(balance))
+func (w *Wallet) saveUTXO(utxo tx.UTXO) error {
+	if err := w.db.Update(func(dbtx *bolt.Tx) error {
+		return putUTXO(dbtx, utxo)
+	}); err != nil {
+		return fmt.Errorf("error saving utxo: %s", err.Error())
+	}
+	return nil
+}
 
-	if err := w.db.Update(func(tx *bolt.Tx) error {
-		walletMetadata := tx.Bucket([]byte(walletMetadataBucket))
-		err := walletMetadata.Put([]byte(balanceKey), balancebytes)
-		return err
+func (w *Wallet) updateUTXO(key string, utxo tx.UTXO) error {
+	if err := w.db.Update(func(dbtx *bolt.Tx) error {
+		utxosb := dbtx.Bucket([]byte(utxosBucket))
+
+		// only put if utxo already exists
+		if utxosb.Get([]byte(key)) == nil {
+			return fmt.Errorf("utxo does not exist")
+		}
+		return putUTXO(dbtx, utxo)
 	}); err != nil {
-		return fmt.Errorf("error updating balance: %s", err.Error())
+		return fmt.Errorf("error updating utxo: %s", err.Error())
 	}
 	return nil
 }
 
-func (w *Wallet) saveUTXO(utxo tx.UTXO) error {
+func (w *Wallet) deleteUTXO(key string) error {
+	if err := w.db.Update(func(dbtx *bolt.Tx) error {
+		return deleteUTXOTx(dbtx, key)
+	}); err != nil {
+		return fmt.Errorf("error deleting utxo: %s", err.Error())
+	}
+	return nil
+}
+
+// putUTXO saves the utxo and adjusts the stored balance
+// in the same db transaction so they can not get out of sync
+func putUTXO(dbtx *bolt.Tx, utxo tx.UTXO) error {
+	utxosb := dbtx.Bucket([]byte(utxosBucket))
+	key := []byte(utxo.GetOutpoint())
+
+	var delta btcutil.Amount
+	if prevBytes := utxosb.Get(key); prevBytes != nil {
+		var prev tx.UTXO
+		if err := json.Unmarshal(prevBytes, &prev); err != nil {
+			return err
+		}
+		if !prev.Spent {
+			delta -= prev.Value
+		}
+	}
+	if !utxo.Spent {
+		delta += utxo.Value
+	}
+
 	jsonbytes, err := json.Marshal(utxo)
 	if err != nil {
-		return fmt.Errorf("error marshalling utxo: %s", err.Error())
+		return err
 	}
+	if err := utxosb.Put(key, jsonbytes); err != nil {
+		return err
+	}
+	return addToBalance(dbtx, delta)
+}
 
-	if err := w.db.Update(func(dbtx *bolt.Tx) error {
-		utxosb := dbtx.Bucket([]byte(utxosBucket))
-		key := []byte(utxo.GetOutpoint())
-		err := utxosb.Put(key, jsonbytes)
+// deleteUTXOTx deletes the utxo and removes its value
+// from the stored balance if it was unspent
+func deleteUTXOTx(dbtx *bolt.Tx, key string) error {
+	utxosb := dbtx.Bucket([]byte(utxosBucket))
+	prevBytes := utxosb.Get([]byte(key))
+	if prevBytes == nil {
+		return nil
+	}
+
+	var prev tx.UTXO
+	if err := json.Unmarshal(prevBytes, &prev); err != nil {
 		return err
+	}
+	if err := utxosb.Delete([]byte(key)); err != nil {
+		return err
+	}
+	if prev.Spent {
+		return nil
+	}
+	return addToBalance(dbtx, -prev.Value)
+}
+
+func addToBalance(dbtx *bolt.Tx, delta btcutil.Amount) error {
+	if delta == 0 {
+		return nil
+	}
+	walletMetadata := dbtx.Bucket([]byte(walletMetadataBucket))
+	balance := utils.BytesToInt64(walletMetadata.Get([]byte(balanceKey)))
+	return walletMetadata.Put([]byte(balanceKey), utils.Int64ToBytes(balance+int64(delta)))
+}
+
+// sumUTXOs returns the sum of unspent utxos in the utxos bucket
+// and the number of utxos in it
+func sumUTXOs(dbtx *bolt.Tx) (btcutil.Amount, int, error) {
+	var sum btcutil.Amount
+	count := 0
+
+	utxosb := dbtx.Bucket([]byte(utxosBucket))
+	c := utxosb.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		var utxo tx.UTXO
+		if err := json.Unmarshal(v, &utxo); err != nil {
+			return 0, 0, fmt.Errorf("error reading utxo %s: %s", k, err.Error())
+		}
+		if !utxo.Spent {
+			sum += utxo.Value
+		}
+		count++
+	}
+	return sum, count, nil
+}
+
+// checkBalanceDB recomputes the balance from the utxos bucket
+// and returns it along with the stored balance. If repair is true
+// the stored balance is set to the recomputed one
+func (w *Wallet) checkBalanceDB(repair bool) (utxosBalance, storedBalance btcutil.Amount, count int, err error) {
+	check := func(dbtx *bolt.Tx) error {
+		utxosBalance, count, err = sumUTXOs(dbtx)
+		if err != nil {
+			return err
+		}
+		walletMetadata := dbtx.Bucket([]byte(walletMetadataBucket))
+		storedBalance = btcutil.Amount(utils.BytesToInt64(walletMetadata.Get([]byte(balanceKey))))
+
+		if repair && utxosBalance != storedBalance {
+			return walletMetadata.Put([]byte(balanceKey), utils.Int64ToBytes(int64(utxosBalance)))
+		}
+		return nil
+	}
+
+	if repair {
+		err = w.db.Update(check)
+	} else {
+		err = w.db.View(check)
+	}
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("error checking balance: %s", err.Error())
+	}
+	return utxosBalance, storedBalance, count, nil
+}
+
+// saveMempoolTx saves serialized unconfirmed tx with txid as key
+func (w *Wallet) saveMempoolTx(txid string, serializedTx []byte) error {
+	if err := w.db.Update(func(tx *bolt.Tx) error {
+		mempoolb := tx.Bucket([]byte(mempoolBucket))
+		return mempoolb.Put([]byte(txid), serializedTx)
 	}); err != nil {
-		return fmt.Errorf("error saving utxo: %s", err.Error())
+		return fmt.Errorf("error saving mempool tx: %s", err.Error())
 	}
 	return nil
 }
 
-func (w *Wallet) updateUTXO(key string, utxo tx.UTXO) error {
-	jsonbytes, err := json.Marshal(utxo)
+func (w *Wallet) deleteMempoolTx(txid string) error {
+	if err := w.db.Update(func(tx *bolt.Tx) error {
+		mempoolb := tx.Bucket([]byte(mempoolBucket))
+		return mempoolb.Delete([]byte(txid))
+	}); err != nil {
+		return fmt.Errorf("error deleting mempool tx: %s", err.Error())
+	}
+	return nil
+}
+
+func (w *Wallet) loadMempoolTxs() error {
+	if err := w.db.View(func(tx *bolt.Tx) error {
+		mempoolb := tx.Bucket([]byte(mempoolBucket))
+
+		c := mempoolb.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			msgTx := wire.NewMsgTx(wire.TxVersion)
+			if err := msgTx.Deserialize(bytes.NewReader(v)); err != nil {
+				return fmt.Errorf("error loading mempool txs: %s", err.Error())
+			}
+			w.mempoolTxs[string(k)] = msgTx
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (w *Wallet) saveTxRecord(record *TxRecord) error {
+	jsonbytes, err := json.Marshal(record)
 	if err != nil {
-		return fmt.Errorf("error marshalling utxo: %s", err.Error())
+		return fmt.Errorf("error marshalling tx record: %s", err.Error())
 	}
 
 	if err := w.db.Update(func(tx *bolt.Tx) error {
-		utxosb := tx.Bucket([]byte(utxosBucket))
-		keyb := []byte(key)
-		val := utxosb.Get(keyb)
+		txsb := tx.Bucket([]byte(transactionsBucket))
+		return txsb.Put([]byte(record.TxID), jsonbytes)
+	}); err != nil {
+		return fmt.Errorf("error saving tx record: %s", err.Error())
+	}
+	return nil
+}
 
-		// only put if utxo already exists
-		if val != nil {
-			err := utxosb.Put(keyb, jsonbytes)
-			if err != nil {
-				return err
+// getTxRecord returns the record of tx with txid or nil if not found
+func (w *Wallet) getTxRecord(txid string) *TxRecord {
+	var record *TxRecord
+
+	w.db.View(func(tx *bolt.Tx) error {
+		txsb := tx.Bucket([]byte(transactionsBucket))
+		recordBytes := txsb.Get([]byte(txid))
+		if recordBytes == nil {
+			return nil
+		}
+		record = &TxRecord{}
+		if err := json.Unmarshal(recordBytes, record); err != nil {
+			record = nil
+			return err
+		}
+		return nil
+	})
+
+	return record
+}
+
+func (w *Wallet) loadTxRecords() ([]TxRecord, error) {
+	records := []TxRecord{}
+
+	if err := w.db.View(func(tx *bolt.Tx) error {
+		txsb := tx.Bucket([]byte(transactionsBucket))
+
+		c := txsb.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var record TxRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return fmt.Errorf("error loading tx records: %s", err.Error())
 			}
-		} else {
-			return fmt.Errorf("utxo does not exist")
+			records = append(records, record)
 		}
 		return nil
 	}); err != nil {
-		return fmt.Errorf("error updating utxo: %s", err.Error())
+		return nil, err
 	}
-	return nil
+	return records, nil
 }
 
 func (w *Wallet) loadUTXOs() error {
@@ -397,3 +1022,173 @@ func (w *Wallet) loadUTXOs() error {
 	w.utxos = utxos
 	return nil
 }
+
+func (w *Wallet) savePendingBroadcast(pending *pendingBroadcast) error {
+	jsonbytes, err := json.Marshal(pending)
+	if err != nil {
+		return fmt.Errorf("error marshalling pending broadcast: %s", err.Error())
+	}
+
+	if err := w.db.Update(func(tx *bolt.Tx) error {
+		pendingb := tx.Bucket([]byte(pendingBroadcastsBucket))
+		return pendingb.Put([]byte(pending.TxID), jsonbytes)
+	}); err != nil {
+		return fmt.Errorf("error saving pending broadcast: %s", err.Error())
+	}
+	return nil
+}
+
+func (w *Wallet) deletePendingBroadcast(txid string) error {
+	if err := w.db.Update(func(tx *bolt.Tx) error {
+		pendingb := tx.Bucket([]byte(pendingBroadcastsBucket))
+		return pendingb.Delete([]byte(txid))
+	}); err != nil {
+		return fmt.Errorf("error deleting pending broadcast: %s", err.Error())
+	}
+	return nil
+}
+
+func (w *Wallet) loadPendingBroadcasts() ([]pendingBroadcast, error) {
+	pending := []pendingBroadcast{}
+
+	if err := w.db.View(func(tx *bolt.Tx) error {
+		pendingb := tx.Bucket([]byte(pendingBroadcastsBucket))
+
+		c := pendingb.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var pb pendingBroadcast
+			if err := json.Unmarshal(v, &pb); err != nil {
+				return fmt.Errorf("error loading pending broadcasts: %s", err.Error())
+			}
+			pending = append(pending, pb)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+// saveDroppedTxs saves the changes of the dropped txs in the db
+func (w *Wallet) saveDroppedTxs(dropped *droppedTxs, replacedBy string) error {
+	if err := w.db.Update(func(dbtx *bolt.Tx) error {
+		return putDroppedTxs(dbtx, dropped, replacedBy)
+	}); err != nil {
+		return fmt.Errorf("error saving dropped txs: %s", err.Error())
+	}
+	return nil
+}
+
+// putDroppedTxs removes the UTXOs created by the dropped txs, unspends the
+// UTXOs spent by them and marks their records as dropped. If replacedBy
+// is set, the record of the first dropped tx is marked as replaced by it
+func putDroppedTxs(dbtx *bolt.Tx, dropped *droppedTxs, replacedBy string) error {
+	for _, outpoint := range dropped.removed {
+		if err := deleteUTXOTx(dbtx, outpoint); err != nil {
+			return err
+		}
+	}
+	for _, utxo := range dropped.unspent {
+		if err := putUTXO(dbtx, utxo); err != nil {
+			return err
+		}
+	}
+
+	mempoolb := dbtx.Bucket([]byte(mempoolBucket))
+	txsb := dbtx.Bucket([]byte(transactionsBucket))
+	for i, txid := range dropped.txids {
+		if err := mempoolb.Delete([]byte(txid)); err != nil {
+			return err
+		}
+
+		recordBytes := txsb.Get([]byte(txid))
+		if recordBytes == nil {
+			continue
+		}
+		var record TxRecord
+		if err := json.Unmarshal(recordBytes, &record); err != nil {
+			return err
+		}
+		record.Dropped = true
+		if i == 0 && replacedBy != "" {
+			record.ReplacedBy = replacedBy
+		}
+		recordBytes, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		if err := txsb.Put([]byte(txid), recordBytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commitSentTxDB saves in a single db transaction all the changes to the
+// wallet from a tx it sent: spent UTXOs, change UTXO and key, change
+// descriptor, tx record and unconfirmed tx. The pending broadcast is removed.
+// If the tx replaces another one, the replaced tx is dropped too
+func (w *Wallet) commitSentTxDB(spent []tx.UTXO, change *changeOutput, changeUTXO *tx.UTXO,
+	changeDescriptor *walletDescriptor, record *TxRecord, serializedTx []byte, replaced *droppedTxs) error {
+	if err := w.db.Update(func(dbtx *bolt.Tx) error {
+		for _, utxo := range spent {
+			if err := putUTXO(dbtx, utxo); err != nil {
+				return err
+			}
+		}
+
+		if changeUTXO != nil {
+			if err := putUTXO(dbtx, *changeUTXO); err != nil {
+				return err
+			}
+			keyPairBytes, err := json.Marshal(change.KeyPair)
+			if err != nil {
+				return err
+			}
+			keysb := dbtx.Bucket([]byte(keysBucket))
+			if err := keysb.Put([]byte(change.Path), keyPairBytes); err != nil {
+				return err
+			}
+			if err := putDescriptor(dbtx, *changeDescriptor); err != nil {
+				return err
+			}
+		}
+
+		if replaced != nil {
+			if err := putDroppedTxs(dbtx, replaced, record.TxID); err != nil {
+				return err
+			}
+		}
+
+		recordBytes, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		txsb := dbtx.Bucket([]byte(transactionsBucket))
+		if err := txsb.Put([]byte(record.TxID), recordBytes); err != nil {
+			return err
+		}
+
+		mempoolb := dbtx.Bucket([]byte(mempoolBucket))
+		if err := mempoolb.Put([]byte(record.TxID), serializedTx); err != nil {
+			return err
+		}
+
+		pendingb := dbtx.Bucket([]byte(pendingBroadcastsBucket))
+		return pendingb.Delete([]byte(record.TxID))
+	}); err != nil {
+		return fmt.Errorf("error saving sent tx: %s", err.Error())
+	}
+	return nil
+}
+
+// countTxRecords returns the number of txs in the wallet history
+func (w *Wallet) countTxRecords() int {
+	count := 0
+	w.db.View(func(tx *bolt.Tx) error {
+		txsb := tx.Bucket([]byte(transactionsBucket))
+		count = txsb.Stats().KeyN
+		return nil
+	})
+	return count
+}
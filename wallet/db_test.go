@@ -0,0 +1,126 @@
+package wallet
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/elnosh/btcw/tx"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBalanceInvariant(t *testing.T) {
+	utxoA := *tx.NewUTXO("aa", 0, 50000, nil, "")
+	utxoB := *tx.NewUTXO("bb", 1, 30000, nil, "")
+	spentA := utxoA
+	spentA.Spent = true
+	spentA.SpentBy = "cc"
+	biggerB := utxoB
+	biggerB.Value = 45000
+
+	put := func(utxo tx.UTXO) func(*bolt.Tx) error {
+		return func(dbtx *bolt.Tx) error { return putUTXO(dbtx, utxo) }
+	}
+	del := func(key string) func(*bolt.Tx) error {
+		return func(dbtx *bolt.Tx) error { return deleteUTXOTx(dbtx, key) }
+	}
+
+	tests := []struct {
+		name          string
+		ops           []func(*bolt.Tx) error
+		wantedBalance btcutil.Amount
+	}{
+		{
+			name:          "put utxos",
+			ops:           []func(*bolt.Tx) error{put(utxoA), put(utxoB)},
+			wantedBalance: 80000,
+		},
+		{
+			name:          "put same utxo twice",
+			ops:           []func(*bolt.Tx) error{put(utxoA), put(utxoA)},
+			wantedBalance: 50000,
+		},
+		{
+			name:          "spend utxo",
+			ops:           []func(*bolt.Tx) error{put(utxoA), put(utxoB), put(spentA)},
+			wantedBalance: 30000,
+		},
+		{
+			name:          "unspend utxo",
+			ops:           []func(*bolt.Tx) error{put(utxoA), put(spentA), put(utxoA)},
+			wantedBalance: 50000,
+		},
+		{
+			name:          "update value",
+			ops:           []func(*bolt.Tx) error{put(utxoB), put(biggerB)},
+			wantedBalance: 45000,
+		},
+		{
+			name:          "delete unspent utxo",
+			ops:           []func(*bolt.Tx) error{put(utxoA), put(utxoB), del(utxoB.GetOutpoint())},
+			wantedBalance: 50000,
+		},
+		{
+			name:          "delete spent utxo",
+			ops:           []func(*bolt.Tx) error{put(utxoA), put(utxoB), put(spentA), del(spentA.GetOutpoint())},
+			wantedBalance: 30000,
+		},
+		{
+			name:          "delete missing utxo",
+			ops:           []func(*bolt.Tx) error{put(utxoA), del(utxoB.GetOutpoint()), del(utxoB.GetOutpoint())},
+			wantedBalance: 50000,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w, _ := newTestWallet(t)
+			for i, op := range test.ops {
+				if err := w.db.Update(op); err != nil {
+					t.Fatalf("error in operation %v: %v", i, err)
+				}
+				utxosBalance, storedBalance, _, err := w.checkBalanceDB(false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if utxosBalance != storedBalance {
+					t.Fatalf("stored balance does not match utxos after operation %v - utxos: %v, stored: %v",
+						i, utxosBalance, storedBalance)
+				}
+			}
+			if balance := w.getBalance(); balance != test.wantedBalance {
+				t.Errorf("balance does not match - expected: %v, got: %v", test.wantedBalance, balance)
+			}
+		})
+	}
+}
+
+func TestCheckBalanceRepair(t *testing.T) {
+	w, client := newTestWallet(t)
+	fundWallet(t, w, client, "", 70000)
+
+	// stored balance out of sync with the utxos
+	if err := w.db.Update(func(dbtx *bolt.Tx) error {
+		return addToBalance(dbtx, 1000)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	check, err := w.CheckWallet(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if check.Consistent {
+		t.Fatal("expected balance to be inconsistent")
+	}
+
+	if _, err := w.CheckWallet(true); err != nil {
+		t.Fatal(err)
+	}
+	utxosBalance, storedBalance, _, err := w.checkBalanceDB(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if utxosBalance != 70000 || storedBalance != 70000 {
+		t.Errorf("expected repaired balance of 70000 - utxos: %v, stored: %v", utxosBalance, storedBalance)
+	}
+}
@@ -0,0 +1,449 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/elnosh/btcw/descriptor"
+	"github.com/elnosh/btcw/tx"
+	"github.com/elnosh/btcw/utils"
+)
+
+const (
+	// ids of the descriptors of the receive and change addresses of account 0
+	// created with the wallet. They match the chain in the BIP-44 path of their keys
+	receiveDescriptorID uint32 = 0
+	changeDescriptorID  uint32 = 1
+
+	// type of the addresses given out if none is set
+	defaultAddressType = "bech32"
+)
+
+// walletDescriptor is an output descriptor stored in the wallet. The
+// keys from RangeStart to RangeEnd (not included) are derived and
+// their addresses tracked. Ranged descriptors give out keys from NextIndex
+type walletDescriptor struct {
+	ID uint32 `json:"id"`
+	// descriptor with public keys and checksum
+	Desc string `json:"desc"`
+	// descriptor with private keys encrypted with the master key.
+	// Only set for imported descriptors with private keys
+	EncryptedDesc []byte `json:"encrypted_desc,omitempty"`
+	// new addresses or change of the address type of the descriptor are from it
+	Active   bool `json:"active"`
+	Internal bool `json:"internal"`
+
+	NextIndex  uint32 `json:"next_index"`
+	RangeStart uint32 `json:"range_start"`
+	RangeEnd   uint32 `json:"range_end"`
+	// time it was added to the wallet
+	Timestamp int64 `json:"timestamp"`
+
+	parsed *descriptor.Descriptor
+}
+
+// Descriptor is an output descriptor of the wallet
+type Descriptor struct {
+	Desc      string `json:"desc"`
+	Timestamp int64  `json:"timestamp"`
+	// addresses of the descriptor are given out by the wallet
+	Active   bool `json:"active"`
+	Internal bool `json:"internal"`
+	// indexes of the keys watched by the wallet. end is included.
+	// Only set for ranged descriptors
+	Range *[2]uint32 `json:"range,omitempty"`
+	// index of the next key to be given out
+	Next *uint32 `json:"next,omitempty"`
+}
+
+// GetXpub returns the extended public key of account 0 with its key
+// origin: [fingerprint/44'/1'/0']tpub... Wallets created before it was
+// saved need to be unlocked the first time
+func (w *Wallet) GetXpub() (string, error) {
+	account, err := w.accountXpub()
+	if err != nil {
+		return "", err
+	}
+	return account.String(), nil
+}
+
+// ListDescriptors returns the BIP380 descriptors with checksum of the wallet
+func (w *Wallet) ListDescriptors() ([]Descriptor, error) {
+	w.descriptorsMtx.RLock()
+	defer w.descriptorsMtx.RUnlock()
+
+	descriptors := make([]Descriptor, 0, len(w.descriptors))
+	for _, wd := range w.sortedDescriptors() {
+		desc := Descriptor{
+			Desc:      wd.Desc,
+			Timestamp: wd.Timestamp,
+			Active:    wd.Active,
+			Internal:  wd.Internal,
+		}
+		if wd.parsed.IsRange() {
+			next := wd.NextIndex
+			desc.Range = &[2]uint32{wd.RangeStart, max(wd.RangeEnd, wd.RangeStart+1) - 1}
+			desc.Next = &next
+		}
+		descriptors = append(descriptors, desc)
+	}
+	return descriptors, nil
+}
+
+// sortedDescriptors returns the descriptors of the wallet
+// sorted by id. Callers must hold descriptorsMtx
+func (w *Wallet) sortedDescriptors() []walletDescriptor {
+	descriptors := make([]walletDescriptor, 0, len(w.descriptors))
+	for _, wd := range w.descriptors {
+		descriptors = append(descriptors, wd)
+	}
+	slices.SortFunc(descriptors, func(a, b walletDescriptor) int {
+		return int(a.ID) - int(b.ID)
+	})
+	return descriptors
+}
+
+// defaultDescriptors returns the descriptors of the receive and
+// change addresses of the account: wpkh(account/0/*) and wpkh(account/1/*)
+func defaultDescriptors(account *AccountXpub, net *chaincfg.Params) ([]walletDescriptor, error) {
+	descriptors := make([]walletDescriptor, 0, 2)
+	for _, id := range []uint32{receiveDescriptorID, changeDescriptorID} {
+		parsed, err := descriptor.Parse(fmt.Sprintf("wpkh(%s/%d/*)", account, id), net)
+		if err != nil {
+			return nil, err
+		}
+		descriptors = append(descriptors, walletDescriptor{
+			ID:        id,
+			Desc:      parsed.String(),
+			Active:    true,
+			Internal:  id == changeDescriptorID,
+			Timestamp: time.Now().Unix(),
+			parsed:    parsed,
+		})
+	}
+	return descriptors, nil
+}
+
+// descriptorPath returns the derivation path that identifies the key
+// at index idx of the descriptor with id in the wallet: id/idx
+func descriptorPath(id, idx uint32) derivationPath {
+	return fmt.Sprintf("%d/%d", id, idx)
+}
+
+// parseDescriptorPath returns the descriptor id and the index of a derivation path
+func parseDescriptorPath(path derivationPath) (uint32, uint32, error) {
+	var id, idx uint32
+	if _, err := fmt.Sscanf(path, "%d/%d", &id, &idx); err != nil {
+		return 0, 0, fmt.Errorf("invalid derivation path '%s'", path)
+	}
+	return id, idx, nil
+}
+
+// getDescriptor returns the descriptor with id
+func (w *Wallet) getDescriptor(id uint32) (walletDescriptor, bool) {
+	w.descriptorsMtx.RLock()
+	defer w.descriptorsMtx.RUnlock()
+	wd, ok := w.descriptors[id]
+	return wd, ok
+}
+
+// activeDescriptor returns the active descriptor for the address
+// type of receive addresses or change if internal is set
+func (w *Wallet) activeDescriptor(addressType string, internal bool) (walletDescriptor, bool) {
+	w.descriptorsMtx.RLock()
+	defer w.descriptorsMtx.RUnlock()
+	for _, wd := range w.sortedDescriptors() {
+		if wd.Active && wd.Internal == internal && wd.parsed.AddressType() == addressType {
+			return wd, true
+		}
+	}
+	return walletDescriptor{}, false
+}
+
+// updateDescriptor calls update with a copy of the descriptor with id
+// and replaces the descriptor with it if it returns no error. update
+// has to save it. Descriptors are updated one at a time
+func (w *Wallet) updateDescriptor(id uint32, update func(wd *walletDescriptor) error) error {
+	w.descriptorsMtx.Lock()
+	defer w.descriptorsMtx.Unlock()
+
+	wd, ok := w.descriptors[id]
+	if !ok {
+		return fmt.Errorf("descriptor %v not found", id)
+	}
+	if err := update(&wd); err != nil {
+		return err
+	}
+	w.descriptors[id] = wd
+	return nil
+}
+
+// expandPath returns the descriptor of the key at path
+// and its output script and keys at the index of the path
+func (w *Wallet) expandPath(path derivationPath) (walletDescriptor, *descriptor.Expansion, error) {
+	id, idx, err := parseDescriptorPath(path)
+	if err != nil {
+		return walletDescriptor{}, nil, err
+	}
+	wd, ok := w.getDescriptor(id)
+	if !ok {
+		return walletDescriptor{}, nil, fmt.Errorf("descriptor of key %s not found", path)
+	}
+	expansion, err := wd.parsed.Expand(idx)
+	if err != nil {
+		return walletDescriptor{}, nil, err
+	}
+	return wd, expansion, nil
+}
+
+// deriveKeyPair returns the key pair at index idx of the descriptor
+func deriveKeyPair(wd *walletDescriptor, idx uint32) (*KeyPair, error) {
+	expansion, err := wd.parsed.Expand(idx)
+	if err != nil {
+		return nil, err
+	}
+	if expansion.Address == nil {
+		return nil, errors.New("descriptor has no address")
+	}
+	return newKeyPair(expansion), nil
+}
+
+// deriveKeyPairs returns the key pairs of the descriptor
+// from start to end (not included) by their derivation path
+func deriveKeyPairs(wd *walletDescriptor, start, end uint32) (map[derivationPath]*KeyPair, error) {
+	keyPairs := make(map[derivationPath]*KeyPair, end-start)
+	for idx := start; idx < end; idx++ {
+		keyPair, err := deriveKeyPair(wd, idx)
+		if err != nil {
+			return nil, err
+		}
+		keyPairs[descriptorPath(wd.ID, idx)] = keyPair
+	}
+	return keyPairs, nil
+}
+
+// saveDescriptorKeys derives the keys of the descriptor from start to end
+// (not included) and saves them along with the descriptor in a single db
+// transaction. The addresses of the keys are tracked by the wallet
+func (w *Wallet) saveDescriptorKeys(wd *walletDescriptor, start, end uint32) (map[derivationPath]*KeyPair, error) {
+	keyPairs, err := deriveKeyPairs(wd, start, end)
+	if err != nil {
+		return nil, err
+	}
+	wd.RangeEnd = max(wd.RangeEnd, end)
+
+	if err := w.putDescriptors([]walletDescriptor{*wd}, keyPairs); err != nil {
+		return nil, err
+	}
+	w.trackKeyPairs(keyPairs)
+	return keyPairs, nil
+}
+
+// trackKeyPairs adds the addresses of the key pairs to the addresses of the wallet
+func (w *Wallet) trackKeyPairs(keyPairs map[derivationPath]*KeyPair) {
+	w.addressesMtx.Lock()
+	defer w.addressesMtx.Unlock()
+	for path, keyPair := range keyPairs {
+		w.addresses[keyPair.Address] = path
+	}
+}
+
+// deriveChangeKey derives the key at the next index of the active change
+// descriptor without saving it or updating the index. It uses the one
+// for bech32 addresses if there is one
+func (w *Wallet) deriveChangeKey() (*changeOutput, error) {
+	change, ok := w.activeDescriptor(defaultAddressType, true)
+	if !ok {
+		w.descriptorsMtx.RLock()
+		for _, wd := range w.sortedDescriptors() {
+			if wd.Active && wd.Internal {
+				change, ok = wd, true
+				break
+			}
+		}
+		w.descriptorsMtx.RUnlock()
+	}
+	if !ok {
+		return nil, errors.New("wallet has no active descriptor for change")
+	}
+
+	keyPair, err := deriveKeyPair(&change, change.NextIndex)
+	if err != nil {
+		return nil, err
+	}
+	return &changeOutput{Path: descriptorPath(change.ID, change.NextIndex), KeyPair: keyPair}, nil
+}
+
+// useKey saves the key at path if it was derived but not saved (i.e
+// change of a tx) and moves the next index of its descriptor past it
+func (w *Wallet) useKey(path derivationPath) error {
+	id, idx, err := parseDescriptorPath(path)
+	if err != nil {
+		return err
+	}
+	return w.updateDescriptor(id, func(wd *walletDescriptor) error {
+		wd.NextIndex = max(wd.NextIndex, idx+1)
+		_, err := w.saveDescriptorKeys(wd, idx, idx+1)
+		return err
+	})
+}
+
+// markKeyUsed moves the next index of the ranged descriptor
+// of the key at path past it if it is not already
+func (w *Wallet) markKeyUsed(path derivationPath) error {
+	id, idx, err := parseDescriptorPath(path)
+	if err != nil {
+		return err
+	}
+	return w.updateDescriptor(id, func(wd *walletDescriptor) error {
+		if !wd.parsed.IsRange() || idx < wd.NextIndex {
+			return nil
+		}
+		wd.NextIndex = idx + 1
+		wd.RangeEnd = max(wd.RangeEnd, idx+1)
+		return w.putDescriptors([]walletDescriptor{*wd}, nil)
+	})
+}
+
+// isChange returns true if the key at path is from an internal descriptor
+func (w *Wallet) isChange(path derivationPath) bool {
+	id, _, err := parseDescriptorPath(path)
+	if err != nil {
+		return false
+	}
+	wd, ok := w.getDescriptor(id)
+	return ok && wd.Internal
+}
+
+// inputWeight returns the estimated weight of an input spending an
+// output to the key at path. 0 if its descriptor is not found
+func (w *Wallet) inputWeight(path derivationPath) int64 {
+	id, _, err := parseDescriptorPath(path)
+	if err != nil {
+		return 0
+	}
+	wd, ok := w.getDescriptor(id)
+	if !ok {
+		return 0
+	}
+	return wd.parsed.InputWeight()
+}
+
+// newUTXO returns a UTXO of the key at path with the
+// weight of the input spending it from its descriptor
+func (w *Wallet) newUTXO(txid string, vout uint32, value btcutil.Amount, pkScript []byte, path derivationPath) *tx.UTXO {
+	utxo := tx.NewUTXO(txid, vout, value, pkScript, path)
+	utxo.InputWeight = w.inputWeight(path)
+	return utxo
+}
+
+// signingKeys returns the private keys of the keys of the descriptor at
+// index idx in the order of the script. Keys the wallet can't sign with are
+// nil. Private keys come from the imported descriptor or are derived from
+// the master key if the key is from it. The decrypted descriptor and master
+// key are wiped on return. Callers should zero the keys once they are done
+// with them. The wallet needs to be unlocked
+func (w *Wallet) signingKeys(wd *walletDescriptor, idx uint32) ([]*btcec.PrivateKey, error) {
+	if w.keys.isLocked() {
+		return nil, ErrWalletLocked
+	}
+
+	desc := wd.parsed
+	if wd.EncryptedDesc != nil {
+		var err error
+		if desc, err = w.decryptDescriptor(wd.EncryptedDesc); err != nil {
+			return nil, err
+		}
+		defer desc.Zero()
+	}
+	expansion, err := desc.Expand(idx)
+	if err != nil {
+		return nil, err
+	}
+
+	privKeys := make([]*btcec.PrivateKey, len(expansion.Keys))
+	var master *hdkeychain.ExtendedKey
+	defer func() {
+		if master != nil {
+			master.Zero()
+		}
+	}()
+	for i, key := range expansion.Keys {
+		if key.PrivKey != nil {
+			// single keys are shared with the descriptor
+			privKeys[i], _ = btcec.PrivKeyFromBytes(key.PrivKey.Serialize())
+			continue
+		}
+		if w.watchOnly {
+			continue
+		}
+		fingerprint, err := w.masterFingerprint()
+		if err != nil {
+			return nil, err
+		}
+		if key.Fingerprint != fingerprint {
+			continue
+		}
+
+		if master == nil {
+			if master, err = w.getDecryptedMasterKey(); err != nil {
+				return nil, err
+			}
+		}
+		derived, err := deriveKeyPath(master, key.Path)
+		if err != nil {
+			return nil, err
+		}
+		privKey, err := derived.ECPrivKey()
+		if err != nil {
+			return nil, err
+		}
+		// fingerprints can collide
+		if privKey.PubKey().IsEqual(key.PubKey) {
+			privKeys[i] = privKey
+		}
+	}
+	return privKeys, nil
+}
+
+// encryptDescriptor encrypts the descriptor with its private
+// keys with the master key. The wallet needs to be unlocked
+func (w *Wallet) encryptDescriptor(desc *descriptor.Descriptor) ([]byte, error) {
+	private, err := desc.PrivateString()
+	if err != nil {
+		return nil, err
+	}
+
+	var encrypted []byte
+	if err := w.keys.withMasterKey(func(masterKey []byte) error {
+		encrypted, err = utils.Encrypt([]byte(private), masterKey)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return encrypted, nil
+}
+
+// decryptDescriptor returns the descriptor with private keys
+// encrypted with the master key. The wallet needs to be unlocked
+func (w *Wallet) decryptDescriptor(encrypted []byte) (*descriptor.Descriptor, error) {
+	var desc *descriptor.Descriptor
+	if err := w.keys.withMasterKey(func(masterKey []byte) error {
+		decrypted, err := utils.Decrypt(encrypted, masterKey)
+		if err != nil {
+			return err
+		}
+		defer utils.Wipe(decrypted)
+		desc, err = descriptor.Parse(string(decrypted), w.network)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("error decrypting descriptor: %v", err)
+	}
+	return desc, nil
+}
@@ -0,0 +1,433 @@
+package wallet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/elnosh/btcw/tx"
+	"github.com/elnosh/btcw/utils"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/term"
+)
+
+// versions of the wallet format. Version 0 wallets encrypted the HD keys
+// and private keys with the key from the passphrase hash stored in the db.
+// Version 1 wallets encrypt the HD keys with a random master key that is
+// encrypted with a key derived from the passphrase. Version 2 wallets
+// derive their keys from output descriptors instead of the account chains
+const (
+	encryptionWalletVersion  uint32 = 1
+	descriptorsWalletVersion uint32 = 2
+	currentWalletVersion            = descriptorsWalletVersion
+)
+
+var (
+	ErrInvalidPassphrase = errors.New("invalid passphrase")
+)
+
+// walletAuth holds what is stored in the auth bucket
+type walletAuth struct {
+	// hash to verify the passphrase. It uses a different salt
+	// than the kdf so it does not reveal the encryption key
+	encodedHash string
+	// params and salt to derive the key that encrypts the master key
+	kdf                string
+	encryptedMasterKey []byte
+}
+
+// newWalletAuth generates a random master key and encrypts it with a key
+// derived from the passphrase. It returns the master key and the
+// auth info to store
+func newWalletAuth(passphrase []byte) ([]byte, *walletAuth, error) {
+	masterKey, err := utils.NewMasterKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	auth, err := wrapMasterKey(passphrase, masterKey, utils.DefaultArgon2Params())
+	if err != nil {
+		return nil, nil, err
+	}
+	return masterKey, auth, nil
+}
+
+// wrapMasterKey encrypts the master key with a key derived from the
+// passphrase using the argon2 cost parameters passed
+func wrapMasterKey(passphrase, masterKey []byte, params utils.Argon2Params) (*walletAuth, error) {
+	encodedHash, err := utils.HashPassphraseWithParams(passphrase, params)
+	if err != nil {
+		return nil, err
+	}
+
+	kdf, err := utils.NewKDFWithParams(params)
+	if err != nil {
+		return nil, err
+	}
+	passKey, err := utils.DeriveKey(passphrase, kdf)
+	if err != nil {
+		return nil, err
+	}
+	defer utils.Wipe(passKey)
+
+	encryptedMasterKey, err := utils.Encrypt(masterKey, passKey)
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting master key: %v", err)
+	}
+
+	return &walletAuth{encodedHash: encodedHash, kdf: kdf, encryptedMasterKey: encryptedMasterKey}, nil
+}
+
+// unwrapMasterKey verifies the passphrase and returns the
+// master key decrypted with the key derived from it
+func (w *Wallet) unwrapMasterKey(passphrase []byte) ([]byte, error) {
+	encodedHash := string(w.getEncodedHash())
+	if !utils.VerifyPassphrase(encodedHash, string(passphrase)) {
+		return nil, ErrInvalidPassphrase
+	}
+
+	kdf := w.getAuth(kdfKey)
+	encryptedMasterKey := w.getAuth(encryptedMasterKeyKey)
+	if kdf == nil || encryptedMasterKey == nil {
+		return nil, errors.New("encrypted master key not found")
+	}
+
+	passKey, err := utils.DeriveKey(passphrase, string(kdf))
+	if err != nil {
+		return nil, err
+	}
+	defer utils.Wipe(passKey)
+
+	masterKey, err := utils.Decrypt(encryptedMasterKey, passKey)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting master key: %v", err)
+	}
+	return masterKey, nil
+}
+
+// kdfParams returns the argon2 cost parameters currently
+// used to derive the key that encrypts the master key
+func (w *Wallet) kdfParams() (utils.Argon2Params, error) {
+	return utils.KDFParams(string(w.getAuth(kdfKey)))
+}
+
+// changePassphrase verifies the old passphrase and replaces the master key
+// with a new one encrypted with the new passphrase. HD keys and imported
+// private descriptors are re-encrypted with the new master key in the same
+// db transaction. It returns the new master key
+func (w *Wallet) changePassphrase(oldPassphrase, newPassphrase []byte, params utils.Argon2Params) ([]byte, error) {
+	oldMasterKey, err := w.unwrapMasterKey(oldPassphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer utils.Wipe(oldMasterKey)
+
+	newMasterKey, err := utils.NewMasterKey()
+	if err != nil {
+		return nil, err
+	}
+	auth, err := wrapMasterKey(newPassphrase, newMasterKey, params)
+	if err != nil {
+		utils.Wipe(newMasterKey)
+		return nil, err
+	}
+
+	w.descriptorsMtx.Lock()
+	defer w.descriptorsMtx.Unlock()
+	reencrypted := make(map[uint32][]byte)
+
+	if err := w.db.Update(func(tx *bolt.Tx) error {
+		for id, wd := range w.descriptors {
+			if wd.EncryptedDesc == nil {
+				continue
+			}
+			decrypted, err := utils.Decrypt(wd.EncryptedDesc, oldMasterKey)
+			if err != nil {
+				return err
+			}
+			encrypted, err := utils.Encrypt(decrypted, newMasterKey)
+			utils.Wipe(decrypted)
+			if err != nil {
+				return err
+			}
+			wd.EncryptedDesc = encrypted
+			if err := putDescriptor(tx, wd); err != nil {
+				return err
+			}
+			reencrypted[id] = encrypted
+		}
+
+		walletMetadata := tx.Bucket([]byte(walletMetadataBucket))
+		for _, key := range []string{masterSeedKey, account0ExternelKey, account0InternalKey} {
+			decrypted, err := utils.Decrypt(walletMetadata.Get([]byte(key)), oldMasterKey)
+			if err != nil {
+				return err
+			}
+			encrypted, err := utils.Encrypt(decrypted, newMasterKey)
+			utils.Wipe(decrypted)
+			if err != nil {
+				return err
+			}
+			if err := walletMetadata.Put([]byte(key), encrypted); err != nil {
+				return err
+			}
+		}
+		return putWalletAuth(tx, auth)
+	}); err != nil {
+		utils.Wipe(newMasterKey)
+		return nil, fmt.Errorf("error changing passphrase: %v", err)
+	}
+
+	for id, encrypted := range reencrypted {
+		wd := w.descriptors[id]
+		wd.EncryptedDesc = encrypted
+		w.descriptors[id] = wd
+	}
+	return newMasterKey, nil
+}
+
+// migrateEncryption upgrades a version 0 wallet with the passphrase
+// asked in the terminal
+func (w *Wallet) migrateEncryption() error {
+	fmt.Println("wallet needs to be upgraded to a new encryption scheme. enter passphrase for wallet: ")
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	if err != nil {
+		return ErrPass
+	}
+	return w.upgradeEncryption(passphrase)
+}
+
+// upgradeEncryption verifies the passphrase of a version 0 wallet and
+// re-encrypts the HD keys with a new random master key. Encrypted private
+// keys are removed since they are derived from the HD keys when signing.
+// Everything is done in a single db transaction
+func (w *Wallet) upgradeEncryption(passphrase []byte) error {
+	encodedHash := string(w.getEncodedHash())
+	if !utils.VerifyPassphrase(encodedHash, string(passphrase)) {
+		return ErrInvalidPassphrase
+	}
+	// version 0 wallets used the key in the hash to encrypt
+	_, legacyKey, _, err := utils.DecodeHash(encodedHash)
+	if err != nil {
+		return fmt.Errorf("error decoding key: %v", err)
+	}
+
+	masterKey, auth, err := newWalletAuth(passphrase)
+	if err != nil {
+		return err
+	}
+	defer utils.Wipe(masterKey)
+
+	if err := w.db.Update(func(tx *bolt.Tx) error {
+		walletMetadata := tx.Bucket([]byte(walletMetadataBucket))
+
+		hdKeys := make([]*hdkeychain.ExtendedKey, 3)
+		for i, key := range []string{masterSeedKey, account0ExternelKey, account0InternalKey} {
+			decrypted, err := utils.Decrypt(walletMetadata.Get([]byte(key)), legacyKey)
+			if err != nil {
+				return err
+			}
+			hdKeys[i], err = hdkeychain.NewKeyFromString(string(decrypted))
+			if err != nil {
+				return err
+			}
+		}
+
+		encryptedMaster, encryptedAcct0ext, encryptedAcct0int, err := EncryptHDKeys(masterKey, hdKeys[0], hdKeys[1], hdKeys[2])
+		if err != nil {
+			return err
+		}
+		if err := walletMetadata.Put([]byte(masterSeedKey), encryptedMaster); err != nil {
+			return err
+		}
+		if err := walletMetadata.Put([]byte(account0ExternelKey), encryptedAcct0ext); err != nil {
+			return err
+		}
+		if err := walletMetadata.Put([]byte(account0InternalKey), encryptedAcct0int); err != nil {
+			return err
+		}
+
+		// rewrite key pairs without the encrypted private keys
+		keysb := tx.Bucket([]byte(keysBucket))
+		keyPairs := make(map[string][]byte)
+		c := keysb.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var kp KeyPair
+			if err := json.Unmarshal(v, &kp); err != nil {
+				return err
+			}
+			jsonbytes, err := json.Marshal(kp)
+			if err != nil {
+				return err
+			}
+			keyPairs[string(k)] = jsonbytes
+		}
+		for path, jsonbytes := range keyPairs {
+			if err := keysb.Put([]byte(path), jsonbytes); err != nil {
+				return err
+			}
+		}
+
+		if err := putWalletAuth(tx, auth); err != nil {
+			return err
+		}
+		if err := putMasterFingerprint(tx, hdKeys[0]); err != nil {
+			return err
+		}
+		if err := putAccount0Xpub(tx, hdKeys[0]); err != nil {
+			return err
+		}
+		return putWalletVersion(tx, encryptionWalletVersion)
+	}); err != nil {
+		return fmt.Errorf("error upgrading wallet encryption: %v", err)
+	}
+
+	w.LogInfo("upgraded wallet to version %v", encryptionWalletVersion)
+	return nil
+}
+
+// migrateDescriptors upgrades a version 1 wallet. The external and internal
+// chains of account 0 are replaced by wpkh() descriptors of the account and
+// keys, UTXOs and pending broadcasts are moved to the derivation paths of
+// the descriptors. Wallets that did not save the account extended public key
+// ask for the passphrase to derive it. Everything is done in a single db transaction
+func (w *Wallet) migrateDescriptors() error {
+	if !w.watchOnly && (w.getMasterFingerprint() == nil || w.getAccount0Xpub() == nil) {
+		fmt.Println("wallet needs to be upgraded to use output descriptors. enter passphrase for wallet: ")
+		passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+		if err != nil {
+			return ErrPass
+		}
+		masterKey, err := w.unwrapMasterKey(passphrase)
+		if err != nil {
+			return err
+		}
+		// locked again once the upgrade is done
+		w.keys.unlock(masterKey, time.Minute)
+		defer w.keys.lock()
+	}
+
+	account, err := w.accountXpub()
+	if err != nil {
+		return err
+	}
+	descriptors, err := defaultDescriptors(account, w.network)
+	if err != nil {
+		return err
+	}
+
+	if err := w.db.Update(func(dbtx *bolt.Tx) error {
+		walletMetadata := dbtx.Bucket([]byte(walletMetadataBucket))
+
+		// keys were named by their BIP-44 path: m/44'/1'/0'/chain/idx. Change keys
+		// of pending broadcasts may not be saved yet so paths are parsed
+		parsePath := func(path string) (uint32, uint32, bool) {
+			var chain, idx uint32
+			if _, err := fmt.Sscanf(path, "m/44'/1'/0'/%d/%d", &chain, &idx); err != nil || chain > changeDescriptorID {
+				return 0, 0, false
+			}
+			return chain, idx, true
+		}
+		migratePath := func(path string) derivationPath {
+			if chain, idx, ok := parsePath(path); ok {
+				return descriptorPath(chain, idx)
+			}
+			return path
+		}
+
+		keysb := dbtx.Bucket([]byte(keysBucket))
+		keyPairs := make(map[string][]byte)
+		rangeEnd := make(map[uint32]uint32)
+		c := keysb.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			chain, idx, ok := parsePath(string(k))
+			if !ok {
+				return fmt.Errorf("invalid derivation path '%s'", k)
+			}
+			keyPairs[string(k)] = v
+			rangeEnd[chain] = max(rangeEnd[chain], idx+1)
+		}
+		for path, v := range keyPairs {
+			if err := keysb.Delete([]byte(path)); err != nil {
+				return err
+			}
+			if err := keysb.Put([]byte(migratePath(path)), v); err != nil {
+				return err
+			}
+		}
+
+		for _, wd := range descriptors {
+			lastIdxKey := lastExternalIdxKey
+			if wd.Internal {
+				lastIdxKey = lastInternalIdxKey
+			}
+			wd.NextIndex = utils.BytesToUint32(walletMetadata.Get([]byte(lastIdxKey)))
+			wd.RangeEnd = max(wd.NextIndex, rangeEnd[wd.ID])
+			if err := putDescriptor(dbtx, wd); err != nil {
+				return err
+			}
+		}
+
+		utxosb := dbtx.Bucket([]byte(utxosBucket))
+		utxos := make(map[string][]byte)
+		c = utxosb.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var utxo tx.UTXO
+			if err := json.Unmarshal(v, &utxo); err != nil {
+				return err
+			}
+			utxo.DerivationPath = migratePath(utxo.DerivationPath)
+			jsonbytes, err := json.Marshal(utxo)
+			if err != nil {
+				return err
+			}
+			utxos[string(k)] = jsonbytes
+		}
+		for k, v := range utxos {
+			if err := utxosb.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+
+		pendingb := dbtx.Bucket([]byte(pendingBroadcastsBucket))
+		pending := make(map[string][]byte)
+		c = pendingb.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var pb pendingBroadcast
+			if err := json.Unmarshal(v, &pb); err != nil {
+				return err
+			}
+			for i := range pb.Inputs {
+				pb.Inputs[i].DerivationPath = migratePath(pb.Inputs[i].DerivationPath)
+			}
+			if pb.Change != nil {
+				pb.Change.Path = migratePath(pb.Change.Path)
+			}
+			jsonbytes, err := json.Marshal(pb)
+			if err != nil {
+				return err
+			}
+			pending[string(k)] = jsonbytes
+		}
+		for k, v := range pending {
+			if err := pendingb.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+
+		for _, key := range []string{lastExternalIdxKey, lastInternalIdxKey, account0ExtXpubKey, account0IntXpubKey} {
+			if err := walletMetadata.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return putWalletVersion(dbtx, descriptorsWalletVersion)
+	}); err != nil {
+		return fmt.Errorf("error upgrading wallet to descriptors: %v", err)
+	}
+
+	w.LogInfo("upgraded wallet to version %v", descriptorsWalletVersion)
+	return nil
+}
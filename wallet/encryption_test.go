@@ -0,0 +1,504 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/elnosh/btcw/tx"
+	"github.com/elnosh/btcw/utils"
+	bolt "go.etcd.io/bbolt"
+)
+
+// legacyPath returns the BIP-44 path keys of the default
+// descriptors were named by in version 1 wallets
+func legacyPath(t *testing.T, path derivationPath) string {
+	t.Helper()
+
+	id, idx, err := parseDescriptorPath(path)
+	if err != nil || id > changeDescriptorID {
+		t.Fatalf("path %s is not from a default descriptor", path)
+	}
+	return fmt.Sprintf("m/44'/1'/0'/%d/%d", id, idx)
+}
+
+// downgradeToV1 rewrites the db of the wallet to the layout of a version 1
+// wallet: keys, UTXOs and pending broadcasts use BIP-44 paths, there are no
+// descriptors and the last indexes of the chains are in the metadata
+func downgradeToV1(t *testing.T, w *Wallet) {
+	t.Helper()
+
+	if err := w.db.Update(func(dbtx *bolt.Tx) error {
+		rewrite := func(bucket string, update func(k, v []byte) (string, []byte, error)) error {
+			b := dbtx.Bucket([]byte(bucket))
+			entries := make(map[string][]byte)
+			c := b.Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				entries[string(k)] = v
+			}
+			for k, v := range entries {
+				newKey, newValue, err := update([]byte(k), v)
+				if err != nil {
+					return err
+				}
+				if err := b.Delete([]byte(k)); err != nil {
+					return err
+				}
+				if err := b.Put([]byte(newKey), newValue); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		if err := rewrite(keysBucket, func(k, v []byte) (string, []byte, error) {
+			return legacyPath(t, string(k)), v, nil
+		}); err != nil {
+			return err
+		}
+		if err := rewrite(utxosBucket, func(k, v []byte) (string, []byte, error) {
+			var utxo tx.UTXO
+			if err := json.Unmarshal(v, &utxo); err != nil {
+				return "", nil, err
+			}
+			utxo.DerivationPath = legacyPath(t, utxo.DerivationPath)
+			v, err := json.Marshal(utxo)
+			return string(k), v, err
+		}); err != nil {
+			return err
+		}
+		if err := rewrite(pendingBroadcastsBucket, func(k, v []byte) (string, []byte, error) {
+			var pb pendingBroadcast
+			if err := json.Unmarshal(v, &pb); err != nil {
+				return "", nil, err
+			}
+			for i := range pb.Inputs {
+				pb.Inputs[i].DerivationPath = legacyPath(t, pb.Inputs[i].DerivationPath)
+			}
+			if pb.Change != nil {
+				pb.Change.Path = legacyPath(t, pb.Change.Path)
+			}
+			v, err := json.Marshal(pb)
+			return string(k), v, err
+		}); err != nil {
+			return err
+		}
+
+		walletMetadata := dbtx.Bucket([]byte(walletMetadataBucket))
+		for _, wd := range w.descriptors {
+			lastIdxKey := lastExternalIdxKey
+			if wd.Internal {
+				lastIdxKey = lastInternalIdxKey
+			}
+			if err := walletMetadata.Put([]byte(lastIdxKey), utils.Uint32ToBytes(wd.NextIndex)); err != nil {
+				return err
+			}
+		}
+		for _, key := range []string{account0ExtXpubKey, account0IntXpubKey} {
+			if err := walletMetadata.Put([]byte(key), []byte("tpub")); err != nil {
+				return err
+			}
+		}
+		if err := dbtx.DeleteBucket([]byte(descriptorsBucket)); err != nil {
+			return err
+		}
+		if _, err := dbtx.CreateBucket([]byte(descriptorsBucket)); err != nil {
+			return err
+		}
+		return putWalletVersion(dbtx, encryptionWalletVersion)
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// migrateTestWallet runs the descriptors migration on the db like LoadWallet
+func migrateTestWallet(db *bolt.DB) error {
+	w := NewWallet(db, &chaincfg.RegressionNetParams)
+	w.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	if err := w.ensureBuckets(); err != nil {
+		return err
+	}
+	w.watchOnly = w.isWatchOnly()
+	return w.migrateDescriptors()
+}
+
+func TestMigrateDescriptors(t *testing.T) {
+	w, client := newTestWallet(t)
+	fundWallet(t, w, client, "", 50000)
+	fundWallet(t, w, client, "", 70000)
+	if _, err := w.GetNewAddress(""); err != nil {
+		t.Fatal(err)
+	}
+	pending, _ := journalSend(t, w, newTestAddress(t), 0.0003)
+
+	descriptors := w.sortedDescriptors()
+	w.utxoMtx.Lock()
+	utxos := append([]tx.UTXO{}, w.utxos...)
+	w.utxoMtx.Unlock()
+	downgradeToV1(t, w)
+
+	if err := migrateTestWallet(w.db); err != nil {
+		t.Fatalf("error migrating wallet: %v", err)
+	}
+	migrated := loadTestWallet(t, w.db, client)
+	if version := migrated.getWalletVersion(); version != descriptorsWalletVersion {
+		t.Fatalf("expected wallet version %v, got %v", descriptorsWalletVersion, version)
+	}
+
+	// default descriptors are the ones of a new wallet
+	for _, wd := range descriptors {
+		got, ok := migrated.getDescriptor(wd.ID)
+		if !ok {
+			t.Fatalf("descriptor %v not found", wd.ID)
+		}
+		if got.Desc != wd.Desc || got.Active != wd.Active || got.Internal != wd.Internal ||
+			got.NextIndex != wd.NextIndex || got.RangeEnd != wd.RangeEnd {
+			t.Errorf("descriptor does not match - expected: %+v, got: %+v", wd, got)
+		}
+		for idx := uint32(0); idx < wd.RangeEnd; idx++ {
+			keyPair := migrated.getKeyPair(descriptorPath(wd.ID, idx))
+			if keyPair == nil {
+				t.Fatalf("key %v of descriptor %v was not migrated", idx, wd.ID)
+			}
+			if path, ok := migrated.lookupAddress(keyPair.Address); !ok || path != descriptorPath(wd.ID, idx) {
+				t.Errorf("address of key %v of descriptor %v is not tracked", idx, wd.ID)
+			}
+		}
+	}
+	if err := migrated.db.View(func(dbtx *bolt.Tx) error {
+		c := dbtx.Bucket([]byte(keysBucket)).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if strings.HasPrefix(string(k), "m/") {
+				t.Errorf("key %s was not migrated", k)
+			}
+		}
+		walletMetadata := dbtx.Bucket([]byte(walletMetadataBucket))
+		for _, key := range []string{lastExternalIdxKey, lastInternalIdxKey, account0ExtXpubKey, account0IntXpubKey} {
+			if walletMetadata.Get([]byte(key)) != nil {
+				t.Errorf("%s was not removed", key)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, utxo := range utxos {
+		if got := findTestUTXO(t, migrated, utxo.GetOutpoint()); got.DerivationPath != utxo.DerivationPath {
+			t.Errorf("utxo path does not match - expected: %v, got: %v", utxo.DerivationPath, got.DerivationPath)
+		}
+	}
+	pendings, err := migrated.loadPendingBroadcasts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pendings) != 1 || pendings[0].Change.Path != pending.Change.Path ||
+		pendings[0].Inputs[0].DerivationPath != pending.Inputs[0].DerivationPath {
+		t.Fatalf("pending broadcast was not migrated: %+v", pendings)
+	}
+	checkConsistent(t, migrated)
+
+	// pending send is committed and the wallet can sign with the migrated keys
+	migrated.scanMtx.Lock()
+	err = migrated.reconcilePendingBroadcasts()
+	migrated.scanMtx.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSentTx(t, migrated, pending)
+	if err := migrated.WalletPassphrase(testPassphrase, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrated.SendToAddress(newTestAddress(t), 0.0002, "", SendOptions{FeeRate: 2000}); err != nil {
+		t.Fatalf("error sending from migrated wallet: %v", err)
+	}
+	verifyTx(t, client.sent[len(client.sent)-1], prevOuts(t, migrated))
+}
+
+func TestMigrateDescriptorsInvalidPath(t *testing.T) {
+	w, client := newTestWallet(t)
+	fundWallet(t, w, client, "", 50000)
+	downgradeToV1(t, w)
+
+	// key of a chain that is not from account 0
+	if err := w.db.Update(func(dbtx *bolt.Tx) error {
+		return dbtx.Bucket([]byte(keysBucket)).Put([]byte("m/44'/1'/0'/2/0"), []byte("{}"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateTestWallet(w.db); err == nil {
+		t.Fatal("expected error migrating wallet with invalid key path")
+	}
+
+	// nothing is changed
+	if version := w.getWalletVersion(); version != encryptionWalletVersion {
+		t.Errorf("expected wallet version %v, got %v", encryptionWalletVersion, version)
+	}
+	if err := w.db.View(func(dbtx *bolt.Tx) error {
+		if dbtx.Bucket([]byte(descriptorsBucket)).Stats().KeyN != 0 {
+			t.Error("descriptors were saved")
+		}
+		if dbtx.Bucket([]byte(keysBucket)).Get([]byte("m/44'/1'/0'/0/0")) == nil {
+			t.Error("keys were migrated")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newV0TestWallet creates the db of a version 0 wallet: the HD keys and the
+// private key of the first receive key are encrypted with the key of the
+// passphrase hash. It returns the db, the master key and the receive address
+func newV0TestWallet(t *testing.T) (*bolt.DB, *hdkeychain.ExtendedKey, string) {
+	t.Helper()
+
+	seed := make([]byte, 32)
+	if _, err := rand.Read(seed); err != nil {
+		t.Fatal(err)
+	}
+	master, acct0ext, acct0int, err := DeriveHDKeys(seed, &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := acct0ext.Derive(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privKey, err := child.ECPrivKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(privKey.PubKey().SerializeCompressed()),
+		&chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wif, err := btcutil.NewWIF(privKey, &chaincfg.RegressionNetParams, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "wallet.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := db.Update(func(dbtx *bolt.Tx) error {
+		encodedHash, err := utils.HashPassphrase([]byte(testPassphrase))
+		if err != nil {
+			return err
+		}
+		_, legacyKey, _, err := utils.DecodeHash(encodedHash)
+		if err != nil {
+			return err
+		}
+		authb, err := dbtx.CreateBucket([]byte(authBucket))
+		if err != nil {
+			return err
+		}
+		if err := authb.Put([]byte(encodedHashKey), []byte(encodedHash)); err != nil {
+			return err
+		}
+
+		if err := createUTXOBucket(dbtx); err != nil {
+			return err
+		}
+		if err := createKeysBucket(dbtx); err != nil {
+			return err
+		}
+		if err := createWalletMetadataBucket(dbtx); err != nil {
+			return err
+		}
+		encryptedMaster, encryptedAcct0ext, encryptedAcct0int, err := EncryptHDKeys(legacyKey, master, acct0ext, acct0int)
+		if err != nil {
+			return err
+		}
+		if err := putEncryptedHDKeys(dbtx, encryptedMaster, encryptedAcct0ext, encryptedAcct0int); err != nil {
+			return err
+		}
+		walletMetadata := dbtx.Bucket([]byte(walletMetadataBucket))
+		if err := walletMetadata.Put([]byte(lastExternalIdxKey), utils.Uint32ToBytes(1)); err != nil {
+			return err
+		}
+		if err := walletMetadata.Put([]byte(lastInternalIdxKey), utils.Uint32ToBytes(0)); err != nil {
+			return err
+		}
+
+		encryptedWIF, err := utils.Encrypt([]byte(wif.String()), legacyKey)
+		if err != nil {
+			return err
+		}
+		keyPair, err := json.Marshal(map[string]any{
+			"publicKey":  privKey.PubKey().SerializeCompressed(),
+			"privateKey": encryptedWIF,
+			"address":    address.EncodeAddress(),
+		})
+		if err != nil {
+			return err
+		}
+		return dbtx.Bucket([]byte(keysBucket)).Put([]byte("m/44'/1'/0'/0/0"), keyPair)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return db, master, address.EncodeAddress()
+}
+
+func TestUpgradeEncryption(t *testing.T) {
+	db, master, address := newV0TestWallet(t)
+	w := NewWallet(db, &chaincfg.RegressionNetParams)
+	w.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	if err := w.ensureBuckets(); err != nil {
+		t.Fatal(err)
+	}
+
+	encryptedMaster := w.getMasterSeed()
+	if err := w.upgradeEncryption([]byte("wrong passphrase")); !errors.Is(err, ErrInvalidPassphrase) {
+		t.Fatalf("expected invalid passphrase error, got: %v", err)
+	}
+	if w.getWalletVersion() != 0 || !bytes.Equal(w.getMasterSeed(), encryptedMaster) {
+		t.Fatal("wallet was changed with a wrong passphrase")
+	}
+
+	if err := w.upgradeEncryption([]byte(testPassphrase)); err != nil {
+		t.Fatalf("error upgrading wallet: %v", err)
+	}
+	if version := w.getWalletVersion(); version != encryptionWalletVersion {
+		t.Fatalf("expected wallet version %v, got %v", encryptionWalletVersion, version)
+	}
+
+	// HD keys are encrypted with the master key of the passphrase
+	masterKey, err := w.unwrapMasterKey([]byte(testPassphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := utils.Decrypt(w.getMasterSeed(), masterKey)
+	if err != nil {
+		t.Fatalf("error decrypting master key: %v", err)
+	}
+	if string(decrypted) != master.String() {
+		t.Error("decrypted master key does not match")
+	}
+	masterFingerprint, err := MasterFingerprint(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if utils.BytesToUint32(w.getMasterFingerprint()) != masterFingerprint || w.getAccount0Xpub() == nil {
+		t.Error("master fingerprint and account key were not saved")
+	}
+	if err := db.View(func(dbtx *bolt.Tx) error {
+		keyPair := dbtx.Bucket([]byte(keysBucket)).Get([]byte("m/44'/1'/0'/0/0"))
+		if bytes.Contains(keyPair, []byte("privateKey")) {
+			t.Error("encrypted private key was not removed")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// upgraded wallet derives the same keys from descriptors
+	if err := migrateTestWallet(db); err != nil {
+		t.Fatalf("error migrating wallet to descriptors: %v", err)
+	}
+	client := newFakeClient()
+	upgraded := loadTestWallet(t, db, client)
+	if path, ok := upgraded.lookupAddress(address); !ok || path != descriptorPath(receiveDescriptorID, 0) {
+		t.Fatalf("address of version 0 wallet is not tracked at 0/0: %v", path)
+	}
+	if err := upgraded.WalletPassphrase(testPassphrase, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	upgraded.lastScannedBlock = testTipHeight
+	fundAddress(t, upgraded, client, address, 50000)
+	if _, err := upgraded.SendToAddress(newTestAddress(t), 0.0002, "", SendOptions{FeeRate: 2000}); err != nil {
+		t.Fatalf("error sending from upgraded wallet: %v", err)
+	}
+	verifyTx(t, client.sent[0], prevOuts(t, upgraded))
+}
+
+func TestWalletPassphraseChange(t *testing.T) {
+	w, client := newTestWallet(t)
+	fundWallet(t, w, client, "bech32", 50000)
+	// private descriptor encrypted with the master key
+	privDesc := fmt.Sprintf("wpkh(%s/0/*)", newTestMasterKey(t).String())
+	importActive(t, w, privDesc)
+	fundWallet(t, w, client, "bech32", 50000)
+
+	encryptedDesc := findDescriptor(t, w, privDesc).EncryptedDesc
+	if encryptedDesc == nil {
+		t.Fatal("private descriptor was not encrypted")
+	}
+	auth := w.getAuth(kdfKey)
+
+	const newPassphrase = "new passphrase"
+	if err := w.WalletPassphraseChange("wrong passphrase", newPassphrase, 0, 0); !errors.Is(err, ErrInvalidPassphrase) {
+		t.Fatalf("expected invalid passphrase error, got: %v", err)
+	}
+	if err := w.WalletPassphraseChange(testPassphrase, "", 0, 0); err == nil {
+		t.Fatal("expected error changing to an empty passphrase")
+	}
+	if err := w.WalletPassphraseChange(testPassphrase, newPassphrase, utils.MinArgon2Memory-1, 0); err == nil {
+		t.Fatal("expected error changing to argon2 memory below the minimum")
+	}
+	if !bytes.Equal(w.getAuth(kdfKey), auth) || !bytes.Equal(findDescriptor(t, w, privDesc).EncryptedDesc, encryptedDesc) {
+		t.Fatal("wallet was changed by a failed passphrase change")
+	}
+
+	if err := w.WalletPassphraseChange(testPassphrase, newPassphrase, utils.MinArgon2Memory, 1); err != nil {
+		t.Fatalf("error changing passphrase: %v", err)
+	}
+	if bytes.Equal(findDescriptor(t, w, privDesc).EncryptedDesc, encryptedDesc) {
+		t.Error("private descriptor was not re-encrypted")
+	}
+	params, err := w.kdfParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params != (utils.Argon2Params{Memory: utils.MinArgon2Memory, Iterations: 1}) {
+		t.Errorf("argon2 params were not changed: %+v", params)
+	}
+
+	// signs with the HD key and the imported one
+	signBoth := func(wallet *Wallet) {
+		t.Helper()
+		funded, err := wallet.WalletCreateFundedPSBT(map[string]float64{newTestAddress(t): 0.0009},
+			SendOptions{FeeRate: 2000})
+		if err != nil {
+			t.Fatal(err)
+		}
+		processed, err := wallet.WalletProcessPSBT(funded.PSBT, true, true)
+		if err != nil {
+			t.Fatalf("error signing psbt: %v", err)
+		}
+		msgTx := extractTx(t, processed)
+		if len(msgTx.TxIn) != 2 {
+			t.Fatalf("expected tx spending 2 inputs, got %v", len(msgTx.TxIn))
+		}
+		verifyTx(t, msgTx, prevOuts(t, wallet))
+	}
+	// wallet stays unlocked with the new master key
+	signBoth(w)
+
+	for _, wallet := range []*Wallet{w, loadTestWallet(t, w.db, client)} {
+		wallet.WalletLock()
+		if err := wallet.WalletPassphrase(testPassphrase, time.Hour); !errors.Is(err, ErrInvalidPassphrase) {
+			t.Fatalf("expected old passphrase to be invalid, got: %v", err)
+		}
+		if err := wallet.WalletPassphrase(newPassphrase, time.Hour); err != nil {
+			t.Fatalf("error unlocking with new passphrase: %v", err)
+		}
+		signBoth(wallet)
+	}
+}
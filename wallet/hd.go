@@ -1,14 +1,27 @@
 package wallet
 
 import (
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"slices"
+	"strconv"
+	"strings"
 
+	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/btcutil/hdkeychain"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/elnosh/btcw/utils"
 )
 
+// path of account 0 in wallets created from a seed - m/44'/1'/0'
+var defaultAccountPath = []uint32{
+	hdkeychain.HardenedKeyStart + 44,
+	hdkeychain.HardenedKeyStart + 1,
+	hdkeychain.HardenedKeyStart + 0,
+}
+
 // DeriveHDKeys derives the keys for initial HD wallet setup - BIP-44
 // that will be external and internal chain for first account
 // external chain path: m/44'/1'/0'/0
@@ -80,18 +93,177 @@ func EncryptHDKeys(key []byte, master, acct0ext, acct0int *hdkeychain.ExtendedKe
 	return encryptedMaster, encryptedAcct0ext, encryptedAcct0int, nil
 }
 
-// DeriveNextHDKey will derive the next child key from fromAcctKey
-// which could be either for external or internal chain
-func DeriveNextHDKey(fromAcctKey []byte, idx uint32) (*hdkeychain.ExtendedKey, error) {
-	acctExtendedKey, err := hdkeychain.NewKeyFromString(string(fromAcctKey))
+// deriveKeyPath derives the key at path from key
+func deriveKeyPath(key *hdkeychain.ExtendedKey, path []uint32) (*hdkeychain.ExtendedKey, error) {
+	for _, idx := range path {
+		var err error
+		if key, err = key.Derive(idx); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+// seedAccountXpub returns the extended public key of account 0 derived
+// from the master key of a wallet created from a seed with its key origin
+func seedAccountXpub(master *hdkeychain.ExtendedKey) (*AccountXpub, error) {
+	acct0, err := deriveKeyPath(master, defaultAccountPath)
+	if err != nil {
+		return nil, err
+	}
+	acct0Pub, err := acct0.Neuter()
+	if err != nil {
+		return nil, err
+	}
+	fingerprint, err := MasterFingerprint(master)
+	if err != nil {
+		return nil, err
+	}
+	return &AccountXpub{Key: acct0Pub, Fingerprint: fingerprint, Path: slices.Clone(defaultAccountPath)}, nil
+}
+
+// MasterFingerprint returns the fingerprint of the master key that identifies
+// it in the key origins of BIP32 derivations (first 4 bytes of the hash160 of
+// its public key). It is little endian so that it serializes in that order
+func MasterFingerprint(master *hdkeychain.ExtendedKey) (uint32, error) {
+	pubKey, err := master.ECPubKey()
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(btcutil.Hash160(pubKey.SerializeCompressed())[:4]), nil
+}
+
+// SLIP-132 version bytes of the extended public keys that can be watched
+// mapped to the BIP32 version bytes of the network they are for.
+// The wallet derives P2WPKH addresses so keys for P2SH-P2WPKH (ypub/upub)
+// are not accepted
+var watchableKeyVersions = map[[4]byte][4]byte{
+	// xpub and zpub
+	{0x04, 0x88, 0xb2, 0x1e}: chaincfg.MainNetParams.HDPublicKeyID,
+	{0x04, 0xb2, 0x47, 0x46}: chaincfg.MainNetParams.HDPublicKeyID,
+	// tpub and vpub
+	{0x04, 0x35, 0x87, 0xcf}: chaincfg.TestNet3Params.HDPublicKeyID,
+	{0x04, 0x5f, 0x1c, 0xf6}: chaincfg.TestNet3Params.HDPublicKeyID,
+}
+
+// AccountXpub is the extended public key of an account to watch
+// with the fingerprint of the master key and the path it was derived at
+type AccountXpub struct {
+	Key         *hdkeychain.ExtendedKey
+	Fingerprint uint32
+	// path of the key from the master key. Empty if the origin of the key
+	// is not known. Then, Fingerprint is the fingerprint of the account key
+	Path []uint32
+}
+
+// ParseAccountXpub parses an xpub, tpub, zpub or vpub of an account (depth 3)
+// optionally prefixed by its key origin as in output descriptors:
+// [fingerprint/84'/1'/0']vpub... The key has to be for the network and
+// is returned with the version bytes of the network
+func ParseAccountXpub(s string, net *chaincfg.Params) (*AccountXpub, error) {
+	s = strings.TrimSpace(s)
+
+	var origin string
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]")
+		if end == -1 {
+			return nil, errors.New("invalid key origin. missing ']'")
+		}
+		origin, s = s[1:end], s[end+1:]
+	}
+
+	key, err := hdkeychain.NewKeyFromString(s)
 	if err != nil {
-		return nil, fmt.Errorf("error deriving new key: %v", err)
+		return nil, fmt.Errorf("invalid extended public key: %v", err)
+	}
+	if key.IsPrivate() {
+		return nil, errors.New("extended key is private. provide the extended public key of the account")
+	}
+	netVersion, ok := watchableKeyVersions[[4]byte(key.Version())]
+	if !ok {
+		return nil, errors.New("unsupported extended public key. provide an xpub, tpub, zpub or vpub")
+	}
+	if netVersion != net.HDPublicKeyID {
+		return nil, fmt.Errorf("extended public key is not for network %s", net.Name)
+	}
+	if key.Depth() != 3 {
+		return nil, fmt.Errorf("extended public key has depth %v. provide the key of an account (depth 3)", key.Depth())
+	}
+	key, err = key.CloneWithVersion(net.HDPublicKeyID[:])
+	if err != nil {
+		return nil, err
 	}
 
-	newKey, err := acctExtendedKey.Derive(idx)
+	if origin == "" {
+		fingerprint, err := MasterFingerprint(key)
+		if err != nil {
+			return nil, err
+		}
+		return &AccountXpub{Key: key, Fingerprint: fingerprint}, nil
+	}
+
+	fingerprintHex, pathStr, _ := strings.Cut(origin, "/")
+	fingerprint, err := hex.DecodeString(fingerprintHex)
+	if err != nil || len(fingerprint) != 4 {
+		return nil, fmt.Errorf("invalid fingerprint in key origin '%s'", origin)
+	}
+	path, err := ParseBIP32Path(strings.TrimSuffix("m/"+pathStr, "/"))
 	if err != nil {
-		return nil, fmt.Errorf("error deriving new key: %v", err)
+		return nil, err
 	}
+	// a fingerprint without path is the origin of the key itself
+	if len(path) != 0 && len(path) != int(key.Depth()) {
+		return nil, fmt.Errorf("key origin '%s' does not match the depth of the key", origin)
+	}
+
+	return &AccountXpub{Key: key, Fingerprint: binary.LittleEndian.Uint32(fingerprint), Path: path}, nil
+}
 
-	return newKey, nil
+// String returns the key prefixed by its key origin as
+// in output descriptors: [fingerprint/44'/1'/0']tpub...
+func (a *AccountXpub) String() string {
+	fingerprint := make([]byte, 4)
+	binary.LittleEndian.PutUint32(fingerprint, a.Fingerprint)
+	path := strings.TrimPrefix(FormatBIP32Path(a.Path), "m")
+	return "[" + hex.EncodeToString(fingerprint) + path + "]" + a.Key.String()
+}
+
+// ParseBIP32Path parses a path like m/84'/1'/0'. Hardened
+// indexes can be marked with ' or h
+func ParseBIP32Path(s string) ([]uint32, error) {
+	elems := strings.Split(s, "/")
+	if elems[0] != "m" {
+		return nil, fmt.Errorf("invalid derivation path '%s'", s)
+	}
+
+	path := make([]uint32, 0, len(elems)-1)
+	for _, elem := range elems[1:] {
+		hardened := strings.HasSuffix(elem, "'") || strings.HasSuffix(elem, "h")
+		if hardened {
+			elem = elem[:len(elem)-1]
+		}
+		idx, err := strconv.ParseUint(elem, 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("invalid derivation path '%s'", s)
+		}
+		if hardened {
+			idx += hdkeychain.HardenedKeyStart
+		}
+		path = append(path, uint32(idx))
+	}
+	return path, nil
+}
+
+// FormatBIP32Path returns the path as m/84'/1'/0'
+func FormatBIP32Path(path []uint32) string {
+	var sb strings.Builder
+	sb.WriteString("m")
+	for _, idx := range path {
+		if idx >= hdkeychain.HardenedKeyStart {
+			fmt.Fprintf(&sb, "/%d'", idx-hdkeychain.HardenedKeyStart)
+		} else {
+			fmt.Fprintf(&sb, "/%d", idx)
+		}
+	}
+	return sb.String()
 }
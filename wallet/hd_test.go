@@ -0,0 +1,391 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/elnosh/btcw/descriptor"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	ypubVersion = []byte{0x04, 0x9d, 0x7c, 0xb2}
+	zpubVersion = []byte{0x04, 0xb2, 0x47, 0x46}
+	vpubVersion = []byte{0x04, 0x5f, 0x1c, 0xf6}
+)
+
+// deriveTestKey derives the key at path from master and returns
+// it with the version bytes. It is neutered if not private
+func deriveTestKey(t *testing.T, master *hdkeychain.ExtendedKey, path []uint32,
+	version []byte, private bool) string {
+	t.Helper()
+
+	key := master
+	for _, idx := range path {
+		var err error
+		if key, err = key.Derive(idx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !private {
+		var err error
+		if key, err = key.Neuter(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if version != nil {
+		var err error
+		if key, err = key.CloneWithVersion(version); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return key.String()
+}
+
+func TestParseAccountXpub(t *testing.T) {
+	master := newTestMasterKey(t)
+	masterFingerprint, err := MasterFingerprint(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := make([]byte, 4)
+	binary.LittleEndian.PutUint32(fingerprint, masterFingerprint)
+	origin := "[" + hex.EncodeToString(fingerprint) + "/84'/1'/0']"
+
+	accountPath := []uint32{hdkeychain.HardenedKeyStart + 84, hdkeychain.HardenedKeyStart + 1,
+		hdkeychain.HardenedKeyStart + 0}
+	tpub := deriveTestKey(t, master, accountPath, nil, false)
+	xpub := deriveTestKey(t, master, accountPath, chaincfg.MainNetParams.HDPublicKeyID[:], false)
+
+	tests := []struct {
+		name string
+		key  string
+		net  *chaincfg.Params
+		// origin of the key if it is parsed
+		wantedPath []uint32
+		noOrigin   bool
+		wantErr    bool
+	}{
+		{
+			name:       "tpub with origin",
+			key:        origin + tpub,
+			net:        &chaincfg.RegressionNetParams,
+			wantedPath: accountPath,
+		},
+		{
+			name:       "vpub with origin",
+			key:        origin + deriveTestKey(t, master, accountPath, vpubVersion, false),
+			net:        &chaincfg.TestNet3Params,
+			wantedPath: accountPath,
+		},
+		{
+			name:       "xpub on mainnet",
+			key:        origin + xpub,
+			net:        &chaincfg.MainNetParams,
+			wantedPath: accountPath,
+		},
+		{
+			name:       "zpub on mainnet",
+			key:        origin + deriveTestKey(t, master, accountPath, zpubVersion, false),
+			net:        &chaincfg.MainNetParams,
+			wantedPath: accountPath,
+		},
+		{
+			name:     "without origin",
+			key:      tpub,
+			net:      &chaincfg.RegressionNetParams,
+			noOrigin: true,
+		},
+		{
+			name: "fingerprint without path",
+			key:  "[" + hex.EncodeToString(fingerprint) + "]" + tpub,
+			net:  &chaincfg.RegressionNetParams,
+		},
+		{
+			name:    "xpub on regtest",
+			key:     xpub,
+			net:     &chaincfg.RegressionNetParams,
+			wantErr: true,
+		},
+		{
+			name:    "zpub on testnet",
+			key:     deriveTestKey(t, master, accountPath, zpubVersion, false),
+			net:     &chaincfg.TestNet3Params,
+			wantErr: true,
+		},
+		{
+			name:    "tpub on mainnet",
+			key:     tpub,
+			net:     &chaincfg.MainNetParams,
+			wantErr: true,
+		},
+		{
+			name:    "vpub on mainnet",
+			key:     deriveTestKey(t, master, accountPath, vpubVersion, false),
+			net:     &chaincfg.MainNetParams,
+			wantErr: true,
+		},
+		{
+			name:    "unsupported version",
+			key:     deriveTestKey(t, master, accountPath, ypubVersion, false),
+			net:     &chaincfg.MainNetParams,
+			wantErr: true,
+		},
+		{
+			name:    "private key",
+			key:     deriveTestKey(t, master, accountPath, nil, true),
+			net:     &chaincfg.RegressionNetParams,
+			wantErr: true,
+		},
+		{
+			name:    "key not at account depth",
+			key:     deriveTestKey(t, master, accountPath[:2], nil, false),
+			net:     &chaincfg.RegressionNetParams,
+			wantErr: true,
+		},
+		{
+			name:    "origin path does not match depth",
+			key:     "[" + hex.EncodeToString(fingerprint) + "/84'/1']" + tpub,
+			net:     &chaincfg.RegressionNetParams,
+			wantErr: true,
+		},
+		{
+			name:    "invalid fingerprint",
+			key:     "[abcd/84'/1'/0']" + tpub,
+			net:     &chaincfg.RegressionNetParams,
+			wantErr: true,
+		},
+		{
+			name:    "invalid origin path",
+			key:     "[" + hex.EncodeToString(fingerprint) + "/84'/x/0']" + tpub,
+			net:     &chaincfg.RegressionNetParams,
+			wantErr: true,
+		},
+		{
+			name:    "missing end of origin",
+			key:     origin[:len(origin)-1] + tpub,
+			net:     &chaincfg.RegressionNetParams,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			account, err := ParseAccountXpub(test.key, test.net)
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("expected error parsing key")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !bytes.Equal(account.Key.Version(), test.net.HDPublicKeyID[:]) {
+				t.Errorf("key does not have the version of network %s", test.net.Name)
+			}
+			if !slices.Equal(account.Path, test.wantedPath) {
+				t.Errorf("path does not match - expected: %v, got: %v", test.wantedPath, account.Path)
+			}
+			wantedFingerprint := masterFingerprint
+			if test.noOrigin {
+				wantedFingerprint, err = MasterFingerprint(account.Key)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if account.Fingerprint != wantedFingerprint {
+				t.Errorf("fingerprint does not match - expected: %x, got: %x", wantedFingerprint, account.Fingerprint)
+			}
+
+			// key is written back with its origin
+			if test.wantedPath != nil && !strings.HasPrefix(account.String(), origin) {
+				t.Errorf("unexpected key origin in %s", account.String())
+			}
+		})
+	}
+}
+
+func TestWatchOnlyWallet(t *testing.T) {
+	w, client := newTestWallet(t)
+	xpub, err := w.GetXpub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := ParseAccountXpub(xpub, &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "wallet.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	// created like CreateWatchOnlyWallet does, without the network set
+	created := &Wallet{db: db}
+	if err := created.initWatchOnlyWalletBuckets(account, &chaincfg.RegressionNetParams); err != nil {
+		t.Fatalf("error creating watch-only wallet: %v", err)
+	}
+	if err := created.enableRecovery(0, DefaultGapLimit); err != nil {
+		t.Fatal(err)
+	}
+	if !walletExists(db) {
+		t.Fatal("watch-only wallet does not exist")
+	}
+
+	watchOnly := loadTestWallet(t, db, client)
+	if !watchOnly.IsWatchOnly() {
+		t.Fatal("expected wallet to be watch-only")
+	}
+	if got, err := watchOnly.GetXpub(); err != nil || got != xpub {
+		t.Errorf("xpub does not match - expected: %s, got: %s (%v)", xpub, got, err)
+	}
+
+	// addresses are the same as the ones of the wallet the xpub is from
+	for i := 0; i < 3; i++ {
+		expected, err := w.GetNewAddress("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		address, err := watchOnly.GetNewAddress("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if address != expected {
+			t.Errorf("address %v does not match - expected: %s, got: %s", i, expected, address)
+		}
+	}
+
+	// funds found while recovering
+	watchOnly.lastScannedBlock = testTipHeight
+	fundWallet(t, watchOnly, client, "", 50000)
+	// the tx is returned as a PSBT to be signed elsewhere
+	funded, err := watchOnly.SendToAddress(newTestAddress(t), 0.0001, "", SendOptions{FeeRate: 2000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := psbt.NewFromRawBytes(strings.NewReader(funded), true); err != nil {
+		t.Errorf("expected psbt from watch-only send: %v", err)
+	}
+	if len(client.sent) != 0 {
+		t.Error("watch-only wallet sent a tx to the node")
+	}
+}
+
+func TestGetXpub(t *testing.T) {
+	seed := bytes.Repeat([]byte{0x42}, 32)
+	master, err := hdkeychain.NewMaster(seed, &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterPubKey, err := master.ECPubKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := hex.EncodeToString(btcutil.Hash160(masterPubKey.SerializeCompressed())[:4])
+	accountKey := deriveTestKey(t, master, defaultAccountPath, nil, false)
+	expected := "[" + fingerprint + "/44'/1'/0']" + accountKey
+
+	w, client := newTestWalletFromSeed(t, seed)
+	xpub, err := w.GetXpub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if xpub != expected {
+		t.Fatalf("expected xpub %s, got %s", expected, xpub)
+	}
+
+	// the account key is saved so the wallet does not need to be unlocked
+	w.WalletLock()
+	for _, wallet := range []*Wallet{w, loadTestWallet(t, w.db, client)} {
+		xpub, err := wallet.GetXpub()
+		if err != nil {
+			t.Fatalf("error getting xpub of locked wallet: %v", err)
+		}
+		if xpub != expected {
+			t.Errorf("expected xpub %s, got %s", expected, xpub)
+		}
+	}
+}
+
+func TestListDescriptors(t *testing.T) {
+	w, client := newTestWallet(t)
+	xpub, err := w.GetXpub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := w.GetNewAddress(""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := RescanNow
+	single := fmt.Sprintf("wpkh(%s/8/0)", xpub)
+	w.scanMtx.Lock()
+	_, err = w.importDescriptor(ImportDescriptorRequest{Desc: single, Timestamp: &now})
+	w.scanMtx.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := func(n uint32) *uint32 { return &n }
+	expected := []Descriptor{
+		{
+			Desc:   fmt.Sprintf("wpkh(%s/0/*)", xpub),
+			Active: true,
+			Range:  &[2]uint32{0, 2},
+			Next:   next(3),
+		},
+		{
+			Desc:     fmt.Sprintf("wpkh(%s/1/*)", xpub),
+			Active:   true,
+			Internal: true,
+			// no keys derived yet
+			Range: &[2]uint32{0, 0},
+			Next:  next(0),
+		},
+		{Desc: single},
+	}
+
+	for _, wallet := range []*Wallet{w, loadTestWallet(t, w.db, client)} {
+		descriptors, err := wallet.ListDescriptors()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(descriptors) != len(expected) {
+			t.Fatalf("expected %v descriptors, got %v", len(expected), len(descriptors))
+		}
+		for i, desc := range descriptors {
+			wanted := expected[i]
+			withChecksum, err := descriptor.AddChecksum(wanted.Desc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if desc.Desc != withChecksum {
+				t.Errorf("expected descriptor %s, got %s", withChecksum, desc.Desc)
+			}
+			if desc.Active != wanted.Active || desc.Internal != wanted.Internal || desc.Timestamp == 0 {
+				t.Errorf("unexpected descriptor %s: %+v", wanted.Desc, desc)
+			}
+			if (desc.Range == nil) != (wanted.Range == nil) || (desc.Range != nil && *desc.Range != *wanted.Range) {
+				t.Errorf("expected range %v of descriptor %s, got %v", wanted.Range, wanted.Desc, desc.Range)
+			}
+			if (desc.Next == nil) != (wanted.Next == nil) || (desc.Next != nil && *desc.Next != *wanted.Next) {
+				t.Errorf("expected next index %v of descriptor %s, got %v", wanted.Next, wanted.Desc, desc.Next)
+			}
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package wallet
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/hex"
+	"errors"
+	"slices"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+var (
+	ErrTxNotFound = errors.New("transaction not found in wallet")
+)
+
+type TxDirection string
+
+const (
+	// tx spends wallet UTXOs to addresses not in the wallet
+	DirectionSend TxDirection = "send"
+	// tx sends to wallet addresses without spending wallet UTXOs
+	DirectionReceive TxDirection = "receive"
+	// tx spends wallet UTXOs only to wallet addresses
+	DirectionSelf TxDirection = "self"
+)
+
+// TxRecord is the record of a transaction that sends to or spends from the wallet
+type TxRecord struct {
+	TxID      string      `json:"txid"`
+	RawTx     string      `json:"hex"`
+	Direction TxDirection `json:"direction"`
+	// sum of outputs to wallet addresses
+	Received btcutil.Amount `json:"received"`
+	// sum of wallet UTXOs spent by the tx
+	Sent btcutil.Amount `json:"sent"`
+	// change in wallet balance from the tx (received - sent)
+	Amount btcutil.Amount `json:"amount"`
+	// only known if all inputs are from the wallet
+	Fee btcutil.Amount `json:"fee"`
+	// recipient addresses if sending or wallet addresses if receiving
+	Addresses     []string `json:"addresses"`
+	BlockHeight   int64    `json:"blockheight"`
+	BlockHash     string   `json:"blockhash"`
+	Confirmations int64    `json:"confirmations"`
+	// time the tx was first seen by the wallet or time of block if found while scanning
+	Timestamp int64  `json:"time"`
+	Label     string `json:"label"`
+	// set if tx was evicted from the mempool or conflicted
+	Dropped bool `json:"dropped"`
+	// txid of the tx that replaced this one
+	ReplacedBy string `json:"replaced_by,omitempty"`
+	// txid of the tx this one replaced
+	Replaces string `json:"replaces,omitempty"`
+}
+
+// recordTx saves a record of the tx in the wallet history. If the tx is
+// already recorded, it updates the block at which it was confirmed.
+// It needs to be called after the UTXOs of the tx have been added to the wallet
+func (w *Wallet) recordTx(msgTx *wire.MsgTx, height int64, blockHash string, timestamp int64) {
+	txid := msgTx.TxHash().String()
+
+	record := w.getTxRecord(txid)
+	if record != nil {
+		if record.BlockHash == blockHash && !record.Dropped {
+			return
+		}
+		record.BlockHeight = height
+		record.BlockHash = blockHash
+		record.Dropped = false
+		if err := w.saveTxRecord(record); err != nil {
+			w.LogError("error updating tx record: %v", err)
+		}
+		return
+	}
+
+	record, err := w.buildTxRecord(msgTx, height, blockHash, timestamp)
+	if err != nil {
+		w.LogError("error serializing tx to record: %v", err)
+		return
+	}
+	if err := w.saveTxRecord(record); err != nil {
+		w.LogError("error saving tx record: %v", err)
+	}
+}
+
+// buildTxRecord creates the record of the tx from the wallet UTXOs
+// spent by it and its outputs to wallet addresses
+func (w *Wallet) buildTxRecord(msgTx *wire.MsgTx, height int64, blockHash string, timestamp int64) (*TxRecord, error) {
+	var buf bytes.Buffer
+	if err := msgTx.Serialize(&buf); err != nil {
+		return nil, err
+	}
+
+	record := &TxRecord{
+		TxID:        msgTx.TxHash().String(),
+		RawTx:       hex.EncodeToString(buf.Bytes()),
+		BlockHeight: height,
+		BlockHash:   blockHash,
+		Timestamp:   timestamp,
+	}
+
+	allInputsFromWallet := true
+	for _, txIn := range msgTx.TxIn {
+		utxo, ok := w.findUTXO(txIn.PreviousOutPoint.String())
+		if !ok {
+			allInputsFromWallet = false
+			continue
+		}
+		record.Sent += utxo.Value
+	}
+
+	var totalOutput btcutil.Amount
+	recipients := []string{}
+	received := []string{}
+	for _, txOut := range msgTx.TxOut {
+		totalOutput += btcutil.Amount(txOut.Value)
+
+		_, addrs, _, err := txscript.ExtractPkScriptAddrs(txOut.PkScript, w.network)
+		if err != nil || len(addrs) != 1 {
+			continue
+		}
+		addr := addrs[0].String()
+		if _, ok := w.lookupAddress(addr); ok {
+			record.Received += btcutil.Amount(txOut.Value)
+			received = append(received, addr)
+		} else {
+			recipients = append(recipients, addr)
+		}
+	}
+
+	record.Amount = record.Received - record.Sent
+	if record.Sent > 0 && allInputsFromWallet {
+		record.Fee = record.Sent - totalOutput
+	}
+
+	switch {
+	case record.Sent == 0:
+		record.Direction = DirectionReceive
+		record.Addresses = received
+	case len(recipients) == 0:
+		record.Direction = DirectionSelf
+		record.Addresses = received
+	default:
+		record.Direction = DirectionSend
+		record.Addresses = recipients
+	}
+
+	return record, nil
+}
+
+// recordTxHex decodes the hex serialized tx and records it
+func (w *Wallet) recordTxHex(txHex string, height int64, blockHash string, timestamp int64) {
+	serializedTx, err := hex.DecodeString(txHex)
+	if err != nil {
+		w.LogError("error decoding tx to record: %v", err)
+		return
+	}
+
+	msgTx := wire.NewMsgTx(wire.TxVersion)
+	if err := msgTx.Deserialize(bytes.NewReader(serializedTx)); err != nil {
+		w.LogError("error decoding tx to record: %v", err)
+		return
+	}
+	w.recordTx(msgTx, height, blockHash, timestamp)
+}
+
+// setTxLabel sets the label of a recorded tx
+func (w *Wallet) setTxLabel(txid, label string) error {
+	record := w.getTxRecord(txid)
+	if record == nil {
+		return ErrTxNotFound
+	}
+	record.Label = label
+	return w.saveTxRecord(record)
+}
+
+// ListTransactions returns up to count transactions from the wallet history
+// confirmed at or after the sinceBlock height or unconfirmed, most recent first.
+// The skip most recent transactions are skipped
+func (w *Wallet) ListTransactions(count, skip int, sinceBlock int64) ([]TxRecord, error) {
+	if count < 0 || skip < 0 {
+		return nil, errors.New("count and skip must be positive")
+	}
+
+	records, err := w.loadTxRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := make([]TxRecord, 0, len(records))
+	for _, record := range records {
+		if record.BlockHeight == 0 || record.BlockHeight >= sinceBlock {
+			record.Confirmations = w.txConfirmations(record)
+			filtered = append(filtered, record)
+		}
+	}
+
+	slices.SortStableFunc(filtered, func(a, b TxRecord) int {
+		if a.Timestamp != b.Timestamp {
+			return cmp.Compare(b.Timestamp, a.Timestamp)
+		}
+		return cmp.Compare(b.BlockHeight, a.BlockHeight)
+	})
+
+	if skip >= len(filtered) {
+		return []TxRecord{}, nil
+	}
+	filtered = filtered[skip:]
+	if count < len(filtered) {
+		filtered = filtered[:count]
+	}
+	return filtered, nil
+}
+
+// GetTransaction returns the record of the tx in the wallet history
+func (w *Wallet) GetTransaction(txid string) (*TxRecord, error) {
+	record := w.getTxRecord(txid)
+	if record == nil {
+		return nil, ErrTxNotFound
+	}
+	record.Confirmations = w.txConfirmations(*record)
+	return record, nil
+}
+
+func (w *Wallet) txConfirmations(record TxRecord) int64 {
+	if record.BlockHeight == 0 || record.BlockHeight > w.lastScannedBlock {
+		return 0
+	}
+	return w.lastScannedBlock - record.BlockHeight + 1
+}
@@ -0,0 +1,131 @@
+package wallet
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestListTransactions(t *testing.T) {
+	w, client := newTestWallet(t)
+	records := []TxRecord{
+		{TxID: "aa", Direction: DirectionReceive, BlockHeight: 190, Timestamp: 1700000000},
+		{TxID: "bb", Direction: DirectionSend, BlockHeight: 195, Timestamp: 1700003000},
+		// same time as bb but in a later block
+		{TxID: "cc", Direction: DirectionReceive, BlockHeight: 200, Timestamp: 1700003000},
+		// unconfirmed
+		{TxID: "dd", Direction: DirectionSend, Timestamp: 1700006000},
+	}
+	for _, record := range records {
+		if err := w.saveTxRecord(&record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		count       int
+		skip        int
+		sinceBlock  int64
+		wantedTxIDs []string
+		wantedErr   bool
+	}{
+		{
+			name:        "most recent first",
+			count:       10,
+			wantedTxIDs: []string{"dd", "cc", "bb", "aa"},
+		},
+		{
+			name:        "count",
+			count:       2,
+			wantedTxIDs: []string{"dd", "cc"},
+		},
+		{
+			name:        "skip",
+			count:       2,
+			skip:        1,
+			wantedTxIDs: []string{"cc", "bb"},
+		},
+		{
+			name:        "skip to the last tx",
+			count:       10,
+			skip:        3,
+			wantedTxIDs: []string{"aa"},
+		},
+		{
+			name:        "skip all txs",
+			count:       10,
+			skip:        4,
+			wantedTxIDs: []string{},
+		},
+		{
+			name:        "skip past the end",
+			count:       10,
+			skip:        20,
+			wantedTxIDs: []string{},
+		},
+		{
+			name:        "count 0",
+			count:       0,
+			wantedTxIDs: []string{},
+		},
+		{
+			name:        "since block",
+			count:       10,
+			sinceBlock:  195,
+			wantedTxIDs: []string{"dd", "cc", "bb"},
+		},
+		{
+			name:        "since block after the tip",
+			count:       10,
+			sinceBlock:  testTipHeight + 1,
+			wantedTxIDs: []string{"dd"},
+		},
+		{
+			name:      "negative count",
+			count:     -1,
+			wantedErr: true,
+		},
+		{
+			name:      "negative skip",
+			count:     10,
+			skip:      -1,
+			wantedErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, wallet := range []*Wallet{w, loadTestWallet(t, w.db, client)} {
+				list, err := wallet.ListTransactions(test.count, test.skip, test.sinceBlock)
+				if test.wantedErr {
+					if err == nil {
+						t.Fatal("expected error listing transactions")
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				txids := make([]string, 0, len(list))
+				for _, record := range list {
+					txids = append(txids, record.TxID)
+				}
+				if !slices.Equal(txids, test.wantedTxIDs) {
+					t.Fatalf("expected txs %v, got %v", test.wantedTxIDs, txids)
+				}
+
+				for _, record := range list {
+					var wantedConfirmations int64
+					if record.BlockHeight != 0 {
+						wantedConfirmations = testTipHeight - record.BlockHeight + 1
+					}
+					if record.Confirmations != wantedConfirmations {
+						t.Errorf("expected %v confirmations of tx %s, got %v",
+							wantedConfirmations, record.TxID, record.Confirmations)
+					}
+				}
+			}
+		})
+	}
+}
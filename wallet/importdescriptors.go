@@ -0,0 +1,359 @@
+package wallet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/elnosh/btcw/descriptor"
+)
+
+const (
+	// RescanNow is the timestamp of descriptors that do not need a rescan
+	RescanNow RescanTime = -1
+
+	// max number of keys of a range to import at once
+	maxImportRange = 1000000
+	// max difference in seconds of the timestamp of a block with the time it was mined
+	blockTimestampWindow = 2 * 60 * 60
+	// number of blocks of the median time past like in consensus rules
+	medianTimeBlocks = 11
+)
+
+// ImportDescriptorRequest is a descriptor to import into the wallet
+type ImportDescriptorRequest struct {
+	Desc string `json:"desc"`
+	// addresses of the type of the descriptor are given out from it.
+	// Only ranged descriptors can be active
+	Active bool `json:"active"`
+	// indexes of the keys to watch of a ranged descriptor. end is included.
+	// If not set it is [0, DefaultGapLimit-1]
+	Range *DescriptorRange `json:"range"`
+	// index of the next key to be given out. Start of the range if not set
+	NextIndex *uint32 `json:"next_index"`
+	// time from when to scan the blockchain for txs of the descriptor
+	Timestamp *RescanTime `json:"timestamp"`
+	// addresses are used for change
+	Internal bool `json:"internal"`
+}
+
+// DescriptorRange is the range of indexes [begin, end] of a ranged
+// descriptor. In JSON it is either [begin, end] or end with begin 0
+type DescriptorRange [2]uint32
+
+func (r *DescriptorRange) UnmarshalJSON(data []byte) error {
+	var end int64
+	if err := json.Unmarshal(data, &end); err == nil {
+		if end < 0 {
+			return errors.New("range should be greater or equal than 0")
+		}
+		*r = DescriptorRange{0, uint32(min(end, hdkeychain.HardenedKeyStart))}
+		return nil
+	}
+
+	var rng [2]int64
+	if err := json.Unmarshal(data, &rng); err != nil {
+		return errors.New("range must be an end index or [begin, end]")
+	}
+	if rng[0] < 0 || rng[1] < 0 {
+		return errors.New("range should be greater or equal than 0")
+	}
+	*r = DescriptorRange{uint32(min(rng[0], hdkeychain.HardenedKeyStart)),
+		uint32(min(rng[1], hdkeychain.HardenedKeyStart))}
+	return nil
+}
+
+// RescanTime is a unix timestamp or RescanNow. In JSON it is either a number or "now"
+type RescanTime int64
+
+func (t *RescanTime) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		if s != "now" {
+			return fmt.Errorf("invalid timestamp '%s'", s)
+		}
+		*t = RescanNow
+		return nil
+	}
+
+	var ts int64
+	if err := json.Unmarshal(data, &ts); err != nil || ts < 0 {
+		return errors.New("timestamp must be a unix time or \"now\"")
+	}
+	*t = RescanTime(ts)
+	return nil
+}
+
+// ImportDescriptorResult is the result of importing a descriptor
+type ImportDescriptorResult struct {
+	Success  bool     `json:"success"`
+	Warnings []string `json:"warnings,omitempty"`
+	Error    string   `json:"error,omitempty"`
+
+	Err error `json:"-"`
+}
+
+// ImportDescriptors imports the descriptors of the requests in order. A
+// request that fails does not stop the others. The addresses of the imported
+// descriptors are tracked and the blocks from the earliest timestamp are
+// scanned again in the background to find their txs
+func (w *Wallet) ImportDescriptors(requests []ImportDescriptorRequest) ([]ImportDescriptorResult, error) {
+	w.scanMtx.Lock()
+	defer w.scanMtx.Unlock()
+
+	results := make([]ImportDescriptorResult, len(requests))
+	imported := false
+	rescanFrom := RescanNow
+	for i, req := range requests {
+		warnings, err := w.importDescriptor(req)
+		if err != nil {
+			results[i] = ImportDescriptorResult{Error: err.Error(), Err: err}
+			continue
+		}
+		results[i] = ImportDescriptorResult{Success: true, Warnings: warnings}
+		imported = true
+
+		if ts := *req.Timestamp; ts != RescanNow && (rescanFrom == RescanNow || ts < rescanFrom) {
+			rescanFrom = ts
+		}
+	}
+	if !imported || w.client == nil {
+		return results, nil
+	}
+
+	if err := w.loadTxFilter(); err != nil {
+		return nil, err
+	}
+	if rescanFrom == RescanNow {
+		return results, nil
+	}
+
+	height, err := w.heightForTime(int64(rescanFrom))
+	if err != nil {
+		return nil, fmt.Errorf("error finding block to rescan from: %v", err)
+	}
+	if height <= w.lastScannedBlock {
+		lastScannedBlock := max(height-1, 0)
+		if err := w.updateRescan(lastScannedBlock); err != nil {
+			return nil, err
+		}
+		w.lastScannedBlock = lastScannedBlock
+		w.LogInfo("rescanning blockchain from block %v for imported descriptors", height)
+		go w.scanMissingBlocks()
+	}
+	return results, nil
+}
+
+// importDescriptor adds the descriptor of the request to the wallet or
+// updates it if it was already imported. It returns the warnings of the import
+func (w *Wallet) importDescriptor(req ImportDescriptorRequest) ([]string, error) {
+	if req.Timestamp == nil {
+		return nil, errors.New("missing required timestamp field")
+	}
+	parsed, err := descriptor.Parse(req.Desc, w.network)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor: %s", err.Error())
+	}
+	if parsed.AddressType() == "" {
+		return nil, errors.New("descriptors without an address (bare multisig) are not supported")
+	}
+
+	// keys from start to end (not included) are derived
+	start, end := uint32(0), uint32(1)
+	if parsed.IsRange() {
+		rng := DescriptorRange{0, DefaultGapLimit - 1}
+		if req.Range != nil {
+			rng = *req.Range
+		}
+		if rng[0] > rng[1] {
+			return nil, errors.New("range specified as [begin, end] must not have begin after end")
+		}
+		if rng[1] >= hdkeychain.HardenedKeyStart {
+			return nil, errors.New("end of range is too high")
+		}
+		if rng[1]-rng[0] >= maxImportRange {
+			return nil, errors.New("range is too large")
+		}
+		start, end = rng[0], rng[1]+1
+	} else {
+		if req.Range != nil {
+			return nil, errors.New("range should not be specified for an un-ranged descriptor")
+		}
+		if req.NextIndex != nil {
+			return nil, errors.New("next_index should not be specified for an un-ranged descriptor")
+		}
+		if req.Active {
+			return nil, errors.New("active descriptors must be ranged")
+		}
+	}
+	nextIndex := start
+	if req.NextIndex != nil {
+		nextIndex = *req.NextIndex
+		if nextIndex < start || nextIndex >= end {
+			return nil, errors.New("next_index is out of range")
+		}
+	}
+
+	var warnings []string
+	var encryptedDesc []byte
+	if w.watchOnly {
+		if parsed.HasPrivateKeys() {
+			return nil, errors.New("cannot import private keys to a watch-only wallet")
+		}
+	} else {
+		signable, err := w.signableKeys(parsed, start)
+		if err != nil {
+			return nil, err
+		}
+		if signable == 0 {
+			return nil, errors.New("cannot import a descriptor without private keys or keys of the wallet")
+		}
+		if signable < len(parsed.Keys) {
+			warnings = append(warnings, "not all private keys provided. some wallet functionality may return unexpected errors")
+		}
+		if parsed.HasPrivateKeys() {
+			if encryptedDesc, err = w.encryptDescriptor(parsed); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	timestamp := time.Now().Unix()
+	if *req.Timestamp != RescanNow {
+		timestamp = int64(*req.Timestamp)
+	}
+
+	w.descriptorsMtx.Lock()
+	defer w.descriptorsMtx.Unlock()
+
+	wd, exists := walletDescriptor{}, false
+	var id uint32
+	for _, existing := range w.sortedDescriptors() {
+		if existing.Desc == parsed.String() {
+			wd, exists = existing, true
+			break
+		}
+		id = existing.ID + 1
+	}
+	if exists {
+		start, end = min(start, wd.RangeStart), max(end, wd.RangeEnd)
+		nextIndex = max(nextIndex, wd.NextIndex)
+		timestamp = min(timestamp, wd.Timestamp)
+		if encryptedDesc == nil {
+			encryptedDesc = wd.EncryptedDesc
+		}
+	} else {
+		// private keys are only kept encrypted
+		public, err := descriptor.Parse(parsed.String(), w.network)
+		if err != nil {
+			return nil, err
+		}
+		wd = walletDescriptor{ID: id, Desc: public.String(), parsed: public}
+	}
+	wd.EncryptedDesc = encryptedDesc
+	wd.Active = req.Active
+	wd.Internal = req.Internal
+	wd.NextIndex = nextIndex
+	wd.RangeStart = start
+	wd.Timestamp = timestamp
+
+	keyPairs, err := deriveKeyPairs(&wd, start, end)
+	if err != nil {
+		return nil, err
+	}
+	wd.RangeEnd = end
+
+	// only one descriptor is active for each address type of receive and change addresses
+	updated := []walletDescriptor{wd}
+	if wd.Active {
+		for _, other := range w.descriptors {
+			if other.ID != wd.ID && other.Active && other.Internal == wd.Internal &&
+				other.parsed.AddressType() == parsed.AddressType() {
+				other.Active = false
+				updated = append(updated, other)
+			}
+		}
+	}
+
+	if err := w.putDescriptors(updated, keyPairs); err != nil {
+		return nil, err
+	}
+	for _, d := range updated {
+		w.descriptors[d.ID] = d
+	}
+	w.trackKeyPairs(keyPairs)
+	return warnings, nil
+}
+
+// signableKeys returns the number of keys of the descriptor that the
+// wallet can sign with. They are either private keys or derived from
+// the master key of the wallet
+func (w *Wallet) signableKeys(desc *descriptor.Descriptor, idx uint32) (int, error) {
+	fingerprint, err := w.masterFingerprint()
+	if err != nil {
+		return 0, err
+	}
+	expansion, err := desc.Expand(idx)
+	if err != nil {
+		return 0, err
+	}
+
+	signable := 0
+	for _, key := range expansion.Keys {
+		if key.PrivKey != nil || key.Fingerprint == fingerprint {
+			signable++
+		}
+	}
+	return signable, nil
+}
+
+// heightForTime returns the height of the first block that can have a
+// timestamp from ts minus the max difference of the timestamp of a block
+// with the time it was mined. Timestamps of blocks do not always increase
+// with the height so it searches the median time past of the blocks, which
+// never decreases. The median is behind the time of the last blocks so it
+// goes back another blockTimestampWindow to not skip blocks with a timestamp
+// ahead of the ones before. It returns the height after the tip if there is none
+func (w *Wallet) heightForTime(ts int64) (int64, error) {
+	tip, err := w.client.GetBlockCount()
+	if err != nil {
+		return 0, err
+	}
+
+	low, high := int64(0), tip+1
+	for low < high {
+		mid := (low + high) / 2
+		medianTime, err := w.medianTimePast(mid)
+		if err != nil {
+			return 0, err
+		}
+		if medianTime >= ts-2*blockTimestampWindow {
+			high = mid
+		} else {
+			low = mid + 1
+		}
+	}
+	return low, nil
+}
+
+// medianTimePast returns the median of the timestamps of
+// the block at height and the medianTimeBlocks-1 blocks before it
+func (w *Wallet) medianTimePast(height int64) (int64, error) {
+	timestamps := make([]int64, 0, medianTimeBlocks)
+	for h := height; h >= 0 && h > height-medianTimeBlocks; h-- {
+		hash, err := w.client.GetBlockHash(h)
+		if err != nil {
+			return 0, err
+		}
+		header, err := w.client.GetBlockHeader(hash)
+		if err != nil {
+			return 0, err
+		}
+		timestamps = append(timestamps, header.Timestamp.Unix())
+	}
+	slices.Sort(timestamps)
+	return timestamps[len(timestamps)/2], nil
+}
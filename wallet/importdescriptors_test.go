@@ -0,0 +1,346 @@
+package wallet
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/elnosh/btcw/descriptor"
+)
+
+// findDescriptor returns the descriptor of the wallet with the same
+// public descriptor as desc
+func findDescriptor(t *testing.T, w *Wallet, desc string) walletDescriptor {
+	t.Helper()
+
+	parsed, err := descriptor.Parse(desc, w.network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.descriptorsMtx.Lock()
+	defer w.descriptorsMtx.Unlock()
+	for _, wd := range w.descriptors {
+		if wd.Desc == parsed.String() {
+			return wd
+		}
+	}
+	t.Fatalf("descriptor %s not found", desc)
+	return walletDescriptor{}
+}
+
+// neuteredTestKey returns the extended public key of a new master key
+func neuteredTestKey(t *testing.T) string {
+	t.Helper()
+
+	key, err := newTestMasterKey(t).Neuter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key.String()
+}
+
+func TestImportDescriptor(t *testing.T) {
+	w, _ := newTestWallet(t)
+	xpub, err := w.GetXpub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := RescanNow
+	index := func(idx uint32) *uint32 { return &idx }
+
+	tests := []struct {
+		name string
+		// %[1]s is the account key of the wallet
+		desc        string
+		rng         *DescriptorRange
+		nextIndex   *uint32
+		active      bool
+		noTimestamp bool
+		wantErr     bool
+		// range [start, end) and next index of the imported descriptor
+		wantedStart uint32
+		wantedEnd   uint32
+		wantedNext  uint32
+	}{
+		{
+			name:      "default range",
+			desc:      "wpkh(%[1]s/5/*)",
+			wantedEnd: DefaultGapLimit,
+		},
+		{
+			name:        "range with next index",
+			desc:        "wpkh(%[1]s/6/*)",
+			rng:         &DescriptorRange{10, 19},
+			nextIndex:   index(15),
+			wantedStart: 10,
+			wantedEnd:   20,
+			wantedNext:  15,
+		},
+		{
+			name:      "unranged",
+			desc:      "wpkh(%[1]s/7/0)",
+			wantedEnd: 1,
+		},
+		{
+			name:    "begin after end",
+			desc:    "wpkh(%[1]s/8/*)",
+			rng:     &DescriptorRange{20, 10},
+			wantErr: true,
+		},
+		{
+			name:    "end of range too high",
+			desc:    "wpkh(%[1]s/8/*)",
+			rng:     &DescriptorRange{0, hdkeychain.HardenedKeyStart},
+			wantErr: true,
+		},
+		{
+			name:    "range too large",
+			desc:    "wpkh(%[1]s/8/*)",
+			rng:     &DescriptorRange{0, maxImportRange},
+			wantErr: true,
+		},
+		{
+			name:      "next index before range",
+			desc:      "wpkh(%[1]s/8/*)",
+			rng:       &DescriptorRange{10, 19},
+			nextIndex: index(5),
+			wantErr:   true,
+		},
+		{
+			name:      "next index after range",
+			desc:      "wpkh(%[1]s/8/*)",
+			rng:       &DescriptorRange{10, 19},
+			nextIndex: index(20),
+			wantErr:   true,
+		},
+		{
+			name:    "range of unranged descriptor",
+			desc:    "wpkh(%[1]s/8/0)",
+			rng:     &DescriptorRange{0, 10},
+			wantErr: true,
+		},
+		{
+			name:      "next index of unranged descriptor",
+			desc:      "wpkh(%[1]s/8/0)",
+			nextIndex: index(0),
+			wantErr:   true,
+		},
+		{
+			name:    "active unranged descriptor",
+			desc:    "wpkh(%[1]s/8/0)",
+			active:  true,
+			wantErr: true,
+		},
+		{
+			name:        "missing timestamp",
+			desc:        "wpkh(%[1]s/8/*)",
+			noTimestamp: true,
+			wantErr:     true,
+		},
+		{
+			name:    "bare multisig",
+			desc:    "multi(1,%[1]s/8/*)",
+			wantErr: true,
+		},
+		{
+			name:    "keys not from the wallet",
+			desc:    "wpkh(" + neuteredTestKey(t) + "/0/*)",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			desc := fmt.Sprintf(test.desc, xpub)
+			req := ImportDescriptorRequest{Desc: desc, Active: test.active, Range: test.rng,
+				NextIndex: test.nextIndex, Timestamp: &now}
+			if test.noTimestamp {
+				req.Timestamp = nil
+			}
+
+			w.scanMtx.Lock()
+			_, err := w.importDescriptor(req)
+			w.scanMtx.Unlock()
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("expected error importing descriptor")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			wd := findDescriptor(t, w, desc)
+			if wd.RangeStart != test.wantedStart || wd.RangeEnd != test.wantedEnd || wd.NextIndex != test.wantedNext {
+				t.Errorf("unexpected range - expected: [%v, %v) next %v, got: [%v, %v) next %v",
+					test.wantedStart, test.wantedEnd, test.wantedNext, wd.RangeStart, wd.RangeEnd, wd.NextIndex)
+			}
+			for idx := wd.RangeStart; idx < wd.RangeEnd; idx++ {
+				if w.getKeyPair(descriptorPath(wd.ID, idx)) == nil {
+					t.Fatalf("key %v of the range was not saved", idx)
+				}
+			}
+		})
+	}
+}
+
+func TestImportDescriptorMerge(t *testing.T) {
+	w, client := newTestWallet(t)
+	xpub, err := w.GetXpub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := fmt.Sprintf("wpkh(%s/5/*)", xpub)
+
+	later, earlier := RescanTime(1700100000), RescanTime(1700000000)
+	nextIndex := uint32(7)
+	// imported without ImportDescriptors to not rescan from the timestamps
+	importDescriptor := func(req ImportDescriptorRequest) {
+		w.scanMtx.Lock()
+		defer w.scanMtx.Unlock()
+		if _, err := w.importDescriptor(req); err != nil {
+			t.Fatalf("error importing descriptor: %v", err)
+		}
+	}
+	importDescriptor(ImportDescriptorRequest{Desc: desc, Range: &DescriptorRange{5, 9},
+		NextIndex: &nextIndex, Timestamp: &later})
+	imported := findDescriptor(t, w, desc)
+
+	// re-import extends the range and keeps the next index and earliest timestamp
+	nextIndex = 1
+	importDescriptor(ImportDescriptorRequest{Desc: desc, Range: &DescriptorRange{0, 29},
+		NextIndex: &nextIndex, Timestamp: &earlier})
+
+	for _, wallet := range []*Wallet{w, loadTestWallet(t, w.db, client)} {
+		merged := findDescriptor(t, wallet, desc)
+		if merged.ID != imported.ID {
+			t.Errorf("descriptor was imported again with id %v", merged.ID)
+		}
+		if merged.RangeStart != 0 || merged.RangeEnd != 30 || merged.NextIndex != 7 {
+			t.Errorf("unexpected range - expected: [0, 30) next 7, got: [%v, %v) next %v",
+				merged.RangeStart, merged.RangeEnd, merged.NextIndex)
+		}
+		if merged.Timestamp != int64(earlier) {
+			t.Errorf("expected timestamp %v, got %v", earlier, merged.Timestamp)
+		}
+		if len(wallet.descriptors) != 3 {
+			t.Errorf("expected 3 descriptors, got %v", len(wallet.descriptors))
+		}
+		for idx := uint32(0); idx < 30; idx++ {
+			keyPair := wallet.getKeyPair(descriptorPath(merged.ID, idx))
+			if keyPair == nil {
+				t.Fatalf("key %v of the range was not saved", idx)
+			}
+			if _, ok := wallet.lookupAddress(keyPair.Address); !ok {
+				t.Errorf("address of key %v is not tracked", idx)
+			}
+		}
+	}
+}
+
+func TestImportDescriptorActive(t *testing.T) {
+	w, client := newTestWallet(t)
+	xpub, err := w.GetXpub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := fmt.Sprintf("pkh(%s/2/*)", xpub)
+	second := fmt.Sprintf("pkh(%s/5/*)", xpub)
+	change := fmt.Sprintf("pkh(%s/6/*)", xpub)
+
+	importActive(t, w, first)
+	if !findDescriptor(t, w, first).Active {
+		t.Fatal("imported descriptor is not active")
+	}
+
+	// active descriptor of the same type deactivates the other one
+	importActive(t, w, second)
+	now := RescanNow
+	results, err := w.ImportDescriptors([]ImportDescriptorRequest{
+		{Desc: change, Active: true, Internal: true, Timestamp: &now},
+	})
+	if err != nil || !results[0].Success {
+		t.Fatalf("error importing descriptor: %v %+v", err, results)
+	}
+
+	for _, wallet := range []*Wallet{w, loadTestWallet(t, w.db, client)} {
+		if findDescriptor(t, wallet, first).Active {
+			t.Error("descriptor of the same type is still active")
+		}
+		if !findDescriptor(t, wallet, second).Active {
+			t.Error("imported descriptor is not active")
+		}
+		// change descriptor does not deactivate the receive one
+		if !findDescriptor(t, wallet, change).Active {
+			t.Error("change descriptor is not active")
+		}
+		if wd, ok := wallet.activeDescriptor("legacy", false); !ok || wd.Desc != findDescriptor(t, wallet, second).Desc {
+			t.Errorf("unexpected active legacy descriptor: %+v", wd)
+		}
+		if wd, ok := wallet.activeDescriptor("legacy", true); !ok || wd.Desc != findDescriptor(t, wallet, change).Desc {
+			t.Errorf("unexpected active legacy change descriptor: %+v", wd)
+		}
+		// descriptors of other types are not changed
+		if _, ok := wallet.activeDescriptor("bech32", false); !ok {
+			t.Error("default descriptor was deactivated")
+		}
+	}
+}
+
+func TestHeightForTime(t *testing.T) {
+	// timestamp of block at height in the fake client
+	blockTime := func(height int64) int64 { return 1700000000 + height*600 }
+
+	tests := []struct {
+		name         string
+		timestamps   map[int64]int64
+		ts           int64
+		wantedHeight int64
+	}{
+		{
+			name:         "increasing timestamps",
+			ts:           blockTime(150),
+			wantedHeight: 131,
+		},
+		{
+			// 110 is the first block with a timestamp from ts minus the window.
+			// The ones after it until 116 have earlier timestamps
+			name:         "block with a timestamp ahead of the next blocks",
+			timestamps:   map[int64]int64{110: blockTime(122)},
+			ts:           blockTime(128),
+			wantedHeight: 109,
+		},
+		{
+			name:         "block with a timestamp behind the previous blocks",
+			timestamps:   map[int64]int64{150: blockTime(145)},
+			ts:           blockTime(150),
+			wantedHeight: 131,
+		},
+		{
+			name:         "before the first block",
+			ts:           1600000000,
+			wantedHeight: 0,
+		},
+		{
+			name:         "after the tip",
+			ts:           blockTime(testTipHeight) + 5*60*60,
+			wantedHeight: testTipHeight + 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w, client := newTestWallet(t)
+			client.timestamps = test.timestamps
+
+			height, err := w.heightForTime(test.ts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if height != test.wantedHeight {
+				t.Errorf("expected height %v, got %v", test.wantedHeight, height)
+			}
+		})
+	}
+}
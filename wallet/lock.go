@@ -0,0 +1,109 @@
+package wallet
+
+import (
+	"sync"
+	"time"
+
+	"github.com/elnosh/btcw/utils"
+)
+
+// keyLock holds the master key while the wallet is unlocked. Each unlock
+// replaces the timeout of the previous one and the master key is wiped
+// from memory when the wallet locks again
+type keyLock struct {
+	mtx       sync.Mutex
+	masterKey []byte
+	timer     *time.Timer
+	// incremented on each unlock so that a timer that already
+	// fired for a previous unlock does not lock the wallet
+	generation    uint64
+	unlockedUntil time.Time
+}
+
+// unlock keeps the master key in memory for duration
+func (l *keyLock) unlock(masterKey []byte, duration time.Duration) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.stopTimer()
+	if l.masterKey != nil {
+		utils.Wipe(l.masterKey)
+	}
+	l.masterKey = masterKey
+	l.unlockedUntil = time.Now().Add(duration)
+
+	l.generation++
+	generation := l.generation
+	l.timer = time.AfterFunc(duration, func() {
+		l.mtx.Lock()
+		defer l.mtx.Unlock()
+		if l.generation == generation {
+			l.wipe()
+		}
+	})
+}
+
+// lock wipes the master key and cancels the unlock timeout
+func (l *keyLock) lock() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.stopTimer()
+	l.wipe()
+}
+
+func (l *keyLock) isLocked() bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.masterKey == nil
+}
+
+// getUnlockedUntil returns the time at which the wallet will lock
+// again or the zero time if it is locked
+func (l *keyLock) getUnlockedUntil() time.Time {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.masterKey == nil {
+		return time.Time{}
+	}
+	return l.unlockedUntil
+}
+
+// withMasterKey calls fn with the master key. It returns
+// ErrWalletLocked without calling fn if the wallet is locked.
+// fn must not keep a reference to the key after returning
+func (l *keyLock) withMasterKey(fn func(masterKey []byte) error) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.masterKey == nil {
+		return ErrWalletLocked
+	}
+	return fn(l.masterKey)
+}
+
+// replaceMasterKey replaces the master key if the wallet is unlocked
+// keeping the same timeout. If it is locked the new key is wiped
+func (l *keyLock) replaceMasterKey(masterKey []byte) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.masterKey == nil {
+		utils.Wipe(masterKey)
+		return
+	}
+	utils.Wipe(l.masterKey)
+	l.masterKey = masterKey
+}
+
+func (l *keyLock) stopTimer() {
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+}
+
+func (l *keyLock) wipe() {
+	if l.masterKey != nil {
+		utils.Wipe(l.masterKey)
+		l.masterKey = nil
+	}
+	l.unlockedUntil = time.Time{}
+}
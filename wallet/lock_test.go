@@ -0,0 +1,151 @@
+package wallet
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// newTestKey returns a master key filled with b and a copy of it
+func newTestKey(b byte) ([]byte, []byte) {
+	key := bytes.Repeat([]byte{b}, 32)
+	return key, bytes.Clone(key)
+}
+
+// checkWiped fails if the key was not overwritten with zeros
+func checkWiped(t *testing.T, key []byte) {
+	t.Helper()
+
+	if !bytes.Equal(key, make([]byte, len(key))) {
+		t.Error("master key was not wiped")
+	}
+}
+
+// checkMasterKey fails if the master key of l does not match expected
+func checkMasterKey(t *testing.T, l *keyLock, expected []byte) {
+	t.Helper()
+
+	err := l.withMasterKey(func(masterKey []byte) error {
+		if !bytes.Equal(masterKey, expected) {
+			t.Error("unexpected master key")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestKeyLockTimeout(t *testing.T) {
+	var l keyLock
+	key, _ := newTestKey(1)
+	l.unlock(key, 20*time.Millisecond)
+	if l.isLocked() || l.getUnlockedUntil().IsZero() {
+		t.Fatal("wallet is not unlocked")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for !l.isLocked() {
+		if time.Now().After(deadline) {
+			t.Fatal("wallet was not locked after the timeout")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	checkWiped(t, key)
+	if !l.getUnlockedUntil().IsZero() {
+		t.Error("locked wallet has an unlock time")
+	}
+}
+
+func TestKeyLockUnlockAgain(t *testing.T) {
+	var l keyLock
+	first, _ := newTestKey(1)
+	second, secondCopy := newTestKey(2)
+	l.unlock(first, 20*time.Millisecond)
+	// timeout of the first unlock does not lock the wallet
+	l.unlock(second, time.Hour)
+	checkWiped(t, first)
+
+	time.Sleep(100 * time.Millisecond)
+	if l.isLocked() {
+		t.Fatal("wallet was locked by the timeout of a previous unlock")
+	}
+	checkMasterKey(t, &l, secondCopy)
+	if until := time.Until(l.getUnlockedUntil()); until < 59*time.Minute {
+		t.Errorf("unexpected unlock time in %v", until)
+	}
+}
+
+func TestKeyLockLock(t *testing.T) {
+	var l keyLock
+	key, _ := newTestKey(1)
+	l.unlock(key, time.Hour)
+	l.lock()
+
+	if !l.isLocked() {
+		t.Fatal("wallet is not locked")
+	}
+	checkWiped(t, key)
+	called := false
+	err := l.withMasterKey(func(masterKey []byte) error {
+		called = true
+		return nil
+	})
+	if !errors.Is(err, ErrWalletLocked) {
+		t.Fatalf("expected wallet locked error, got: %v", err)
+	}
+	if called {
+		t.Error("function was called with a locked wallet")
+	}
+
+	// replaced key of a locked wallet is wiped
+	replaced, _ := newTestKey(2)
+	l.replaceMasterKey(replaced)
+	if !l.isLocked() {
+		t.Error("wallet was unlocked by replacing the master key")
+	}
+	checkWiped(t, replaced)
+}
+
+func TestKeyLockReplaceMasterKey(t *testing.T) {
+	var l keyLock
+	old, _ := newTestKey(1)
+	l.unlock(old, time.Hour)
+	unlockedUntil := l.getUnlockedUntil()
+
+	replaced, replacedCopy := newTestKey(2)
+	l.replaceMasterKey(replaced)
+	checkWiped(t, old)
+	checkMasterKey(t, &l, replacedCopy)
+	if !l.getUnlockedUntil().Equal(unlockedUntil) {
+		t.Error("unlock time was changed by replacing the master key")
+	}
+}
+
+func TestWalletLock(t *testing.T) {
+	w, client := newTestWallet(t)
+	fundWallet(t, w, client, "", 50000)
+	w.WalletLock()
+
+	if info := w.GetWalletInfo(); !info.Locked || info.UnlockedUntil != 0 {
+		t.Errorf("unexpected info of locked wallet: %+v", info)
+	}
+	_, err := w.SendToAddress(newTestAddress(t), 0.0002, "", SendOptions{FeeRate: 2000})
+	if !errors.Is(err, ErrWalletLocked) {
+		t.Fatalf("expected wallet locked error, got: %v", err)
+	}
+	if len(client.sent) != 0 {
+		t.Error("tx was sent by a locked wallet")
+	}
+
+	if err := w.WalletPassphrase(testPassphrase, 0); err == nil {
+		t.Error("expected error unlocking without duration")
+	}
+	if err := w.WalletPassphrase(testPassphrase, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if info := w.GetWalletInfo(); info.Locked || info.UnlockedUntil == 0 {
+		t.Errorf("unexpected info of unlocked wallet: %+v", info)
+	}
+}
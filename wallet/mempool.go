@@ -0,0 +1,306 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/elnosh/btcw/tx"
+)
+
+// handleMempoolTx is called when a tx is accepted to the mempool of
+// the node. If the tx sends to or spends from the wallet, it adds
+// the unconfirmed UTXOs and spends to the wallet and tracks the tx
+// until it gets confirmed or dropped from the mempool
+func (w *Wallet) handleMempoolTx(msgTx *wire.MsgTx) {
+	w.scanMtx.Lock()
+	defer w.scanMtx.Unlock()
+
+	txid := msgTx.TxHash().String()
+	if w.isKnownTx(txid) {
+		return
+	}
+
+	relevant := false
+	for _, txIn := range msgTx.TxIn {
+		outpoint := txIn.PreviousOutPoint.String()
+		utxo, ok := w.findUTXO(outpoint)
+		if !ok {
+			continue
+		}
+
+		if utxo.Spent {
+			// tx spending the same UTXO is already confirmed
+			if utxo.SpentHeight > 0 {
+				w.LogInfo("ignoring unconfirmed tx %s conflicting with confirmed tx %s", txid, utxo.SpentBy)
+				return
+			}
+			// tx replaces the one that spent the UTXO
+			w.dropMempoolTx(utxo.SpentBy, txid, "replaced by "+txid)
+		}
+
+		if _, _, err := w.spendUTXO(outpoint, txid, 0); err != nil {
+			w.LogError("error marking UTXO as spent by unconfirmed tx: %v", err)
+			continue
+		}
+		relevant = true
+	}
+
+	for voutIdx, txOut := range msgTx.TxOut {
+		_, addrs, _, err := txscript.ExtractPkScriptAddrs(txOut.PkScript, w.network)
+		if err != nil || len(addrs) != 1 {
+			continue
+		}
+
+		path, ok := w.lookupAddress(addrs[0].String())
+		if !ok {
+			continue
+		}
+		w.markAddressUsed(path)
+
+		utxo := w.newUTXO(txid, uint32(voutIdx), btcutil.Amount(txOut.Value), txOut.PkScript, path)
+		if err := w.addUTXO(*utxo); err != nil {
+			w.LogError("error adding unconfirmed UTXO: %v", err)
+			continue
+		}
+		w.addOutPointToTxFilter(*utxo)
+		relevant = true
+	}
+
+	if relevant {
+		w.LogInfo("detected unconfirmed tx %s", txid)
+		w.trackMempoolTx(msgTx)
+		w.recordTx(msgTx, 0, "", time.Now().Unix())
+	}
+}
+
+// isKnownTx returns true if tx is already tracked or has
+// created or spent UTXOs of the wallet
+func (w *Wallet) isKnownTx(txid string) bool {
+	w.mempoolMtx.Lock()
+	_, tracked := w.mempoolTxs[txid]
+	w.mempoolMtx.Unlock()
+	if tracked {
+		return true
+	}
+
+	w.utxoMtx.Lock()
+	defer w.utxoMtx.Unlock()
+	for _, utxo := range w.utxos {
+		if utxo.TxID == txid || utxo.SpentBy == txid {
+			return true
+		}
+	}
+	return false
+}
+
+// trackMempoolTx saves the unconfirmed tx to know
+// if it gets evicted from the mempool
+func (w *Wallet) trackMempoolTx(msgTx *wire.MsgTx) {
+	var buf bytes.Buffer
+	if err := msgTx.Serialize(&buf); err != nil {
+		w.LogError("error serializing unconfirmed tx: %v", err)
+		return
+	}
+
+	txid := msgTx.TxHash().String()
+	if err := w.saveMempoolTx(txid, buf.Bytes()); err != nil {
+		w.LogError("error saving unconfirmed tx: %v", err)
+		return
+	}
+
+	w.mempoolMtx.Lock()
+	w.mempoolTxs[txid] = msgTx
+	w.mempoolMtx.Unlock()
+}
+
+// confirmMempoolTx stops tracking the tx once
+// it has been confirmed in a block
+func (w *Wallet) confirmMempoolTx(txid string) {
+	w.mempoolMtx.Lock()
+	_, tracked := w.mempoolTxs[txid]
+	delete(w.mempoolTxs, txid)
+	w.mempoolMtx.Unlock()
+	if !tracked {
+		return
+	}
+
+	if err := w.deleteMempoolTx(txid); err != nil {
+		w.LogError("error removing confirmed tx from mempool: %v", err)
+		return
+	}
+	w.LogInfo("unconfirmed tx %s got confirmed", txid)
+}
+
+// droppedTxs are the changes to the wallet from dropping unconfirmed txs.
+// UTXOs created by the txs are removed and UTXOs spent by them are unspent
+type droppedTxs struct {
+	// the tx dropped first followed by the txs spending its outputs
+	txids   []string
+	removed []string
+	unspent []tx.UTXO
+}
+
+// planDrop returns the changes to drop the unconfirmed tx and the txs
+// spending its outputs without applying them. UTXOs in keep are not
+// unspent (i.e inputs of the tx replacing it)
+func (w *Wallet) planDrop(txid string, keep map[string]bool) *droppedTxs {
+	w.utxoMtx.Lock()
+	defer w.utxoMtx.Unlock()
+
+	dropped := &droppedTxs{}
+	isDropped := map[string]bool{txid: true}
+	isRemoved := make(map[string]bool)
+	for queue := []string{txid}; len(queue) > 0; queue = queue[1:] {
+		dropped.txids = append(dropped.txids, queue[0])
+		for _, utxo := range w.utxos {
+			if utxo.TxID != queue[0] || utxo.Height != 0 {
+				continue
+			}
+			dropped.removed = append(dropped.removed, utxo.GetOutpoint())
+			isRemoved[utxo.GetOutpoint()] = true
+			if utxo.Spent && utxo.SpentHeight == 0 && !isDropped[utxo.SpentBy] {
+				isDropped[utxo.SpentBy] = true
+				queue = append(queue, utxo.SpentBy)
+			}
+		}
+	}
+
+	for _, utxo := range w.utxos {
+		outpoint := utxo.GetOutpoint()
+		if !utxo.Spent || utxo.SpentHeight != 0 || !isDropped[utxo.SpentBy] || isRemoved[outpoint] || keep[outpoint] {
+			continue
+		}
+		utxo.Spent = false
+		utxo.SpentBy = ""
+		dropped.unspent = append(dropped.unspent, utxo)
+	}
+	return dropped
+}
+
+// applyDroppedTxs updates the wallet in memory with
+// the dropped txs once they are saved in the db
+func (w *Wallet) applyDroppedTxs(dropped *droppedTxs, reason string) {
+	w.LogInfo("dropping unconfirmed tx %s: %s", dropped.txids[0], reason)
+	for _, txid := range dropped.txids[1:] {
+		w.LogInfo("dropping unconfirmed tx %s: spends outputs of dropped tx", txid)
+	}
+
+	w.utxoMtx.Lock()
+	w.utxos = slices.DeleteFunc(w.utxos, func(utxo tx.UTXO) bool {
+		return slices.Contains(dropped.removed, utxo.GetOutpoint())
+	})
+	for _, unspent := range dropped.unspent {
+		for i := range w.utxos {
+			if w.utxos[i].GetOutpoint() == unspent.GetOutpoint() {
+				w.utxos[i] = unspent
+				break
+			}
+		}
+	}
+	w.utxoMtx.Unlock()
+
+	w.mempoolMtx.Lock()
+	for _, txid := range dropped.txids {
+		delete(w.mempoolTxs, txid)
+	}
+	w.mempoolMtx.Unlock()
+}
+
+// dropMempoolTx reverts the changes of an unconfirmed tx that was evicted
+// from the mempool or conflicted. UTXOs created by the tx are removed and
+// UTXOs spent by it are marked unspent. Txs spending its outputs are dropped too.
+// If replacedBy is set, the record of the tx is marked as replaced by it
+func (w *Wallet) dropMempoolTx(txid, replacedBy, reason string) {
+	dropped := w.planDrop(txid, nil)
+	if err := w.saveDroppedTxs(dropped, replacedBy); err != nil {
+		w.LogError("error dropping unconfirmed tx %s: %v", txid, err)
+		return
+	}
+	w.applyDroppedTxs(dropped, reason)
+}
+
+// checkMempoolTxs drops the tracked unconfirmed txs that are
+// no longer in the mempool of the node. Callers must hold scanMtx
+func (w *Wallet) checkMempoolTxs() {
+	w.mempoolMtx.Lock()
+	tracked := len(w.mempoolTxs)
+	w.mempoolMtx.Unlock()
+	if tracked == 0 {
+		return
+	}
+
+	mempool, err := w.client.GetRawMempool()
+	if err != nil {
+		w.LogError("error getting mempool: %v", err)
+		return
+	}
+	inMempool := make(map[string]struct{}, len(mempool))
+	for _, hash := range mempool {
+		inMempool[hash.String()] = struct{}{}
+	}
+
+	w.mempoolMtx.Lock()
+	evicted := []string{}
+	for txid := range w.mempoolTxs {
+		if _, ok := inMempool[txid]; !ok {
+			evicted = append(evicted, txid)
+		}
+	}
+	w.mempoolMtx.Unlock()
+
+	for _, txid := range evicted {
+		w.dropMempoolTx(txid, "", "evicted from mempool")
+	}
+}
+
+// pollMempool gets the txs in the mempool of the node that have not
+// been seen in previous polls and checks if they are relevant to the wallet.
+// Used when the node does not send notifications for new txs
+func (w *Wallet) pollMempool() {
+	mempool, err := w.client.GetRawMempool()
+	if err != nil {
+		w.LogError("error getting mempool: %v", err)
+		return
+	}
+
+	seen := make(map[string]struct{}, len(mempool))
+	for _, hash := range mempool {
+		txid := hash.String()
+		seen[txid] = struct{}{}
+		if _, ok := w.mempoolSeen[txid]; ok {
+			continue
+		}
+
+		rawTx, err := w.client.GetRawTransaction(hash)
+		if err != nil {
+			// tx could have been removed from mempool since
+			continue
+		}
+		w.handleMempoolTx(rawTx.MsgTx())
+	}
+	w.mempoolSeen = seen
+}
+
+// watchMempool polls the mempool of the node periodically
+func watchMempool(ctx context.Context, wallet *Wallet) {
+	wallet.LogInfo("Polling mempool for new transactions")
+	ticker := time.NewTicker(time.Second * 30)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			wallet.pollMempool()
+
+			wallet.scanMtx.Lock()
+			wallet.checkMempoolTxs()
+			wallet.scanMtx.Unlock()
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package wallet
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+// addToMempool adds the txs to the mempool of the node
+func addToMempool(client *fakeClient, txs ...*wire.MsgTx) {
+	for _, msgTx := range txs {
+		client.txs[msgTx.TxHash()] = msgTx
+		client.entries[msgTx.TxHash()] = &MempoolEntry{}
+	}
+}
+
+// removeFromMempool removes the txs from the mempool of the node
+func removeFromMempool(client *fakeClient, txs ...*wire.MsgTx) {
+	for _, msgTx := range txs {
+		delete(client.entries, msgTx.TxHash())
+	}
+}
+
+// checkDropped fails if the unconfirmed tx is still in the wallet
+func checkDropped(t *testing.T, w *Wallet, msgTx *wire.MsgTx) {
+	t.Helper()
+
+	txid := msgTx.TxHash().String()
+	if record := w.getTxRecord(txid); record == nil || !record.Dropped {
+		t.Errorf("tx %s was not dropped: %+v", txid, record)
+	}
+	if _, ok := w.mempoolTxs[txid]; ok {
+		t.Errorf("dropped tx %s is still tracked as unconfirmed", txid)
+	}
+	for i := range msgTx.TxOut {
+		if utxo, ok := w.findUTXO(fmt.Sprintf("%s:%v", txid, i)); ok {
+			t.Errorf("utxo of dropped tx was not removed: %+v", utxo)
+		}
+	}
+}
+
+func TestMempoolTxConfirmed(t *testing.T) {
+	for _, scanner := range testScanners {
+		t.Run(scanner.name, func(t *testing.T) {
+			w, client := newTestWallet(t)
+			address, err := w.GetNewAddress("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			payment := paymentTx(t, address, 20000)
+			txid := payment.TxHash().String()
+			outpoint := txid + ":0"
+
+			// found polling the mempool when the node does not send notifications
+			addToMempool(client, payment)
+			w.pollMempool()
+			w.pollMempool()
+			w.handleMempoolTx(payment)
+
+			for _, wallet := range []*Wallet{w, loadTestWallet(t, w.db, client)} {
+				if utxo := findTestUTXO(t, wallet, outpoint); utxo.Height != 0 {
+					t.Errorf("unexpected height of unconfirmed utxo: %v", utxo.Height)
+				}
+				record := wallet.getTxRecord(txid)
+				if record == nil || record.Direction != DirectionReceive || record.BlockHeight != 0 {
+					t.Errorf("unexpected record of unconfirmed tx: %+v", record)
+				}
+				if _, ok := wallet.mempoolTxs[txid]; !ok {
+					t.Error("unconfirmed tx is not tracked")
+				}
+				if balances := wallet.GetBalances(0); balances.UntrustedPending != 20000 || balances.Trusted != 0 {
+					t.Errorf("unexpected balances with unconfirmed tx: %+v", balances)
+				}
+				checkConsistent(t, wallet)
+			}
+
+			// promoted when its block is scanned
+			removeFromMempool(client, payment)
+			height := scanner.scan(t, w, client, payment)
+			w.scanMtx.Lock()
+			w.checkMempoolTxs()
+			w.scanMtx.Unlock()
+
+			for _, wallet := range []*Wallet{w, loadTestWallet(t, w.db, client)} {
+				if utxo := findTestUTXO(t, wallet, outpoint); utxo.Height != height {
+					t.Errorf("utxo not confirmed at block %v: %+v", height, utxo)
+				}
+				if record := wallet.getTxRecord(txid); record.BlockHeight != height || record.Dropped {
+					t.Errorf("unexpected record of confirmed tx: %+v", record)
+				}
+				if _, ok := wallet.mempoolTxs[txid]; ok {
+					t.Error("confirmed tx is still tracked as unconfirmed")
+				}
+				if balances := wallet.GetBalances(0); balances.Trusted != 20000 || balances.UntrustedPending != 0 {
+					t.Errorf("unexpected balances with confirmed tx: %+v", balances)
+				}
+				checkConsistent(t, wallet)
+			}
+		})
+	}
+}
+
+func TestMempoolTxEvicted(t *testing.T) {
+	w, client := newTestWallet(t)
+	addresses := make([]string, 3)
+	for i := range addresses {
+		address, err := w.GetNewAddress("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addresses[i] = address
+	}
+	payment := paymentTx(t, addresses[0], 20000)
+	addToMempool(client, payment)
+	w.handleMempoolTx(payment)
+	// unconfirmed tx spending the output of the payment to the wallet
+	child := spendingTestTx(t, findTestUTXO(t, w, payment.TxHash().String()+":0"), addresses[1])
+	addToMempool(client, child)
+	w.handleMempoolTx(child)
+	// tx that stays in the mempool
+	kept := paymentTx(t, addresses[2], 30000)
+	addToMempool(client, kept)
+	w.handleMempoolTx(kept)
+
+	// nothing is dropped while the txs are in the mempool
+	w.scanMtx.Lock()
+	w.checkMempoolTxs()
+	w.scanMtx.Unlock()
+	if tracked := len(w.mempoolTxs); tracked != 3 {
+		t.Fatalf("expected 3 unconfirmed txs, got %v", tracked)
+	}
+
+	removeFromMempool(client, payment, child)
+	w.scanMtx.Lock()
+	w.checkMempoolTxs()
+	w.scanMtx.Unlock()
+
+	for _, wallet := range []*Wallet{w, loadTestWallet(t, w.db, client)} {
+		checkDropped(t, wallet, payment)
+		checkDropped(t, wallet, child)
+		if _, ok := wallet.mempoolTxs[kept.TxHash().String()]; !ok {
+			t.Error("tx in the mempool is not tracked")
+		}
+		if balance := wallet.GetBalances(0).UntrustedPending; balance != 30000 {
+			t.Errorf("unexpected pending balance after eviction - expected: %v, got: %v", 30000, balance)
+		}
+		checkConsistent(t, wallet)
+	}
+}
+
+func TestMempoolTxConflicted(t *testing.T) {
+	for _, scanner := range testScanners {
+		t.Run(scanner.name, func(t *testing.T) {
+			w, client := newTestWallet(t)
+			funding := fundWallet(t, w, client, "", 50000)
+			address, err := w.GetNewAddress("")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// unconfirmed spend of the wallet utxo signed elsewhere
+			// and a tx spending its output
+			spend := spendingTestTx(t, funding, address)
+			addToMempool(client, spend)
+			w.handleMempoolTx(spend)
+			child := spendingTestTx(t, findTestUTXO(t, w, spend.TxHash().String()+":0"), newTestAddress(t))
+			addToMempool(client, child)
+			w.handleMempoolTx(child)
+			if utxo := findTestUTXO(t, w, funding.GetOutpoint()); utxo.SpentBy != spend.TxHash().String() {
+				t.Fatalf("utxo not spent by unconfirmed tx: %+v", utxo)
+			}
+
+			// another spend of the same utxo confirms
+			conflicting := spendingTestTx(t, funding, newTestAddress(t))
+			conflicting.TxOut[0].Value -= 1000
+			removeFromMempool(client, spend, child)
+			height := scanner.scan(t, w, client, conflicting)
+
+			// unconfirmed tx conflicting with the confirmed one is ignored
+			late := spendingTestTx(t, funding, address)
+			late.TxOut[0].Value -= 2000
+			w.handleMempoolTx(late)
+
+			for _, wallet := range []*Wallet{w, loadTestWallet(t, w.db, client)} {
+				checkDropped(t, wallet, spend)
+				checkDropped(t, wallet, child)
+				utxo := findTestUTXO(t, wallet, funding.GetOutpoint())
+				if utxo.SpentBy != conflicting.TxHash().String() || utxo.SpentHeight != height {
+					t.Errorf("utxo not spent by confirmed tx: %+v", utxo)
+				}
+				if wallet.getTxRecord(late.TxHash().String()) != nil {
+					t.Error("tx conflicting with confirmed tx was recorded")
+				}
+				if balances := wallet.GetBalances(0); balances != (Balances{}) {
+					t.Errorf("unexpected balances after conflict: %+v", balances)
+				}
+				checkConsistent(t, wallet)
+			}
+		})
+	}
+}
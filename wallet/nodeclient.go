@@ -1,6 +1,7 @@
 package wallet
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -13,24 +14,35 @@ import (
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/rpcclient"
 	"github.com/btcsuite/btcd/wire"
+	"github.com/elnosh/btcw/tx"
 	"github.com/libsv/go-bn/zmq"
 )
 
 type NodeClient interface {
 	GetBlockCount() (int64, error)
 	GetBlockHash(int64) (*chainhash.Hash, error)
+	GetBlockHeader(*chainhash.Hash) (*wire.BlockHeader, error)
 	GetBlockVerboseTx(*chainhash.Hash) (*btcjson.GetBlockVerboseTxResult, error)
 	SendRawTransaction(*wire.MsgTx, bool) (*chainhash.Hash, error)
-	EstimateFee(int64) btcutil.Amount
+	EstimateFee(int64) (tx.FeeRate, error)
 	LoadTxFilter(bool, []btcutil.Address, []wire.OutPoint) error
+	GetRawMempool() ([]*chainhash.Hash, error)
+	GetRawTransaction(*chainhash.Hash) (*btcutil.Tx, error)
+	GetMempoolEntry(*chainhash.Hash) (*MempoolEntry, error)
 }
 
-var (
-	defaultFee = btcutil.Amount(2)
-)
+// MempoolEntry is the size and fee of an unconfirmed tx in the mempool of
+// the node. Ancestor size and fees include the tx and its unconfirmed ancestors
+type MempoolEntry struct {
+	VSize        int64
+	Fee          btcutil.Amount
+	AncestorSize int64
+	AncestorFees btcutil.Amount
+}
 
 var (
 	ErrZMQNotEnabled = errors.New("ZeroMQ is not enabled")
+	ErrNoFeeEstimate = errors.New("node does not have enough data to estimate fee")
 )
 
 type BtcdClient struct {
@@ -48,7 +60,22 @@ func SetupBtcdClient(wallet *Wallet, net *chaincfg.Params, rpcuser, rpcpass stri
 		OnFilteredBlockConnected: func(height int32, header *wire.BlockHeader, txs []*btcutil.Tx) {
 			blockhash := header.BlockHash().String()
 			wallet.LogInfo("received new block with id: %s", blockhash)
-			go wallet.scanBlockTxs(blockhash, txs)
+			go wallet.handleFilteredBlockConnected(int64(height), header, txs)
+		},
+		// notification handler for when block is removed from the chain
+		OnFilteredBlockDisconnected: func(height int32, header *wire.BlockHeader) {
+			wallet.LogInfo("block %s disconnected from chain", header.BlockHash().String())
+			go wallet.handleFilteredBlockDisconnected(int64(height), header)
+		},
+		// notification handler for txs accepted to the mempool that
+		// match the addresses and outpoints in the loaded tx filter
+		OnRelevantTxAccepted: func(transaction []byte) {
+			msgTx := wire.NewMsgTx(wire.TxVersion)
+			if err := msgTx.Deserialize(bytes.NewReader(transaction)); err != nil {
+				wallet.LogError("error decoding relevant tx: %v", err)
+				return
+			}
+			go wallet.handleMempoolTx(msgTx)
 		},
 	}
 
@@ -74,6 +101,9 @@ func SetupBtcdClient(wallet *Wallet, net *chaincfg.Params, rpcuser, rpcpass stri
 		// scan blocks added to the blockchain while wallet server was not up
 		wallet.scanMissingBlocks()
 
+		// check txs that entered the mempool while wallet server was not up
+		wallet.pollMempool()
+
 		// setup btcd notifications for when new block is added
 		client.NotifyBlocks()
 	}()
@@ -90,6 +120,10 @@ func (btcd *BtcdClient) GetBlockHash(height int64) (*chainhash.Hash, error) {
 	return btcd.client.GetBlockHash(height)
 }
 
+func (btcd *BtcdClient) GetBlockHeader(hash *chainhash.Hash) (*wire.BlockHeader, error) {
+	return btcd.client.GetBlockHeader(hash)
+}
+
 func (btcd *BtcdClient) GetBlockVerboseTx(hash *chainhash.Hash) (*btcjson.GetBlockVerboseTxResult, error) {
 	return btcd.client.GetBlockVerboseTx(hash)
 }
@@ -98,20 +132,73 @@ func (btcd *BtcdClient) SendRawTransaction(tx *wire.MsgTx, highFees bool) (*chai
 	return btcd.client.SendRawTransaction(tx, highFees)
 }
 
-func (btcd *BtcdClient) EstimateFee(numBlocks int64) btcutil.Amount {
-	estimateFee, err := btcd.client.EstimateFee(numBlocks)
-	if err != nil || estimateFee == 0 {
-		return defaultFee
+func (btcd *BtcdClient) GetRawMempool() ([]*chainhash.Hash, error) {
+	return btcd.client.GetRawMempool()
+}
+
+func (btcd *BtcdClient) GetRawTransaction(hash *chainhash.Hash) (*btcutil.Tx, error) {
+	return btcd.client.GetRawTransaction(hash)
+}
+
+// GetMempoolEntry returns the size and fee of the tx from the verbose
+// mempool since btcd does not implement getmempoolentry. Ancestors are
+// found following the unconfirmed txs it depends on
+func (btcd *BtcdClient) GetMempoolEntry(hash *chainhash.Hash) (*MempoolEntry, error) {
+	mempool, err := btcd.client.GetRawMempoolVerbose()
+	if err != nil {
+		return nil, err
+	}
+	txEntry, ok := mempool[hash.String()]
+	if !ok {
+		return nil, errors.New("transaction not in mempool")
+	}
+	fee, err := btcutil.NewAmount(txEntry.Fee)
+	if err != nil {
+		return nil, err
+	}
+	entry := &MempoolEntry{VSize: int64(txEntry.Vsize), Fee: fee}
+
+	visited := map[string]bool{}
+	pending := []string{hash.String()}
+	for len(pending) > 0 {
+		txid := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		ancestor, ok := mempool[txid]
+		if visited[txid] || !ok {
+			continue
+		}
+		visited[txid] = true
+
+		ancestorFee, err := btcutil.NewAmount(ancestor.Fee)
+		if err != nil {
+			return nil, err
+		}
+		entry.AncestorSize += int64(ancestor.Vsize)
+		entry.AncestorFees += ancestorFee
+		pending = append(pending, ancestor.Depends...)
+	}
+	return entry, nil
+}
+
+// EstimateFee returns the fee rate estimated by the node
+// for a tx to confirm within numBlocks
+func (btcd *BtcdClient) EstimateFee(numBlocks int64) (tx.FeeRate, error) {
+	// btcd returns the fee rate in BTC/kB
+	btcPerKvB, err := btcd.client.EstimateFee(numBlocks)
+	if err != nil {
+		return 0, err
+	}
+	if btcPerKvB <= 0 {
+		return 0, ErrNoFeeEstimate
 	}
-	fee, _ := btcutil.NewAmount(estimateFee)
-	return fee
+	return tx.FeeRateFromBTCPerKvB(btcPerKvB)
 }
 
-// loadTxFilter sends the list of wallet external addresses
-// in the loadtxfilter RPC call. This is specific to btcd.
-// to be used whenever a new address is generated so that
-// btcd notifcations will add the new address to the filter
+// loadTxFilter sends the list of wallet addresses of all
+// descriptors in the loadtxfilter RPC call.
+// This is specific to btcd.
 func (w *Wallet) loadTxFilter() error {
+	w.addressesMtx.RLock()
 	addrs := make([]btcutil.Address, len(w.addresses))
 	i := 0
 	for k := range w.addresses {
@@ -119,13 +206,73 @@ func (w *Wallet) loadTxFilter() error {
 		addrs[i] = addr
 		i++
 	}
+	w.addressesMtx.RUnlock()
+
+	// add outpoints of unspent UTXOs to get notified when they are spent
+	outpoints := []wire.OutPoint{}
+	w.utxoMtx.Lock()
+	for _, utxo := range w.utxos {
+		if utxo.Spent {
+			continue
+		}
+		outpoint, err := utxoOutPoint(utxo)
+		if err != nil {
+			continue
+		}
+		outpoints = append(outpoints, *outpoint)
+	}
+	w.utxoMtx.Unlock()
 
-	if err := w.client.LoadTxFilter(true, addrs, []wire.OutPoint{}); err != nil {
+	if err := w.client.LoadTxFilter(true, addrs, outpoints); err != nil {
 		return fmt.Errorf("client.LoadTxFilter: %v", err)
 	}
 	return nil
 }
 
+// addToTxFilter adds a newly generated address to the tx filter
+// so that btcd notifications will include transactions to it
+func (w *Wallet) addToTxFilter(address string) {
+	if w.client == nil {
+		return
+	}
+
+	addr, err := btcutil.DecodeAddress(address, w.network)
+	if err != nil {
+		w.LogError("error adding address to tx filter: %v", err)
+		return
+	}
+
+	if err := w.client.LoadTxFilter(false, []btcutil.Address{addr}, []wire.OutPoint{}); err != nil {
+		w.LogError("error adding address to tx filter: %v", err)
+	}
+}
+
+// addOutPointToTxFilter adds the outpoint of a new UTXO to the
+// tx filter so that btcd notifications will include transactions spending it
+func (w *Wallet) addOutPointToTxFilter(utxo tx.UTXO) {
+	if w.client == nil {
+		return
+	}
+
+	outpoint, err := utxoOutPoint(utxo)
+	if err != nil {
+		w.LogError("error adding outpoint to tx filter: %v", err)
+		return
+	}
+
+	if err := w.client.LoadTxFilter(false, []btcutil.Address{}, []wire.OutPoint{*outpoint}); err != nil {
+		w.LogError("error adding outpoint to tx filter: %v", err)
+	}
+}
+
+func utxoOutPoint(utxo tx.UTXO) (*wire.OutPoint, error) {
+	hash, err := chainhash.NewHashFromStr(utxo.TxID)
+	if err != nil {
+		return nil, err
+	}
+	return wire.NewOutPoint(hash, utxo.VoutIdx), nil
+}
+
 func (btcd *BtcdClient) LoadTxFilter(reload bool, addresses []btcutil.Address, outpoints []wire.OutPoint) error {
 	return btcd.client.LoadTxFilter(reload, addresses, outpoints)
 }
@@ -160,21 +307,26 @@ func SetupBitcoinCoreClient(wallet *Wallet, net *chaincfg.Params, rpcuser, rpcpa
 		wallet.scanMissingBlocks()
 
 		// setup ZeroMQ notifications for new blocks added
-		err = subscribeZeroMQNotifications(wallet, coreClient)
+		// and new txs in the mempool
+		mempoolNotifications, err := subscribeZeroMQNotifications(wallet, coreClient)
 		// if err with ZeroMQ notifcations, sync manually
 		if err != nil {
-			ctx, cancel := context.WithCancel(context.Background())
-			defer cancel()
-
+			errChan := make(chan error)
+			go scanForNewBlocks(context.Background(), wallet, errChan)
 			go func() {
-				errChan := make(chan error)
-				go scanForNewBlocks(ctx, wallet, errChan)
-				err = <-errChan
+				err := <-errChan
 				if err != nil {
 					wallet.LogError("error scanning blockchain: %v", err)
 				}
 			}()
 		}
+
+		if !mempoolNotifications {
+			go watchMempool(context.Background(), wallet)
+		} else {
+			// check txs that entered the mempool while wallet server was not up
+			wallet.pollMempool()
+		}
 	}()
 
 	return coreClient, nil
@@ -188,6 +340,10 @@ func (core *BitcoinCoreClient) GetBlockHash(height int64) (*chainhash.Hash, erro
 	return core.client.GetBlockHash(height)
 }
 
+func (core *BitcoinCoreClient) GetBlockHeader(hash *chainhash.Hash) (*wire.BlockHeader, error) {
+	return core.client.GetBlockHeader(hash)
+}
+
 func (core *BitcoinCoreClient) GetBlockVerboseTx(hash *chainhash.Hash) (*btcjson.GetBlockVerboseTxResult, error) {
 	return core.client.GetBlockVerboseTx(hash)
 }
@@ -196,45 +352,133 @@ func (core *BitcoinCoreClient) SendRawTransaction(tx *wire.MsgTx, highFees bool)
 	return core.client.SendRawTransaction(tx, highFees)
 }
 
-func (core *BitcoinCoreClient) EstimateFee(numBlocks int64) btcutil.Amount {
+func (core *BitcoinCoreClient) GetRawMempool() ([]*chainhash.Hash, error) {
+	return core.client.GetRawMempool()
+}
+
+func (core *BitcoinCoreClient) GetRawTransaction(hash *chainhash.Hash) (*btcutil.Tx, error) {
+	return core.client.GetRawTransaction(hash)
+}
+
+func (core *BitcoinCoreClient) GetMempoolEntry(hash *chainhash.Hash) (*MempoolEntry, error) {
+	coreEntry, err := core.client.GetMempoolEntry(hash.String())
+	if err != nil {
+		return nil, err
+	}
+	fee, err := btcutil.NewAmount(coreEntry.Fees.Base)
+	if err != nil {
+		return nil, err
+	}
+	ancestorFees, err := btcutil.NewAmount(coreEntry.Fees.Ancestor)
+	if err != nil {
+		return nil, err
+	}
+	return &MempoolEntry{
+		VSize:        int64(coreEntry.VSize),
+		Fee:          fee,
+		AncestorSize: coreEntry.AncestorSize,
+		AncestorFees: ancestorFees,
+	}, nil
+}
+
+// EstimateFee returns the fee rate estimated by the node
+// for a tx to confirm within numBlocks
+func (core *BitcoinCoreClient) EstimateFee(numBlocks int64) (tx.FeeRate, error) {
 	feeRes, err := core.client.EstimateSmartFee(numBlocks, &btcjson.EstimateModeConservative)
-	if err != nil || *feeRes.FeeRate == 0 {
-		return defaultFee
+	if err != nil {
+		return 0, err
 	}
-	fee, _ := btcutil.NewAmount(*feeRes.FeeRate)
-	return fee
+	// fee rate is not set if the node does not have enough data
+	if feeRes.FeeRate == nil || *feeRes.FeeRate <= 0 {
+		if len(feeRes.Errors) > 0 {
+			return 0, fmt.Errorf("%w: %s", ErrNoFeeEstimate, feeRes.Errors[0])
+		}
+		return 0, ErrNoFeeEstimate
+	}
+	// bitcoin core returns the fee rate in BTC/kvB
+	return tx.FeeRateFromBTCPerKvB(*feeRes.FeeRate)
 }
 
 func (core *BitcoinCoreClient) LoadTxFilter(reload bool, addresses []btcutil.Address, outpoints []wire.OutPoint) error {
 	return nil
 }
 
-func subscribeZeroMQNotifications(wallet *Wallet, core *BitcoinCoreClient) error {
+// subscribeZeroMQNotifications subscribes to the ZeroMQ notifications enabled
+// in the node. It returns true if notifications for new txs are enabled
+func subscribeZeroMQNotifications(wallet *Wallet, core *BitcoinCoreClient) (bool, error) {
 	zmqNotifications, err := core.client.GetZmqNotifications()
 	if err != nil || len(zmqNotifications) == 0 {
-		return ErrZMQNotEnabled
+		return false, ErrZMQNotEnabled
 	}
 
+	blockNotifications := false
+	mempoolNotifications := false
 	for _, notification := range zmqNotifications {
 		addr := notification.Address.String()
 
-		z := zmq.NewNodeMQ(zmq.WithHost(addr))
-		if err := z.SubscribeHashBlock(func(_ context.Context, hashStr string) {
-			wallet.LogInfo("received new block with id: %s", hashStr)
-			blockhash, err := chainhash.NewHashFromStr(hashStr)
-			if err != nil {
-				wallet.LogError("error decoding hash string: %v", err)
+		var z zmq.NodeMQ
+		switch notification.Type {
+		case "pubhashblock":
+			z = zmq.NewNodeMQ(zmq.WithHost(addr))
+			if err := z.SubscribeHashBlock(func(_ context.Context, hashStr string) {
+				wallet.LogInfo("received new block with id: %s", hashStr)
+				go wallet.handleNewBlock()
+			}); err != nil {
+				wallet.LogError("error with ZeroMQ notifications: %v", err)
+				continue
+			}
+			blockNotifications = true
+
+		case "pubrawtx":
+			z = zmq.NewNodeMQ(zmq.WithHost(addr), zmq.WithRaw())
+			if err := z.Subscribe(zmq.TopicRawTx, func(_ context.Context, frames [][]byte) {
+				// frames are the topic, the raw tx and the sequence number
+				if len(frames) < 2 {
+					wallet.LogError("skipping malformed raw tx notification with %v frames", len(frames))
+					return
+				}
+				msgTx := wire.NewMsgTx(wire.TxVersion)
+				if err := msgTx.Deserialize(bytes.NewReader(frames[1])); err != nil {
+					wallet.LogError("error decoding raw tx: %v", err)
+					return
+				}
+				go wallet.handleMempoolTx(msgTx)
+			}); err != nil {
+				wallet.LogError("error with ZeroMQ notifications: %v", err)
+				continue
 			}
-			go wallet.scanBlock(blockhash)
-		}); err != nil {
-			wallet.LogError("error with ZeroMQ notifications: %v", err)
+			mempoolNotifications = true
+
+		case "pubhashtx":
+			z = zmq.NewNodeMQ(zmq.WithHost(addr))
+			if err := z.SubscribeHashTx(func(_ context.Context, hashStr string) {
+				hash, err := chainhash.NewHashFromStr(hashStr)
+				if err != nil {
+					wallet.LogError("error decoding hash string: %v", err)
+					return
+				}
+				rawTx, err := core.GetRawTransaction(hash)
+				if err != nil {
+					return
+				}
+				go wallet.handleMempoolTx(rawTx.MsgTx())
+			}); err != nil {
+				wallet.LogError("error with ZeroMQ notifications: %v", err)
+				continue
+			}
+			mempoolNotifications = true
+
+		default:
+			continue
 		}
 
 		go func() {
 			fmt.Println(z.Connect())
 		}()
-
 	}
 
-	return nil
+	if !blockNotifications {
+		return mempoolNotifications, ErrZMQNotEnabled
+	}
+	return mempoolNotifications, nil
 }
@@ -0,0 +1,890 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/elnosh/btcw/descriptor"
+	"github.com/elnosh/btcw/tx"
+)
+
+// FundedPSBT is an unsigned PSBT funded with UTXOs of the wallet
+type FundedPSBT struct {
+	PSBT string         `json:"psbt"`
+	Fee  btcutil.Amount `json:"fee"`
+	// index of the change output. -1 if there is no change
+	ChangePos int `json:"changepos"`
+}
+
+// ProcessedPSBT is a PSBT updated by the wallet. Hex is the
+// extracted tx if it was requested and all inputs are finalized
+type ProcessedPSBT struct {
+	PSBT     string `json:"psbt"`
+	Hex      string `json:"hex,omitempty"`
+	Complete bool   `json:"complete"`
+}
+
+// WalletCreateFundedPSBT creates a PSBT paying the amounts in BTC to the
+// addresses funded with UTXOs of the wallet like SendMany. The PSBT is not
+// signed. Inputs have the UTXOs they spend and inputs and change have the
+// BIP32 derivation of the keys. The change key is saved in the wallet so
+// that the change is found once the tx is broadcast by any signer
+func (w *Wallet) WalletCreateFundedPSBT(amounts map[string]float64, opts SendOptions) (*FundedPSBT, error) {
+	outputs, subtractFeeFrom, err := w.recipientOutputs(amounts, opts.SubtractFeeFrom)
+	if err != nil {
+		return nil, err
+	}
+	feeRate, err := w.feeRate(opts)
+	if err != nil {
+		return nil, err
+	}
+	selector, err := w.coinSelector(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	w.scanMtx.Lock()
+	defer w.scanMtx.Unlock()
+
+	rawTx, _, change, err := w.fundTransaction(outputs, subtractFeeFrom, feeRate, selector)
+	if err != nil {
+		w.LogError("unable to create psbt - error creating transaction: %s", err.Error())
+		return nil, err
+	}
+	setReplaceable(rawTx, !opts.DisableRBF)
+
+	return w.newFundedPSBT(rawTx, change)
+}
+
+// newFundedPSBT creates a PSBT with the information of the wallet for the
+// unsigned tx funded by the wallet. The change key is saved in the wallet
+// so that the change is found once the tx is sent. Callers must hold scanMtx
+func (w *Wallet) newFundedPSBT(rawTx *wire.MsgTx, change *changeOutput) (*FundedPSBT, error) {
+	packet, err := psbt.NewFromUnsignedTx(rawTx)
+	if err != nil {
+		return nil, fmt.Errorf("error creating psbt: %s", err.Error())
+	}
+
+	changePos := -1
+	if change != nil {
+		if err := w.useKey(change.Path); err != nil {
+			return nil, err
+		}
+		w.addToTxFilter(change.KeyPair.Address)
+		changePos = int(change.Index)
+	}
+
+	if err := w.updatePSBT(packet); err != nil {
+		return nil, err
+	}
+	fee, err := packet.GetTxFee()
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := packet.B64Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	return &FundedPSBT{PSBT: encoded, Fee: fee, ChangePos: changePos}, nil
+}
+
+// WalletProcessPSBT adds the information the wallet has about the inputs and
+// outputs of the PSBT. If sign is set, it signs the inputs spending UTXOs of
+// the wallet unless it is watch-only. If finalize is set, inputs with all
+// their signatures are finalized
+func (w *Wallet) WalletProcessPSBT(encoded string, sign, finalize bool) (*ProcessedPSBT, error) {
+	packet, err := decodePSBT(encoded)
+	if err != nil {
+		return nil, err
+	}
+	// watch-only wallets only add the information they have
+	sign = sign && !w.watchOnly
+	if sign && w.keys.isLocked() {
+		return nil, ErrWalletLocked
+	}
+
+	if err := w.updatePSBT(packet); err != nil {
+		return nil, err
+	}
+	if sign {
+		if err := w.signPSBT(packet); err != nil {
+			return nil, err
+		}
+	}
+	complete := packet.IsComplete()
+	if finalize {
+		if complete, err = finalizePSBT(packet); err != nil {
+			return nil, err
+		}
+	}
+
+	return processedPSBT(packet, complete, finalize && complete)
+}
+
+// FinalizePSBT finalizes the inputs of the PSBT that have all their
+// signatures. If all inputs are finalized and extract is set, the
+// network serialized tx is returned too
+func (w *Wallet) FinalizePSBT(encoded string, extract bool) (*ProcessedPSBT, error) {
+	packet, err := decodePSBT(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	complete, err := finalizePSBT(packet)
+	if err != nil {
+		return nil, err
+	}
+	return processedPSBT(packet, complete, extract && complete)
+}
+
+// CombinePSBT merges the signatures and information of PSBTs
+// for the same tx (i.e signed by different signers) into one
+func (w *Wallet) CombinePSBT(encoded []string) (string, error) {
+	if len(encoded) == 0 {
+		return "", errors.New("no psbts to combine")
+	}
+
+	combined, err := decodePSBT(encoded[0])
+	if err != nil {
+		return "", err
+	}
+	txHash := combined.UnsignedTx.TxHash()
+	for _, e := range encoded[1:] {
+		packet, err := decodePSBT(e)
+		if err != nil {
+			return "", err
+		}
+		if packet.UnsignedTx.TxHash() != txHash {
+			return "", errors.New("psbts not compatible (different transactions)")
+		}
+
+		for i := range combined.Inputs {
+			combinePSBTInput(&combined.Inputs[i], &packet.Inputs[i])
+		}
+		for i := range combined.Outputs {
+			combinePSBTOutput(&combined.Outputs[i], &packet.Outputs[i])
+		}
+		combined.Unknowns = combineUnknowns(combined.Unknowns, packet.Unknowns)
+	}
+
+	if err := combined.SanityCheck(); err != nil {
+		return "", fmt.Errorf("invalid combined psbt: %s", err.Error())
+	}
+	return combined.B64Encode()
+}
+
+// SendPSBT extracts the tx of a PSBT with all its inputs
+// finalized and sends it to the network. If it spends
+// UTXOs of the wallet, the wallet is updated with it
+func (w *Wallet) SendPSBT(encoded string) (string, error) {
+	packet, err := decodePSBT(encoded)
+	if err != nil {
+		return "", err
+	}
+	complete, err := finalizePSBT(packet)
+	if err != nil {
+		return "", err
+	}
+	if !complete {
+		return "", errors.New("psbt is not complete. not all inputs are signed")
+	}
+	msgTx, err := psbt.Extract(packet)
+	if err != nil {
+		return "", fmt.Errorf("error extracting transaction: %s", err.Error())
+	}
+
+	w.scanMtx.Lock()
+	defer w.scanMtx.Unlock()
+
+	inputs := []tx.UTXO{}
+	for _, txIn := range msgTx.TxIn {
+		if utxo, ok := w.findUTXO(txIn.PreviousOutPoint.String()); ok && !utxo.Spent {
+			inputs = append(inputs, utxo)
+		}
+	}
+	// tx does not spend from the wallet. If it pays
+	// to the wallet, it is found in the mempool
+	if len(inputs) == 0 {
+		if _, err := w.client.SendRawTransaction(msgTx, true); err != nil {
+			return "", fmt.Errorf("error sending transaction: %s", err.Error())
+		}
+		return msgTx.TxHash().String(), nil
+	}
+
+	var change *changeOutput
+	for i, txOut := range msgTx.TxOut {
+		if path, ok := w.changePath(txOut.PkScript); ok {
+			if keyPair := w.getKeyPair(path); keyPair != nil {
+				change = &changeOutput{Index: uint32(i), Path: path, KeyPair: keyPair}
+				break
+			}
+		}
+	}
+
+	if err := w.broadcastTx(msgTx, inputs, change, "", ""); err != nil {
+		return "", err
+	}
+	return msgTx.TxHash().String(), nil
+}
+
+// updatePSBT adds the UTXOs spent by the inputs, their scripts and the BIP32
+// derivation of the keys to the inputs and outputs that belong to the wallet.
+// Segwit v0 inputs get the whole previous tx too (CVE-2020-14199)
+func (w *Wallet) updatePSBT(packet *psbt.Packet) error {
+	updater, err := psbt.NewUpdater(packet)
+	if err != nil {
+		return err
+	}
+
+	for i, txIn := range packet.UnsignedTx.TxIn {
+		utxo, ok := w.findUTXO(txIn.PreviousOutPoint.String())
+		if !ok {
+			continue
+		}
+		if err := w.updatePSBTInput(updater, i, utxo); err != nil {
+			return err
+		}
+	}
+
+	for i, txOut := range packet.UnsignedTx.TxOut {
+		derivationPath, ok := w.scriptDerivationPath(txOut.PkScript)
+		if !ok {
+			continue
+		}
+		if err := w.updatePSBTOutput(updater, i, derivationPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updatePSBTInput adds the UTXO spent by the input at index i, the scripts
+// and the BIP32 derivation of the keys of its descriptor
+func (w *Wallet) updatePSBTInput(updater *psbt.Updater, i int, utxo tx.UTXO) error {
+	wd, expansion, err := w.expandPath(utxo.DerivationPath)
+	if err != nil {
+		return err
+	}
+	pInput := &updater.Upsbt.Inputs[i]
+	prevOutPoint := updater.Upsbt.UnsignedTx.TxIn[i].PreviousOutPoint
+	taproot := wd.parsed.Type == descriptor.Tr
+	witness := isWitnessDescriptor(wd.parsed)
+
+	// taproot sighashes commit to the amounts so the previous tx is not needed
+	if pInput.NonWitnessUtxo == nil && !taproot {
+		if prevTx := w.prevTx(&prevOutPoint.Hash); prevTx != nil {
+			if err := updater.AddInNonWitnessUtxo(prevTx, i); err != nil {
+				return err
+			}
+		} else if !witness {
+			return fmt.Errorf("previous transaction of input %v not found", i)
+		}
+	}
+	if pInput.WitnessUtxo == nil && witness {
+		if err := updater.AddInWitnessUtxo(wire.NewTxOut(int64(utxo.Value), utxo.ScriptPubKey), i); err != nil {
+			return err
+		}
+	}
+	if pInput.RedeemScript == nil && expansion.RedeemScript != nil {
+		if err := updater.AddInRedeemScript(expansion.RedeemScript, i); err != nil {
+			return err
+		}
+	}
+	if pInput.WitnessScript == nil && expansion.WitnessScript != nil {
+		if err := updater.AddInWitnessScript(expansion.WitnessScript, i); err != nil {
+			return err
+		}
+	}
+
+	if taproot {
+		key := expansion.Keys[0]
+		if pInput.TaprootInternalKey == nil {
+			pInput.TaprootInternalKey = schnorr.SerializePubKey(key.PubKey)
+		}
+		pInput.TaprootBip32Derivation = addTaprootBip32Derivation(pInput.TaprootBip32Derivation, key)
+		return nil
+	}
+	for _, key := range expansion.Keys {
+		pubKey := key.PubKey.SerializeCompressed()
+		if !hasBip32Derivation(pInput.Bip32Derivation, pubKey) {
+			if err := updater.AddInBip32Derivation(key.Fingerprint, key.Path, pubKey, i); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// updatePSBTOutput adds the scripts and the BIP32 derivation of the keys
+// of the descriptor of the output at index i paying to the wallet
+func (w *Wallet) updatePSBTOutput(updater *psbt.Updater, i int, derivationPath derivationPath) error {
+	wd, expansion, err := w.expandPath(derivationPath)
+	if err != nil {
+		return err
+	}
+	pOutput := &updater.Upsbt.Outputs[i]
+
+	if pOutput.RedeemScript == nil && expansion.RedeemScript != nil {
+		if err := updater.AddOutRedeemScript(expansion.RedeemScript, i); err != nil {
+			return err
+		}
+	}
+	if pOutput.WitnessScript == nil && expansion.WitnessScript != nil {
+		if err := updater.AddOutWitnessScript(expansion.WitnessScript, i); err != nil {
+			return err
+		}
+	}
+
+	if wd.parsed.Type == descriptor.Tr {
+		key := expansion.Keys[0]
+		if pOutput.TaprootInternalKey == nil {
+			pOutput.TaprootInternalKey = schnorr.SerializePubKey(key.PubKey)
+		}
+		pOutput.TaprootBip32Derivation = addTaprootBip32Derivation(pOutput.TaprootBip32Derivation, key)
+		return nil
+	}
+	for _, key := range expansion.Keys {
+		pubKey := key.PubKey.SerializeCompressed()
+		if !hasBip32Derivation(pOutput.Bip32Derivation, pubKey) {
+			if err := updater.AddOutBip32Derivation(key.Fingerprint, key.Path, pubKey, i); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isWitnessDescriptor returns true if the outputs of the descriptor are
+// spent with a witness (native or nested in P2SH)
+func isWitnessDescriptor(desc *descriptor.Descriptor) bool {
+	switch desc.Type {
+	case descriptor.Wpkh, descriptor.ShWpkh, descriptor.Tr, descriptor.WshMulti, descriptor.ShWshMulti:
+		return true
+	}
+	return false
+}
+
+// signPSBT adds signatures to the inputs that spend UTXOs of the wallet
+// and are not finalized or signed already. Only SIGHASH_ALL is supported
+// (and SIGHASH_DEFAULT for taproot inputs)
+func (w *Wallet) signPSBT(packet *psbt.Packet) error {
+	updater, err := psbt.NewUpdater(packet)
+	if err != nil {
+		return err
+	}
+
+	// outputs spent by inputs the wallet does not know about are
+	// only needed to compute the sighashes of taproot inputs
+	inputFetcher := txscript.NewMultiPrevOutFetcher(nil)
+	for i, txIn := range packet.UnsignedTx.TxIn {
+		prevOut, ok := psbtPrevOut(packet, i)
+		if !ok {
+			prevOut = wire.NewTxOut(0, nil)
+		}
+		inputFetcher.AddPrevOut(txIn.PreviousOutPoint, prevOut)
+	}
+	sigHashes := txscript.NewTxSigHashes(packet.UnsignedTx, inputFetcher)
+
+	for i, txIn := range packet.UnsignedTx.TxIn {
+		pInput := &packet.Inputs[i]
+		if pInput.FinalScriptSig != nil || pInput.FinalScriptWitness != nil {
+			continue
+		}
+		utxo, ok := w.findUTXO(txIn.PreviousOutPoint.String())
+		if !ok {
+			continue
+		}
+		if pInput.SighashType != 0 && pInput.SighashType != txscript.SigHashAll {
+			return fmt.Errorf("sighash type %v of input %v is not supported", pInput.SighashType, i)
+		}
+
+		if err := w.signPSBTInput(updater, sigHashes, i, utxo); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// signPSBTInput signs the input at index i spending the utxo with the keys of
+// its descriptor the wallet has until the input has the signatures it needs
+func (w *Wallet) signPSBTInput(updater *psbt.Updater, sigHashes *txscript.TxSigHashes, i int, utxo tx.UTXO) error {
+	wd, expansion, err := w.expandPath(utxo.DerivationPath)
+	if err != nil {
+		return err
+	}
+	_, idx, err := parseDescriptorPath(utxo.DerivationPath)
+	if err != nil {
+		return err
+	}
+	privKeys, err := w.signingKeys(&wd, idx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, privKey := range privKeys {
+			if privKey != nil {
+				privKey.Zero()
+			}
+		}
+	}()
+
+	unsignedTx := updater.Upsbt.UnsignedTx
+	pInput := &updater.Upsbt.Inputs[i]
+	amount := int64(utxo.Value)
+
+	if wd.parsed.Type == descriptor.Tr {
+		if pInput.TaprootKeySpendSig != nil || privKeys[0] == nil {
+			return nil
+		}
+		sig, err := txscript.RawTxInTaprootSignature(unsignedTx, sigHashes, i, amount, utxo.ScriptPubKey,
+			[]byte{}, txscript.SigHashDefault, privKeys[0])
+		if err != nil {
+			return fmt.Errorf("error signing input %v: %s", i, err.Error())
+		}
+		pInput.TaprootKeySpendSig = sig
+		return nil
+	}
+
+	// script the signatures commit to
+	subScript := utxo.ScriptPubKey
+	if expansion.WitnessScript != nil {
+		subScript = expansion.WitnessScript
+	} else if expansion.RedeemScript != nil {
+		subScript = expansion.RedeemScript
+	}
+	witness := expansion.WitnessScript != nil || txscript.IsWitnessProgram(subScript)
+	needed := max(wd.parsed.Threshold, 1)
+
+	for k, privKey := range privKeys {
+		if privKey == nil || len(pInput.PartialSigs) >= needed {
+			continue
+		}
+		pubKey := expansion.Keys[k].PubKey.SerializeCompressed()
+		if slices.ContainsFunc(pInput.PartialSigs, func(sig *psbt.PartialSig) bool {
+			return bytes.Equal(sig.PubKey, pubKey)
+		}) {
+			continue
+		}
+
+		var sig []byte
+		if witness {
+			sig, err = txscript.RawTxInWitnessSignature(unsignedTx, sigHashes, i, amount,
+				subScript, txscript.SigHashAll, privKey)
+		} else {
+			sig, err = txscript.RawTxInSignature(unsignedTx, i, subScript, txscript.SigHashAll, privKey)
+		}
+		if err != nil {
+			return fmt.Errorf("error signing input %v: %s", i, err.Error())
+		}
+
+		if _, err := updater.Sign(i, sig, pubKey, expansion.RedeemScript, expansion.WitnessScript); err != nil {
+			return fmt.Errorf("error adding signature to input %v: %s", i, err.Error())
+		}
+	}
+	return nil
+}
+
+// scriptDerivationPath returns the derivation path of the
+// key of the pkScript if it pays to an address of the wallet
+func (w *Wallet) scriptDerivationPath(pkScript []byte) (derivationPath, bool) {
+	_, addrs, _, err := txscript.ExtractPkScriptAddrs(pkScript, w.network)
+	if err != nil || len(addrs) != 1 {
+		return "", false
+	}
+	return w.lookupAddress(addrs[0].String())
+}
+
+// prevTx returns the tx with the hash from wallet history or from the node
+func (w *Wallet) prevTx(hash *chainhash.Hash) *wire.MsgTx {
+	if record := w.getTxRecord(hash.String()); record != nil {
+		if serializedTx, err := hex.DecodeString(record.RawTx); err == nil {
+			msgTx := wire.NewMsgTx(wire.TxVersion)
+			if err := msgTx.Deserialize(bytes.NewReader(serializedTx)); err == nil {
+				return msgTx
+			}
+		}
+	}
+
+	if w.client == nil {
+		return nil
+	}
+	prevTx, err := w.client.GetRawTransaction(hash)
+	if err != nil {
+		return nil
+	}
+	return prevTx.MsgTx()
+}
+
+func decodePSBT(encoded string) (*psbt.Packet, error) {
+	packet, err := psbt.NewFromRawBytes(strings.NewReader(strings.TrimSpace(encoded)), true)
+	if err != nil {
+		return nil, fmt.Errorf("invalid psbt: %s", err.Error())
+	}
+	return packet, nil
+}
+
+// finalizePSBT finalizes the inputs that have all their signatures.
+// It returns true if all inputs are finalized
+func finalizePSBT(packet *psbt.Packet) (bool, error) {
+	for i := range packet.UnsignedTx.TxIn {
+		pInput := &packet.Inputs[i]
+		// multisig inputs are finalized with exactly threshold signatures
+		if script := multiSigScript(pInput); script != nil && pInput.FinalScriptSig == nil &&
+			pInput.FinalScriptWitness == nil {
+			_, threshold, err := txscript.CalcMultiSigStats(script)
+			if err != nil || len(pInput.PartialSigs) < threshold {
+				continue
+			}
+			pInput.PartialSigs = pInput.PartialSigs[:threshold]
+		}
+
+		if _, err := psbt.MaybeFinalize(packet, i); err != nil && !errors.Is(err, psbt.ErrNotFinalizable) {
+			return false, fmt.Errorf("error finalizing input %v: %s", i, err.Error())
+		}
+	}
+	return packet.IsComplete(), nil
+}
+
+// multiSigScript returns the multisig script of the input or nil
+// if it does not spend a P2SH or P2WSH multisig output
+func multiSigScript(pInput *psbt.PInput) []byte {
+	script := pInput.WitnessScript
+	if script == nil {
+		script = pInput.RedeemScript
+	}
+	if txscript.GetScriptClass(script) != txscript.MultiSigTy {
+		return nil
+	}
+	return script
+}
+
+// processedPSBT encodes the PSBT and the extracted tx if extract is set
+func processedPSBT(packet *psbt.Packet, complete, extract bool) (*ProcessedPSBT, error) {
+	encoded, err := packet.B64Encode()
+	if err != nil {
+		return nil, err
+	}
+	processed := &ProcessedPSBT{PSBT: encoded, Complete: complete}
+
+	if extract {
+		msgTx, err := psbt.Extract(packet)
+		if err != nil {
+			return nil, fmt.Errorf("error extracting transaction: %s", err.Error())
+		}
+		var buf bytes.Buffer
+		if err := msgTx.Serialize(&buf); err != nil {
+			return nil, err
+		}
+		processed.Hex = hex.EncodeToString(buf.Bytes())
+	}
+	return processed, nil
+}
+
+// psbtPrevOut returns the output spent by the input at idx if it is in the PSBT
+func psbtPrevOut(packet *psbt.Packet, idx int) (*wire.TxOut, bool) {
+	pInput := packet.Inputs[idx]
+	if pInput.WitnessUtxo != nil {
+		return pInput.WitnessUtxo, true
+	}
+	vout := packet.UnsignedTx.TxIn[idx].PreviousOutPoint.Index
+	if pInput.NonWitnessUtxo != nil && int(vout) < len(pInput.NonWitnessUtxo.TxOut) {
+		return pInput.NonWitnessUtxo.TxOut[vout], true
+	}
+	return nil, false
+}
+
+func hasBip32Derivation(derivations []*psbt.Bip32Derivation, pubKey []byte) bool {
+	return slices.ContainsFunc(derivations, func(derivation *psbt.Bip32Derivation) bool {
+		return bytes.Equal(derivation.PubKey, pubKey)
+	})
+}
+
+func hasTaprootBip32Derivation(derivations []*psbt.TaprootBip32Derivation, xOnlyPubKey []byte) bool {
+	return slices.ContainsFunc(derivations, func(derivation *psbt.TaprootBip32Derivation) bool {
+		return bytes.Equal(derivation.XOnlyPubKey, xOnlyPubKey)
+	})
+}
+
+// addTaprootBip32Derivation adds the derivation of the key of a
+// taproot key path spend if it is not in derivations
+func addTaprootBip32Derivation(derivations []*psbt.TaprootBip32Derivation,
+	key *descriptor.DerivedKey) []*psbt.TaprootBip32Derivation {
+	xOnlyPubKey := schnorr.SerializePubKey(key.PubKey)
+	if hasTaprootBip32Derivation(derivations, xOnlyPubKey) {
+		return derivations
+	}
+	return append(derivations, &psbt.TaprootBip32Derivation{
+		XOnlyPubKey:          xOnlyPubKey,
+		MasterKeyFingerprint: key.Fingerprint,
+		Bip32Path:            key.Path,
+	})
+}
+
+// combinePSBTInput adds the fields of other missing in input
+func combinePSBTInput(input, other *psbt.PInput) {
+	if input.NonWitnessUtxo == nil {
+		input.NonWitnessUtxo = other.NonWitnessUtxo
+	}
+	if input.WitnessUtxo == nil {
+		input.WitnessUtxo = other.WitnessUtxo
+	}
+	for _, sig := range other.PartialSigs {
+		if !slices.ContainsFunc(input.PartialSigs, func(s *psbt.PartialSig) bool {
+			return bytes.Equal(s.PubKey, sig.PubKey)
+		}) {
+			input.PartialSigs = append(input.PartialSigs, sig)
+		}
+	}
+	if input.SighashType == 0 {
+		input.SighashType = other.SighashType
+	}
+	if input.RedeemScript == nil {
+		input.RedeemScript = other.RedeemScript
+	}
+	if input.WitnessScript == nil {
+		input.WitnessScript = other.WitnessScript
+	}
+	for _, derivation := range other.Bip32Derivation {
+		if !hasBip32Derivation(input.Bip32Derivation, derivation.PubKey) {
+			input.Bip32Derivation = append(input.Bip32Derivation, derivation)
+		}
+	}
+	if input.FinalScriptSig == nil {
+		input.FinalScriptSig = other.FinalScriptSig
+	}
+	if input.FinalScriptWitness == nil {
+		input.FinalScriptWitness = other.FinalScriptWitness
+	}
+	if input.TaprootKeySpendSig == nil {
+		input.TaprootKeySpendSig = other.TaprootKeySpendSig
+	}
+	if input.TaprootInternalKey == nil {
+		input.TaprootInternalKey = other.TaprootInternalKey
+	}
+	if input.TaprootMerkleRoot == nil {
+		input.TaprootMerkleRoot = other.TaprootMerkleRoot
+	}
+	for _, derivation := range other.TaprootBip32Derivation {
+		if !hasTaprootBip32Derivation(input.TaprootBip32Derivation, derivation.XOnlyPubKey) {
+			input.TaprootBip32Derivation = append(input.TaprootBip32Derivation, derivation)
+		}
+	}
+	input.Unknowns = combineUnknowns(input.Unknowns, other.Unknowns)
+}
+
+// combinePSBTOutput adds the fields of other missing in output
+func combinePSBTOutput(output, other *psbt.POutput) {
+	if output.RedeemScript == nil {
+		output.RedeemScript = other.RedeemScript
+	}
+	if output.WitnessScript == nil {
+		output.WitnessScript = other.WitnessScript
+	}
+	for _, derivation := range other.Bip32Derivation {
+		if !hasBip32Derivation(output.Bip32Derivation, derivation.PubKey) {
+			output.Bip32Derivation = append(output.Bip32Derivation, derivation)
+		}
+	}
+	if output.TaprootInternalKey == nil {
+		output.TaprootInternalKey = other.TaprootInternalKey
+	}
+	for _, derivation := range other.TaprootBip32Derivation {
+		if !hasTaprootBip32Derivation(output.TaprootBip32Derivation, derivation.XOnlyPubKey) {
+			output.TaprootBip32Derivation = append(output.TaprootBip32Derivation, derivation)
+		}
+	}
+}
+
+func combineUnknowns(unknowns, other []*psbt.Unknown) []*psbt.Unknown {
+	for _, unknown := range other {
+		if !slices.ContainsFunc(unknowns, func(u *psbt.Unknown) bool {
+			return bytes.Equal(u.Key, unknown.Key)
+		}) {
+			unknowns = append(unknowns, unknown)
+		}
+	}
+	return unknowns
+}
+
+// DecodedPSBT is the information in a PSBT
+type DecodedPSBT struct {
+	TxID     string              `json:"txid"`
+	Version  int32               `json:"version"`
+	LockTime uint32              `json:"locktime"`
+	Inputs   []DecodedPSBTInput  `json:"inputs"`
+	Outputs  []DecodedPSBTOutput `json:"outputs"`
+	// fee is only known if all inputs have the UTXO they spend
+	Fee      *btcutil.Amount `json:"fee,omitempty"`
+	Complete bool            `json:"complete"`
+}
+
+// DecodedPSBTInput is an input of a decoded PSBT. The UTXO
+// fields are only set if the PSBT has the UTXO it spends
+type DecodedPSBTInput struct {
+	TxID         string          `json:"txid"`
+	Vout         uint32          `json:"vout"`
+	Sequence     uint32          `json:"sequence"`
+	Amount       *btcutil.Amount `json:"amount,omitempty"`
+	ScriptPubKey string          `json:"scriptPubKey,omitempty"`
+	Type         string          `json:"type,omitempty"`
+	Address      string          `json:"address,omitempty"`
+	// signatures by public key
+	PartialSigs        map[string]string        `json:"partial_signatures,omitempty"`
+	SighashType        uint32                   `json:"sighash,omitempty"`
+	RedeemScript       string                   `json:"redeem_script,omitempty"`
+	WitnessScript      string                   `json:"witness_script,omitempty"`
+	Bip32Derivs        []DecodedBip32Derivation `json:"bip32_derivs,omitempty"`
+	FinalScriptSig     string                   `json:"final_scriptSig,omitempty"`
+	FinalScriptWitness []string                 `json:"final_scriptwitness,omitempty"`
+	IsMine             bool                     `json:"is_mine"`
+}
+
+// DecodedPSBTOutput is an output of a decoded PSBT
+type DecodedPSBTOutput struct {
+	Amount       btcutil.Amount           `json:"amount"`
+	ScriptPubKey string                   `json:"scriptPubKey"`
+	Type         string                   `json:"type"`
+	Address      string                   `json:"address,omitempty"`
+	Bip32Derivs  []DecodedBip32Derivation `json:"bip32_derivs,omitempty"`
+	IsMine       bool                     `json:"is_mine"`
+}
+
+// DecodedBip32Derivation is the derivation of a key from a master key
+type DecodedBip32Derivation struct {
+	PubKey            string `json:"pubkey"`
+	MasterFingerprint string `json:"master_fingerprint"`
+	Path              string `json:"path"`
+}
+
+// DecodePSBT returns the tx, the UTXOs spent, signatures and key
+// derivations in the PSBT and if inputs and outputs are from the wallet
+func (w *Wallet) DecodePSBT(encoded string) (*DecodedPSBT, error) {
+	packet, err := decodePSBT(encoded)
+	if err != nil {
+		return nil, err
+	}
+	unsignedTx := packet.UnsignedTx
+
+	decoded := &DecodedPSBT{
+		TxID:     unsignedTx.TxHash().String(),
+		Version:  unsignedTx.Version,
+		LockTime: unsignedTx.LockTime,
+		Inputs:   make([]DecodedPSBTInput, len(unsignedTx.TxIn)),
+		Outputs:  make([]DecodedPSBTOutput, len(unsignedTx.TxOut)),
+		Complete: packet.IsComplete(),
+	}
+
+	for i, txIn := range unsignedTx.TxIn {
+		pInput := packet.Inputs[i]
+		input := DecodedPSBTInput{
+			TxID:           txIn.PreviousOutPoint.Hash.String(),
+			Vout:           txIn.PreviousOutPoint.Index,
+			Sequence:       txIn.Sequence,
+			SighashType:    uint32(pInput.SighashType),
+			RedeemScript:   hex.EncodeToString(pInput.RedeemScript),
+			WitnessScript:  hex.EncodeToString(pInput.WitnessScript),
+			Bip32Derivs:    decodeBip32Derivations(pInput.Bip32Derivation),
+			FinalScriptSig: hex.EncodeToString(pInput.FinalScriptSig),
+		}
+		if input.FinalScriptWitness, err = witnessItems(pInput.FinalScriptWitness); err != nil {
+			return nil, fmt.Errorf("invalid final script witness of input %v: %v", i, err)
+		}
+		if prevOut, ok := psbtPrevOut(packet, i); ok {
+			amount := btcutil.Amount(prevOut.Value)
+			input.Amount = &amount
+			input.ScriptPubKey = hex.EncodeToString(prevOut.PkScript)
+			input.Type, input.Address = w.scriptInfo(prevOut.PkScript)
+		}
+		if len(pInput.PartialSigs) > 0 {
+			input.PartialSigs = make(map[string]string, len(pInput.PartialSigs))
+			for _, sig := range pInput.PartialSigs {
+				input.PartialSigs[hex.EncodeToString(sig.PubKey)] = hex.EncodeToString(sig.Signature)
+			}
+		}
+		_, input.IsMine = w.findUTXO(txIn.PreviousOutPoint.String())
+		decoded.Inputs[i] = input
+	}
+
+	for i, txOut := range unsignedTx.TxOut {
+		output := DecodedPSBTOutput{
+			Amount:       btcutil.Amount(txOut.Value),
+			ScriptPubKey: hex.EncodeToString(txOut.PkScript),
+			Bip32Derivs:  decodeBip32Derivations(packet.Outputs[i].Bip32Derivation),
+		}
+		output.Type, output.Address = w.scriptInfo(txOut.PkScript)
+		_, output.IsMine = w.scriptDerivationPath(txOut.PkScript)
+		decoded.Outputs[i] = output
+	}
+
+	if fee, err := packet.GetTxFee(); err == nil {
+		decoded.Fee = &fee
+	}
+
+	return decoded, nil
+}
+
+// scriptInfo returns the type of the pkScript and its address if it has one
+func (w *Wallet) scriptInfo(pkScript []byte) (string, string) {
+	class, addrs, _, err := txscript.ExtractPkScriptAddrs(pkScript, w.network)
+	if err != nil || len(addrs) != 1 {
+		return class.String(), ""
+	}
+	return class.String(), addrs[0].String()
+}
+
+// witnessItems returns the hex items of a serialized witness
+func witnessItems(serialized []byte) ([]string, error) {
+	if len(serialized) == 0 {
+		return nil, nil
+	}
+	r := bytes.NewReader(serialized)
+	count, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	// each item takes at least one byte for its length
+	if count > uint64(r.Len()) {
+		return nil, fmt.Errorf("witness has %v items but only %v bytes left", count, r.Len())
+	}
+	items := make([]string, 0, count)
+	for i := uint64(0); i < count; i++ {
+		item, err := wire.ReadVarBytes(r, 0, uint32(len(serialized)), "witness item")
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, hex.EncodeToString(item))
+	}
+	if r.Len() != 0 {
+		return nil, errors.New("unexpected data after witness items")
+	}
+	return items, nil
+}
+
+func decodeBip32Derivations(derivations []*psbt.Bip32Derivation) []DecodedBip32Derivation {
+	decoded := make([]DecodedBip32Derivation, 0, len(derivations))
+	for _, derivation := range derivations {
+		fingerprint := make([]byte, 4)
+		binary.LittleEndian.PutUint32(fingerprint, derivation.MasterKeyFingerprint)
+
+		decoded = append(decoded, DecodedBip32Derivation{
+			PubKey:            hex.EncodeToString(derivation.PubKey),
+			MasterFingerprint: hex.EncodeToString(fingerprint),
+			Path:              FormatBIP32Path(derivation.Bip32Path),
+		})
+	}
+	return decoded
+}
@@ -0,0 +1,359 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// importTestDescriptors imports active descriptors of the account of
+// the wallet for the address types it does not have by default
+func importTestDescriptors(t *testing.T, w *Wallet) {
+	t.Helper()
+
+	xpub, err := w.GetXpub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	importActive(t, w, fmt.Sprintf("pkh(%s/2/*)", xpub), fmt.Sprintf("sh(wpkh(%s/3/*))", xpub),
+		fmt.Sprintf("tr(%s/4/*)", xpub))
+}
+
+// importActive imports the descriptors as active for receive addresses
+func importActive(t *testing.T, w *Wallet, descs ...string) {
+	t.Helper()
+
+	now := RescanNow
+	requests := make([]ImportDescriptorRequest, len(descs))
+	for i, desc := range descs {
+		requests[i] = ImportDescriptorRequest{Desc: desc, Active: true, Timestamp: &now}
+	}
+	results, err := w.ImportDescriptors(requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range results {
+		if !result.Success {
+			t.Fatalf("error importing %s: %v", descs[i], result.Error)
+		}
+	}
+}
+
+func newTestMasterKey(t *testing.T) *hdkeychain.ExtendedKey {
+	t.Helper()
+
+	seed := make([]byte, 32)
+	if _, err := rand.Read(seed); err != nil {
+		t.Fatal(err)
+	}
+	master, err := hdkeychain.NewMaster(seed, &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return master
+}
+
+// extractTx decodes the network serialized tx of a processed PSBT
+func extractTx(t *testing.T, processed *ProcessedPSBT) *wire.MsgTx {
+	t.Helper()
+
+	if !processed.Complete || processed.Hex == "" {
+		t.Fatalf("psbt is not complete: %+v", processed)
+	}
+	serialized, err := hex.DecodeString(processed.Hex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgTx := wire.NewMsgTx(wire.TxVersion)
+	if err := msgTx.Deserialize(bytes.NewReader(serialized)); err != nil {
+		t.Fatal(err)
+	}
+	return msgTx
+}
+
+func TestPSBTCreateProcessFinalize(t *testing.T) {
+	w, client := newTestWallet(t)
+	importTestDescriptors(t, w)
+	for _, addressType := range []string{"legacy", "p2sh-segwit", "bech32", "bech32m"} {
+		fundWallet(t, w, client, addressType, 30000)
+	}
+
+	// needs all the utxos
+	funded, err := w.WalletCreateFundedPSBT(map[string]float64{newTestAddress(t): 0.001},
+		SendOptions{FeeRate: 2000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := w.DecodePSBT(funded.PSBT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Inputs) != 4 || decoded.Complete {
+		t.Fatalf("unexpected funded psbt: %+v", decoded)
+	}
+	for i, input := range decoded.Inputs {
+		if !input.IsMine || input.Amount == nil {
+			t.Errorf("input %v is missing wallet information: %+v", i, input)
+		}
+	}
+
+	processed, err := w.WalletProcessPSBT(funded.PSBT, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if processed.Complete || processed.Hex != "" {
+		t.Fatal("psbt should not be complete before finalizing")
+	}
+
+	finalized, err := w.FinalizePSBT(processed.PSBT, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgTx := extractTx(t, finalized)
+	verifyTx(t, msgTx, prevOuts(t, w))
+
+	txid, err := w.SendPSBT(finalized.PSBT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txid != msgTx.TxHash().String() {
+		t.Errorf("sent tx does not match - expected: %v, got: %v", msgTx.TxHash(), txid)
+	}
+	if balance := w.GetBalance(0); balance != 120000-100000-funded.Fee {
+		t.Errorf("unexpected balance after send: %v", balance)
+	}
+	checkConsistent(t, w)
+}
+
+func TestCombinePSBT(t *testing.T) {
+	walletA, client := newTestWallet(t)
+	walletB, _ := newTestWallet(t)
+
+	xpubA, err := walletA.GetXpub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	xpubB, err := walletB.GetXpub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := fmt.Sprintf("wsh(sortedmulti(2,%s/7/*,%s/7/*))", xpubA, xpubB)
+	importActive(t, walletA, desc)
+	importActive(t, walletB, desc)
+
+	address, err := walletA.GetNewAddress("bech32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addressB, err := walletB.GetNewAddress("bech32"); err != nil || addressB != address {
+		t.Fatalf("multisig addresses do not match: %v %v", address, addressB)
+	}
+	utxo := fundAddress(t, walletA, client, address, 100000)
+	if err := walletB.addUTXO(utxo); err != nil {
+		t.Fatal(err)
+	}
+
+	funded, err := walletA.WalletCreateFundedPSBT(map[string]float64{newTestAddress(t): 0.0005},
+		SendOptions{FeeRate: 2000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each signer signs the funded psbt
+	signed := make([]string, 2)
+	for i, w := range []*Wallet{walletA, walletB} {
+		processed, err := w.WalletProcessPSBT(funded.PSBT, true, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if processed.Complete {
+			t.Fatal("psbt with one signature should not be complete")
+		}
+		signed[i] = processed.PSBT
+	}
+
+	combined, err := walletA.CombinePSBT(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := walletA.DecodePSBT(combined)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Inputs[0].PartialSigs) != 2 {
+		t.Fatalf("expected 2 signatures in combined psbt, got %v", len(decoded.Inputs[0].PartialSigs))
+	}
+
+	finalized, err := walletA.FinalizePSBT(combined, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTx(t, extractTx(t, finalized), prevOuts(t, walletA))
+
+	// psbts of different txs can't be combined
+	other, err := walletA.WalletCreateFundedPSBT(map[string]float64{newTestAddress(t): 0.0002},
+		SendOptions{FeeRate: 2000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := walletA.CombinePSBT([]string{funded.PSBT, other.PSBT}); err == nil {
+		t.Error("expected error combining psbts of different txs")
+	}
+}
+
+func TestFinalizePSBTMultisigThreshold(t *testing.T) {
+	walletA, client := newTestWallet(t)
+	walletB, _ := newTestWallet(t)
+
+	// 2 of 3 multisig. A signs with the first 2 keys and B with the third one
+	masters := []*hdkeychain.ExtendedKey{newTestMasterKey(t), newTestMasterKey(t), newTestMasterKey(t)}
+	keys := func(private ...bool) string {
+		keys := make([]string, len(masters))
+		for i, master := range masters {
+			key := master
+			if !private[i] {
+				key, _ = master.Neuter()
+			}
+			keys[i] = key.String() + "/0/*"
+		}
+		return strings.Join(keys, ",")
+	}
+	importActive(t, walletA, fmt.Sprintf("wsh(multi(2,%s))", keys(true, true, false)))
+	importActive(t, walletB, fmt.Sprintf("wsh(multi(2,%s))", keys(false, false, true)))
+
+	address, err := walletA.GetNewAddress("bech32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addressB, err := walletB.GetNewAddress("bech32"); err != nil || addressB != address {
+		t.Fatalf("multisig addresses do not match: %v %v", address, addressB)
+	}
+	utxo := fundAddress(t, walletA, client, address, 100000)
+	if err := walletB.addUTXO(utxo); err != nil {
+		t.Fatal(err)
+	}
+
+	funded, err := walletA.WalletCreateFundedPSBT(map[string]float64{newTestAddress(t): 0.0005},
+		SendOptions{FeeRate: 2000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := make([]string, 2)
+	for i, w := range []*Wallet{walletA, walletB} {
+		processed, err := w.WalletProcessPSBT(funded.PSBT, true, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed[i] = processed.PSBT
+	}
+	combined, err := walletA.CombinePSBT(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := walletA.DecodePSBT(combined)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sigs := len(decoded.Inputs[0].PartialSigs); sigs != 3 {
+		t.Fatalf("expected 3 signatures in combined psbt, got %v", sigs)
+	}
+
+	finalized, err := walletA.FinalizePSBT(combined, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgTx := extractTx(t, finalized)
+	verifyTx(t, msgTx, prevOuts(t, walletA))
+	// empty item for CHECKMULTISIG, threshold signatures and the script
+	if items := len(msgTx.TxIn[0].Witness); items != 4 {
+		t.Errorf("expected witness with 2 signatures, got %v items", items)
+	}
+}
+
+func TestDecodePSBTFinalScriptWitness(t *testing.T) {
+	w, client := newTestWallet(t)
+	fundWallet(t, w, client, "", 100000)
+	funded, err := w.WalletCreateFundedPSBT(map[string]float64{newTestAddress(t): 0.0005},
+		SendOptions{FeeRate: 2000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		witness     []byte
+		wantedItems []string
+		wantErr     bool
+	}{
+		{
+			name:        "valid witness",
+			witness:     []byte{0x02, 0x01, 0xaa, 0x02, 0xbb, 0xcc},
+			wantedItems: []string{"aa", "bbcc"},
+		},
+		{
+			name:        "empty items",
+			witness:     []byte{0x02, 0x00, 0x00},
+			wantedItems: []string{"", ""},
+		},
+		{
+			name:    "truncated item",
+			witness: []byte{0x02, 0x01, 0xaa, 0x05, 0xbb},
+			wantErr: true,
+		},
+		{
+			name:    "missing items",
+			witness: []byte{0x03, 0x01, 0xaa},
+			wantErr: true,
+		},
+		{
+			name:    "oversized item count",
+			witness: []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f, 0x00},
+			wantErr: true,
+		},
+		{
+			name:    "truncated item count",
+			witness: []byte{0xfd, 0x01},
+			wantErr: true,
+		},
+		{
+			name:    "data after items",
+			witness: []byte{0x01, 0x01, 0xaa, 0xbb},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packet, err := decodePSBT(funded.PSBT)
+			if err != nil {
+				t.Fatal(err)
+			}
+			packet.Inputs[0].FinalScriptWitness = test.witness
+			encoded, err := packet.B64Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decoded, err := w.DecodePSBT(encoded)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected error but got witness %v", decoded.Inputs[0].FinalScriptWitness)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if items := decoded.Inputs[0].FinalScriptWitness; !slices.Equal(items, test.wantedItems) {
+				t.Errorf("witness items do not match - expected: %v, got: %v", test.wantedItems, items)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	bolt "go.etcd.io/bbolt"
+)
+
+// DefaultGapLimit is the number of consecutive unused addresses
+// to look ahead in each ranged descriptor while recovering a wallet (BIP-44)
+const DefaultGapLimit = 20
+
+// recoveryState keeps track of the gap limit while recovering. The
+// addresses derived ahead of the next index of each descriptor are
+// the ones up to the end of its range
+type recoveryState struct {
+	gapLimit uint32
+	mtx      sync.Mutex
+}
+
+// EnableRecovery sets the wallet to recovery mode. The next time the wallet
+// is loaded, it will scan the blockchain from the birthday height deriving
+// addresses ahead by gapLimit in each ranged descriptor to find funds sent to them
+func EnableRecovery(net *chaincfg.Params, birthday int64, gapLimit uint32) error {
+	path := setupWalletDir(net)
+	db, err := bolt.Open(filepath.Join(path, "wallet.db"), 0600, nil)
+	if err != nil {
+		return fmt.Errorf("error opening db: %v", err)
+	}
+	defer db.Close()
+
+	if !walletExists(db) {
+		return ErrWalletNotExists
+	}
+
+	wallet := &Wallet{db: db}
+	return wallet.enableRecovery(birthday, gapLimit)
+}
+
+func (w *Wallet) enableRecovery(birthday int64, gapLimit uint32) error {
+	if gapLimit == 0 {
+		return errors.New("gap limit must be greater than 0")
+	}
+	if birthday < 0 {
+		return errors.New("invalid birthday height")
+	}
+
+	// start scanning from the birthday block
+	lastScannedBlock := birthday - 1
+	if lastScannedBlock < 0 {
+		lastScannedBlock = 0
+	}
+	return w.updateRecovery(gapLimit, lastScannedBlock)
+}
+
+// startRecovery derives the lookahead addresses of the ranged
+// descriptors so that they can be matched while scanning blocks
+func (w *Wallet) startRecovery(gapLimit uint32) error {
+	w.recovery = &recoveryState{gapLimit: gapLimit}
+
+	w.descriptorsMtx.RLock()
+	ids := make([]uint32, 0, len(w.descriptors))
+	for _, wd := range w.sortedDescriptors() {
+		if wd.parsed.IsRange() {
+			ids = append(ids, wd.ID)
+		}
+	}
+	w.descriptorsMtx.RUnlock()
+
+	for _, id := range ids {
+		if _, err := w.extendLookahead(id); err != nil {
+			return err
+		}
+	}
+
+	w.LogInfo("wallet in recovery mode. scanning from block %v with gap limit %v",
+		w.lastScannedBlock+1, gapLimit)
+	return nil
+}
+
+// extendLookahead derives and saves keys of the descriptor until there are
+// gapLimit addresses after the next index. It returns true if keys were added
+func (w *Wallet) extendLookahead(id uint32) (bool, error) {
+	extended := false
+	err := w.updateDescriptor(id, func(wd *walletDescriptor) error {
+		target := wd.NextIndex + w.recovery.gapLimit
+		if !wd.parsed.IsRange() || wd.RangeEnd >= target {
+			return nil
+		}
+		if _, err := w.saveDescriptorKeys(wd, wd.RangeEnd, target); err != nil {
+			return err
+		}
+		extended = true
+		return nil
+	})
+	return extended, err
+}
+
+// markAddressUsed is called when a block or unconfirmed tx has an output to an
+// address of the wallet. It moves the next index of its descriptor past the key.
+// While recovering, it extends the lookahead so that there are still gapLimit
+// unused addresses
+func (w *Wallet) markAddressUsed(path derivationPath) {
+	if err := w.markKeyUsed(path); err != nil {
+		w.LogError("error marking address as used: %v", err)
+		return
+	}
+	if w.recovery == nil {
+		return
+	}
+
+	id, _, err := parseDescriptorPath(path)
+	if err != nil {
+		w.LogError("error marking address as used: %v", err)
+		return
+	}
+
+	w.recovery.mtx.Lock()
+	defer w.recovery.mtx.Unlock()
+
+	extended, err := w.extendLookahead(id)
+	if err != nil {
+		w.LogError("error extending address lookahead: %v", err)
+		return
+	}
+
+	if extended && w.client != nil {
+		if err := w.loadTxFilter(); err != nil {
+			w.LogError("error reloading tx filter: %v", err)
+		}
+	}
+}
+
+// finishRecovery takes the wallet out of recovery mode
+// once it is synced with the blockchain
+func (w *Wallet) finishRecovery() {
+	if w.recovery == nil {
+		return
+	}
+
+	if err := w.deleteRecovery(); err != nil {
+		w.LogError("error finishing recovery: %v", err)
+		return
+	}
+	w.recovery = nil
+
+	w.descriptorsMtx.RLock()
+	defer w.descriptorsMtx.RUnlock()
+	for _, wd := range w.sortedDescriptors() {
+		if wd.parsed.IsRange() {
+			w.LogInfo("finished recovery. next index of descriptor %v: %v", wd.ID, wd.NextIndex)
+		}
+	}
+}
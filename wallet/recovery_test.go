@@ -0,0 +1,165 @@
+package wallet
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil"
+)
+
+// newRecoveringWallet returns a wallet and the same wallet restored from its
+// seed in recovery mode with the gapLimit from the block after the tip
+func newRecoveringWallet(t *testing.T, gapLimit uint32) (*Wallet, *Wallet, *fakeClient) {
+	t.Helper()
+
+	seed := make([]byte, 32)
+	if _, err := rand.Read(seed); err != nil {
+		t.Fatal(err)
+	}
+	original, _ := newTestWalletFromSeed(t, seed)
+
+	restored, client := newTestWalletFromSeed(t, seed)
+	if err := restored.enableRecovery(testTipHeight+1, gapLimit); err != nil {
+		t.Fatal(err)
+	}
+	restored = loadTestWallet(t, restored.db, client)
+	if err := restored.startRecovery(restored.getRecoveryGapLimit()); err != nil {
+		t.Fatal(err)
+	}
+	if restored.lastScannedBlock != testTipHeight {
+		t.Fatalf("expected recovery to start after block %v, got %v", testTipHeight, restored.lastScannedBlock)
+	}
+	return original, restored, client
+}
+
+// testReceiveAddresses returns the next n receive addresses of the wallet
+func testReceiveAddresses(t *testing.T, w *Wallet, n int) []string {
+	t.Helper()
+
+	addresses := make([]string, n)
+	for i := range addresses {
+		address, err := w.GetNewAddress("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addresses[i] = address
+	}
+	return addresses
+}
+
+func TestRecoveryGapLimit(t *testing.T) {
+	const gapLimit = 5
+
+	original, restored, client := newRecoveringWallet(t, gapLimit)
+	addresses := testReceiveAddresses(t, original, 25)
+	changeDescriptor, ok := original.getDescriptor(changeDescriptorID)
+	if !ok {
+		t.Fatal("wallet has no change descriptor")
+	}
+	change, err := deriveKeyPair(&changeDescriptor, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkDescriptor := func(id, wantedNext uint32) {
+		t.Helper()
+		wd, ok := restored.getDescriptor(id)
+		if !ok {
+			t.Fatalf("descriptor %v not found", id)
+		}
+		if wd.NextIndex != wantedNext || wd.RangeEnd != wantedNext+gapLimit {
+			t.Errorf("descriptor %v - expected next index %v and range end %v, got %v and %v",
+				id, wantedNext, wantedNext+gapLimit, wd.NextIndex, wd.RangeEnd)
+		}
+	}
+	checkDescriptor(receiveDescriptorID, 0)
+	checkDescriptor(changeDescriptorID, 0)
+
+	// each payment is within the gap limit of the last used address
+	found := []int{3, 8, 12}
+	for _, idx := range found {
+		connectBlock(t, restored, client, paymentTx(t, addresses[idx], 10000))
+		checkDescriptor(receiveDescriptorID, uint32(idx)+1)
+	}
+	connectBlock(t, restored, client, paymentTx(t, change.Address, 20000))
+	checkDescriptor(changeDescriptorID, 3)
+
+	// more than gapLimit unused addresses after the last used one
+	missed := paymentTx(t, addresses[19], 50000)
+	connectBlock(t, restored, client, missed)
+	checkDescriptor(receiveDescriptorID, 13)
+	if restored.getTxRecord(missed.TxHash().String()) != nil {
+		t.Error("found payment beyond the gap limit")
+	}
+
+	restored.scanMtx.Lock()
+	restored.finishRecovery()
+	restored.scanMtx.Unlock()
+	if restored.recovery != nil || restored.getRecoveryGapLimit() != 0 {
+		t.Error("wallet is still in recovery mode")
+	}
+
+	reloaded := loadTestWallet(t, restored.db, client)
+	for _, idx := range found {
+		if _, ok := reloaded.lookupAddress(addresses[idx]); !ok {
+			t.Errorf("address %v is not tracked", idx)
+		}
+	}
+	if balance := reloaded.GetBalance(1); balance != btcutil.Amount(3*10000+20000) {
+		t.Errorf("unexpected balance of recovered wallet: %v", balance)
+	}
+	checkConsistent(t, reloaded)
+
+	// addresses given out continue after the last used one
+	address, err := reloaded.GetNewAddress("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address != addresses[13] {
+		t.Errorf("expected next address to be %s, got %s", addresses[13], address)
+	}
+}
+
+func TestRecoveryInterruptedSync(t *testing.T) {
+	const gapLimit = 5
+
+	original, restored, client := newRecoveringWallet(t, gapLimit)
+	addresses := testReceiveAddresses(t, original, 15)
+
+	// each payment is only within the gap limit of the one before
+	found := []int{4, 9, 14}
+	heights := make([]int64, len(found))
+	for i, idx := range found {
+		heights[i], _ = client.addBlock(paymentTx(t, addresses[idx], 10000))
+	}
+
+	// node fails before the wallet reaches the tip
+	client.hashErrs = map[int64]error{heights[1]: errNodeTimeout}
+	restored.scanMissingBlocks()
+	if restored.lastScannedBlock != heights[0] {
+		t.Fatalf("expected last scanned block %v, got %v", heights[0], restored.lastScannedBlock)
+	}
+	if restored.recovery == nil || restored.getRecoveryGapLimit() != gapLimit {
+		t.Fatal("wallet left recovery mode before reaching the tip")
+	}
+
+	client.hashErrs = nil
+	restored.scanMissingBlocks()
+	if restored.lastScannedBlock != heights[2] {
+		t.Fatalf("expected last scanned block %v, got %v", heights[2], restored.lastScannedBlock)
+	}
+	if restored.recovery != nil || restored.getRecoveryGapLimit() != 0 {
+		t.Error("wallet is still in recovery mode after reaching the tip")
+	}
+
+	for _, wallet := range []*Wallet{restored, loadTestWallet(t, restored.db, client)} {
+		if balance := wallet.GetBalance(1); balance != btcutil.Amount(3*10000) {
+			t.Errorf("unexpected balance of recovered wallet: %v", balance)
+		}
+		wd, ok := wallet.getDescriptor(receiveDescriptorID)
+		if !ok || wd.NextIndex != 15 {
+			t.Errorf("unexpected receive descriptor after recovery: %+v", wd)
+		}
+		checkConsistent(t, wallet)
+	}
+}
@@ -0,0 +1,145 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/hex"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/elnosh/btcw/tx"
+)
+
+// maxReorgDepth is the number of hashes of last scanned blocks
+// kept to detect chain reorganizations
+const maxReorgDepth = 100
+
+// detectReorg compares the hashes of the last scanned blocks with the ones
+// in the chain of the node. If they differ, it rolls back the wallet to the
+// last block in common (fork point) so that the new branch can be scanned.
+// Callers must hold scanMtx
+func (w *Wallet) detectReorg() error {
+	nodeHeight, err := w.client.GetBlockCount()
+	if err != nil {
+		return err
+	}
+
+	forkHeight := w.lastScannedBlock
+	if forkHeight > nodeHeight {
+		forkHeight = nodeHeight
+	}
+
+	for ; forkHeight > 0; forkHeight-- {
+		storedHash := w.getBlockHash(forkHeight)
+		// no hash stored for block so it can't be checked
+		if storedHash == "" {
+			break
+		}
+
+		nodeHash, err := w.client.GetBlockHash(forkHeight)
+		if err != nil {
+			return err
+		}
+		if nodeHash.String() == storedHash {
+			break
+		}
+	}
+
+	if forkHeight < w.lastScannedBlock {
+		return w.rollback(forkHeight)
+	}
+	return nil
+}
+
+// rollback reverts the changes to the wallet from blocks after forkHeight.
+// Txs of the wallet confirmed after the fork go back to the mempool: their
+// UTXOs and spends are unconfirmed again and they are tracked until they are
+// confirmed in the new chain or dropped. Coinbase txs can't go back to the
+// mempool so their UTXOs are removed. Callers must hold scanMtx
+func (w *Wallet) rollback(forkHeight int64) error {
+	w.LogInfo("chain reorganization detected. rolling back from block %v to block %v",
+		w.lastScannedBlock, forkHeight)
+
+	unconfirmed, err := w.disconnectedTxs(forkHeight)
+	if err != nil {
+		return err
+	}
+
+	w.utxoMtx.Lock()
+	utxos := make([]tx.UTXO, 0, len(w.utxos))
+	removed := []string{}
+	updated := []tx.UTXO{}
+	for _, utxo := range w.utxos {
+		changed := false
+		if utxo.Height > forkHeight {
+			if _, ok := unconfirmed[utxo.TxID]; !ok {
+				removed = append(removed, utxo.GetOutpoint())
+				continue
+			}
+			utxo.Height = 0
+			utxo.BlockHash = ""
+			changed = true
+		}
+
+		if utxo.Spent && utxo.SpentHeight > forkHeight {
+			if _, ok := unconfirmed[utxo.SpentBy]; !ok {
+				utxo.Spent = false
+				utxo.SpentBy = ""
+			}
+			utxo.SpentHeight = 0
+			changed = true
+		}
+		if changed {
+			updated = append(updated, utxo)
+		}
+		utxos = append(utxos, utxo)
+	}
+
+	if err := w.rollbackDB(forkHeight, removed, updated, unconfirmed); err != nil {
+		w.utxoMtx.Unlock()
+		return err
+	}
+	w.utxos = utxos
+	w.utxoMtx.Unlock()
+
+	w.mempoolMtx.Lock()
+	for txid, msgTx := range unconfirmed {
+		w.mempoolTxs[txid] = msgTx
+	}
+	w.mempoolMtx.Unlock()
+	w.lastScannedBlock = forkHeight
+
+	w.LogInfo("removed %v UTXOs and returned %v txs to the mempool. balance: %v",
+		len(removed), len(unconfirmed), w.getBalance())
+	return nil
+}
+
+// disconnectedTxs returns the txs of the wallet confirmed after forkHeight
+// that can go back to the mempool. Coinbase txs are left out
+func (w *Wallet) disconnectedTxs(forkHeight int64) (map[string]*wire.MsgTx, error) {
+	records, err := w.loadTxRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	unconfirmed := make(map[string]*wire.MsgTx)
+	for _, record := range records {
+		if record.BlockHeight <= forkHeight {
+			continue
+		}
+		serializedTx, err := hex.DecodeString(record.RawTx)
+		if err != nil {
+			w.LogError("error decoding disconnected tx %s: %v", record.TxID, err)
+			continue
+		}
+		msgTx := wire.NewMsgTx(wire.TxVersion)
+		if err := msgTx.Deserialize(bytes.NewReader(serializedTx)); err != nil {
+			w.LogError("error decoding disconnected tx %s: %v", record.TxID, err)
+			continue
+		}
+		if blockchain.IsCoinBaseTx(msgTx) {
+			continue
+		}
+		unconfirmed[record.TxID] = msgTx
+	}
+	return unconfirmed, nil
+}
@@ -0,0 +1,225 @@
+package wallet
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/elnosh/btcw/tx"
+)
+
+// spendingTestTx returns a tx spending the utxo to address. It is not signed
+func spendingTestTx(t *testing.T, utxo tx.UTXO, address string) *wire.MsgTx {
+	t.Helper()
+
+	outpoint, err := utxoOutPoint(utxo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txOut, err := tx.CreateTxOut(address, utxo.Value-1000, &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgTx := wire.NewMsgTx(wire.TxVersion)
+	msgTx.AddTxIn(wire.NewTxIn(outpoint, nil, nil))
+	msgTx.AddTxOut(txOut)
+	return msgTx
+}
+
+func TestDetectReorg(t *testing.T) {
+	tests := []struct {
+		name string
+		// changes the chain of the node after the wallet scanned it
+		reorg      func(client *fakeClient)
+		wantedFork int64
+	}{
+		{
+			name:       "no reorg",
+			reorg:      func(client *fakeClient) {},
+			wantedFork: testTipHeight,
+		},
+		{
+			name: "reorg of the tip",
+			reorg: func(client *fakeClient) {
+				client.blocks[testTipHeight] = chainhash.HashH([]byte("new tip"))
+			},
+			wantedFork: testTipHeight - 1,
+		},
+		{
+			name: "reorg before spend and receive",
+			reorg: func(client *fakeClient) {
+				for height := 196; height <= testTipHeight; height++ {
+					client.blocks[height] = chainhash.HashH([]byte(fmt.Sprintf("new block %v", height)))
+				}
+			},
+			wantedFork: 195,
+		},
+		{
+			name: "node behind the wallet",
+			reorg: func(client *fakeClient) {
+				client.blocks = client.blocks[:198]
+			},
+			wantedFork: 197,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w, client := newTestWallet(t)
+			for height := int64(testTipHeight - 20); height <= testTipHeight; height++ {
+				if err := w.setLastScannedBlock(height, client.blocks[height].String()); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// confirmed at 191 and spent at 197
+			spent := fundWallet(t, w, client, "", 50000)
+			spendingTx := spendingTestTx(t, spent, newTestAddress(t))
+			spendingTxID := spendingTx.TxHash().String()
+			client.txs[spendingTx.TxHash()] = spendingTx
+			if _, _, err := w.spendUTXO(spent.GetOutpoint(), spendingTxID, 197); err != nil {
+				t.Fatal(err)
+			}
+			// confirmed at 198. funded utxos are confirmed 9 blocks below the last scanned one
+			w.lastScannedBlock = 207
+			received := fundWallet(t, w, client, "", 30000)
+			w.lastScannedBlock = testTipHeight
+			records := map[string]int64{spent.TxID: 191, spendingTxID: 197, received.TxID: 198}
+			for txid, height := range records {
+				hash, err := chainhash.NewHashFromStr(txid)
+				if err != nil {
+					t.Fatal(err)
+				}
+				record, err := w.buildTxRecord(client.txs[*hash], height, client.blocks[height].String(), 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := w.saveTxRecord(record); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			test.reorg(client)
+			w.scanMtx.Lock()
+			err := w.detectReorg()
+			w.scanMtx.Unlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, wallet := range []*Wallet{w, loadTestWallet(t, w.db, client)} {
+				if wallet.lastScannedBlock != test.wantedFork {
+					t.Errorf("expected last scanned block %v, got %v", test.wantedFork, wallet.lastScannedBlock)
+				}
+				for height := test.wantedFork + 1; height <= testTipHeight; height++ {
+					if wallet.getBlockHash(height) != "" {
+						t.Errorf("hash of block %v after the fork was not removed", height)
+					}
+				}
+				if wallet.getBlockHash(test.wantedFork) == "" {
+					t.Error("hash of the fork block was removed")
+				}
+
+				// txs confirmed after the fork go back to the mempool
+				utxo := findTestUTXO(t, wallet, received.GetOutpoint())
+				if confirmed := utxo.Height != 0; confirmed != (test.wantedFork >= 198) {
+					t.Errorf("unexpected height %v of utxo confirmed at 198", utxo.Height)
+				}
+				utxo = findTestUTXO(t, wallet, spent.GetOutpoint())
+				if !utxo.Spent || utxo.SpentBy != spendingTxID {
+					t.Errorf("utxo spent at 197 is not spent by the same tx: %+v", utxo)
+				}
+				if confirmed := utxo.SpentHeight != 0; confirmed != (test.wantedFork >= 197) {
+					t.Errorf("unexpected spent height %v of utxo spent at 197", utxo.SpentHeight)
+				}
+				for txid, height := range records {
+					record := wallet.getTxRecord(txid)
+					if confirmed := record.BlockHeight != 0; confirmed != (height <= test.wantedFork) {
+						t.Errorf("unexpected height %v of tx confirmed at %v", record.BlockHeight, height)
+					}
+					if record.Dropped {
+						t.Errorf("tx confirmed at %v was dropped", height)
+					}
+					if _, ok := wallet.mempoolTxs[txid]; ok != (height > test.wantedFork) {
+						t.Errorf("expected tx confirmed at %v to be unconfirmed: %v", height, height > test.wantedFork)
+					}
+				}
+				if balances := wallet.GetBalances(0); balances.Trusted+balances.UntrustedPending != 30000 {
+					t.Errorf("unexpected balance after reorg: %+v", balances)
+				}
+				checkConsistent(t, wallet)
+			}
+		})
+	}
+}
+
+func TestFilteredBlockDisconnected(t *testing.T) {
+	w, client := newTestWallet(t)
+	funding := fundWallet(t, w, client, "", 100000)
+	txid, err := w.SendToAddress(newTestAddress(t), 0.0003, "", SendOptions{FeeRate: 2000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sentTx := client.sent[0]
+	change := findTestUTXO(t, w, fmt.Sprintf("%s:%v", txid, changeIndex(t, w, sentTx)))
+	balance := w.GetBalance(0)
+
+	// sent tx is confirmed in the next block
+	header := wire.BlockHeader{PrevBlock: client.blocks[testTipHeight], Timestamp: time.Unix(1700200000, 0)}
+	client.blocks = append(client.blocks, header.BlockHash())
+	w.handleFilteredBlockConnected(testTipHeight+1, &header, []*btcutil.Tx{btcutil.NewTx(sentTx)})
+	if utxo := findTestUTXO(t, w, change.GetOutpoint()); utxo.Height != testTipHeight+1 {
+		t.Fatalf("change was not confirmed: %+v", utxo)
+	}
+	if _, ok := w.mempoolTxs[txid]; ok {
+		t.Fatal("confirmed tx is still tracked as unconfirmed")
+	}
+
+	w.handleFilteredBlockDisconnected(testTipHeight+1, &header)
+
+	for _, wallet := range []*Wallet{w, loadTestWallet(t, w.db, client)} {
+		if wallet.lastScannedBlock != testTipHeight {
+			t.Errorf("expected last scanned block %v, got %v", testTipHeight, wallet.lastScannedBlock)
+		}
+		// change and spend of the sent tx are unconfirmed again
+		if utxo := findTestUTXO(t, wallet, change.GetOutpoint()); utxo.Height != 0 || utxo.BlockHash != "" {
+			t.Errorf("change of disconnected tx is not unconfirmed: %+v", utxo)
+		}
+		utxo := findTestUTXO(t, wallet, funding.GetOutpoint())
+		if !utxo.Spent || utxo.SpentBy != txid || utxo.SpentHeight != 0 {
+			t.Errorf("input of disconnected tx is not spent by it: %+v", utxo)
+		}
+		if _, ok := wallet.mempoolTxs[txid]; !ok {
+			t.Error("disconnected tx is not tracked as unconfirmed")
+		}
+		if record := wallet.getTxRecord(txid); record.BlockHeight != 0 || record.Dropped {
+			t.Errorf("unexpected record of disconnected tx: %+v", record)
+		}
+		if wallet.GetBalance(0) != balance {
+			t.Errorf("balance changed after disconnected block - expected: %v, got: %v", balance, wallet.GetBalance(0))
+		}
+		for _, spendable := range wallet.spendableUTXOs() {
+			if spendable.GetOutpoint() == funding.GetOutpoint() {
+				t.Error("input of disconnected tx can be spent again")
+			}
+		}
+		checkConsistent(t, wallet)
+	}
+}
+
+// changeIndex returns the index of the output of msgTx to a change address
+func changeIndex(t *testing.T, w *Wallet, msgTx *wire.MsgTx) int {
+	t.Helper()
+
+	for i, txOut := range msgTx.TxOut {
+		if _, ok := w.changePath(txOut.PkScript); ok {
+			return i
+		}
+	}
+	t.Fatal("tx has no change output")
+	return 0
+}
@@ -3,92 +3,483 @@ package wallet
 import (
 	"errors"
 	"fmt"
+	"slices"
 	"time"
 
 	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/wire"
 	"github.com/elnosh/btcw/tx"
-	"github.com/elnosh/btcw/utils"
 )
 
 var (
 	ErrInsufficientFunds = errors.New("insufficient funds to make transaction")
+	ErrWalletLocked      = errors.New("wallet is locked. unlock wallet with 'walletpassphrase' command first")
+	ErrWatchOnly         = errors.New("wallet is watch-only and has no private keys")
 )
 
-func (w *Wallet) GetBalance() btcutil.Amount {
-	return w.balance
+const (
+	// DefaultSpendMinConf is the minimum confirmations for UTXOs received
+	// from others to be used when sending
+	DefaultSpendMinConf = 1
+)
+
+// Balances of the wallet broken down like
+// bitcoin core's getbalances
+type Balances struct {
+	// confirmed with at least minconf and unconfirmed outputs from wallet txs
+	Trusted btcutil.Amount `json:"trusted"`
+	// unconfirmed outputs from txs not sent by the wallet
+	UntrustedPending btcutil.Amount `json:"untrusted_pending"`
+	// coinbase outputs that have not matured yet
+	Immature btcutil.Amount `json:"immature"`
+}
+
+// GetBalance returns the trusted balance with at least minConf confirmations
+func (w *Wallet) GetBalance(minConf int64) btcutil.Amount {
+	return w.GetBalances(minConf).Trusted
+}
+
+// GetBalances returns the balances of the unspent outputs in the wallet
+func (w *Wallet) GetBalances(minConf int64) Balances {
+	// last scanned block is updated while holding scanMtx
+	w.scanMtx.Lock()
+	tipHeight := w.lastScannedBlock
+	w.scanMtx.Unlock()
+
+	return w.balances(minConf, tipHeight)
+}
+
+// balances returns the balances of the unspent outputs
+// with their confirmations counted up to tipHeight
+func (w *Wallet) balances(minConf, tipHeight int64) Balances {
+	var balances Balances
+
+	w.utxoMtx.Lock()
+	defer w.utxoMtx.Unlock()
+
+	for _, utxo := range w.utxos {
+		if utxo.Spent {
+			continue
+		}
+
+		if !utxo.IsMature(tipHeight, w.network.CoinbaseMaturity) {
+			balances.Immature += utxo.Value
+			continue
+		}
+
+		confs := utxo.Confirmations(tipHeight)
+		trusted := confs > 0 || utxo.FromWallet
+		if trusted && confs >= minConf {
+			balances.Trusted += utxo.Value
+		} else if !trusted {
+			balances.UntrustedPending += utxo.Value
+		}
+	}
+
+	return balances
 }
 
-func (w *Wallet) GetNewAddress() (string, error) {
-	newKeyPair, err := w.generateNewExternalKeyPair()
+// WalletCheck is the result of checking that the stored balance
+// and the UTXOs loaded in the wallet match the utxos bucket
+type WalletCheck struct {
+	// sum of unspent outputs in the utxos bucket
+	UTXOsBalance btcutil.Amount `json:"utxos_balance"`
+	// balance stored in the wallet metadata
+	StoredBalance btcutil.Amount `json:"stored_balance"`
+	// sum of unspent outputs loaded in the wallet
+	LoadedBalance btcutil.Amount `json:"loaded_balance"`
+	UTXOs         int            `json:"utxos"`
+	LoadedUTXOs   int            `json:"loaded_utxos"`
+	Consistent    bool           `json:"consistent"`
+	Repaired      bool           `json:"repaired"`
+}
+
+// CheckWallet recomputes the balance from the utxos bucket and compares it
+// with the stored balance and the UTXOs loaded in the wallet. If repair is
+// true and there is a mismatch, the stored balance is overwritten and the
+// UTXOs are loaded again from the db
+func (w *Wallet) CheckWallet(repair bool) (*WalletCheck, error) {
+	w.scanMtx.Lock()
+	defer w.scanMtx.Unlock()
+
+	utxosBalance, storedBalance, count, err := w.checkBalanceDB(false)
+	if err != nil {
+		return nil, err
+	}
+
+	check := &WalletCheck{UTXOsBalance: utxosBalance, StoredBalance: storedBalance, UTXOs: count}
+	w.utxoMtx.Lock()
+	for _, utxo := range w.utxos {
+		if !utxo.Spent {
+			check.LoadedBalance += utxo.Value
+		}
+	}
+	check.LoadedUTXOs = len(w.utxos)
+	w.utxoMtx.Unlock()
+
+	check.Consistent = check.UTXOsBalance == check.StoredBalance &&
+		check.UTXOsBalance == check.LoadedBalance && check.UTXOs == check.LoadedUTXOs
+	if check.Consistent || !repair {
+		return check, nil
+	}
+
+	if _, _, _, err := w.checkBalanceDB(true); err != nil {
+		return nil, err
+	}
+	w.utxoMtx.Lock()
+	err = w.loadUTXOs()
+	w.utxoMtx.Unlock()
 	if err != nil {
+		return nil, err
+	}
+	check.Repaired = true
+	w.LogInfo("repaired wallet balance. stored: %v, loaded: %v, utxos: %v",
+		check.StoredBalance, check.LoadedBalance, check.UTXOsBalance)
+
+	return check, nil
+}
+
+// spendPolicy returns the policy used to select UTXOs when sending
+func (w *Wallet) spendPolicy() tx.SpendPolicy {
+	return tx.SpendPolicy{
+		TipHeight:              w.lastScannedBlock,
+		MinConf:                DefaultSpendMinConf,
+		CoinbaseMaturity:       w.network.CoinbaseMaturity,
+		SpendUnconfirmedChange: true,
+	}
+}
+
+// spendableUTXOs returns the UTXOs that can be used to fund a tx
+func (w *Wallet) spendableUTXOs() []tx.UTXO {
+	w.utxoMtx.Lock()
+	defer w.utxoMtx.Unlock()
+	return tx.FilterSpendable(w.utxos, w.spendPolicy())
+}
+
+// GetNewAddress gives out the address at the next index of the active
+// descriptor for the address type: legacy, p2sh-segwit, bech32 or
+// bech32m. If no type is set, it is bech32
+func (w *Wallet) GetNewAddress(addressType string) (string, error) {
+	if addressType == "" {
+		addressType = defaultAddressType
+	}
+	active, ok := w.activeDescriptor(addressType, false)
+	if !ok {
+		return "", fmt.Errorf("wallet has no active descriptor for %s addresses", addressType)
+	}
+
+	var keyPair *KeyPair
+	if err := w.updateDescriptor(active.ID, func(wd *walletDescriptor) error {
+		idx := wd.NextIndex
+		wd.NextIndex++
+		keyPairs, err := w.saveDescriptorKeys(wd, idx, idx+1)
+		if err != nil {
+			return err
+		}
+		keyPair = keyPairs[descriptorPath(wd.ID, idx)]
+		return nil
+	}); err != nil {
 		return "", err
 	}
+	w.addToTxFilter(keyPair.Address)
+
+	return keyPair.Address, nil
+}
 
-	return newKeyPair.Address, nil
+func (w *Wallet) SendToAddress(address string, amount float64, label string, opts SendOptions) (string, error) {
+	return w.SendMany(map[string]float64{address: amount}, label, opts)
 }
 
-func (w *Wallet) SendToAddress(address string, amount float64) (string, error) {
-	if w.locked {
-		return "", fmt.Errorf("wallet is locked. unlock wallet with 'walletpassphrase' command first.")
+// SendMany sends the amounts in BTC to the addresses in a single tx.
+// Outputs are in random order. It returns the txid or the unsigned
+// PSBT of the tx if the wallet is watch-only
+func (w *Wallet) SendMany(amounts map[string]float64, label string, opts SendOptions) (string, error) {
+	if !w.watchOnly && w.keys.isLocked() {
+		return "", ErrWalletLocked
+	}
+
+	outputs, subtractFeeFrom, err := w.recipientOutputs(amounts, opts.SubtractFeeFrom)
+	if err != nil {
+		return "", err
+	}
+	feeRate, err := w.feeRate(opts)
+	if err != nil {
+		return "", err
+	}
+	selector, err := w.coinSelector(opts)
+	if err != nil {
+		return "", err
 	}
 
-	amountToSend, err := btcutil.NewAmount(amount)
+	// hold scanMtx so that concurrent sends do not select the same UTXOs
+	// or change key and so that notifications for the tx are handled
+	// after the wallet is updated
+	w.scanMtx.Lock()
+	defer w.scanMtx.Unlock()
+
+	// create unsigned tx funded with utxos selected from the wallet
+	txToSend, selectedUtxos, change, err := w.fundTransaction(outputs, subtractFeeFrom, feeRate, selector)
 	if err != nil {
-		return "", fmt.Errorf("invalid amount")
+		w.LogError("unable to send - error creating transaction: %s", err.Error())
+		return "", err
 	}
 
-	if w.balance < amountToSend {
-		return "", ErrInsufficientFunds
+	setReplaceable(txToSend, !opts.DisableRBF)
+	return w.signAndBroadcast(txToSend, selectedUtxos, change, label)
+}
+
+// recipientOutputs returns the outputs paying the amounts in BTC to the
+// addresses and the indexes of the outputs of the addresses in subtractFeeFrom
+func (w *Wallet) recipientOutputs(amounts map[string]float64, subtractFeeFrom []string) ([]*wire.TxOut, []int, error) {
+	if len(amounts) == 0 {
+		return nil, nil, errors.New("no addresses to send to")
 	}
 
-	// select utxos from wallet to fulfill amountToSend
-	selectedUtxos, _, err := tx.SelectUTXOs(amountToSend, w.utxos)
+	outputs := make([]*wire.TxOut, 0, len(amounts))
+	// index of the output of each address as passed
+	outputIndexes := make(map[string]int, len(amounts))
+	// addresses decoded to catch duplicates in different encodings
+	addresses := make(map[string]bool, len(amounts))
+	for address, amount := range amounts {
+		amountToSend, err := btcutil.NewAmount(amount)
+		if err != nil || amountToSend <= 0 {
+			return nil, nil, fmt.Errorf("invalid amount for address %s", address)
+		}
+
+		addr, err := btcutil.DecodeAddress(address, w.network)
+		if err != nil || !addr.IsForNet(w.network) {
+			return nil, nil, fmt.Errorf("invalid address: %s", address)
+		}
+		if addresses[addr.EncodeAddress()] {
+			return nil, nil, fmt.Errorf("duplicated address: %s", address)
+		}
+		addresses[addr.EncodeAddress()] = true
+
+		txOut, err := tx.CreateTxOut(address, amountToSend, w.network)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid address: %s", err.Error())
+		}
+		outputIndexes[address] = len(outputs)
+		outputs = append(outputs, txOut)
+	}
+
+	indexes := make([]int, 0, len(subtractFeeFrom))
+	for _, address := range subtractFeeFrom {
+		idx, ok := outputIndexes[address]
+		if !ok {
+			return nil, nil, fmt.Errorf("address %s to subtract fee from is not a recipient", address)
+		}
+		if slices.Contains(indexes, idx) {
+			return nil, nil, fmt.Errorf("duplicated address to subtract fee from: %s", address)
+		}
+		indexes = append(indexes, idx)
+	}
+
+	return outputs, indexes, nil
+}
+
+// fundTransaction creates an unsigned tx paying the outputs funded with
+// spendable utxos of the wallet. Callers must hold scanMtx
+func (w *Wallet) fundTransaction(outputs []*wire.TxOut, subtractFeeFrom []int, feeRate tx.FeeRate,
+	selector tx.CoinSelector) (*wire.MsgTx, []tx.UTXO, *changeOutput, error) {
+	totalAmount := btcutil.Amount(0)
+	for _, txOut := range outputs {
+		totalAmount += btcutil.Amount(txOut.Value)
+	}
+
+	spendable := w.spendableUTXOs()
+	if tx.SumValues(spendable) < totalAmount {
+		return nil, nil, nil, ErrInsufficientFunds
+	}
+
+	rawTx, utxos, change, err := w.createRawTransaction(outputs, subtractFeeFrom, feeRate, selector, spendable)
+	if err != nil {
+		if errors.Is(err, tx.ErrInsufficientAmount) {
+			return nil, nil, nil, fmt.Errorf("%w. not enough to pay amount and fee at %v", ErrInsufficientFunds, feeRate)
+		}
+		return nil, nil, nil, err
+	}
+	return rawTx, utxos, change, nil
+}
+
+// SendAll sends all the spendable utxos to the address in a single tx with
+// no change. If outpoints (txid:vout) are passed, only those utxos are sent.
+// The fee is paid from the amount sent. Like SendMany, watch-only
+// wallets return the unsigned PSBT of the tx instead of the txid
+func (w *Wallet) SendAll(address string, outpoints []string, label string, opts SendOptions) (string, error) {
+	if !w.watchOnly && w.keys.isLocked() {
+		return "", ErrWalletLocked
+	}
+
+	addr, err := btcutil.DecodeAddress(address, w.network)
+	if err != nil || !addr.IsForNet(w.network) {
+		return "", fmt.Errorf("invalid address: %s", address)
+	}
+	if len(opts.SubtractFeeFrom) > 0 {
+		return "", errors.New("fee is always subtracted from the amount when sending all")
+	}
+
+	feeRate, err := w.feeRate(opts)
 	if err != nil {
-		w.LogError("unable to send to address - error selecting UTXOs: %s", err.Error())
 		return "", err
 	}
 
-	// create unsigned tx from the selected utxos
-	txToSend, err := w.createRawTransaction(address, amountToSend, defaultFee, selectedUtxos)
+	w.scanMtx.Lock()
+	defer w.scanMtx.Unlock()
+
+	spendable := w.spendableUTXOs()
+	utxos := spendable
+	if len(outpoints) > 0 {
+		utxos = make([]tx.UTXO, 0, len(outpoints))
+		for _, outpoint := range outpoints {
+			idx := slices.IndexFunc(spendable, func(utxo tx.UTXO) bool {
+				return utxo.GetOutpoint() == outpoint
+			})
+			if idx == -1 {
+				return "", fmt.Errorf("utxo %s is not in the wallet or can't be spent", outpoint)
+			}
+			if slices.ContainsFunc(utxos, func(utxo tx.UTXO) bool { return utxo.GetOutpoint() == outpoint }) {
+				return "", fmt.Errorf("duplicated utxo: %s", outpoint)
+			}
+			utxos = append(utxos, spendable[idx])
+		}
+	}
+	if len(utxos) == 0 {
+		return "", ErrInsufficientFunds
+	}
+
+	txToSend, err := w.createSweepTransaction(address, feeRate, utxos)
 	if err != nil {
-		w.LogError("unable to send to address - error creating transaction: %s", err.Error())
+		w.LogError("unable to send all - error creating transaction: %s", err.Error())
 		return "", err
 	}
 
+	setReplaceable(txToSend, !opts.DisableRBF)
+	return w.signAndBroadcast(txToSend, utxos, nil, label)
+}
+
+// signAndBroadcast signs the tx spending the utxos, sends it
+// to the network and updates the wallet with it. Watch-only wallets
+// return the tx as a PSBT to be signed elsewhere and sent with SendPSBT
+func (w *Wallet) signAndBroadcast(msgTx *wire.MsgTx, utxos []tx.UTXO, change *changeOutput, label string) (string, error) {
+	if w.watchOnly {
+		funded, err := w.newFundedPSBT(msgTx, change)
+		if err != nil {
+			return "", err
+		}
+		w.LogInfo("created psbt of tx %s to sign. fee: %v", msgTx.TxHash(), funded.Fee)
+		return funded.PSBT, nil
+	}
+
 	// sign raw transaction using keys associated with selected utxos
-	err = w.signTransaction(txToSend, selectedUtxos)
+	err := w.signTransaction(msgTx, utxos)
 	if err != nil {
-		w.LogError("unable to send to address - error signing transaction: %s", err.Error())
+		w.LogError("unable to send - error signing transaction: %s", err.Error())
 		return "", fmt.Errorf("error signing transaction: %s", err.Error())
 	}
 
-	// send tx to network after validating
-	_, err = w.client.SendRawTransaction(txToSend, true)
+	// send tx to network and update the wallet with it
+	if err := w.broadcastTx(msgTx, utxos, change, label, ""); err != nil {
+		return "", err
+	}
+
+	return msgTx.TxHash().String(), nil
+}
+
+func (w *Wallet) WalletPassphrase(passphrase string, duration time.Duration) error {
+	if w.watchOnly {
+		return ErrWatchOnly
+	}
+	if duration <= 0 {
+		return errors.New("unlock duration must be positive")
+	}
+
+	masterKey, err := w.unwrapMasterKey([]byte(passphrase))
 	if err != nil {
-		w.LogError("error sending transaction to network: %s", err.Error())
-		return "", fmt.Errorf("error sending transaction: %s", err.Error())
+		return err
 	}
-	w.LogInfo("sent tx %s to network", txToSend.TxHash().String())
 
-	// if no errors while creating and broadcasting tx, then update the wallet fields
-	// accordingly. Subtract amount sent and fee from balance, mark spent utxos
-	// and add change utxo to list of wallet utxos
-	w.updateWalletAfterTx(txToSend, selectedUtxos, amountToSend)
+	// replaces the timeout of a previous unlock
+	w.keys.unlock(masterKey, duration)
+	return nil
+}
 
-	return txToSend.TxHash().String(), nil
+// WalletInfo is general information about the state of the wallet
+type WalletInfo struct {
+	WalletVersion    uint32         `json:"walletversion"`
+	Network          string         `json:"network"`
+	Balance          btcutil.Amount `json:"balance"`
+	TxCount          int            `json:"txcount"`
+	LastScannedBlock int64          `json:"last_scanned_block"`
+	Recovering       bool           `json:"recovering"`
+	Locked           bool           `json:"locked"`
+	WatchOnly        bool           `json:"watch_only"`
+	// unix time at which the wallet will be locked. 0 if the wallet is locked
+	UnlockedUntil int64 `json:"unlocked_until"`
 }
 
-func (w *Wallet) WalletPassphrase(passphrase string, duration time.Duration) error {
-	encodedHash := string(w.getEncodedHash())
+func (w *Wallet) GetWalletInfo() WalletInfo {
+	w.scanMtx.Lock()
+	lastScannedBlock := w.lastScannedBlock
+	recovering := w.recovery != nil
+	w.scanMtx.Unlock()
+
+	info := WalletInfo{
+		WalletVersion:    w.getWalletVersion(),
+		Network:          w.network.Name,
+		Balance:          w.balances(DefaultSpendMinConf, lastScannedBlock).Trusted,
+		TxCount:          w.countTxRecords(),
+		LastScannedBlock: lastScannedBlock,
+		Recovering:       recovering,
+		WatchOnly:        w.watchOnly,
+	}
 
-	if !utils.VerifyPassphrase(encodedHash, passphrase) {
-		return errors.New("invalid passphrase")
+	if unlockedUntil := w.keys.getUnlockedUntil(); !unlockedUntil.IsZero() {
+		info.UnlockedUntil = unlockedUntil.Unix()
+	} else {
+		info.Locked = true
 	}
+	return info
+}
+
+// WalletPassphraseChange changes the wallet passphrase from oldPassphrase
+// to newPassphrase. If memory or iterations are not zero, the argon2 cost
+// parameters are changed to them. Otherwise the current ones are kept
+func (w *Wallet) WalletPassphraseChange(oldPassphrase, newPassphrase string, memory, iterations uint32) error {
+	if w.watchOnly {
+		return ErrWatchOnly
+	}
+	if newPassphrase == "" {
+		return errors.New("new passphrase can not be empty")
+	}
+
+	params, err := w.kdfParams()
+	if err != nil {
+		return fmt.Errorf("error reading current argon2 params: %v", err)
+	}
+	if memory != 0 {
+		params.Memory = memory
+	}
+	if iterations != 0 {
+		params.Iterations = iterations
+	}
+	if err := params.Validate(); err != nil {
+		return err
+	}
+
+	newMasterKey, err := w.changePassphrase([]byte(oldPassphrase), []byte(newPassphrase), params)
+	if err != nil {
+		return err
+	}
+
+	// keep the wallet unlocked with the new master key if it was unlocked
+	w.keys.replaceMasterKey(newMasterKey)
 
-	w.unlock(duration)
+	w.LogInfo("wallet passphrase changed. argon2 memory: %v KiB, iterations: %v",
+		params.Memory, params.Iterations)
 	return nil
 }
 
 func (w *Wallet) WalletLock() {
-	w.lock()
+	w.keys.lock()
 }
@@ -0,0 +1,88 @@
+package wallet
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/elnosh/btcw/tx"
+)
+
+// coinbaseTx returns a coinbase tx paying value to address
+func coinbaseTx(t *testing.T, address string, value btcutil.Amount) *wire.MsgTx {
+	t.Helper()
+
+	txOut, err := tx.CreateTxOut(address, value, &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgTx := wire.NewMsgTx(wire.TxVersion)
+	prevOut := wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex)
+	msgTx.AddTxIn(wire.NewTxIn(prevOut, []byte{0x51, 0x51}, nil))
+	msgTx.AddTxOut(txOut)
+	return msgTx
+}
+
+func TestGetBalances(t *testing.T) {
+	for _, scanner := range testScanners {
+		t.Run(scanner.name, func(t *testing.T) {
+			w, client := newTestWallet(t)
+			addresses := make([]string, 3)
+			for i := range addresses {
+				address, err := w.GetNewAddress("")
+				if err != nil {
+					t.Fatal(err)
+				}
+				addresses[i] = address
+			}
+
+			coinbase := coinbaseTx(t, addresses[0], 50000)
+			height := scanner.scan(t, w, client, coinbase, paymentTx(t, addresses[1], 30000))
+			unconfirmed := paymentTx(t, addresses[2], 20000)
+			addToMempool(client, unconfirmed)
+			w.handleMempoolTx(unconfirmed)
+
+			if utxo := findTestUTXO(t, w, coinbase.TxHash().String()+":0"); !utxo.Coinbase {
+				t.Fatalf("coinbase utxo is not marked as coinbase: %+v", utxo)
+			}
+
+			checkBalances := func(minConf int64, wanted Balances) {
+				t.Helper()
+				for _, wallet := range []*Wallet{w, loadTestWallet(t, w.db, client)} {
+					if balances := wallet.GetBalances(minConf); balances != wanted {
+						t.Errorf("unexpected balances with minconf %v - expected: %+v, got: %+v",
+							minConf, wanted, balances)
+					}
+
+					check, err := wallet.CheckWallet(false)
+					if err != nil {
+						t.Fatal(err)
+					}
+					// stored balance counts all unspent outputs
+					if !check.Consistent || check.StoredBalance != 100000 ||
+						check.UTXOsBalance != 100000 || check.LoadedBalance != 100000 {
+						t.Errorf("stored balance drifted from utxos: %+v", check)
+					}
+				}
+			}
+			checkBalances(0, Balances{Trusted: 30000, UntrustedPending: 20000, Immature: 50000})
+			checkBalances(2, Balances{UntrustedPending: 20000, Immature: 50000})
+
+			// coinbase matures after CoinbaseMaturity confirmations
+			maturity := int64(chaincfg.RegressionNetParams.CoinbaseMaturity)
+			for w.lastScannedBlock < height+maturity-2 {
+				scanner.scan(t, w, client)
+			}
+			checkBalances(0, Balances{Trusted: 30000, UntrustedPending: 20000, Immature: 50000})
+			scanner.scan(t, w, client)
+			checkBalances(0, Balances{Trusted: 80000, UntrustedPending: 20000})
+
+			// unconfirmed receive is trusted once confirmed
+			removeFromMempool(client, unconfirmed)
+			scanner.scan(t, w, client, unconfirmed)
+			checkBalances(1, Balances{Trusted: 100000})
+		})
+	}
+}
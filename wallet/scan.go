@@ -3,76 +3,222 @@ package wallet
 import (
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
-	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/blockchain"
 	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
 	"github.com/elnosh/btcw/tx"
 )
 
+var (
+	errBlockNotConnected = errors.New("block does not connect to last scanned block")
+)
+
 // scanMissingBlocks will look at the last scanned block and the current
 // height of the blockchain and scan any missing blocks if needed
 func (w *Wallet) scanMissingBlocks() {
+	w.scanMtx.Lock()
+	defer w.scanMtx.Unlock()
+
+	if w.syncAndFinishRecovery() {
+		w.LogInfo("Finished scanning. Synced with blockchain at height: %v", w.lastScannedBlock)
+	}
+	w.checkMempoolTxs()
+}
+
+// syncAndFinishRecovery syncs the wallet with the chain and takes it out
+// of recovery mode only if it reached the tip. Otherwise the gap limit
+// lookahead is still needed when the sync is retried. It returns true if
+// the wallet is synced. Callers must hold scanMtx
+func (w *Wallet) syncAndFinishRecovery() bool {
+	if err := w.syncWithChain(); err != nil {
+		w.LogError("error scanning blockchain: %v", err)
+		return false
+	}
+	w.finishRecovery()
+	return true
+}
+
+// syncWithChain rolls back blocks that are no longer in the main chain
+// and scans the blocks after the last scanned block up to the tip.
+// It returns an error if the tip was not reached. Callers must hold scanMtx
+func (w *Wallet) syncWithChain() error {
+	if err := w.detectReorg(); err != nil {
+		return fmt.Errorf("could not check for reorg: %v", err)
+	}
+
 	height, err := w.client.GetBlockCount()
 	if err != nil {
-		w.LogError("error scanning blockchain - could not get block count: %v", err)
-		return
+		return fmt.Errorf("could not get block count: %v", err)
 	}
 
 	for w.lastScannedBlock < height {
 		nextBlockHash, err := w.client.GetBlockHash(w.lastScannedBlock + 1)
 		if err != nil {
-			w.LogError("error scanning blockchain - could not get block hash: %v", err)
+			return fmt.Errorf("could not get block hash: %v", err)
 		}
 
-		w.scanBlock(nextBlockHash)
+		err = w.scanBlock(nextBlockHash)
+		if err == errBlockNotConnected {
+			// chain changed while scanning
+			if err := w.detectReorg(); err != nil {
+				return fmt.Errorf("could not check for reorg: %v", err)
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if w.recovery != nil && w.lastScannedBlock%1000 == 0 {
+			w.LogInfo("recovery progress: scanned up to block %v of %v", w.lastScannedBlock, height)
+		}
 	}
-	w.LogInfo("Finished scanning. Synced with blockchain at height: %v", w.lastScannedBlock)
+	return nil
 }
 
-// scanBlockTxs scans the new block received for addresses owned by
+// handleNewBlock is called when the node notifies of a new block.
+// It syncs the wallet with the chain of the node
+func (w *Wallet) handleNewBlock() {
+	w.scanMtx.Lock()
+	defer w.scanMtx.Unlock()
+
+	w.syncAndFinishRecovery()
+	w.checkMempoolTxs()
+}
+
+// handleFilteredBlockConnected is called by btcd notification handler for
+// when new blocks are added to the blockchain. If the block does not connect to
+// the last scanned block, it will sync with the chain instead
+func (w *Wallet) handleFilteredBlockConnected(height int64, header *wire.BlockHeader, txs []*btcutil.Tx) {
+	w.scanMtx.Lock()
+	defer w.scanMtx.Unlock()
+
+	lastHash := w.getBlockHash(w.lastScannedBlock)
+	if height != w.lastScannedBlock+1 || (lastHash != "" && header.PrevBlock.String() != lastHash) {
+		w.syncAndFinishRecovery()
+		return
+	}
+
+	w.scanBlockTxs(header.BlockHash().String(), height, header.Timestamp.Unix(), txs)
+}
+
+// handleFilteredBlockDisconnected is called by btcd notification handler
+// for when a block is removed from the main chain
+func (w *Wallet) handleFilteredBlockDisconnected(height int64, header *wire.BlockHeader) {
+	w.scanMtx.Lock()
+	defer w.scanMtx.Unlock()
+
+	if height > w.lastScannedBlock {
+		return
+	}
+
+	if err := w.rollback(height - 1); err != nil {
+		w.LogError("error rolling back disconnected block %s: %v", header.BlockHash().String(), err)
+	}
+}
+
+// scanBlockTxs scans the txs of new block received for addresses owned by
 // wallet and adds UTXOs to wallet and updates balance.
-// This is called by btcd notification handler setup for when
-// new blocks are added to the blockchain
-func (w *Wallet) scanBlockTxs(blockHash string, txsInBlock []*btcutil.Tx) {
+// Callers must hold scanMtx
+func (w *Wallet) scanBlockTxs(blockHash string, height, blockTime int64, txsInBlock []*btcutil.Tx) {
 	for _, txb := range txsInBlock {
+		txid := txb.Hash().String()
+		isCoinbase := blockchain.IsCoinBase(txb)
+		w.confirmMempoolTx(txid)
+		relevant := false
+		for _, txIn := range txb.MsgTx().TxIn {
+			if w.debitOutpoint(txIn.PreviousOutPoint.String(), txid, height, blockHash) {
+				relevant = true
+			}
+		}
+
 		for voutIdx, txOut := range txb.MsgTx().TxOut {
 			script, err := txscript.ParsePkScript(txOut.PkScript)
 			if err != nil {
 				w.LogError("error scanning block - could not parse tx pkScript: %v", err)
+				continue
 			}
 
 			addr, err := script.Address(w.network)
 			if err != nil {
 				w.LogError("error scanning block - could not get address: %v", err)
+				continue
 			}
 
 			addrStr := addr.String()
-			path, ok := w.addresses[addrStr]
+			path, ok := w.lookupAddress(addrStr)
 			// if ok, output found that sends to address owned by wallet
 			if ok {
-				w.LogInfo("found new receiving transaction in block %s", blockHash)
+				w.markAddressUsed(path)
 				value := btcutil.Amount(txOut.Value)
-				txid := txb.Hash().String()
-
-				utxo := tx.NewUTXO(txid, uint32(voutIdx), value, script.Script(), path)
-				if err := w.addUTXO(*utxo); err != nil {
-					w.LogError("error adding receiving UTXO to wallet: %v", err)
-				}
-
-				balance := w.balance + utxo.Value
-				if err := w.setBalance(balance); err != nil {
-					w.LogError("error updating balance for new receiving UTXO: %v", err)
-				}
 
-				w.LogInfo("added new transaction %s to wallet", txid)
+				utxo := w.newUTXO(txid, uint32(voutIdx), value, script.Script(), path)
+				utxo.Height = height
+				utxo.BlockHash = blockHash
+				utxo.Coinbase = isCoinbase
+				w.creditUTXO(*utxo, blockHash)
+				relevant = true
 			}
 		}
+
+		if relevant {
+			w.recordTx(txb.MsgTx(), height, blockHash, blockTime)
+		}
 	}
-	w.setLastScannedBlock(w.lastScannedBlock + 1)
+	if err := w.setLastScannedBlock(height, blockHash); err != nil {
+		w.LogError("error updating last scanned block: %v", err)
+	}
+}
+
+// creditUTXO adds the UTXO found in block to the wallet
+func (w *Wallet) creditUTXO(utxo tx.UTXO, blockHash string) {
+	isNew, err := w.receiveUTXO(utxo)
+	if err != nil {
+		w.LogError("error adding UTXO to wallet: %v", err)
+		return
+	}
+
+	if !isNew {
+		w.LogInfo("transaction %s confirmed in block %s", utxo.TxID, blockHash)
+		return
+	}
+
+	w.LogInfo("found new receiving transaction in block %s", blockHash)
+	w.LogInfo("added new transaction %s to wallet", utxo.TxID)
+	w.addOutPointToTxFilter(utxo)
+}
+
+// debitOutpoint checks if the outpoint spent by an input of tx spendingTxID
+// is a wallet UTXO. If it is, it marks it as spent and returns true
+func (w *Wallet) debitOutpoint(outpoint, spendingTxID string, height int64, blockHash string) bool {
+	// if UTXO was spent by a different unconfirmed tx, that tx is now conflicted
+	if existing, ok := w.findUTXO(outpoint); ok && existing.Spent &&
+		existing.SpentBy != spendingTxID && existing.SpentHeight == 0 {
+		w.dropMempoolTx(existing.SpentBy, "", "conflicts with tx "+spendingTxID)
+	}
+
+	utxo, wasUnspent, err := w.spendUTXO(outpoint, spendingTxID, height)
+	if err != nil {
+		w.LogError("error marking UTXO as spent: %v", err)
+		return false
+	}
+	if utxo == nil {
+		return false
+	}
+
+	if !wasUnspent {
+		w.LogInfo("spend of UTXO %s confirmed in block %s", outpoint, blockHash)
+		return true
+	}
+
+	w.LogInfo("found spend of UTXO %s by tx %s in block %s", outpoint, spendingTxID, blockHash)
+	return true
 }
 
 // scanForNewBlocks used when node is bitcoin core
@@ -87,91 +233,91 @@ func scanForNewBlocks(ctx context.Context, wallet *Wallet, errChan chan error) {
 				errChan <- nil
 				return
 			case <-ticker.C:
-				height, err := wallet.client.GetBlockCount()
-				if err != nil {
-					errChan <- err
-					return
-				}
 				// if there are any new blocks, scan them
-				for wallet.lastScannedBlock < height {
-					nextBlockHash, err := wallet.client.GetBlockHash(wallet.lastScannedBlock + 1)
-					if err != nil {
-						errChan <- fmt.Errorf("error getting block hash: %v", err)
-					}
-
-					wallet.scanBlock(nextBlockHash)
-				}
+				wallet.handleNewBlock()
 			}
 		}
 	}(ctx)
 }
 
-func (w *Wallet) scanBlock(blockHash *chainhash.Hash) {
+// scanBlock scans the block with blockHash for txs sending to or spending
+// from the wallet. Block needs to be the next block after the last scanned
+// block, otherwise it returns errBlockNotConnected.
+// Callers must hold scanMtx
+func (w *Wallet) scanBlock(blockHash *chainhash.Hash) error {
 	// get block info
 	block, err := w.client.GetBlockVerboseTx(blockHash)
 	if err != nil {
-		w.LogError("error getting block: %v", err)
-		return
+		return fmt.Errorf("error getting block: %v", err)
+	}
+
+	lastHash := w.getBlockHash(w.lastScannedBlock)
+	if block.Height != w.lastScannedBlock+1 || (lastHash != "" && block.PreviousHash != lastHash) {
+		return errBlockNotConnected
 	}
 
 	// there is a difference between btcd and bitcoin core
 	// in the []TxRawResult returned from GetBlockVerboseTx call.
-	// if node is btcd use RawTx field, if core then use Tx field
-	var txsInBlock []btcjson.TxRawResult
-	switch v := w.client.(type) {
-	case *BtcdClient:
+	// btcd sets the RawTx field and bitcoin core the Tx field
+	txsInBlock := block.Tx
+	if len(block.RawTx) > 0 {
 		txsInBlock = block.RawTx
-	case *BitcoinCoreClient:
-		txsInBlock = block.Tx
-	default:
-		w.LogError("invalid client type: %T", v)
 	}
 
 	for _, rawTx := range txsInBlock {
+		isCoinbase := len(rawTx.Vin) > 0 && rawTx.Vin[0].IsCoinBase()
+		w.confirmMempoolTx(rawTx.Txid)
+		relevant := false
+		for _, vin := range rawTx.Vin {
+			if vin.IsCoinBase() {
+				continue
+			}
+			outpoint := vin.Txid + ":" + strconv.FormatUint(uint64(vin.Vout), 10)
+			if w.debitOutpoint(outpoint, rawTx.Txid, block.Height, block.Hash) {
+				relevant = true
+			}
+		}
+
 		for _, vout := range rawTx.Vout {
 			script, err := hex.DecodeString(vout.ScriptPubKey.Hex)
 			if err != nil {
-				w.LogError("error decoding hex script: %v", err)
-				return
+				return fmt.Errorf("error decoding hex script: %v", err)
 			}
 
 			// this will extract the address from the script
-			class, addrs, _, err := txscript.ExtractPkScriptAddrs(script, w.network)
+			_, addrs, _, err := txscript.ExtractPkScriptAddrs(script, w.network)
 			if err != nil {
-				w.LogError("error extractring address script info: %v", err)
-				return
+				return fmt.Errorf("error extractring address script info: %v", err)
 			}
 
-			if class == txscript.PubKeyHashTy || class == txscript.WitnessV0PubKeyHashTy {
+			if len(addrs) == 1 {
 				// check if address extracted from script is in wallet
 				addr := addrs[0].String()
-				path, ok := w.addresses[addr]
+				path, ok := w.lookupAddress(addr)
 				// if match is found
 				// add UTXO and update wallet balance
 				if ok {
-					w.LogInfo("found new receiving transaction in block %s", block.Hash)
+					w.markAddressUsed(path)
 					utxoAmount, err := btcutil.NewAmount(vout.Value)
 					if err != nil {
-						w.LogError("error getting tx amount: %v", err)
-						return
-					}
-
-					utxo := tx.NewUTXO(rawTx.Txid, vout.N, utxoAmount, script, path)
-					if err := w.addUTXO(*utxo); err != nil {
-						w.LogError("error adding new UTXO: %v", err)
-						return
+						return fmt.Errorf("error getting tx amount: %v", err)
 					}
 
-					balance := w.balance + utxoAmount
-					if err := w.setBalance(balance); err != nil {
-						w.LogError("error setting wallet balance: %v", err)
-						return
-					}
-					w.LogInfo("added new transaction %s to wallet", rawTx.Txid)
+					utxo := w.newUTXO(rawTx.Txid, vout.N, utxoAmount, script, path)
+					utxo.Height = block.Height
+					utxo.BlockHash = block.Hash
+					utxo.Coinbase = isCoinbase
+					w.creditUTXO(*utxo, block.Hash)
+					relevant = true
 				}
 			}
 		}
+
+		if relevant {
+			w.recordTxHex(rawTx.Hex, block.Height, block.Hash, block.Time)
+		}
 	}
-	// increase last scanned block
-	w.setLastScannedBlock(w.lastScannedBlock + 1)
+
+	// update last scanned block
+	return w.setLastScannedBlock(block.Height, block.Hash)
 }
@@ -0,0 +1,175 @@
+package wallet
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/elnosh/btcw/tx"
+)
+
+// testScanners add a block with the txs to the chain of the node and
+// scan it the way the wallet does with each node. They return its height
+var testScanners = []struct {
+	name string
+	scan func(t *testing.T, w *Wallet, client *fakeClient, txs ...*wire.MsgTx) int64
+}{
+	{name: "btcd filtered block", scan: connectBlock},
+	{name: "bitcoin core block", scan: scanNextBlock},
+}
+
+// scanNextBlock adds a block with the txs to the chain of the node
+// and syncs the wallet with it like it does with bitcoin core
+func scanNextBlock(t *testing.T, w *Wallet, client *fakeClient, txs ...*wire.MsgTx) int64 {
+	t.Helper()
+
+	height, _ := client.addBlock(txs...)
+	w.scanMtx.Lock()
+	err := w.syncWithChain()
+	w.scanMtx.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.lastScannedBlock != height {
+		t.Fatalf("block %v was not scanned", height)
+	}
+	return height
+}
+
+func TestScanChange(t *testing.T) {
+	for _, scanner := range testScanners {
+		t.Run(scanner.name, func(t *testing.T) {
+			w, client := newTestWallet(t)
+			fundWallet(t, w, client, "", 100000)
+
+			// send interrupted before the wallet was updated. Only the change key is saved
+			pending, msgTx := journalSend(t, w, newTestAddress(t), 0.0003)
+			if pending.Change == nil {
+				t.Fatal("expected tx with change")
+			}
+			w.dropPendingBroadcast(pending)
+			changeOutpoint := fmt.Sprintf("%s:%v", pending.TxID, pending.Change.Index)
+			if _, ok := w.findUTXO(changeOutpoint); ok {
+				t.Fatal("change was added before the tx was found")
+			}
+
+			height := scanner.scan(t, w, client, msgTx)
+
+			// payment from outside to the change address
+			payment := paymentTx(t, pending.Change.KeyPair.Address, 20000)
+			paymentHeight := scanner.scan(t, w, client, payment)
+
+			for _, wallet := range []*Wallet{w, loadTestWallet(t, w.db, client)} {
+				change := findTestUTXO(t, wallet, changeOutpoint)
+				if change.Height != height || change.BlockHash != client.blocks[height].String() {
+					t.Errorf("change not confirmed at block %v: %+v", height, change)
+				}
+				if change.DerivationPath != pending.Change.Path || !wallet.isChange(change.DerivationPath) {
+					t.Errorf("change is not from the internal chain: %+v", change)
+				}
+				if record := wallet.getTxRecord(pending.TxID); record == nil || record.Direction != DirectionSend {
+					t.Errorf("unexpected record of tx with change: %+v", record)
+				}
+
+				received := findTestUTXO(t, wallet, payment.TxHash().String()+":0")
+				if received.Height != paymentHeight || received.DerivationPath != pending.Change.Path {
+					t.Errorf("unexpected utxo received to change address: %+v", received)
+				}
+				if record := wallet.getTxRecord(payment.TxHash().String()); record == nil ||
+					record.Direction != DirectionReceive || record.Amount != 20000 {
+					t.Errorf("unexpected record of payment to change address: %+v", record)
+				}
+
+				// next change is not the used key
+				next, err := wallet.deriveChangeKey()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if next.Path == pending.Change.Path {
+					t.Error("used change key is given out again")
+				}
+				checkConsistent(t, wallet)
+			}
+		})
+	}
+}
+
+func TestScanSpends(t *testing.T) {
+	for _, scanner := range testScanners {
+		t.Run(scanner.name, func(t *testing.T) {
+			w, client := newTestWallet(t)
+			// unconfirmed tx sent by the wallet
+			sent := fundWallet(t, w, client, "", 100000)
+			sentTxID, err := w.SendToAddress(newTestAddress(t), 0.0003, "", SendOptions{FeeRate: 2000})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sentTx := client.sent[0]
+			change := findTestUTXO(t, w, fmt.Sprintf("%s:%v", sentTxID, changeIndex(t, w, sentTx)))
+
+			// unconfirmed tx sent by the wallet that conflicts with a tx in the block
+			conflicted := fundWallet(t, w, client, "", 40000)
+			droppedTxID, err := w.SendAll(newTestAddress(t), []string{conflicted.GetOutpoint()}, "", SendOptions{FeeRate: 2000})
+			if err != nil {
+				t.Fatal(err)
+			}
+			conflictingTx := spendingTestTx(t, conflicted, newTestAddress(t))
+
+			// tx spending a wallet utxo created somewhere else with the same keys
+			external := fundWallet(t, w, client, "", 30000)
+			externalTx := spendingTestTx(t, external, newTestAddress(t))
+
+			unrelated := paymentTx(t, newTestAddress(t), 10000)
+			height := scanner.scan(t, w, client, sentTx, conflictingTx, externalTx, unrelated)
+
+			for _, wallet := range []*Wallet{w, loadTestWallet(t, w.db, client)} {
+				spends := []struct {
+					utxo    tx.UTXO
+					spentBy string
+				}{
+					{utxo: sent, spentBy: sentTxID},
+					{utxo: conflicted, spentBy: conflictingTx.TxHash().String()},
+					{utxo: external, spentBy: externalTx.TxHash().String()},
+				}
+				for _, spend := range spends {
+					utxo := findTestUTXO(t, wallet, spend.utxo.GetOutpoint())
+					if !utxo.Spent || utxo.SpentBy != spend.spentBy || utxo.SpentHeight != height {
+						t.Errorf("spend by tx %s in block %v not detected: %+v", spend.spentBy, height, utxo)
+					}
+				}
+
+				if utxo := findTestUTXO(t, wallet, change.GetOutpoint()); utxo.Height != height {
+					t.Errorf("change of sent tx not confirmed at block %v: %+v", height, utxo)
+				}
+				if record := wallet.getTxRecord(sentTxID); record.BlockHeight != height {
+					t.Errorf("sent tx not confirmed at block %v: %+v", height, record)
+				}
+				if _, ok := wallet.mempoolTxs[sentTxID]; ok {
+					t.Error("confirmed tx is still tracked as unconfirmed")
+				}
+
+				if record := wallet.getTxRecord(droppedTxID); record == nil || !record.Dropped {
+					t.Errorf("conflicted tx was not dropped: %+v", record)
+				}
+				if _, ok := wallet.mempoolTxs[droppedTxID]; ok {
+					t.Error("conflicted tx is still tracked as unconfirmed")
+				}
+
+				for _, spendingTx := range []*wire.MsgTx{conflictingTx, externalTx} {
+					record := wallet.getTxRecord(spendingTx.TxHash().String())
+					if record == nil || record.Direction != DirectionSend || record.BlockHeight != height {
+						t.Errorf("unexpected record of tx spending wallet utxo: %+v", record)
+					}
+				}
+				if wallet.getTxRecord(unrelated.TxHash().String()) != nil {
+					t.Error("unrelated tx was recorded")
+				}
+
+				if balance := wallet.GetBalance(1); balance != change.Value {
+					t.Errorf("unexpected balance - expected: %v, got: %v", change.Value, balance)
+				}
+				checkConsistent(t, wallet)
+			}
+		})
+	}
+}
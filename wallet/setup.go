@@ -3,6 +3,7 @@ package wallet
 import (
 	"bufio"
 	"bytes"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
@@ -12,7 +13,7 @@ import (
 
 	"github.com/btcsuite/btcd/btcutil/hdkeychain"
 	"github.com/btcsuite/btcd/chaincfg"
-	"github.com/elnosh/btcw/utils"
+	"github.com/tyler-smith/go-bip39"
 	bolt "go.etcd.io/bbolt"
 	"golang.org/x/term"
 )
@@ -22,75 +23,237 @@ var (
 	ErrWalletNotExists = errors.New("wallet does not exist")
 )
 
-func CreateWallet(net *chaincfg.Params) error {
-	path := setupWalletDir(net)
-	db, err := bolt.Open(filepath.Join(path, "wallet.db"), 0600, nil)
+// CreateWallet creates a new wallet from a freshly generated BIP-39 mnemonic.
+// wordCount is the number of words in the mnemonic (12 or 24)
+func CreateWallet(net *chaincfg.Params, wordCount int) error {
+	bitSize, err := entropyBitSize(wordCount)
 	if err != nil {
-		return errors.New("error setting wallet")
+		return err
 	}
 
-	if walletExists(db) {
-		return errors.New("wallet already exists")
+	wallet, err := openNewWallet(net)
+	if err != nil {
+		return err
 	}
-
-	wallet := &Wallet{db: db}
 	defer wallet.db.Close()
 
 	// create wallet prompt
 	reader := bufio.NewReader(os.Stdin)
 	fmt.Println("do you want to create a new wallet? (y/n)")
+	if !promptYes(reader) {
+		os.Exit(0)
+	}
+
+	passphrase, err := promptPassphrase()
+	if err != nil {
+		return err
+	}
+
+	entropy, err := bip39.NewEntropy(bitSize)
+	if err != nil {
+		return fmt.Errorf("error creating wallet: %v", err)
+	}
+	mnemonic, err := bip39.NewMnemonic(entropy)
+	if err != nil {
+		return fmt.Errorf("error creating wallet: %v", err)
+	}
+
+	mnemonicPassphrase, err := promptMnemonicPassphrase(reader)
+	if err != nil {
+		return err
+	}
+	seed := bip39.NewSeed(mnemonic, mnemonicPassphrase)
+
+	fmt.Println("Next will be the mnemonic. Write it down and store securely. Anyone with access to the mnemonic has access to the funds.")
+	if mnemonicPassphrase != "" {
+		fmt.Println("The mnemonic passphrase is also needed to restore the wallet. Do not lose it.")
+	}
+	fmt.Printf("mnemonic: %s\n", mnemonic)
+
+	if err = wallet.initWalletBuckets(seed, passphrase, net); err != nil {
+		return fmt.Errorf("error creating wallet: %v", err)
+	}
+
+	return nil
+}
+
+// CreateWatchOnlyWallet creates a wallet from the extended public key of an
+// account (xpub, tpub, zpub or vpub) optionally prefixed by its key origin.
+// It derives addresses and tracks funds but has no private keys to sign.
+// The wallet is set to recovery mode to find funds already sent to
+// the account starting from the birthday height
+func CreateWatchOnlyWallet(net *chaincfg.Params, xpub string, birthday int64, gapLimit uint32) error {
+	account, err := ParseAccountXpub(xpub, net)
+	if err != nil {
+		return err
+	}
+
+	wallet, err := openNewWallet(net)
+	if err != nil {
+		return err
+	}
+	defer wallet.db.Close()
+
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Println("do you want to create a new watch-only wallet? (y/n)")
+	if !promptYes(reader) {
+		os.Exit(0)
+	}
+
+	if err = wallet.initWatchOnlyWalletBuckets(account, net); err != nil {
+		return fmt.Errorf("error creating wallet: %v", err)
+	}
+
+	if err = wallet.enableRecovery(birthday, gapLimit); err != nil {
+		return fmt.Errorf("error creating wallet: %v", err)
+	}
+
+	fmt.Println("watch-only wallet created. funds will be recovered next time the wallet is started")
+	return nil
+}
+
+// RestoreWallet creates a wallet from an existing BIP-39 mnemonic
+// or a hex encoded seed. Keys derived will be the same as the ones of
+// the wallet the mnemonic or seed came from. The wallet is set to recovery
+// mode to find its funds starting from the birthday height
+func RestoreWallet(net *chaincfg.Params, birthday int64, gapLimit uint32) error {
+	wallet, err := openNewWallet(net)
+	if err != nil {
+		return err
+	}
+	defer wallet.db.Close()
+
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Println("enter mnemonic or hex seed of the wallet to restore:")
 	input, err := reader.ReadString('\n')
 	if err != nil {
-		log.Fatal("error reading input, please try again")
+		return errors.New("error reading input, please try again")
 	}
 
-	input = strings.ToLower(strings.TrimSpace(input))
-	var encodedHash string
-	if input == "y" || input == "yes" {
-		encodedHash, err = promptPassphrase()
+	var seed []byte
+	input = strings.TrimSpace(input)
+	if hexSeed, err := hex.DecodeString(input); err == nil {
+		if len(hexSeed) < hdkeychain.MinSeedBytes || len(hexSeed) > hdkeychain.MaxSeedBytes {
+			return fmt.Errorf("invalid seed length. seed must be between %d and %d bytes",
+				hdkeychain.MinSeedBytes, hdkeychain.MaxSeedBytes)
+		}
+		seed = hexSeed
+	} else {
+		mnemonic := normalizeMnemonic(input)
+		if !bip39.IsMnemonicValid(mnemonic) {
+			return errors.New("invalid mnemonic")
+		}
+
+		mnemonicPassphrase, err := promptMnemonicPassphrase(reader)
 		if err != nil {
 			return err
 		}
-	} else {
-		os.Exit(0)
+		seed = bip39.NewSeed(mnemonic, mnemonicPassphrase)
 	}
 
-	seed, err := hdkeychain.GenerateSeed(hdkeychain.RecommendedSeedLen)
+	passphrase, err := promptPassphrase()
 	if err != nil {
-		return fmt.Errorf("error creating wallet: %v", err)
+		return err
 	}
 
-	fmt.Println("Next will be the master seed. Write it down and store securely. Anyone with access to the seed has access to the funds.")
-	fmt.Printf("seed: %x\n", seed)
+	if err = wallet.initWalletBuckets(seed, passphrase, net); err != nil {
+		return fmt.Errorf("error restoring wallet: %v", err)
+	}
 
-	if err = wallet.initWalletBuckets(seed, encodedHash, net); err != nil {
-		return fmt.Errorf("error creating wallet: %v", err)
+	if err = wallet.enableRecovery(birthday, gapLimit); err != nil {
+		return fmt.Errorf("error restoring wallet: %v", err)
 	}
 
+	fmt.Println("wallet restored. funds will be recovered next time the wallet is started")
 	return nil
 }
 
-func promptPassphrase() (string, error) {
-	fmt.Print("enter passphrase for wallet: \n")
+// openNewWallet opens the wallet db and returns an error
+// if a wallet already exists in it
+func openNewWallet(net *chaincfg.Params) (*Wallet, error) {
+	path := setupWalletDir(net)
+	db, err := bolt.Open(filepath.Join(path, "wallet.db"), 0600, nil)
+	if err != nil {
+		return nil, errors.New("error setting wallet")
+	}
+
+	if walletExists(db) {
+		db.Close()
+		return nil, errors.New("wallet already exists")
+	}
+
+	return &Wallet{db: db}, nil
+}
+
+// normalizeMnemonic returns the words of the mnemonic in
+// lower case separated by a single space
+func normalizeMnemonic(mnemonic string) string {
+	return strings.Join(strings.Fields(strings.ToLower(mnemonic)), " ")
+}
+
+// entropyBitSize returns the size of the entropy needed
+// to generate a mnemonic with the number of words passed
+func entropyBitSize(wordCount int) (int, error) {
+	switch wordCount {
+	case 12:
+		return 128, nil
+	case 24:
+		return 256, nil
+	default:
+		return 0, errors.New("invalid number of words for mnemonic. please provide 12 or 24")
+	}
+}
+
+func promptYes(reader *bufio.Reader) bool {
+	input, err := reader.ReadString('\n')
+	if err != nil {
+		log.Fatal("error reading input, please try again")
+	}
+	input = strings.ToLower(strings.TrimSpace(input))
+	return input == "y" || input == "yes"
+}
+
+// promptMnemonicPassphrase asks for the optional BIP-39 passphrase
+// that is used along with the mnemonic to derive the seed
+func promptMnemonicPassphrase(reader *bufio.Reader) (string, error) {
+	fmt.Println("do you want to use a mnemonic passphrase (25th word)? (y/n)")
+	if !promptYes(reader) {
+		return "", nil
+	}
+
+	fmt.Print("enter mnemonic passphrase: \n")
 	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
 	if err != nil {
 		return "", ErrPass
 	}
-	fmt.Print("confirm passphrase: \n")
+	fmt.Print("confirm mnemonic passphrase: \n")
 	confirmPassphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
 	if err != nil {
 		return "", ErrPass
 	}
 	if !bytes.Equal(passphrase, confirmPassphrase) {
-		return "", errors.New("passphrases do not match, please try again")
+		return "", errors.New("mnemonic passphrases do not match, please try again")
 	}
 
-	encodedHash, err := utils.HashPassphrase(confirmPassphrase)
+	return string(passphrase), nil
+}
+
+func promptPassphrase() ([]byte, error) {
+	fmt.Print("enter passphrase for wallet: \n")
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
 	if err != nil {
-		return "", err
+		return nil, ErrPass
+	}
+	fmt.Print("confirm passphrase: \n")
+	confirmPassphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	if err != nil {
+		return nil, ErrPass
+	}
+	if !bytes.Equal(passphrase, confirmPassphrase) {
+		return nil, errors.New("passphrases do not match, please try again")
 	}
 
-	return encodedHash, nil
+	return passphrase, nil
 }
 
 func setupWalletDir(net *chaincfg.Params) string {
@@ -116,7 +279,7 @@ func walletExists(db *bolt.DB) bool {
 		authb := tx.Bucket([]byte(authBucket))
 
 		if utxosb != nil && keysb != nil && authb != nil && walletMetadata != nil {
-			if walletMetadata.Get([]byte(masterSeedKey)) != nil {
+			if walletMetadata.Get([]byte(masterSeedKey)) != nil || walletMetadata.Get([]byte(watchOnlyKey)) != nil {
 				exists = true
 			}
 		}
@@ -137,13 +300,32 @@ func LoadWallet(net *chaincfg.Params, rpcuser, rpcpass, node string) (*Wallet, e
 	}
 
 	wallet := NewWallet(db, net)
-	wallet.balance = wallet.getBalance()
-	wallet.lastExternalIdx = wallet.getLastExternalIdx()
-	wallet.lastInternalIdx = wallet.getLastInternalIdx()
+	if err := wallet.ensureBuckets(); err != nil {
+		return nil, fmt.Errorf("error opening db: %v", err)
+	}
+	if wallet.getWalletVersion() < encryptionWalletVersion {
+		if err := wallet.migrateEncryption(); err != nil {
+			return nil, err
+		}
+	}
+	wallet.watchOnly = wallet.isWatchOnly()
+	if wallet.getWalletVersion() < descriptorsWalletVersion {
+		if err := wallet.migrateDescriptors(); err != nil {
+			return nil, err
+		}
+	}
+	if err := wallet.loadDescriptors(); err != nil {
+		return nil, err
+	}
 	wallet.lastScannedBlock = wallet.getLastScannedBlock()
-	wallet.locked = true
 
-	err = wallet.loadExternalAddresses()
+	if gapLimit := wallet.getRecoveryGapLimit(); gapLimit > 0 {
+		if err := wallet.startRecovery(gapLimit); err != nil {
+			return nil, fmt.Errorf("error starting recovery: %v", err)
+		}
+	}
+
+	err = wallet.loadAddresses()
 	if err != nil {
 		return nil, err
 	}
@@ -152,6 +334,22 @@ func LoadWallet(net *chaincfg.Params, rpcuser, rpcpass, node string) (*Wallet, e
 	if err != nil {
 		return nil, err
 	}
+	if check, err := wallet.CheckWallet(false); err != nil {
+		return nil, err
+	} else if !check.Consistent {
+		wallet.LogError("stored balance %v does not match UTXOs balance %v. run checkwallet --repair",
+			check.StoredBalance, check.UTXOsBalance)
+	}
+
+	err = wallet.loadMempoolTxs()
+	if err != nil {
+		return nil, err
+	}
+
+	// hold scanMtx until the starting block is set
+	// so that clients do not start scanning before
+	wallet.scanMtx.Lock()
+	defer wallet.scanMtx.Unlock()
 
 	var client NodeClient
 	switch node {
@@ -170,6 +368,11 @@ func LoadWallet(net *chaincfg.Params, rpcuser, rpcpass, node string) (*Wallet, e
 	}
 	wallet.client = client
 
+	// update wallet with sends interrupted before it was updated
+	if err := wallet.reconcilePendingBroadcasts(); err != nil {
+		return nil, err
+	}
+
 	err = wallet.loadTxFilter()
 	if err != nil {
 		return nil, err
@@ -177,12 +380,17 @@ func LoadWallet(net *chaincfg.Params, rpcuser, rpcpass, node string) (*Wallet, e
 
 	// if this is new wallet, set last scanned block to current height of chain - 10
 	// no need to scan entire blockchain if wallet is new
-	if wallet.lastScannedBlock == 0 {
+	if wallet.lastScannedBlock == 0 && wallet.recovery == nil {
 		chainHeight, err := wallet.client.GetBlockCount()
 		if err != nil {
 			return nil, err
 		}
-		wallet.setLastScannedBlock(chainHeight - 10)
+		startHeight := max(chainHeight-10, 0)
+		startHash, err := wallet.client.GetBlockHash(startHeight)
+		if err != nil {
+			return nil, err
+		}
+		wallet.setLastScannedBlock(startHeight, startHash.String())
 	}
 	return wallet, nil
 }
@@ -0,0 +1,109 @@
+package wallet
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/tyler-smith/go-bip39"
+)
+
+func TestMnemonicSeed(t *testing.T) {
+	// BIP-39 test vector
+	mnemonic := "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about"
+
+	tests := []struct {
+		name       string
+		mnemonic   string
+		passphrase string
+		wantedSeed string
+	}{
+		{
+			name:       "without passphrase",
+			mnemonic:   mnemonic,
+			wantedSeed: "5eb00bbddcf069084889a8ab9155568165f5c453ccb85e70811aaed6f6da5fc19a5ac40b389cd370d086206dec8aa6c43daea6690f20ad3d8d48b2d2ce9e38e4",
+		},
+		{
+			name:       "with passphrase",
+			mnemonic:   mnemonic,
+			passphrase: "TREZOR",
+			wantedSeed: "c55257c360c07c72029aebc1b53c05ed0362ada38ead3e3e9efa3708e53495531f09a6987599d18264c1e1c92f2cf141630c7a3c4ab7c81b2f001698e7463b04",
+		},
+		{
+			name:       "entered in upper case with extra spaces",
+			mnemonic:   "  ABANDON abandon abandon abandon abandon abandon\tabandon abandon abandon abandon abandon   About\n",
+			passphrase: "TREZOR",
+			wantedSeed: "c55257c360c07c72029aebc1b53c05ed0362ada38ead3e3e9efa3708e53495531f09a6987599d18264c1e1c92f2cf141630c7a3c4ab7c81b2f001698e7463b04",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			normalized := normalizeMnemonic(test.mnemonic)
+			if !bip39.IsMnemonicValid(normalized) {
+				t.Fatalf("mnemonic %q is not valid", normalized)
+			}
+			seed := bip39.NewSeed(normalized, test.passphrase)
+			if hex.EncodeToString(seed) != test.wantedSeed {
+				t.Errorf("seed does not match - expected: %s, got: %x", test.wantedSeed, seed)
+			}
+		})
+	}
+}
+
+func TestRestoreWallet(t *testing.T) {
+	entropy, err := bip39.NewEntropy(128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnemonic, err := bip39.NewMnemonic(entropy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created, _ := newTestWalletFromSeed(t, bip39.NewSeed(mnemonic, "passphrase"))
+	restored, _ := newTestWalletFromSeed(t, bip39.NewSeed(normalizeMnemonic(" "+mnemonic+"\n"), "passphrase"))
+	// same mnemonic with other passphrase is a different wallet
+	other, _ := newTestWalletFromSeed(t, bip39.NewSeed(mnemonic, ""))
+
+	createdXpub, err := created.GetXpub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restoredXpub, err := restored.GetXpub(); err != nil || restoredXpub != createdXpub {
+		t.Errorf("xpub of restored wallet does not match - expected: %s, got: %s (%v)", createdXpub, restoredXpub, err)
+	}
+
+	for i := 0; i < 3; i++ {
+		expected, err := created.GetNewAddress("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		address, err := restored.GetNewAddress("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if address != expected {
+			t.Errorf("address %v of restored wallet does not match - expected: %s, got: %s", i, expected, address)
+		}
+		otherAddress, err := other.GetNewAddress("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if otherAddress == expected {
+			t.Errorf("address %v is the same with a different mnemonic passphrase", i)
+		}
+	}
+
+	change, err := created.deriveChangeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restoredChange, err := restored.deriveChangeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.KeyPair.Address != restoredChange.KeyPair.Address || change.Path != restoredChange.Path {
+		t.Errorf("change of restored wallet does not match - expected: %s, got: %s",
+			change.KeyPair.Address, restoredChange.KeyPair.Address)
+	}
+}
@@ -1,207 +1,384 @@
 package wallet
 
 import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/btcsuite/btcd/blockchain"
 	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/psbt"
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/elnosh/btcw/tx"
 )
 
-// createRawTransaction will create an unsigned tx to the address
-// and amountToSend. It will create it from the set of utxos passed and
-// it will add change output if needed
-func (w *Wallet) createRawTransaction(address string, amountToSend, feeRate btcutil.Amount, utxos []tx.UTXO) (*wire.MsgTx, error) {
-	txOut, err := tx.CreateTxOut(address, amountToSend, w.network)
+const (
+	// confirmation target used to estimate the fee rate if none is set
+	defaultConfTarget = 6
+	// max confirmation target nodes estimate fees for
+	maxConfTarget = 1008
+	// max weight of a tx relayed by nodes
+	maxStandardTxWeight = 400000
+)
+
+var (
+	// used if the node cannot estimate the fee rate for the default target
+	fallbackFeeRate = tx.FeeRate(2000)
+	// fee rate at which utxos are expected to be spent in the future.
+	// Used by coin selection to weigh the cost of inputs and change
+	longTermFeeRate = tx.FeeRate(10000)
+)
+
+// SendOptions sets the fee rate of a tx. If FeeRate is not set, the fee
+// rate is estimated by the node for the tx to confirm within ConfTarget blocks
+type SendOptions struct {
+	FeeRate    tx.FeeRate
+	ConfTarget int64
+	// name of the coin selection method. If not set, the one of the wallet is used
+	CoinSelection string
+	// addresses of the outputs that pay the fee. It is split
+	// equally between them and subtracted from their amounts
+	SubtractFeeFrom []string
+	// txs signal that they can be replaced with a higher fee (BIP125)
+	// unless disabled
+	DisableRBF bool
+}
+
+// setReplaceable sets the sequence of the inputs to signal
+// if the tx can be replaced with a higher fee or not
+func setReplaceable(msgTx *wire.MsgTx, replaceable bool) {
+	sequence := uint32(wire.MaxTxInSequenceNum)
+	if replaceable {
+		sequence = tx.RBFSequence
+	}
+	for _, txIn := range msgTx.TxIn {
+		txIn.Sequence = sequence
+	}
+}
+
+// coinSelector returns the selector set in the options or the one of the wallet
+func (w *Wallet) coinSelector(opts SendOptions) (tx.CoinSelector, error) {
+	if opts.CoinSelection != "" {
+		return tx.NewCoinSelector(opts.CoinSelection)
+	}
+	return w.selector, nil
+}
+
+// SetCoinSelection sets the coin selection method used when sending
+func (w *Wallet) SetCoinSelection(name string) error {
+	selector, err := tx.NewCoinSelector(name)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	rawTx := wire.NewMsgTx(wire.TxVersion)
-	rawTx.AddTxOut(txOut)
+	w.selector = selector
+	return nil
+}
 
-	totalUtxosAmount := btcutil.Amount(0)
-	for _, utxo := range utxos {
-		txIn, err := tx.CreateTxIn(utxo)
-		if err != nil {
-			return nil, err
+// feeRate returns the fee rate set in the options or the one estimated
+// by the node. If no options are set and the node cannot estimate the
+// fee rate, the fallback fee rate is used
+func (w *Wallet) feeRate(opts SendOptions) (tx.FeeRate, error) {
+	if opts.FeeRate != 0 && opts.ConfTarget != 0 {
+		return 0, errors.New("cannot set both fee rate and confirmation target")
+	}
+	if opts.FeeRate != 0 {
+		if opts.FeeRate < tx.MinRelayFeeRate {
+			return 0, fmt.Errorf("fee rate is below the min relay fee rate of %v", tx.MinRelayFeeRate)
 		}
-		rawTx.AddTxIn(txIn)
-
-		totalUtxosAmount += utxo.Value
+		return opts.FeeRate, nil
 	}
 
-	if totalUtxosAmount > amountToSend {
-		changeAmount := totalUtxosAmount - amountToSend
+	confTarget := opts.ConfTarget
+	if confTarget == 0 {
+		confTarget = defaultConfTarget
+	}
+	if confTarget < 1 || confTarget > maxConfTarget {
+		return 0, fmt.Errorf("confirmation target must be between 1 and %v", maxConfTarget)
+	}
 
-		// get new internal key for change
-		newInternalKey, err := w.generateNewInternalKeyPair()
-		if err != nil {
-			return nil, err
+	feeRate, err := w.client.EstimateFee(confTarget)
+	if err != nil {
+		if opts.ConfTarget != 0 {
+			return 0, fmt.Errorf("error estimating fee: %s", err.Error())
 		}
+		w.LogError("error estimating fee, using fallback fee rate of %v: %s", fallbackFeeRate, err.Error())
+		return fallbackFeeRate, nil
+	}
+	return max(feeRate, tx.MinRelayFeeRate), nil
+}
 
-		// create change output from new internal address and change amount
-		changeTxOut, err := tx.CreateTxOut(newInternalKey.Address, changeAmount, w.network)
-		if err != nil {
-			return nil, err
+// createRawTransaction will create an unsigned tx with the outputs and
+// select utxos from spendable with the selector to fund it at feeRate.
+// It will add a change output if the change left after paying for it
+// is not dust. Otherwise, the change goes to the fee. If subtractFeeFrom
+// has indexes of outputs, the fee is split between them instead of being
+// paid on top of the amounts. The key for the change output is returned
+// but not saved in the wallet until the tx is broadcast
+func (w *Wallet) createRawTransaction(outputs []*wire.TxOut, subtractFeeFrom []int, feeRate tx.FeeRate,
+	selector tx.CoinSelector, spendable []tx.UTXO) (*wire.MsgTx, []tx.UTXO, *changeOutput, error) {
+	rawTx := wire.NewMsgTx(wire.TxVersion)
+	amountToSend := btcutil.Amount(0)
+	for _, txOut := range outputs {
+		if tx.IsDust(txOut) {
+			return nil, nil, nil, fmt.Errorf("amount %v is below the dust threshold",
+				btcutil.Amount(txOut.Value))
 		}
-		rawTx.AddTxOut(changeTxOut)
-
-		// calculate estimate fee for tx
-		size := rawTx.SerializeSize()
-		estimateFee := int64(size) * int64(feeRate) * 2
-
-		// subtract fee from change
-		rawTx.TxOut[len(rawTx.TxOut)-1].Value -= estimateFee
-	} else {
-		return nil, tx.ErrInsufficientAmount
+		rawTx.AddTxOut(txOut)
+		amountToSend += btcutil.Amount(txOut.Value)
 	}
 
-	return rawTx, nil
-}
+	// derive next key of the change descriptor
+	change, err := w.deriveChangeKey()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	changeTxOut, err := tx.CreateTxOut(change.KeyPair.Address, 0, w.network)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
-// signTransaction will sign all inputs in tx using the keys associated with
-// the utxos referenced
-func (w *Wallet) signTransaction(tx *wire.MsgTx, utxos []tx.UTXO) error {
-	prevOuts := make(map[wire.OutPoint]*wire.TxOut, 1)
-	inputFetcher := txscript.NewMultiPrevOutFetcher(prevOuts)
-	for i, txIn := range tx.TxIn {
-		inputFetcher.AddPrevOut(txIn.PreviousOutPoint, wire.NewTxOut(int64(utxos[i].Value), utxos[i].ScriptPubKey))
+	// select utxos to pay for the outputs and the fee of the
+	// tx without inputs. utxos pay for their own fee
+	changeOutputFee := feeRate.FeeForVSize(int64(changeTxOut.SerializeSize()))
+	changeInputWeight := w.inputWeight(change.Path)
+	params := tx.SelectionParams{
+		FeeRate:         feeRate,
+		LongTermFeeRate: longTermFeeRate,
+		CostOfChange:    changeOutputFee + longTermFeeRate.FeeForWeight(changeInputWeight),
+		MinChange:       changeOutputFee + tx.DustThreshold(changeTxOut.PkScript),
+	}
+	subtractFee := len(subtractFeeFrom) > 0
+	if subtractFee {
+		// recipients pay the fee so utxos only need to cover the amounts.
+		// utxos that cost more to spend than their value are left out
+		spendable = economicalUTXOs(spendable, feeRate)
+		params = tx.SelectionParams{Target: amountToSend, MinChange: tx.DustThreshold(changeTxOut.PkScript)}
 	}
-	sigHashes := txscript.NewTxSigHashes(tx, inputFetcher)
 
-	for i, txIn := range tx.TxIn {
-		utxo := utxos[i]
+	// the overhead is first estimated with a 1 byte count of inputs. If more
+	// inputs are selected than fit in it, select again with the larger count
+	var utxos []tx.UTXO
+	for numInputs := 1; ; {
+		if !subtractFee {
+			params.Target = amountToSend + feeRate.FeeForWeight(tx.TxOverheadWeight(numInputs, outputs))
+		}
+		utxos, err = selector.Select(spendable, params)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if subtractFee || wire.VarIntSerializeSize(uint64(len(utxos))) <= wire.VarIntSerializeSize(uint64(numInputs)) {
+			break
+		}
+		numInputs = len(utxos)
+	}
+	totalUtxosAmount := tx.SumValues(utxos)
+	w.LogInfo("selected %v utxos with %v. waste: %v", len(utxos), selector.Name(), tx.Waste(utxos, params))
 
-		// get private key that can create valid signature to spend utxo
-		wif, err := w.getPrivateKeyForUTXO(utxo)
+	for _, utxo := range utxos {
+		txIn, err := tx.CreateTxIn(utxo)
 		if err != nil {
-			return err
+			return nil, nil, nil, err
 		}
+		rawTx.AddTxIn(txIn)
+	}
 
-		scriptClass := txscript.GetScriptClass(utxo.ScriptPubKey)
-		switch scriptClass {
-		case txscript.WitnessV0PubKeyHashTy:
-			witness, err := txscript.WitnessSignature(tx, sigHashes, i, int64(utxo.Value),
-				utxo.ScriptPubKey, txscript.SigHashAll, wif.PrivKey, wif.CompressPubKey)
-			if err != nil {
-				return err
-			}
-			txIn.Witness = witness
+	vsize, err := tx.EstimateVirtualSize(utxos, rawTx.TxOut)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if vsize*blockchain.WitnessScaleFactor > maxStandardTxWeight {
+		return nil, nil, nil, errors.New("transaction is too large. send to fewer addresses")
+	}
+	fee := feeRate.FeeForVSize(vsize)
 
-		case txscript.PubKeyHashTy:
-			scriptSig, err := txscript.SignatureScript(tx, i, utxo.ScriptPubKey,
-				txscript.SigHashAll, wif.PrivKey, wif.CompressPubKey)
-			if err != nil {
-				return err
-			}
-			txIn.SignatureScript = scriptSig
+	// fee of the tx with the change output
+	vsizeWithChange, err := tx.EstimateVirtualSize(utxos, append(rawTx.TxOut, changeTxOut))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	feeWithChange := feeRate.FeeForVSize(vsizeWithChange)
+
+	if subtractFee {
+		// change is what is left over the amounts. If it is dust, it goes
+		// to the fee so the recipients pay that much less
+		changeTxOut.Value = int64(totalUtxosAmount - amountToSend)
+		if changeTxOut.Value <= 0 || tx.IsDust(changeTxOut) {
+			fee = max(fee-btcutil.Amount(changeTxOut.Value), 0)
+			changeTxOut = nil
+		} else {
+			fee = feeWithChange
+		}
+		if err := subtractFeeFromOutputs(rawTx.TxOut, subtractFeeFrom, fee); err != nil {
+			return nil, nil, nil, err
 		}
+	} else {
+		if totalUtxosAmount < amountToSend+fee {
+			return nil, nil, nil, tx.ErrInsufficientAmount
+		}
+		changeTxOut.Value = int64(totalUtxosAmount - amountToSend - feeWithChange)
+		if changeTxOut.Value <= 0 || tx.IsDust(changeTxOut) {
+			fee = totalUtxosAmount - amountToSend
+			changeTxOut = nil
+		} else {
+			fee = feeWithChange
+		}
+	}
 
+	if changeTxOut == nil {
+		w.LogInfo("creating tx with no change. fee: %v (%v)", fee, feeRate)
+		tx.ShuffleTxOuts(rawTx.TxOut)
+		return rawTx, utxos, nil, nil
 	}
 
-	return nil
-}
+	rawTx.AddTxOut(changeTxOut)
+	w.LogInfo("creating tx with fee: %v (%v)", fee, feeRate)
 
-func validateSignedTransaction(tx *wire.MsgTx, utxos []tx.UTXO) error {
-	for i := range tx.TxIn {
-		utxo := utxos[i]
+	// random order so that the change output can't be told by its position
+	tx.ShuffleTxOuts(rawTx.TxOut)
+	change.Index = uint32(slices.Index(rawTx.TxOut, changeTxOut))
 
-		vm, err := txscript.NewEngine(utxo.ScriptPubKey, tx, i, txscript.StandardVerifyFlags, nil, nil, int64(utxo.Value), nil)
-		if err != nil {
-			return err
-		}
+	return rawTx, utxos, change, nil
+}
 
-		err = vm.Execute()
-		if err != nil {
-			return err
+// subtractFeeFromOutputs splits the fee equally between the outputs at
+// the indexes. The first one pays what is left from the split
+func subtractFeeFromOutputs(outputs []*wire.TxOut, indexes []int, fee btcutil.Amount) error {
+	share := fee / btcutil.Amount(len(indexes))
+	remainder := fee % btcutil.Amount(len(indexes))
+	for i, idx := range indexes {
+		outputFee := share
+		if i == 0 {
+			outputFee += remainder
+		}
+		outputs[idx].Value -= int64(outputFee)
+		if outputs[idx].Value <= 0 || tx.IsDust(outputs[idx]) {
+			return fmt.Errorf("amount of output %v is too small to pay the fee", idx)
 		}
 	}
-
 	return nil
 }
 
-// extractTxInfo takes in a wire tx, utxos used as input and amount sent. From that,
-// it will return the change output, index of change output and fee
-func extractTxInfo(txMsg *wire.MsgTx, usedUTXOs []tx.UTXO, amountToSend btcutil.Amount) (wire.TxOut, uint32, btcutil.Amount) {
-	var totalOutput int64 = 0
-	var totalInput int64 = 0
-
-	for _, utxo := range usedUTXOs {
-		totalInput += int64(utxo.Value)
+// economicalUTXOs returns the utxos with value higher than the fee to spend them
+func economicalUTXOs(utxos []tx.UTXO, feeRate tx.FeeRate) []tx.UTXO {
+	economical := make([]tx.UTXO, 0, len(utxos))
+	for _, utxo := range utxos {
+		if effectiveValue, ok := tx.EffectiveValue(utxo, feeRate); ok && effectiveValue > 0 {
+			economical = append(economical, utxo)
+		}
 	}
+	return economical
+}
 
-	var changeOutput wire.TxOut
-	changeIdx := 0
-	for idx, txout := range txMsg.TxOut {
-		totalOutput += txout.Value
+// createSweepTransaction will create an unsigned tx spending all the utxos
+// to the address with no change. The fee is paid from the amount sent
+func (w *Wallet) createSweepTransaction(address string, feeRate tx.FeeRate, utxos []tx.UTXO) (*wire.MsgTx, error) {
+	txOut, err := tx.CreateTxOut(address, 0, w.network)
+	if err != nil {
+		return nil, err
+	}
 
-		if txout.Value != int64(amountToSend) {
-			changeOutput = *txout
-			changeIdx = idx
+	rawTx := wire.NewMsgTx(wire.TxVersion)
+	for _, utxo := range utxos {
+		txIn, err := tx.CreateTxIn(utxo)
+		if err != nil {
+			return nil, err
 		}
+		rawTx.AddTxIn(txIn)
 	}
-	fee := btcutil.Amount(totalInput - totalOutput)
+	rawTx.AddTxOut(txOut)
 
-	return changeOutput, uint32(changeIdx), fee
-}
+	vsize, err := tx.EstimateVirtualSize(utxos, rawTx.TxOut)
+	if err != nil {
+		return nil, err
+	}
+	if vsize*blockchain.WitnessScaleFactor > maxStandardTxWeight {
+		return nil, errors.New("transaction is too large. sweep fewer utxos")
+	}
+	fee := feeRate.FeeForVSize(vsize)
 
-// updateWalletAfterTx will update wallet fields based on the transaction sent.
-// It will mark utxos used in the tx as spent, add change UTXO to wallet and update
-// the balance
-func (w *Wallet) updateWalletAfterTx(txMsg *wire.MsgTx, usedUTXOs []tx.UTXO, amountToSend btcutil.Amount) {
-	changeOutput, changeIdx, fee := extractTxInfo(txMsg, usedUTXOs, amountToSend)
+	txOut.Value = int64(tx.SumValues(utxos) - fee)
+	if txOut.Value <= 0 || tx.IsDust(txOut) {
+		return nil, fmt.Errorf("%w. amount left after fee of %v is dust", ErrInsufficientFunds, fee)
+	}
+	w.LogInfo("creating sweep tx of %v utxos with fee: %v (%v)", len(utxos), fee, feeRate)
 
-	// mark utxos used to create transaction as spent
-	//go w.markSpentUTXOs(usedUTXOs)
-	go w.markSpentUTXOs(usedUTXOs)
+	return rawTx, nil
+}
 
-	// add change utxo to wallet utxo list
-	//go w.addChangeUTXO(txMsg, changeOutput, changeIdx)
-	go w.addChangeUTXO(txMsg, changeOutput, changeIdx)
+// signTransaction will sign all inputs in tx using the keys of the
+// descriptors of the utxos referenced. Inputs are signed and finalized
+// through a PSBT so that all the descriptor types are spent the same way
+func (w *Wallet) signTransaction(msgTx *wire.MsgTx, utxos []tx.UTXO) error {
+	if err := w.canSign(); err != nil {
+		return err
+	}
 
-	// new balance will be current wallet balance - amount wanting to be sent - fee
-	newBalance := w.balance - amountToSend - fee
-	go w.setBalance(newBalance)
-}
+	packet, err := psbt.NewFromUnsignedTx(msgTx)
+	if err != nil {
+		return err
+	}
+	updater, err := psbt.NewUpdater(packet)
+	if err != nil {
+		return err
+	}
+	sigHashes := txscript.NewTxSigHashes(msgTx, utxosPrevOutFetcher(msgTx, utxos))
 
-// markSpentUTXOs takes a list of utxos and if it finds them in the wallet
-// it will mark them as spent
-func (w *Wallet) markSpentUTXOs(utxos []tx.UTXO) {
-	w.LogInfo("marking spent UTXOs")
-	for _, utxo := range utxos {
-		for i := range w.utxos {
-			if w.utxos[i].TxID == utxo.TxID {
-				key := utxo.GetOutpoint()
-				err := w.updateUTXO(key, utxo)
-				// only update utxo in wallet struct if update in db succeeded
-				if err == nil {
-					w.utxos[i].Spent = true
-				}
-				break
-			}
+	for i, utxo := range utxos {
+		if err := w.updatePSBTInput(updater, i, utxo); err != nil {
+			return err
+		}
+		if err := w.signPSBTInput(updater, sigHashes, i, utxo); err != nil {
+			return err
 		}
 	}
-}
 
-// adds change output to wallet utxos
-func (w *Wallet) addChangeUTXO(txMsg *wire.MsgTx, changeOutput wire.TxOut, changeIdx uint32) {
-	txId := txMsg.TxHash().String()
-
-	_, addrs, _, err := txscript.ExtractPkScriptAddrs(changeOutput.PkScript, w.network)
+	complete, err := finalizePSBT(packet)
 	if err != nil {
-		w.LogError("error adding change UTXO - could not extract address script info: %s", err.Error())
-		return
+		return err
 	}
-	derivationPath := w.getDerivationPathForAddress(addrs[0].String())
-	if derivationPath == "" {
-		w.LogError("error adding change UTXO - no derivation path for address: %s", addrs[0].String())
-		return
+	if !complete {
+		return errors.New("wallet does not have the keys to sign all inputs")
 	}
-	value := btcutil.Amount(changeOutput.Value)
-	script, err := txscript.ParsePkScript(changeOutput.PkScript)
+	signed, err := psbt.Extract(packet)
 	if err != nil {
-		w.LogError("error adding change UTXO - could not parse pkScript of change utxo: %s", err.Error())
+		return err
+	}
+	for i, txIn := range msgTx.TxIn {
+		txIn.SignatureScript = signed.TxIn[i].SignatureScript
+		txIn.Witness = signed.TxIn[i].Witness
+	}
+
+	return nil
+}
+
+// utxosPrevOutFetcher returns the outputs spent by the inputs of the tx
+func utxosPrevOutFetcher(msgTx *wire.MsgTx, utxos []tx.UTXO) *txscript.MultiPrevOutFetcher {
+	inputFetcher := txscript.NewMultiPrevOutFetcher(nil)
+	for i, txIn := range msgTx.TxIn {
+		inputFetcher.AddPrevOut(txIn.PreviousOutPoint, wire.NewTxOut(int64(utxos[i].Value), utxos[i].ScriptPubKey))
 	}
+	return inputFetcher
+}
 
-	changeUTXO := tx.NewUTXO(txId, changeIdx, value, script.Script(), derivationPath)
-	_ = w.addUTXO(*changeUTXO)
+func validateSignedTransaction(msgTx *wire.MsgTx, utxos []tx.UTXO) error {
+	inputFetcher := utxosPrevOutFetcher(msgTx, utxos)
+	sigHashes := txscript.NewTxSigHashes(msgTx, inputFetcher)
+
+	for i := range msgTx.TxIn {
+		utxo := utxos[i]
+
+		vm, err := txscript.NewEngine(utxo.ScriptPubKey, msgTx, i, txscript.StandardVerifyFlags, nil,
+			sigHashes, int64(utxo.Value), inputFetcher)
+		if err != nil {
+			return err
+		}
+
+		err = vm.Execute()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
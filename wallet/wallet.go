@@ -1,28 +1,23 @@
 package wallet
 
 import (
-	"errors"
 	"fmt"
 	"log/slog"
+	"slices"
 	"sync"
-	"time"
 
-	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
 	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
 	"github.com/elnosh/btcw/tx"
 	"github.com/elnosh/btcw/utils"
 	bolt "go.etcd.io/bbolt"
 )
 
 type (
-	address        = string
+	address = string
+	// path that identifies a key of the wallet: descriptor id/index
 	derivationPath = string
-	chain          int
-)
-
-const (
-	externalChain chain = iota
-	internalChain
 )
 
 type Wallet struct {
@@ -34,48 +29,52 @@ type Wallet struct {
 	utxos   []tx.UTXO
 	utxoMtx sync.Mutex
 
-	balance    btcutil.Amount
-	balanceMtx sync.Mutex
-
-	lastExternalIdx  uint32
-	lastInternalIdx  uint32
 	lastScannedBlock int64
+	// held while scanning blocks or rolling back from a reorg
+	scanMtx sync.Mutex
+
+	// output descriptors of the wallet by id
+	descriptors    map[uint32]walletDescriptor
+	descriptorsMtx sync.RWMutex
 
-	// only for external addresses to track when receiving
-	addresses map[address]derivationPath
+	// addresses derived from the descriptors to track when receiving
+	addresses    map[address]derivationPath
+	addressesMtx sync.RWMutex
 
-	locked bool
+	// unconfirmed txs relevant to the wallet
+	mempoolTxs map[string]*wire.MsgTx
+	mempoolMtx sync.Mutex
+	// txs in the mempool of the node from last poll
+	mempoolSeen map[string]struct{}
+
+	// set while the wallet is recovering funds. nil otherwise
+	recovery *recoveryState
+
+	// master key that decrypts the HD keys while the wallet is unlocked
+	keys keyLock
+	// wallet only has the extended public key of the account and can't sign
+	watchOnly bool
+
+	// coin selection method used when sending
+	selector tx.CoinSelector
 }
 
 func NewWallet(db *bolt.DB, net *chaincfg.Params) *Wallet {
 	logger := slog.Default()
 	addresses := make(map[address]derivationPath)
-	balance := btcutil.Amount(0)
-
-	return &Wallet{db: db, network: net, logger: logger,
-		balance: balance, addresses: addresses}
-}
 
-func (w *Wallet) setLastExternalIdx(idx uint32) error {
-	err := w.updateLastExternalIdx(idx)
-	if err != nil {
-		return err
-	}
-	w.lastExternalIdx = idx
-	return nil
+	return &Wallet{db: db, network: net, logger: logger, addresses: addresses,
+		descriptors: make(map[uint32]walletDescriptor),
+		mempoolTxs:  make(map[string]*wire.MsgTx), mempoolSeen: make(map[string]struct{}),
+		selector: tx.DefaultCoinSelector}
 }
 
-func (w *Wallet) setLastInternalIdx(idx uint32) error {
-	err := w.updateLastInternalIdx(idx)
-	if err != nil {
-		return err
-	}
-	w.lastInternalIdx = idx
-	return nil
+func (w *Wallet) Network() *chaincfg.Params {
+	return w.network
 }
 
-func (w *Wallet) setLastScannedBlock(height int64) error {
-	err := w.updateLastScannedBlock(height)
+func (w *Wallet) setLastScannedBlock(height int64, hash string) error {
+	err := w.updateLastScannedBlock(height, hash)
 	if err != nil {
 		return err
 	}
@@ -83,17 +82,6 @@ func (w *Wallet) setLastScannedBlock(height int64) error {
 	return nil
 }
 
-func (w *Wallet) setBalance(balance btcutil.Amount) error {
-	err := w.updateBalanceDB(balance)
-	if err != nil {
-		return err
-	}
-	w.balanceMtx.Lock()
-	w.balance = balance
-	w.balanceMtx.Unlock()
-	return nil
-}
-
 func (w *Wallet) addUTXO(utxo tx.UTXO) error {
 	err := w.saveUTXO(utxo)
 	if err != nil {
@@ -105,96 +93,214 @@ func (w *Wallet) addUTXO(utxo tx.UTXO) error {
 	return nil
 }
 
-// add key in db and update addresses map with address of key
-func (w *Wallet) addKey(derivationPath string, key *KeyPair) error {
-	err := w.saveKeyPair(derivationPath, key)
-	if err != nil {
-		return err
+// receiveUTXO adds a UTXO found while scanning a block to the wallet.
+// If the UTXO is already in the wallet (i.e change from a tx sent by
+// the wallet) it only updates the height at which it was confirmed.
+// It returns true if the UTXO was not in the wallet
+func (w *Wallet) receiveUTXO(utxo tx.UTXO) (bool, error) {
+	outpoint := utxo.GetOutpoint()
+
+	w.utxoMtx.Lock()
+	for i := range w.utxos {
+		if w.utxos[i].GetOutpoint() == outpoint {
+			confirmed := w.utxos[i]
+			confirmed.Height = utxo.Height
+			confirmed.BlockHash = utxo.BlockHash
+			if err := w.updateUTXO(outpoint, confirmed); err != nil {
+				w.utxoMtx.Unlock()
+				return false, err
+			}
+			w.utxos[i] = confirmed
+			w.utxoMtx.Unlock()
+			return false, nil
+		}
 	}
-	w.addresses[key.Address] = derivationPath
-	return nil
+	w.utxoMtx.Unlock()
+
+	return true, w.addUTXO(utxo)
 }
 
-// getDecodedKey retrieves the hashed passphrase from db
-// and decodes it.
-func (w *Wallet) getDecodedKey() ([]byte, error) {
-	encodedHash := w.getEncodedHash()
-	if encodedHash == nil {
-		return nil, errors.New("encoded hash not found")
-	}
+// findUTXO returns the wallet UTXO referenced by outpoint
+func (w *Wallet) findUTXO(outpoint string) (tx.UTXO, bool) {
+	w.utxoMtx.Lock()
+	defer w.utxoMtx.Unlock()
 
-	_, key, _, err := utils.DecodeHash(string(encodedHash))
-	if err != nil {
-		return nil, fmt.Errorf("error decoding key: %v", err)
+	for _, utxo := range w.utxos {
+		if utxo.GetOutpoint() == outpoint {
+			return utxo, true
+		}
 	}
-
-	return key, nil
+	return tx.UTXO{}, false
 }
 
-// getDecryptedAccountKey will take a Chain which can be either external
-// or internal and return a decrypted chain key
-func (w *Wallet) getDecryptedAccountKey(chain chain) ([]byte, error) {
-	var encryptedChainKey []byte
+// removeUTXO deletes the UTXO referenced by outpoint from the wallet
+func (w *Wallet) removeUTXO(outpoint string) (*tx.UTXO, error) {
+	w.utxoMtx.Lock()
+	defer w.utxoMtx.Unlock()
+
+	for i := range w.utxos {
+		if w.utxos[i].GetOutpoint() != outpoint {
+			continue
+		}
+
+		removed := w.utxos[i]
+		if err := w.deleteUTXO(outpoint); err != nil {
+			return nil, err
+		}
+		w.utxos = slices.Delete(w.utxos, i, i+1)
+		return &removed, nil
+	}
+	return nil, fmt.Errorf("utxo %s not found", outpoint)
+}
 
-	switch chain {
-	case externalChain:
-		encryptedChainKey = w.getAcct0External()
-	case internalChain:
-		encryptedChainKey = w.getAcct0Internal()
-	default:
-		return nil, errors.New("invalid chain value")
+// unspendUTXO marks the UTXO referenced by outpoint as unspent
+func (w *Wallet) unspendUTXO(outpoint string) (*tx.UTXO, error) {
+	w.utxoMtx.Lock()
+	defer w.utxoMtx.Unlock()
+
+	for i := range w.utxos {
+		if w.utxos[i].GetOutpoint() != outpoint {
+			continue
+		}
+
+		unspent := w.utxos[i]
+		unspent.Spent = false
+		unspent.SpentBy = ""
+		unspent.SpentHeight = 0
+		if err := w.updateUTXO(outpoint, unspent); err != nil {
+			return nil, err
+		}
+		w.utxos[i] = unspent
+		return &unspent, nil
 	}
+	return nil, fmt.Errorf("utxo %s not found", outpoint)
+}
 
-	passKey, err := w.getDecodedKey()
-	if err != nil {
-		return nil, err
+// spendUTXO marks the wallet UTXO referenced by outpoint as spent by
+// the tx spendingTxID confirmed at height. It returns the UTXO and
+// true if it was unspent in the wallet before.
+// If outpoint is not from a wallet UTXO it returns nil
+func (w *Wallet) spendUTXO(outpoint, spendingTxID string, height int64) (*tx.UTXO, bool, error) {
+	w.utxoMtx.Lock()
+	defer w.utxoMtx.Unlock()
+
+	for i := range w.utxos {
+		if w.utxos[i].GetOutpoint() != outpoint {
+			continue
+		}
+
+		spent := w.utxos[i]
+		wasUnspent := !spent.Spent
+		// do not lose height if spend was already seen in a block
+		if spent.SpentBy == spendingTxID && height == 0 {
+			height = spent.SpentHeight
+		}
+		spent.Spent = true
+		spent.SpentBy = spendingTxID
+		spent.SpentHeight = height
+		if err := w.updateUTXO(outpoint, spent); err != nil {
+			return nil, false, err
+		}
+		w.utxos[i] = spent
+		return &spent, wasUnspent, nil
 	}
 
-	decryptedChainKey, err := utils.Decrypt(encryptedChainKey, passKey)
+	return nil, false, nil
+}
+
+// lookupAddress returns the derivation path of the key for the
+// address if it is tracked by the wallet
+func (w *Wallet) lookupAddress(addr address) (derivationPath, bool) {
+	w.addressesMtx.RLock()
+	defer w.addressesMtx.RUnlock()
+	path, ok := w.addresses[addr]
+	return path, ok
+}
+
+// masterFingerprint returns the fingerprint of the master key. Wallets that
+// did not save it when created need to be unlocked to derive it the first time
+func (w *Wallet) masterFingerprint() (uint32, error) {
+	if fingerprint := w.getMasterFingerprint(); fingerprint != nil {
+		return utils.BytesToUint32(fingerprint), nil
+	}
+	master, err := w.getDecryptedMasterKey()
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	return decryptedChainKey, nil
+	if err := w.saveMasterFingerprint(master); err != nil {
+		return 0, err
+	}
+	return MasterFingerprint(master)
 }
 
-// getPrivateKeyForUTXO returns the private key in WIF that can sign
-// or spend that UTXO
-func (w *Wallet) getPrivateKeyForUTXO(utxo tx.UTXO) (*btcutil.WIF, error) {
-	kp := w.getKeyPair(utxo.DerivationPath)
-	if kp == nil {
-		return nil, fmt.Errorf("key for UTXO not found")
+// accountXpub returns the extended public key of account 0 with its key origin.
+// Wallets that did not save it when created need to be unlocked to derive it the first time
+func (w *Wallet) accountXpub() (*AccountXpub, error) {
+	fingerprint, err := w.masterFingerprint()
+	if err != nil {
+		return nil, err
 	}
-
-	passKey, err := w.getDecodedKey()
+	path, err := w.accountPath()
 	if err != nil {
 		return nil, err
 	}
 
-	wifStr, err := utils.Decrypt(kp.EncryptedPrivateKey, passKey)
+	xpub := w.getAccount0Xpub()
+	if xpub == nil {
+		master, err := w.getDecryptedMasterKey()
+		if err != nil {
+			return nil, err
+		}
+		if err := w.saveAccount0Xpub(master); err != nil {
+			return nil, err
+		}
+		xpub = w.getAccount0Xpub()
+	}
+
+	key, err := hdkeychain.NewKeyFromString(string(xpub))
 	if err != nil {
 		return nil, err
 	}
+	return &AccountXpub{Key: key, Fingerprint: fingerprint, Path: path}, nil
+}
 
-	wif, err := btcutil.DecodeWIF(string(wifStr))
-	if err != nil {
-		return nil, fmt.Errorf("error decoding wif: %s", err.Error())
+// getDecryptedMasterKey returns the master HD key. The wallet needs to be unlocked
+func (w *Wallet) getDecryptedMasterKey() (*hdkeychain.ExtendedKey, error) {
+	if w.keys.isLocked() {
+		return nil, ErrWalletLocked
 	}
 
-	return wif, nil
+	var master *hdkeychain.ExtendedKey
+	if err := w.keys.withMasterKey(func(masterKey []byte) error {
+		decrypted, err := utils.Decrypt(w.getMasterSeed(), masterKey)
+		if err != nil {
+			return err
+		}
+		defer utils.Wipe(decrypted)
+		master, err = hdkeychain.NewKeyFromString(string(decrypted))
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return master, nil
 }
 
-func (w *Wallet) lock() {
-	w.locked = true
+// IsWatchOnly returns true if the wallet has no private keys
+func (w *Wallet) IsWatchOnly() bool {
+	return w.watchOnly
 }
 
-func (w *Wallet) unlock(duration time.Duration) {
-	w.locked = false
-
-	go func() {
-		time.Sleep(duration)
-		w.lock()
-	}()
+// canSign returns an error if the wallet can't sign
+// because it is watch-only or it is locked
+func (w *Wallet) canSign() error {
+	if w.watchOnly {
+		return ErrWatchOnly
+	}
+	if w.keys.isLocked() {
+		return ErrWalletLocked
+	}
+	return nil
 }
 
 func (w *Wallet) LogInfo(format string, v ...any) {
@@ -0,0 +1,409 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/elnosh/btcw/tx"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	testPassphrase = "passphrase"
+	// height of the tip of the chain of the fake node
+	testTipHeight = 200
+)
+
+var errNotFound = errors.New("not found")
+
+// fakeClient is a node for tests. Blocks only have a hash and txs sent
+// are added to its mempool unless sendErr is set
+type fakeClient struct {
+	// hashes of the blocks by height
+	blocks []chainhash.Hash
+	// txs the node can return
+	txs map[chainhash.Hash]*wire.MsgTx
+	// entries of txs in the mempool
+	entries map[chainhash.Hash]*MempoolEntry
+	// txs of the blocks added with addBlock
+	blockTxs map[chainhash.Hash][]*wire.MsgTx
+	// timestamps of blocks by height that are not 10 minutes after the previous block
+	timestamps map[int64]int64
+	// errors getting the hash of blocks by height
+	hashErrs map[int64]error
+	sent     []*wire.MsgTx
+	sendErr  error
+}
+
+func newFakeClient() *fakeClient {
+	blocks := make([]chainhash.Hash, testTipHeight+1)
+	for height := range blocks {
+		blocks[height] = chainhash.HashH([]byte(fmt.Sprintf("block %v", height)))
+	}
+	return &fakeClient{
+		blocks:   blocks,
+		txs:      make(map[chainhash.Hash]*wire.MsgTx),
+		entries:  make(map[chainhash.Hash]*MempoolEntry),
+		blockTxs: make(map[chainhash.Hash][]*wire.MsgTx),
+	}
+}
+
+func (f *fakeClient) GetBlockCount() (int64, error) {
+	return int64(len(f.blocks) - 1), nil
+}
+
+func (f *fakeClient) GetBlockHash(height int64) (*chainhash.Hash, error) {
+	if err, ok := f.hashErrs[height]; ok {
+		return nil, err
+	}
+	if height < 0 || height >= int64(len(f.blocks)) {
+		return nil, errNotFound
+	}
+	hash := f.blocks[height]
+	return &hash, nil
+}
+
+// GetBlockHeader returns a header with a block every 10 minutes
+// from 1700000000 unless the timestamp of the block is set
+func (f *fakeClient) GetBlockHeader(hash *chainhash.Hash) (*wire.BlockHeader, error) {
+	for height := range f.blocks {
+		if f.blocks[height] == *hash {
+			timestamp, ok := f.timestamps[int64(height)]
+			if !ok {
+				timestamp = 1700000000 + int64(height)*600
+			}
+			return &wire.BlockHeader{Timestamp: time.Unix(timestamp, 0)}, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+// GetBlockVerboseTx returns the blocks added with addBlock
+// with their txs in the Tx field like bitcoin core
+func (f *fakeClient) GetBlockVerboseTx(hash *chainhash.Hash) (*btcjson.GetBlockVerboseTxResult, error) {
+	txs, ok := f.blockTxs[*hash]
+	if !ok {
+		return nil, errNotFound
+	}
+	height := slices.Index(f.blocks, *hash)
+	if height < 0 {
+		return nil, errNotFound
+	}
+
+	block := &btcjson.GetBlockVerboseTxResult{
+		Hash:         hash.String(),
+		Height:       int64(height),
+		PreviousHash: f.blocks[height-1].String(),
+		Time:         1700000000 + int64(height)*600,
+	}
+	for _, msgTx := range txs {
+		var buf bytes.Buffer
+		if err := msgTx.Serialize(&buf); err != nil {
+			return nil, err
+		}
+		rawTx := btcjson.TxRawResult{Hex: hex.EncodeToString(buf.Bytes()), Txid: msgTx.TxHash().String()}
+		for _, txIn := range msgTx.TxIn {
+			if blockchain.IsCoinBaseTx(msgTx) {
+				rawTx.Vin = append(rawTx.Vin, btcjson.Vin{Coinbase: hex.EncodeToString(txIn.SignatureScript)})
+				continue
+			}
+			rawTx.Vin = append(rawTx.Vin, btcjson.Vin{
+				Txid: txIn.PreviousOutPoint.Hash.String(),
+				Vout: txIn.PreviousOutPoint.Index,
+			})
+		}
+		for i, txOut := range msgTx.TxOut {
+			rawTx.Vout = append(rawTx.Vout, btcjson.Vout{
+				Value:        btcutil.Amount(txOut.Value).ToBTC(),
+				N:            uint32(i),
+				ScriptPubKey: btcjson.ScriptPubKeyResult{Hex: hex.EncodeToString(txOut.PkScript)},
+			})
+		}
+		block.Tx = append(block.Tx, rawTx)
+	}
+	return block, nil
+}
+
+func (f *fakeClient) SendRawTransaction(msgTx *wire.MsgTx, allowHighFees bool) (*chainhash.Hash, error) {
+	if f.sendErr != nil {
+		return nil, f.sendErr
+	}
+	f.sent = append(f.sent, msgTx)
+	hash := msgTx.TxHash()
+	f.txs[hash] = msgTx
+	return &hash, nil
+}
+
+func (f *fakeClient) EstimateFee(int64) (tx.FeeRate, error) {
+	return 0, ErrNoFeeEstimate
+}
+
+func (f *fakeClient) LoadTxFilter(bool, []btcutil.Address, []wire.OutPoint) error {
+	return nil
+}
+
+func (f *fakeClient) GetRawMempool() ([]*chainhash.Hash, error) {
+	hashes := make([]*chainhash.Hash, 0, len(f.entries))
+	for hash := range f.entries {
+		hash := hash
+		hashes = append(hashes, &hash)
+	}
+	return hashes, nil
+}
+
+func (f *fakeClient) GetRawTransaction(hash *chainhash.Hash) (*btcutil.Tx, error) {
+	msgTx, ok := f.txs[*hash]
+	if !ok {
+		return nil, errNotFound
+	}
+	return btcutil.NewTx(msgTx), nil
+}
+
+func (f *fakeClient) GetMempoolEntry(hash *chainhash.Hash) (*MempoolEntry, error) {
+	entry, ok := f.entries[*hash]
+	if !ok {
+		return nil, errNotFound
+	}
+	return entry, nil
+}
+
+// newTestWallet creates a wallet from a random seed in a temp dir
+// connected to a fake node. The wallet is unlocked
+func newTestWallet(t *testing.T) (*Wallet, *fakeClient) {
+	t.Helper()
+
+	seed := make([]byte, 32)
+	if _, err := rand.Read(seed); err != nil {
+		t.Fatal(err)
+	}
+	return newTestWalletFromSeed(t, seed)
+}
+
+// newTestWalletFromSeed creates a wallet from the seed like newTestWallet
+func newTestWalletFromSeed(t *testing.T, seed []byte) (*Wallet, *fakeClient) {
+	t.Helper()
+
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "wallet.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	w := NewWallet(db, &chaincfg.RegressionNetParams)
+	if err := w.initWalletBuckets(seed, []byte(testPassphrase), w.network); err != nil {
+		t.Fatalf("error creating wallet: %v", err)
+	}
+	client := newFakeClient()
+	w = loadTestWallet(t, db, client)
+	if err := w.setLastScannedBlock(testTipHeight, client.blocks[testTipHeight].String()); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WalletPassphrase(testPassphrase, time.Hour); err != nil {
+		t.Fatalf("error unlocking wallet: %v", err)
+	}
+	return w, client
+}
+
+// loadTestWallet loads the wallet in db like LoadWallet does
+// when it starts, without reconciling pending broadcasts
+func loadTestWallet(t *testing.T, db *bolt.DB, client *fakeClient) *Wallet {
+	t.Helper()
+
+	w := NewWallet(db, &chaincfg.RegressionNetParams)
+	w.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	w.client = client
+	if err := w.ensureBuckets(); err != nil {
+		t.Fatal(err)
+	}
+	w.watchOnly = w.isWatchOnly()
+	if err := w.loadDescriptors(); err != nil {
+		t.Fatal(err)
+	}
+	w.lastScannedBlock = w.getLastScannedBlock()
+	if err := w.loadAddresses(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.loadUTXOs(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.loadMempoolTxs(); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+// fundWallet adds a UTXO confirmed 10 blocks ago to a new address of the type.
+// The tx that creates it is known by the node
+func fundWallet(t *testing.T, w *Wallet, client *fakeClient, addressType string, value btcutil.Amount) tx.UTXO {
+	t.Helper()
+
+	address, err := w.GetNewAddress(addressType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fundAddress(t, w, client, address, value)
+}
+
+// fundAddress adds a UTXO confirmed 10 blocks ago to the wallet address
+func fundAddress(t *testing.T, w *Wallet, client *fakeClient, address string, value btcutil.Amount) tx.UTXO {
+	t.Helper()
+
+	path, ok := w.lookupAddress(address)
+	if !ok {
+		t.Fatalf("address %s is not from the wallet", address)
+	}
+	txOut, err := tx.CreateTxOut(address, value, w.network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var prevHash chainhash.Hash
+	if _, err := rand.Read(prevHash[:]); err != nil {
+		t.Fatal(err)
+	}
+	fundingTx := wire.NewMsgTx(wire.TxVersion)
+	fundingTx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&prevHash, 0), nil, nil))
+	fundingTx.AddTxOut(txOut)
+	hash := fundingTx.TxHash()
+	client.txs[hash] = fundingTx
+
+	height := w.lastScannedBlock - 9
+	utxo := w.newUTXO(hash.String(), 0, value, txOut.PkScript, path)
+	utxo.Height = height
+	utxo.BlockHash = client.blocks[height].String()
+	if err := w.addUTXO(*utxo); err != nil {
+		t.Fatal(err)
+	}
+	return *utxo
+}
+
+// newTestAddress returns an address that is not from the wallet
+func newTestAddress(t *testing.T) string {
+	t.Helper()
+
+	hash := make([]byte, 20)
+	if _, err := rand.Read(hash); err != nil {
+		t.Fatal(err)
+	}
+	addr, err := btcutil.NewAddressWitnessPubKeyHash(hash, &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr.EncodeAddress()
+}
+
+// prevOuts returns the outputs of the UTXOs of the wallet by outpoint
+func prevOuts(t *testing.T, w *Wallet) map[wire.OutPoint]*wire.TxOut {
+	t.Helper()
+
+	w.utxoMtx.Lock()
+	defer w.utxoMtx.Unlock()
+	outputs := make(map[wire.OutPoint]*wire.TxOut, len(w.utxos))
+	for _, utxo := range w.utxos {
+		outpoint, err := utxoOutPoint(utxo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs[*outpoint] = wire.NewTxOut(int64(utxo.Value), utxo.ScriptPubKey)
+	}
+	return outputs
+}
+
+// verifyTx executes the scripts of the inputs of msgTx spending outputs
+func verifyTx(t *testing.T, msgTx *wire.MsgTx, outputs map[wire.OutPoint]*wire.TxOut) {
+	t.Helper()
+
+	fetcher := txscript.NewMultiPrevOutFetcher(outputs)
+	sigHashes := txscript.NewTxSigHashes(msgTx, fetcher)
+	for i, txIn := range msgTx.TxIn {
+		prevOut, ok := outputs[txIn.PreviousOutPoint]
+		if !ok {
+			t.Fatalf("output spent by input %v not found", i)
+		}
+		vm, err := txscript.NewEngine(prevOut.PkScript, msgTx, i, txscript.StandardVerifyFlags,
+			nil, sigHashes, prevOut.Value, fetcher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := vm.Execute(); err != nil {
+			t.Fatalf("invalid signature of input %v: %v", i, err)
+		}
+	}
+}
+
+// findTestUTXO returns the UTXO of the wallet at outpoint
+func findTestUTXO(t *testing.T, w *Wallet, outpoint string) tx.UTXO {
+	t.Helper()
+
+	utxo, ok := w.findUTXO(outpoint)
+	if !ok {
+		t.Fatalf("utxo %s not found", outpoint)
+	}
+	return utxo
+}
+
+// paymentTx returns a tx from outside the wallet paying value to address
+func paymentTx(t *testing.T, address string, value btcutil.Amount) *wire.MsgTx {
+	t.Helper()
+
+	txOut, err := tx.CreateTxOut(address, value, &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var prevHash chainhash.Hash
+	if _, err := rand.Read(prevHash[:]); err != nil {
+		t.Fatal(err)
+	}
+	msgTx := wire.NewMsgTx(wire.TxVersion)
+	msgTx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&prevHash, 0), nil, nil))
+	msgTx.AddTxOut(txOut)
+	return msgTx
+}
+
+// addBlock adds a block with the txs to the chain of the node
+func (f *fakeClient) addBlock(txs ...*wire.MsgTx) (int64, *wire.BlockHeader) {
+	height := int64(len(f.blocks))
+	header := &wire.BlockHeader{
+		PrevBlock: f.blocks[height-1],
+		Timestamp: time.Unix(1700000000+height*600, 0),
+	}
+	hash := header.BlockHash()
+	f.blocks = append(f.blocks, hash)
+	f.blockTxs[hash] = txs
+	for _, msgTx := range txs {
+		f.txs[msgTx.TxHash()] = msgTx
+	}
+	return height, header
+}
+
+// connectBlock adds a block with the txs to the chain of the node and
+// notifies the wallet of it like btcd does. It returns the height of the block
+func connectBlock(t *testing.T, w *Wallet, client *fakeClient, txs ...*wire.MsgTx) int64 {
+	t.Helper()
+
+	height, header := client.addBlock(txs...)
+	blockTxs := make([]*btcutil.Tx, len(txs))
+	for i, msgTx := range txs {
+		blockTxs[i] = btcutil.NewTx(msgTx)
+	}
+	w.handleFilteredBlockConnected(height, header, blockTxs)
+	if w.lastScannedBlock != height {
+		t.Fatalf("block %v was not scanned", height)
+	}
+	return height
+}